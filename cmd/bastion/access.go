@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+type accessRequest struct {
+	ID              int64      `json:"id"`
+	MachineName     string     `json:"machine_name"`
+	Requester       string     `json:"requester"`
+	Reason          string     `json:"reason"`
+	DurationSeconds int64      `json:"duration_seconds"`
+	Status          string     `json:"status"`
+	CreatedAt       time.Time  `json:"created_at"`
+	KeyExpiresAt    *time.Time `json:"key_expires_at"`
+}
+
+func accessCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "access",
+		Short: "Request temporary access to a machine, or decide requests for your machines",
+		Long: `Anyone can ask for temporary access to a machine with their public key. The
+machine's owner is notified and approves or denies the request with an owner
+token (set with 'bastion config set owner_token ...'); an admin can decide any
+request with the API key. Approval adds the key as an access key that is
+removed when its time is up.`,
+	}
+	cmd.AddCommand(accessRequestCmd(), accessListCmd(), accessApproveCmd(), accessDenyCmd(), accessTokenCmd())
+	return cmd
+}
+
+func accessRequestCmd() *cobra.Command {
+	var keyPath, reason, duration, requester, server string
+	var users []string
+	cmd := &cobra.Command{
+		Use:   "request <machine>",
+		Short: "Ask a machine's owner for temporary access with your public key",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if reason == "" {
+				return fmt.Errorf("--reason is required")
+			}
+			// Requesting needs no credentials, only the server
+			cfg := &clientConfig{ServerURL: server}
+			if server == "" {
+				loaded, err := loadConfig()
+				if err != nil {
+					return fmt.Errorf("%w, or pass --server", err)
+				}
+				cfg.ServerURL = loaded.ServerURL
+			}
+			if keyPath == "" {
+				home, _ := os.UserHomeDir()
+				keyPath = filepath.Join(home, ".ssh", "id_ed25519.pub")
+			}
+			pub, err := os.ReadFile(keyPath)
+			if err != nil {
+				return fmt.Errorf("read public key: %w", err)
+			}
+			if requester == "" {
+				requester = currentUser()
+			}
+
+			resp, err := apiRequest(cfg, "POST", "/api/machines/"+url.PathEscape(args[0])+"/access-requests", map[string]any{
+				"requester":   requester,
+				"public_key":  strings.TrimSpace(string(pub)),
+				"local_users": users,
+				"reason":      reason,
+				"duration":    duration,
+			})
+			if err != nil {
+				return fmt.Errorf("request failed: %w", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusAccepted {
+				body, _ := io.ReadAll(resp.Body)
+				return fmt.Errorf("failed (%d): %s", resp.StatusCode, string(body))
+			}
+			// The server answers every well-formed request alike, so this
+			// cannot say whether the machine exists
+			fmt.Printf("Request submitted. If %s takes access requests, its owner has been asked.\n", args[0])
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&keyPath, "key", "", "Public key file to grant (default ~/.ssh/id_ed25519.pub)")
+	cmd.Flags().StringVar(&reason, "reason", "", "Why you need access")
+	cmd.Flags().StringVar(&duration, "duration", "8h", "How long you need access, e.g. 2h or 3d")
+	cmd.Flags().StringVar(&requester, "name", "", "Your name as shown to the owner (default the current user)")
+	cmd.Flags().StringSliceVar(&users, "as", nil, "Local users to log in as, or * for all (default the machine's default user)")
+	cmd.Flags().StringVar(&server, "server", "", "Bastion server URL, if this host has no bastion config")
+	return cmd
+}
+
+func accessListCmd() *cobra.Command {
+	var status, machine string
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List access requests for your machines with an owner token, or all of them with the API key",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := loadConfig()
+			if err != nil {
+				return err
+			}
+
+			q := url.Values{}
+			if status != "" {
+				q.Set("status", status)
+			}
+			if machine != "" {
+				q.Set("machine", machine)
+			}
+			var requests []accessRequest
+			if err := getJSON(cfg, "/api/access-requests?"+q.Encode(), &requests); err != nil {
+				return err
+			}
+			if len(requests) == 0 {
+				fmt.Println("No access requests.")
+				return nil
+			}
+
+			fmt.Printf("%-6s %-17s %-15s %-15s %-9s %-10s %s\n", "ID", "CREATED", "MACHINE", "REQUESTER", "DURATION", "STATUS", "REASON")
+			for _, a := range requests {
+				state := a.Status
+				if a.KeyExpiresAt != nil && a.KeyExpiresAt.After(time.Now()) {
+					state += " (until " + a.KeyExpiresAt.Local().Format("Jan 2 15:04") + ")"
+				}
+				fmt.Printf("%-6d %-17s %-15s %-15s %-9s %-10s %s\n", a.ID, a.CreatedAt.Local().Format("2006-01-02 15:04"),
+					a.MachineName, a.Requester, formatUptime(time.Duration(a.DurationSeconds)*time.Second), state, a.Reason)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&status, "status", "pending", "Only requests in this state: pending, approved, denied or expired (empty for all)")
+	cmd.Flags().StringVar(&machine, "machine", "", "Only requests for this machine")
+	return cmd
+}
+
+// decideAccess posts an approval or denial and returns the response body.
+func decideAccess(id, decision string, body map[string]any) ([]byte, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := apiRequest(cfg, "POST", "/api/access-requests/"+url.PathEscape(id)+"/"+decision, body)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed (%d): %s", resp.StatusCode, string(data))
+	}
+	return data, nil
+}
+
+func accessApproveCmd() *cobra.Command {
+	var duration, note string
+	cmd := &cobra.Command{
+		Use:   "approve <id>",
+		Short: "Approve an access request, adding its key until the duration is up",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			data, err := decideAccess(args[0], "approve", map[string]any{"duration": duration, "note": note})
+			if err != nil {
+				return err
+			}
+			var result struct {
+				Request accessRequest `json:"request"`
+			}
+			json.Unmarshal(data, &result)
+			a := result.Request
+			fmt.Printf("Approved request %d: %s can log into %s", a.ID, a.Requester, a.MachineName)
+			if a.KeyExpiresAt != nil {
+				fmt.Printf(" until %s", a.KeyExpiresAt.Local().Format("2006-01-02 15:04"))
+			}
+			fmt.Println()
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&duration, "duration", "", "Grant access for this long instead of the requested duration")
+	cmd.Flags().StringVar(&note, "note", "", "Note recorded with the decision")
+	return cmd
+}
+
+func accessDenyCmd() *cobra.Command {
+	var note string
+	cmd := &cobra.Command{
+		Use:   "deny <id>",
+		Short: "Deny an access request",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if _, err := decideAccess(args[0], "deny", map[string]any{"note": note}); err != nil {
+				return err
+			}
+			fmt.Printf("Denied request %s\n", args[0])
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&note, "note", "", "Note recorded with the decision")
+	return cmd
+}
+
+func accessTokenCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "token",
+		Short: "Manage owner tokens, which decide access requests for one owner's machines",
+	}
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "create <owner>",
+		Short: "Mint an owner token for 'bastion config set owner_token'",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := loadConfig()
+			if err != nil {
+				return err
+			}
+			resp, err := apiRequest(cfg, "POST", "/api/owner-tokens", map[string]string{"owner": args[0]})
+			if err != nil {
+				return fmt.Errorf("request failed: %w", err)
+			}
+			defer resp.Body.Close()
+
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusCreated {
+				return fmt.Errorf("create owner token failed (%d): %s", resp.StatusCode, string(body))
+			}
+			var result struct {
+				Token string `json:"token"`
+			}
+			json.Unmarshal(body, &result)
+			fmt.Println(result.Token)
+			fmt.Printf("Decides access requests for machines owned by %s. The owner runs:\n", args[0])
+			fmt.Printf("  bastion config set owner_token %s\n", result.Token)
+			return nil
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List owner tokens",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := loadConfig()
+			if err != nil {
+				return err
+			}
+			var tokens []struct {
+				ID         int64      `json:"id"`
+				Owner      string     `json:"owner"`
+				CreatedAt  time.Time  `json:"created_at"`
+				LastUsedAt *time.Time `json:"last_used_at"`
+			}
+			if err := getJSON(cfg, "/api/owner-tokens", &tokens); err != nil {
+				return err
+			}
+			if len(tokens) == 0 {
+				fmt.Println("No owner tokens.")
+				return nil
+			}
+			fmt.Printf("%-6s %-20s %-17s %s\n", "ID", "OWNER", "CREATED", "LAST USED")
+			for _, t := range tokens {
+				used := "never"
+				if t.LastUsedAt != nil {
+					used = t.LastUsedAt.Local().Format("2006-01-02 15:04")
+				}
+				fmt.Printf("%-6d %-20s %-17s %s\n", t.ID, t.Owner, t.CreatedAt.Local().Format("2006-01-02 15:04"), used)
+			}
+			return nil
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "revoke <id>",
+		Short: "Revoke an owner token",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := loadConfig()
+			if err != nil {
+				return err
+			}
+			resp, err := apiRequest(cfg, "DELETE", "/api/owner-tokens/"+url.PathEscape(args[0]), nil)
+			if err != nil {
+				return fmt.Errorf("request failed: %w", err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				body, _ := io.ReadAll(resp.Body)
+				return fmt.Errorf("failed (%d): %s", resp.StatusCode, string(body))
+			}
+			fmt.Printf("Revoked owner token %s\n", args[0])
+			return nil
+		},
+	})
+	return cmd
+}
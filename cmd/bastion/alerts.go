@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func alertsCmd() *cobra.Command {
+	var all bool
+	var machine string
+	cmd := &cobra.Command{
+		Use:   "alerts",
+		Short: "List firing offline alerts (--all includes resolved ones)",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := loadConfig()
+			if err != nil {
+				return err
+			}
+
+			q := url.Values{}
+			if !all {
+				q.Set("state", "firing")
+			}
+			if machine != "" {
+				q.Set("machine", machine)
+			}
+			resp, err := apiRequest(cfg, "GET", "/api/alerts?"+q.Encode(), nil)
+			if err != nil {
+				return fmt.Errorf("request failed: %w", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				body, _ := io.ReadAll(resp.Body)
+				return fmt.Errorf("failed (%d): %s", resp.StatusCode, string(body))
+			}
+
+			var alerts []struct {
+				Rule         string     `json:"rule"`
+				MachineName  string     `json:"machine_name"`
+				OfflineSince time.Time  `json:"offline_since"`
+				FiredAt      time.Time  `json:"fired_at"`
+				ResolvedAt   *time.Time `json:"resolved_at"`
+			}
+			json.NewDecoder(resp.Body).Decode(&alerts)
+			if len(alerts) == 0 {
+				fmt.Println("No alerts.")
+				return nil
+			}
+
+			const stamp = "2006-01-02 15:04"
+			fmt.Printf("%-20s %-20s %-17s %-17s %s\n", "MACHINE", "RULE", "OFFLINE SINCE", "FIRED", "RESOLVED")
+			for _, a := range alerts {
+				resolved := "-"
+				if a.ResolvedAt != nil {
+					resolved = a.ResolvedAt.Local().Format(stamp)
+				}
+				fmt.Printf("%-20s %-20s %-17s %-17s %s\n", a.MachineName, a.Rule,
+					a.OfflineSince.Local().Format(stamp), a.FiredAt.Local().Format(stamp), resolved)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&all, "all", false, "Include resolved alerts")
+	cmd.Flags().StringVar(&machine, "machine", "", "Only alerts for this machine")
+	return cmd
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func aliasCmd() *cobra.Command {
+	var machine string
+
+	cmd := &cobra.Command{
+		Use:   "alias",
+		Short: "Manage additional SSH usernames for a machine",
+	}
+	cmd.PersistentFlags().StringVar(&machine, "machine", "", "Machine to manage (defaults to this machine)")
+
+	machineName := func(cfg *clientConfig) string {
+		if machine != "" {
+			return machine
+		}
+		return cfg.MachineName
+	}
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "add <alias>",
+		Short: "Make the machine reachable under another username",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := loadConfig()
+			if err != nil {
+				return err
+			}
+			name := machineName(cfg)
+
+			resp, err := apiRequest(cfg, "POST", "/api/machines/"+name+"/aliases", map[string]string{"alias": args[0]})
+			if err != nil {
+				return fmt.Errorf("request failed: %w", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusCreated {
+				body, _ := io.ReadAll(resp.Body)
+				return fmt.Errorf("add alias failed (%d): %s", resp.StatusCode, string(body))
+			}
+			fmt.Printf("%q now routes to %q\n", args[0], name)
+			return nil
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List the machine's aliases",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := loadConfig()
+			if err != nil {
+				return err
+			}
+
+			resp, err := apiRequest(cfg, "GET", "/api/machines/"+machineName(cfg)+"/aliases", nil)
+			if err != nil {
+				return fmt.Errorf("request failed: %w", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				body, _ := io.ReadAll(resp.Body)
+				return fmt.Errorf("failed (%d): %s", resp.StatusCode, string(body))
+			}
+
+			var aliases []struct {
+				Alias     string     `json:"alias"`
+				ExpiresAt *time.Time `json:"expires_at"`
+			}
+			json.NewDecoder(resp.Body).Decode(&aliases)
+
+			if len(aliases) == 0 {
+				fmt.Println("No aliases.")
+				return nil
+			}
+			for _, a := range aliases {
+				if a.ExpiresAt != nil {
+					fmt.Printf("%s (deprecated, expires %s)\n", a.Alias, a.ExpiresAt.Local().Format("2006-01-02 15:04"))
+				} else {
+					fmt.Println(a.Alias)
+				}
+			}
+			return nil
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "remove <alias>",
+		Short: "Remove an alias",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := loadConfig()
+			if err != nil {
+				return err
+			}
+
+			resp, err := apiRequest(cfg, "DELETE", "/api/machines/"+machineName(cfg)+"/aliases/"+args[0], nil)
+			if err != nil {
+				return fmt.Errorf("request failed: %w", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				body, _ := io.ReadAll(resp.Body)
+				return fmt.Errorf("remove alias failed (%d): %s", resp.StatusCode, string(body))
+			}
+			fmt.Printf("Removed alias %q\n", args[0])
+			return nil
+		},
+	})
+
+	return cmd
+}
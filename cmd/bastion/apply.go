@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/manifest"
+)
+
+func applyCmd() *cobra.Command {
+	var file string
+	var prune, dryRun bool
+
+	cmd := &cobra.Command{
+		Use:   "apply",
+		Short: "Bring machine access policy in line with a YAML manifest",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := loadConfig()
+			if err != nil {
+				return err
+			}
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			m, err := manifest.Parse(data)
+			if err != nil {
+				return err
+			}
+
+			names := make(map[string]bool)
+			for _, machine := range m.Machines {
+				names[machine.Name] = true
+			}
+			live, err := fetchLive(cfg, names)
+			if err != nil {
+				return err
+			}
+
+			plan := manifest.Diff(m, live, prune)
+			for _, w := range plan.Warnings {
+				fmt.Printf("! %s\n", w)
+			}
+			if len(plan.Changes) == 0 {
+				fmt.Println("No changes.")
+				return nil
+			}
+			for _, c := range plan.Changes {
+				fmt.Println(c)
+			}
+			if dryRun {
+				fmt.Printf("\n%d changes (dry run, nothing applied)\n", len(plan.Changes))
+				return nil
+			}
+
+			fmt.Println()
+			for i, c := range plan.Changes {
+				if err := applyChange(cfg, c); err != nil {
+					return fmt.Errorf("applied %d of %d changes; %s failed: %w", i, len(plan.Changes), c, err)
+				}
+			}
+			fmt.Printf("Applied %d changes.\n", len(plan.Changes))
+			return nil
+		},
+	}
+	cmd.Flags().StringVarP(&file, "file", "f", "", "Manifest file")
+	cmd.Flags().BoolVar(&prune, "prune", false, "Remove tags, labels, access keys, aliases and local users not in the manifest")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Print the plan without applying it")
+	cmd.MarkFlagRequired("file")
+	return cmd
+}
+
+func exportCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "export",
+		Short: "Print the live access policy of every machine as a manifest",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := loadConfig()
+			if err != nil {
+				return err
+			}
+			live, err := fetchLive(cfg, nil)
+			if err != nil {
+				return err
+			}
+			data, err := manifest.Marshal(manifest.Export(live))
+			if err != nil {
+				return err
+			}
+			fmt.Printf("# Exported from %s at %s\n", cfg.ServerURL, time.Now().UTC().Format(time.RFC3339))
+			os.Stdout.Write(data)
+			return nil
+		},
+	}
+}
+
+// fetchLive reads the live state of the named machines, or of every machine
+// when names is nil.
+func fetchLive(cfg *clientConfig, names map[string]bool) ([]manifest.Live, error) {
+	var machines []struct {
+		Name       string            `json:"name"`
+		Owner      string            `json:"owner"`
+		LocalUser  string            `json:"local_user"`
+		LocalUsers []string          `json:"local_users"`
+		Tags       []string          `json:"tags"`
+		Labels     map[string]string `json:"labels"`
+		Aliases    []struct {
+			Alias     string     `json:"alias"`
+			ExpiresAt *time.Time `json:"expires_at"`
+		} `json:"aliases"`
+	}
+	if err := getJSON(cfg, "/api/machines", &machines); err != nil {
+		return nil, err
+	}
+
+	var live []manifest.Live
+	for _, m := range machines {
+		if names != nil && !names[m.Name] {
+			continue
+		}
+		l := manifest.Live{Name: m.Name, Owner: m.Owner, LocalUser: m.LocalUser, Tags: m.Tags, Labels: m.Labels, Users: m.LocalUsers}
+		for _, a := range m.Aliases {
+			if a.ExpiresAt == nil {
+				l.Aliases = append(l.Aliases, a.Alias)
+			}
+		}
+
+		var keys []struct {
+			ID          int64    `json:"id"`
+			Label       string   `json:"label"`
+			PublicKey   string   `json:"public_key"`
+			Fingerprint string   `json:"fingerprint"`
+			LocalUsers  []string `json:"local_users"`
+
+			Schedule         string `json:"schedule"`
+			ScheduleTimezone string `json:"schedule_timezone"`
+
+			manifest.Restrictions
+
+			ExpiresAt *time.Time `json:"expires_at"`
+		}
+		if err := getJSON(cfg, "/api/machines/"+url.PathEscape(m.Name)+"/keys", &keys); err != nil {
+			return nil, err
+		}
+		for _, k := range keys {
+			// Keys granted by access requests expire on their own and are
+			// not the manifest's to keep or prune
+			if k.ExpiresAt != nil {
+				continue
+			}
+			l.AccessKeys = append(l.AccessKeys, manifest.LiveKey{
+				ID:          k.ID,
+				Label:       k.Label,
+				PublicKey:   k.PublicKey,
+				Fingerprint: k.Fingerprint,
+				LocalUsers:  k.LocalUsers,
+
+				Schedule:         k.Schedule,
+				ScheduleTimezone: k.ScheduleTimezone,
+
+				Restrictions: k.Restrictions,
+			})
+		}
+		live = append(live, l)
+	}
+	return live, nil
+}
+
+func getJSON(cfg *clientConfig, path string, v any) error {
+	resp, err := apiRequest(cfg, "GET", path, nil)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("GET %s failed (%d): %s", path, resp.StatusCode, string(body))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// applyChange performs one planned change through the API.
+func applyChange(cfg *clientConfig, c manifest.Change) error {
+	base := "/api/machines/" + url.PathEscape(c.Machine)
+	var method, path string
+	var body any
+	switch {
+	case c.Kind == "owner":
+		method, path, body = "PATCH", base, map[string]string{"owner": c.Name}
+	case c.Kind == "tag" && c.Action == manifest.Add:
+		method, path, body = "PATCH", base, map[string][]string{"add_tags": {c.Name}}
+	case c.Kind == "tag":
+		method, path, body = "PATCH", base, map[string][]string{"remove_tags": {c.Name}}
+	case c.Kind == "label" && c.Action == manifest.Remove:
+		method, path, body = "PATCH", base, map[string]any{"labels": map[string]any{c.Name: nil}}
+	case c.Kind == "label":
+		method, path, body = "PATCH", base, map[string]any{"labels": map[string]string{c.Name: c.Value}}
+	case c.Kind == "user" && c.Action == manifest.Add:
+		method, path, body = "POST", base+"/users", map[string]string{"username": c.Name}
+	case c.Kind == "user":
+		method, path = "DELETE", base+"/users/"+url.PathEscape(c.Name)
+	case c.Kind == "alias" && c.Action == manifest.Add:
+		method, path, body = "POST", base+"/aliases", map[string]string{"alias": c.Name}
+	case c.Kind == "alias":
+		method, path = "DELETE", base+"/aliases/"+url.PathEscape(c.Name)
+	case c.Kind == "access_key" && c.Action == manifest.Add:
+		method, path, body = "POST", base+"/keys", map[string]any{
+			"label":       c.Key.Label,
+			"public_key":  c.Key.PublicKey,
+			"local_users": c.Key.LocalUsers,
+
+			"schedule":          c.Key.Schedule,
+			"schedule_timezone": c.Key.ScheduleTimezone,
+
+			"source_cidrs":        c.Key.SourceCIDRs,
+			"force_command":       c.Key.ForceCommand,
+			"sftp_only":           c.Key.SFTPOnly,
+			"no_port_forwarding":  c.Key.NoPortForwarding,
+			"no_agent_forwarding": c.Key.NoAgentForwarding,
+		}
+	default:
+		method, path = "DELETE", fmt.Sprintf("%s/keys/%d", base, c.KeyID)
+	}
+
+	resp, err := apiRequest(cfg, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%d: %s", resp.StatusCode, string(respBody))
+	}
+	fmt.Println(c)
+	return nil
+}
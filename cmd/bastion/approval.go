@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// waitForApproval polls the server until the machine is approved, rejected
+// or the timeout passes.
+func waitForApproval(cfg *clientConfig, name string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(5 * time.Second)
+
+		resp, err := apiRequest(cfg, "GET", "/api/machines/"+url.PathEscape(name), nil)
+		if err != nil {
+			continue
+		}
+		var m struct {
+			State string `json:"state"`
+		}
+		status := resp.StatusCode
+		if status == http.StatusOK {
+			json.NewDecoder(resp.Body).Decode(&m)
+		}
+		resp.Body.Close()
+
+		switch {
+		// Rejection deletes the machine, which also invalidates its token
+		case status == http.StatusNotFound, status == http.StatusUnauthorized && cfg.APIKey == "":
+			return fmt.Errorf("registration of %s was rejected", name)
+		case status == http.StatusOK && m.State == "active":
+			return nil
+		}
+	}
+	return fmt.Errorf("still pending approval after %s; once approved, run 'bastion connect'", timeout)
+}
+
+func approveCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "approve <name>",
+		Short: "Approve a pending machine registration",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return machineAction(args[0], "approve", "Approved")
+		},
+	}
+}
+
+func rejectCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "reject <name>",
+		Short: "Reject a pending machine registration",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return machineAction(args[0], "reject", "Rejected")
+		},
+	}
+}
+
+func disableCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "disable <name>",
+		Short: "Take a machine out of service, keeping its port, keys and metadata",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return machineAction(args[0], "disable", "Disabled")
+		},
+	}
+}
+
+func enableCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "enable <name>",
+		Short: "Return a disabled machine to service",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return machineAction(args[0], "enable", "Enabled")
+		},
+	}
+}
+
+// machineAction posts to /api/machines/{name}/{action}.
+func machineAction(name, action, done string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	resp, err := apiRequest(cfg, "POST", "/api/machines/"+url.PathEscape(name)+"/"+action, nil)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s failed (%d): %s", action, resp.StatusCode, string(body))
+	}
+	fmt.Printf("%s %s\n", done, name)
+	return nil
+}
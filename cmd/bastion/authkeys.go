@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// Markers around the authorized_keys lines bastion manages.
+const (
+	managedKeysBegin = "# BEGIN bastion restricted access keys"
+	managedKeysEnd   = "# END bastion restricted access keys"
+)
+
+type restrictedKey struct {
+	KeyID      int64    `json:"key_id"`
+	Label      string   `json:"label"`
+	LocalUsers []string `json:"local_users"`
+	Line       string   `json:"line"`
+}
+
+func (k restrictedKey) allowsUser(name string) bool {
+	return len(k.LocalUsers) == 0 || slices.Contains(k.LocalUsers, "*") || slices.Contains(k.LocalUsers, name)
+}
+
+func fetchRestrictedKeys(cfg *clientConfig) ([]restrictedKey, error) {
+	var result struct {
+		Keys []restrictedKey `json:"keys"`
+	}
+	if err := getJSON(cfg, "/api/machines/"+url.PathEscape(cfg.MachineName)+"/authorized-keys", &result); err != nil {
+		return nil, err
+	}
+	return result.Keys, nil
+}
+
+// currentUser returns the name of the user running bastion. Services may run
+// without $USER set.
+func currentUser() string {
+	if name := os.Getenv("USER"); name != "" {
+		return name
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return ""
+}
+
+// writeManagedKeys replaces the lines bastion manages in
+// ~/.ssh/authorized_keys with those of keys that apply to the current user,
+// leaving every other line alone. It reports whether the file changed.
+func writeManagedKeys(keys []restrictedKey) (bool, error) {
+	home, _ := os.UserHomeDir()
+	path := filepath.Join(home, ".ssh", "authorized_keys")
+	existing, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	var out []string
+	inBlock := false
+	if len(existing) > 0 {
+		for _, line := range strings.Split(strings.TrimRight(string(existing), "\n"), "\n") {
+			switch {
+			case line == managedKeysBegin:
+				inBlock = true
+			case line == managedKeysEnd:
+				inBlock = false
+			case !inBlock:
+				out = append(out, line)
+			}
+		}
+	}
+	name := currentUser()
+	var managed []string
+	for _, k := range keys {
+		if k.allowsUser(name) {
+			managed = append(managed, k.Line)
+		}
+	}
+	if len(managed) > 0 {
+		out = append(out, managedKeysBegin)
+		out = append(out, managed...)
+		out = append(out, managedKeysEnd)
+	}
+
+	var data string
+	if len(out) > 0 {
+		data = strings.Join(out, "\n") + "\n"
+	}
+	if data == string(existing) {
+		return false, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return false, err
+	}
+	return true, os.WriteFile(path, []byte(data), 0600)
+}
+
+// syncAuthorizedKeys keeps this machine's restricted access keys installed,
+// logging only changes and failures.
+func syncAuthorizedKeys(cfg *clientConfig) {
+	keys, err := fetchRestrictedKeys(cfg)
+	if err != nil {
+		log.Printf("Restricted access key sync failed: %v", err)
+		return
+	}
+	changed, err := writeManagedKeys(keys)
+	if err != nil {
+		log.Printf("Restricted access key sync failed: %v", err)
+	} else if changed {
+		log.Printf("Updated restricted access keys in ~/.ssh/authorized_keys")
+	}
+}
+
+func authorizedKeysCmd() *cobra.Command {
+	var write bool
+
+	cmd := &cobra.Command{
+		Use:   "authorized-keys",
+		Short: "Show or install the authorized_keys lines of this machine's restricted access keys",
+		Long: `Access keys with a forced command, SFTP only or forwarding turned off reach
+this machine with a key of their own, which sshd must hold with the
+restrictions as options. 'bastion connect' keeps them installed for the user
+it runs as; --write installs them now. Every other local user a restricted
+key can log in as must have the lines in their own authorized_keys too.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := loadConfig()
+			if err != nil {
+				return err
+			}
+			keys, err := fetchRestrictedKeys(cfg)
+			if err != nil {
+				return err
+			}
+
+			if write {
+				changed, err := writeManagedKeys(keys)
+				if err != nil {
+					return err
+				}
+				if changed {
+					fmt.Println("Updated ~/.ssh/authorized_keys")
+				} else {
+					fmt.Println("~/.ssh/authorized_keys is up to date")
+				}
+				return nil
+			}
+
+			if len(keys) == 0 {
+				fmt.Printf("No restricted access keys for %s\n", cfg.MachineName)
+				return nil
+			}
+			for _, k := range keys {
+				users := "all users"
+				if len(k.LocalUsers) > 0 && !slices.Contains(k.LocalUsers, "*") {
+					users = strings.Join(k.LocalUsers, ", ")
+				}
+				fmt.Printf("# %s (%s)\n%s\n", k.Label, users, k.Line)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&write, "write", false, "Install the lines for the current user in ~/.ssh/authorized_keys")
+	return cmd
+}
@@ -0,0 +1,7 @@
+//go:build !unix
+
+package main
+
+func diskUsage(path string) (free, total uint64) {
+	return 0, 0
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+func editCmd() *cobra.Command {
+	var owner, schedule, scheduleTimezone string
+	var recordSessions, yes bool
+	var tags, addTags, removeTags, labels, removeLabels []string
+
+	cmd := &cobra.Command{
+		Use:   "edit [name]",
+		Short: "Change a machine's owner, tags, labels, session recording or access schedule (defaults to this machine)",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := loadConfig()
+			if err != nil {
+				return err
+			}
+			name := cfg.MachineName
+			if len(args) > 0 {
+				name = args[0]
+			}
+
+			body := map[string]any{}
+			if cmd.Flags().Changed("owner") {
+				body["owner"] = owner
+			}
+			if cmd.Flags().Changed("tags") {
+				body["tags"] = tags
+			}
+			if len(addTags) > 0 {
+				body["add_tags"] = addTags
+			}
+			if len(removeTags) > 0 {
+				body["remove_tags"] = removeTags
+			}
+			if len(labels) > 0 || len(removeLabels) > 0 {
+				changes := map[string]any{}
+				parsed, err := parseLabels(labels)
+				if err != nil {
+					return err
+				}
+				for k, v := range parsed {
+					changes[k] = v
+				}
+				for _, k := range removeLabels {
+					changes[k] = nil
+				}
+				body["labels"] = changes
+			}
+			if cmd.Flags().Changed("record-sessions") {
+				body["record_sessions"] = recordSessions
+			}
+			if cmd.Flags().Changed("schedule") {
+				body["schedule"] = schedule
+			}
+			if cmd.Flags().Changed("schedule-timezone") {
+				body["schedule_timezone"] = scheduleTimezone
+			}
+			if len(body) == 0 {
+				return fmt.Errorf("nothing to change: use --owner, --tags, --add-tag, --remove-tag, --label, --remove-label, --record-sessions or --schedule")
+			}
+
+			if yes {
+				body["confirm_recording"] = true
+			}
+			resp, err := apiRequest(cfg, "PATCH", "/api/machines/"+name, body)
+			if err != nil {
+				return fmt.Errorf("request failed: %w", err)
+			}
+			defer resp.Body.Close()
+
+			// The server asks before a recording change that restarts sshpiperd
+			if resp.StatusCode == http.StatusConflict && body["record_sessions"] != nil && !yes {
+				var result struct {
+					Error string `json:"error"`
+				}
+				json.NewDecoder(resp.Body).Decode(&result)
+				fmt.Printf("Warning: %s.\nContinue? [y/N]: ", strings.TrimSuffix(result.Error, "."))
+				var input string
+				fmt.Scanln(&input)
+				if !strings.EqualFold(input, "y") && !strings.EqualFold(input, "yes") {
+					return fmt.Errorf("not changed")
+				}
+				body["confirm_recording"] = true
+				resp, err = apiRequest(cfg, "PATCH", "/api/machines/"+name, body)
+				if err != nil {
+					return fmt.Errorf("request failed: %w", err)
+				}
+				defer resp.Body.Close()
+			}
+
+			if resp.StatusCode != http.StatusOK {
+				respBody, _ := io.ReadAll(resp.Body)
+				return fmt.Errorf("edit failed (%d): %s", resp.StatusCode, string(respBody))
+			}
+			var m struct {
+				Owner  string            `json:"owner"`
+				Tags   []string          `json:"tags"`
+				Labels map[string]string `json:"labels"`
+
+				RecordSessions bool `json:"record_sessions"`
+
+				Schedule         string `json:"schedule"`
+				ScheduleTimezone string `json:"schedule_timezone"`
+				OutsideSchedule  bool   `json:"outside_schedule"`
+			}
+			json.NewDecoder(resp.Body).Decode(&m)
+			fmt.Printf("Updated %s: owner %s, tags [%s], %d labels\n", name, m.Owner, strings.Join(m.Tags, ","), len(m.Labels))
+			if m.RecordSessions {
+				fmt.Println("SSH sessions to this machine are recorded.")
+			}
+			if m.Schedule != "" {
+				fmt.Printf("Reachable %s\n", describeSchedule(m.Schedule, m.ScheduleTimezone, m.OutsideSchedule))
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&owner, "owner", "", "New owner")
+	cmd.Flags().StringSliceVar(&tags, "tags", nil, "Replace all tags (comma-separated; empty to clear)")
+	cmd.Flags().StringArrayVar(&addTags, "add-tag", nil, "Add a tag (repeatable)")
+	cmd.Flags().StringArrayVar(&removeTags, "remove-tag", nil, "Remove a tag (repeatable)")
+	cmd.Flags().StringArrayVar(&labels, "label", nil, "Set a key=value label (repeatable)")
+	cmd.Flags().StringArrayVar(&removeLabels, "remove-label", nil, "Remove a label by key (repeatable)")
+	cmd.Flags().BoolVar(&recordSessions, "record-sessions", false, "Record SSH sessions to the machine (--record-sessions=false to stop)")
+	cmd.Flags().BoolVarP(&yes, "yes", "y", false, "Don't ask before a recording change that restarts sshpiperd")
+	cmd.Flags().StringVar(&schedule, "schedule", "", `Only route the machine during these windows, e.g. "mon-fri 09:00-18:00" (empty to remove)`)
+	cmd.Flags().StringVar(&scheduleTimezone, "schedule-timezone", "", "IANA timezone of the schedule, e.g. Europe/London (default UTC)")
+	return cmd
+}
+
+// describeSchedule formats an access schedule for display.
+func describeSchedule(schedule, timezone string, outside bool) string {
+	s := schedule
+	if timezone != "" {
+		s += " " + timezone
+	}
+	if outside {
+		s += " (closed now)"
+	}
+	return s
+}
+
+// parseLabels turns key=value flags into a map.
+func parseLabels(pairs []string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, p := range pairs {
+		k, v, ok := strings.Cut(p, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid label %q: use key=value", p)
+		}
+		labels[k] = v
+	}
+	return labels, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func enrollCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "enroll",
+		Short: "Manage one-time enrollment tokens for new machines",
+	}
+
+	var owner, namePrefix, expires string
+	var tags []string
+	create := &cobra.Command{
+		Use:   "create",
+		Short: "Mint a single-use token for 'bastion register --token'",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := loadConfig()
+			if err != nil {
+				return err
+			}
+
+			resp, err := apiRequest(cfg, "POST", "/api/enrollments", map[string]any{
+				"owner":       owner,
+				"name_prefix": namePrefix,
+				"tags":        tags,
+				"expires_in":  expires,
+			})
+			if err != nil {
+				return fmt.Errorf("request failed: %w", err)
+			}
+			defer resp.Body.Close()
+
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusCreated {
+				return fmt.Errorf("create enrollment failed (%d): %s", resp.StatusCode, string(body))
+			}
+			var result struct {
+				Token     string    `json:"token"`
+				ExpiresAt time.Time `json:"expires_at"`
+			}
+			json.Unmarshal(body, &result)
+
+			fmt.Println(result.Token)
+			fmt.Printf("Single use, expires %s. On the new machine run:\n", result.ExpiresAt.Local().Format("2006-01-02 15:04"))
+			fmt.Printf("  bastion register --token %s\n", result.Token)
+			return nil
+		},
+	}
+	create.Flags().StringVar(&owner, "owner", "", "Require (and default) this owner")
+	create.Flags().StringVar(&namePrefix, "name-prefix", "", "Require the machine name to start with this prefix")
+	create.Flags().StringArrayVar(&tags, "tag", nil, "Tag machines registered with the token (repeatable)")
+	create.Flags().StringVar(&expires, "expires", "24h", "Token lifetime, e.g. 1h or 7d")
+	cmd.AddCommand(create)
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List enrollment tokens and whether they were used",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := loadConfig()
+			if err != nil {
+				return err
+			}
+
+			resp, err := apiRequest(cfg, "GET", "/api/enrollments", nil)
+			if err != nil {
+				return fmt.Errorf("request failed: %w", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				body, _ := io.ReadAll(resp.Body)
+				return fmt.Errorf("failed (%d): %s", resp.StatusCode, string(body))
+			}
+
+			var enrollments []struct {
+				ID         int64      `json:"id"`
+				Owner      string     `json:"owner"`
+				NamePrefix string     `json:"name_prefix"`
+				ExpiresAt  time.Time  `json:"expires_at"`
+				UsedAt     *time.Time `json:"used_at"`
+				UsedBy     string     `json:"used_by"`
+			}
+			json.NewDecoder(resp.Body).Decode(&enrollments)
+
+			fmt.Printf("%-5s %-15s %-15s %-17s %s\n", "ID", "OWNER", "PREFIX", "EXPIRES", "STATUS")
+			for _, e := range enrollments {
+				status := "unused"
+				switch {
+				case e.UsedAt != nil:
+					status = "used by " + e.UsedBy
+				case time.Now().After(e.ExpiresAt):
+					status = "expired"
+				}
+				fmt.Printf("%-5d %-15s %-15s %-17s %s\n", e.ID, defaultStr(e.Owner, "-"), defaultStr(e.NamePrefix, "-"),
+					e.ExpiresAt.Local().Format("2006-01-02 15:04"), status)
+			}
+			return nil
+		},
+	})
+
+	return cmd
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hostFacts is the telemetry sent with each heartbeat.
+type hostFacts struct {
+	OS             string    `json:"os,omitempty"`
+	Arch           string    `json:"arch,omitempty"`
+	Kernel         string    `json:"kernel,omitempty"`
+	Hostname       string    `json:"hostname,omitempty"`
+	UptimeSeconds  int64     `json:"uptime_seconds,omitempty"`
+	Load           []float64 `json:"load,omitempty"`
+	DiskFreeBytes  uint64    `json:"disk_free_bytes,omitempty"`
+	DiskTotalBytes uint64    `json:"disk_total_bytes,omitempty"`
+	ClientVersion  string    `json:"client_version,omitempty"`
+	SSHDVersion    string    `json:"sshd_version,omitempty"`
+}
+
+var (
+	bootTimePattern    = regexp.MustCompile(`sec = (\d+)`)
+	sshdVersionPattern = regexp.MustCompile(`OpenSSH_[^\s,]+`)
+)
+
+// collectFacts gathers what it can; facts that cannot be read are left empty.
+func collectFacts() hostFacts {
+	f := hostFacts{
+		OS:            runtime.GOOS,
+		Arch:          runtime.GOARCH,
+		Kernel:        commandOutput("uname", "-r"),
+		UptimeSeconds: uptimeSeconds(),
+		Load:          loadAverage(),
+		ClientVersion: version,
+		SSHDVersion:   sshdVersion(),
+	}
+	f.Hostname, _ = os.Hostname()
+	home, _ := os.UserHomeDir()
+	f.DiskFreeBytes, f.DiskTotalBytes = diskUsage(home)
+	return f
+}
+
+func commandOutput(name string, args ...string) string {
+	out, err := exec.Command(name, args...).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func uptimeSeconds() int64 {
+	switch runtime.GOOS {
+	case "linux":
+		data, err := os.ReadFile("/proc/uptime")
+		if err != nil {
+			return 0
+		}
+		fields := strings.Fields(string(data))
+		if len(fields) == 0 {
+			return 0
+		}
+		secs, _ := strconv.ParseFloat(fields[0], 64)
+		return int64(secs)
+	case "darwin":
+		// "{ sec = 1700000000, usec = 0 } Tue Nov 14 22:13:20 2023"
+		m := bootTimePattern.FindStringSubmatch(commandOutput("sysctl", "-n", "kern.boottime"))
+		if m == nil {
+			return 0
+		}
+		boot, _ := strconv.ParseInt(m[1], 10, 64)
+		return time.Now().Unix() - boot
+	}
+	return 0
+}
+
+func loadAverage() []float64 {
+	var raw string
+	switch runtime.GOOS {
+	case "linux":
+		data, _ := os.ReadFile("/proc/loadavg")
+		raw = string(data)
+	case "darwin":
+		// "{ 1.52 1.61 1.70 }"
+		raw = strings.Trim(commandOutput("sysctl", "-n", "vm.loadavg"), "{} ")
+	}
+	fields := strings.Fields(raw)
+	if len(fields) < 3 {
+		return nil
+	}
+	load := make([]float64, 3)
+	for i := range load {
+		v, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return nil
+		}
+		load[i] = v
+	}
+	return load
+}
+
+var (
+	sshdVersionOnce  sync.Once
+	sshdVersionCache string
+)
+
+// sshdVersion returns the local OpenSSH server version, e.g. "OpenSSH_9.6p1".
+// Older sshd builds reject -V but still print the version in their usage.
+func sshdVersion() string {
+	sshdVersionOnce.Do(func() {
+		for _, path := range []string{"/usr/sbin/sshd", "sshd"} {
+			out, _ := exec.Command(path, "-V").CombinedOutput()
+			if v := sshdVersionPattern.Find(out); v != nil {
+				sshdVersionCache = string(v)
+				return
+			}
+		}
+	})
+	return sshdVersionCache
+}
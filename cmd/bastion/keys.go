@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/sshkey"
+)
+
+func keysCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "keys",
+		Short: "Inspect SSH keys known to the bastion",
+	}
+	cmd.AddCommand(keysWhoisCmd(), keysOrphanedCmd())
+	return cmd
+}
+
+func keysWhoisCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "whois <pubkey-file|fingerprint>",
+		Short: "List every machine a public key can log into",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := loadConfig()
+			if err != nil {
+				return err
+			}
+
+			fingerprint, err := resolveFingerprint(args[0])
+			if err != nil {
+				return err
+			}
+
+			resp, err := apiRequest(cfg, "GET", "/api/keys/"+url.PathEscape(fingerprint)+"/access", nil)
+			if err != nil {
+				return fmt.Errorf("request failed: %w", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				body, _ := io.ReadAll(resp.Body)
+				return fmt.Errorf("failed (%d): %s", resp.StatusCode, string(body))
+			}
+
+			var result struct {
+				Fingerprint string `json:"fingerprint"`
+				Revoked     bool   `json:"revoked"`
+				Grants      []struct {
+					Machine     string    `json:"machine"`
+					Kind        string    `json:"kind"`
+					AccessKeyID int64     `json:"access_key_id"`
+					Label       string    `json:"label"`
+					Owner       string    `json:"owner"`
+					LocalUser   string    `json:"local_user"`
+					LocalUsers  []string  `json:"local_users"`
+					State       string    `json:"state"`
+					CreatedAt   time.Time `json:"created_at"`
+				} `json:"grants"`
+			}
+			json.NewDecoder(resp.Body).Decode(&result)
+
+			fmt.Printf("Fingerprint: %s\n", result.Fingerprint)
+			if result.Revoked {
+				fmt.Println("Status:      REVOKED")
+			}
+			if len(result.Grants) == 0 {
+				fmt.Println("This key cannot reach any machine.")
+				return nil
+			}
+
+			fmt.Printf("\n%-20s %-12s %-20s %-10s %-15s %-9s %s\n", "MACHINE", "AS", "LABEL", "OWNER", "USER", "STATE", "CREATED")
+			for _, g := range result.Grants {
+				label := g.Label
+				if g.Kind == "access_key" {
+					label = fmt.Sprintf("%s (#%d)", g.Label, g.AccessKeyID)
+				}
+				users := g.LocalUser
+				if len(g.LocalUsers) > 0 {
+					users = strings.Join(g.LocalUsers, ",")
+				}
+				fmt.Printf("%-20s %-12s %-20s %-10s %-15s %-9s %s\n",
+					g.Machine, g.Kind, defaultStr(label, "-"), g.Owner, users, g.State, g.CreatedAt.Format("2006-01-02"))
+			}
+			return nil
+		},
+	}
+}
+
+func keysOrphanedCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "orphaned",
+		Short: "List, restore or delete access keys whose machine was missing when the database was upgraded",
+		Long: `Before access keys followed renames, renaming or deleting a machine could
+leave its access keys pointing at a name that no longer exists. The upgrade
+sets these keys aside instead of deleting them. They grant nothing until
+restored to a machine.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := loadConfig()
+			if err != nil {
+				return err
+			}
+			var keys []struct {
+				ID          int64     `json:"id"`
+				MachineName string    `json:"machine_name"`
+				Label       string    `json:"label"`
+				Fingerprint string    `json:"fingerprint"`
+				OrphanedAt  time.Time `json:"orphaned_at"`
+			}
+			if err := getJSON(cfg, "/api/orphaned-keys", &keys); err != nil {
+				return err
+			}
+			if len(keys) == 0 {
+				fmt.Println("No orphaned access keys.")
+				return nil
+			}
+			fmt.Printf("%-6s %-20s %-20s %-12s %s\n", "ID", "OLD MACHINE", "LABEL", "ORPHANED", "FINGERPRINT")
+			for _, k := range keys {
+				fmt.Printf("%-6d %-20s %-20s %-12s %s\n", k.ID, k.MachineName, k.Label, k.OrphanedAt.Format("2006-01-02"), k.Fingerprint)
+			}
+			return nil
+		},
+	}
+
+	var machine string
+	restore := &cobra.Command{
+		Use:   "restore <id>",
+		Short: "Add an orphaned key back to a machine, found from its old name as an alias unless --machine is given",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := loadConfig()
+			if err != nil {
+				return err
+			}
+			resp, err := apiRequest(cfg, "POST", "/api/orphaned-keys/"+url.PathEscape(args[0])+"/restore", map[string]string{"machine": machine})
+			if err != nil {
+				return fmt.Errorf("request failed: %w", err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("failed (%d): %s", resp.StatusCode, string(body))
+			}
+			var key struct {
+				ID          int64  `json:"id"`
+				MachineName string `json:"machine_name"`
+				Label       string `json:"label"`
+			}
+			json.Unmarshal(body, &key)
+			fmt.Printf("Restored %q to %s as access key %d\n", key.Label, key.MachineName, key.ID)
+			return nil
+		},
+	}
+	restore.Flags().StringVar(&machine, "machine", "", "Machine to restore the key to")
+
+	del := &cobra.Command{
+		Use:   "delete <id>",
+		Short: "Discard an orphaned key",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := loadConfig()
+			if err != nil {
+				return err
+			}
+			resp, err := apiRequest(cfg, "DELETE", "/api/orphaned-keys/"+url.PathEscape(args[0]), nil)
+			if err != nil {
+				return fmt.Errorf("request failed: %w", err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				body, _ := io.ReadAll(resp.Body)
+				return fmt.Errorf("failed (%d): %s", resp.StatusCode, string(body))
+			}
+			fmt.Printf("Deleted orphaned access key %s\n", args[0])
+			return nil
+		},
+	}
+
+	cmd.AddCommand(restore, del)
+	return cmd
+}
+
+// resolveFingerprint accepts either a SHA256 fingerprint or a path to a
+// public key file and returns the fingerprint.
+func resolveFingerprint(arg string) (string, error) {
+	if strings.HasPrefix(strings.ToUpper(arg), "SHA256:") {
+		return sshkey.NormalizeFingerprint(arg), nil
+	}
+	data, err := os.ReadFile(arg)
+	if err != nil {
+		return "", fmt.Errorf("cannot read public key %s: %w", arg, err)
+	}
+	key, err := sshkey.Parse(string(data))
+	if err != nil {
+		return "", err
+	}
+	return key.Fingerprint, nil
+}
@@ -8,11 +8,14 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -28,6 +31,17 @@ type clientConfig struct {
 	MachineName  string `json:"machine_name"`
 	AssignedPort int    `json:"assigned_port,omitempty"`
 	KeyPath      string `json:"key_path"`
+
+	// MachineToken authenticates this machine's own API calls (heartbeat,
+	// approval polling). It is issued by the server at registration.
+	MachineToken string `json:"machine_token,omitempty"`
+
+	// OwnerToken decides access requests for its owner's machines. It is
+	// minted by an admin with 'bastion access token create'.
+	OwnerToken string `json:"owner_token,omitempty"`
+
+	// EnrollmentToken is sent with a single register request; never saved.
+	EnrollmentToken string `json:"-"`
 }
 
 func configDir() string {
@@ -84,27 +98,58 @@ func apiRequest(cfg *clientConfig, method, path string, body any) (*http.Respons
 	if cfg.APIKey != "" {
 		req.Header.Set("X-API-Key", cfg.APIKey)
 	}
+	if cfg.MachineToken != "" {
+		req.Header.Set("X-Machine-Token", cfg.MachineToken)
+	}
+	if cfg.EnrollmentToken != "" {
+		req.Header.Set("X-Enrollment-Token", cfg.EnrollmentToken)
+	}
+	if cfg.OwnerToken != "" {
+		req.Header.Set("X-Owner-Token", cfg.OwnerToken)
+	}
 
 	client := &http.Client{Timeout: 15 * time.Second}
 	return client.Do(req)
 }
 
+// version is set at release build time.
+var version = "dev"
+
 func main() {
 	root := &cobra.Command{
-		Use:   "bastion",
-		Short: "SSH bastion tunnel manager",
+		Use:     "bastion",
+		Short:   "SSH bastion tunnel manager",
+		Version: version,
 	}
 
 	root.AddCommand(initCmd())
 	root.AddCommand(registerCmd())
+	root.AddCommand(enrollCmd())
 	root.AddCommand(connectCmd())
 	root.AddCommand(installCmd())
 	root.AddCommand(uninstallCmd())
 	root.AddCommand(statusCmd())
 	root.AddCommand(listCmd())
+	root.AddCommand(showCmd())
+	root.AddCommand(uptimeCmd())
+	root.AddCommand(alertsCmd())
+	root.AddCommand(sessionsCmd())
+	root.AddCommand(accessCmd())
 	root.AddCommand(deleteCmd())
+	root.AddCommand(approveCmd())
+	root.AddCommand(rejectCmd())
+	root.AddCommand(disableCmd())
+	root.AddCommand(enableCmd())
 	root.AddCommand(renameCmd())
+	root.AddCommand(editCmd())
 	root.AddCommand(configCmd())
+	root.AddCommand(keysCmd())
+	root.AddCommand(authorizedKeysCmd())
+	root.AddCommand(aliasCmd())
+	root.AddCommand(usersCmd())
+	root.AddCommand(backupCmd())
+	root.AddCommand(applyCmd())
+	root.AddCommand(exportCmd())
 
 	if err := root.Execute(); err != nil {
 		os.Exit(1)
@@ -134,7 +179,7 @@ func initCmd() *cobra.Command {
 				return fmt.Errorf("server URL is required")
 			}
 
-			fmt.Printf("API Key [%s]: ", maskStr(cfg.APIKey))
+			fmt.Printf("API Key (empty if registering with an enrollment token) [%s]: ", maskStr(cfg.APIKey))
 			input = ""
 			fmt.Scanln(&input)
 			if input != "" {
@@ -196,6 +241,10 @@ func initCmd() *cobra.Command {
 func registerCmd() *cobra.Command {
 	var owner string
 	var localUser string
+	var wait time.Duration
+	var token string
+	var reclaim bool
+	var tags, labels []string
 
 	cmd := &cobra.Command{
 		Use:   "register",
@@ -205,6 +254,10 @@ func registerCmd() *cobra.Command {
 			if err != nil {
 				return err
 			}
+			if owner == "" && token == "" && cfg.MachineToken == "" {
+				return fmt.Errorf("--owner is required unless the enrollment token sets it")
+			}
+			cfg.EnrollmentToken = token
 
 			// Read public key
 			pubKeyPath := cfg.KeyPath + ".pub"
@@ -217,11 +270,28 @@ func registerCmd() *cobra.Command {
 				localUser = os.Getenv("USER")
 			}
 
-			body := map[string]string{
+			// Prove we hold the private key for the key being registered
+			nonce, signature, err := registrationProof(cfg, pubKeyData)
+			if err != nil {
+				return err
+			}
+
+			body := map[string]any{
 				"name":       cfg.MachineName,
 				"owner":      owner,
 				"local_user": localUser,
 				"public_key": strings.TrimSpace(string(pubKeyData)),
+				"nonce":      nonce,
+				"signature":  signature,
+				"reclaim":    reclaim,
+				"tags":       tags,
+			}
+			if len(labels) > 0 {
+				parsed, err := parseLabels(labels)
+				if err != nil {
+					return err
+				}
+				body["labels"] = parsed
 			}
 
 			resp, err := apiRequest(cfg, "POST", "/api/register", body)
@@ -231,21 +301,31 @@ func registerCmd() *cobra.Command {
 			defer resp.Body.Close()
 
 			respBody, _ := io.ReadAll(resp.Body)
-			if resp.StatusCode != http.StatusCreated {
+			switch resp.StatusCode {
+			case http.StatusCreated, http.StatusAccepted:
+			case http.StatusOK:
+				fmt.Println("Machine already registered; restored its existing assignment.")
+			case http.StatusConflict:
+				return fmt.Errorf("registration failed (%d): %s\nIf this machine's key changed, re-run with --reclaim (needs the API key or the machine token)", resp.StatusCode, string(respBody))
+			default:
 				return fmt.Errorf("registration failed (%d): %s", resp.StatusCode, string(respBody))
 			}
 
 			var result struct {
 				Name            string `json:"name"`
+				Status          string `json:"status"`
 				Port            int    `json:"port"`
 				Server          string `json:"server"`
 				TunnelPort      int    `json:"tunnel_port"`
 				SSHUser         string `json:"ssh_user"`
 				ServerPublicKey string `json:"server_public_key"`
+				MachineToken    string `json:"machine_token"`
 			}
 			json.Unmarshal(respBody, &result)
 
 			cfg.AssignedPort = result.Port
+			cfg.MachineToken = result.MachineToken
+			cfg.EnrollmentToken = ""
 			if err := saveConfig(cfg); err != nil {
 				return err
 			}
@@ -261,6 +341,22 @@ func registerCmd() *cobra.Command {
 				}
 			}
 
+			if result.Status == "disabled" {
+				fmt.Printf("%s is disabled on the server (port %d kept); it is routed again once an admin runs 'bastion enable %s'.\n", result.Name, result.Port, result.Name)
+			}
+			if result.Status == "pending" {
+				fmt.Printf("Registration of %s is pending admin approval (port %d reserved).\n", result.Name, result.Port)
+				if wait <= 0 {
+					fmt.Println("Once approved, run 'bastion connect' to start the tunnel.")
+					return nil
+				}
+				fmt.Printf("Waiting up to %s for approval...\n", wait)
+				if err := waitForApproval(cfg, result.Name, wait); err != nil {
+					return err
+				}
+				fmt.Println("Approved.")
+			}
+
 			fmt.Printf("Registered successfully!\n")
 			fmt.Printf("  Machine: %s\n", result.Name)
 			fmt.Printf("  Port:    %d\n", result.Port)
@@ -298,9 +394,13 @@ func registerCmd() *cobra.Command {
 		},
 	}
 
-	cmd.Flags().StringVar(&owner, "owner", "", "Owner name (required)")
+	cmd.Flags().StringVar(&owner, "owner", "", "Owner name (required unless the enrollment token sets it)")
 	cmd.Flags().StringVar(&localUser, "local-user", "", "Local SSH username (defaults to $USER)")
-	cmd.MarkFlagRequired("owner")
+	cmd.Flags().DurationVar(&wait, "wait", 15*time.Minute, "How long to wait for approval when the server requires it (0 to return immediately)")
+	cmd.Flags().StringVar(&token, "token", "", "Register with a one-time enrollment token instead of the API key")
+	cmd.Flags().BoolVar(&reclaim, "reclaim", false, "Take over an existing registration of this name with a new key")
+	cmd.Flags().StringArrayVar(&tags, "tag", nil, "Tag the machine (repeatable)")
+	cmd.Flags().StringArrayVar(&labels, "label", nil, "Label the machine with key=value (repeatable)")
 	return cmd
 }
 
@@ -337,6 +437,10 @@ func connectCmd() *cobra.Command {
 			// Start heartbeat in background
 			go heartbeatLoop(ctx, cfg)
 
+			// Report tunnel connects and disconnects for uptime history
+			events := newEventReporter(cfg)
+			go events.run(ctx)
+
 			fmt.Printf("Connecting tunnel: localhost:22 -> %s:%d (remote port %d)\n",
 				serverHost, 2222, cfg.AssignedPort)
 
@@ -347,6 +451,7 @@ func connectCmd() *cobra.Command {
 				RemotePort: cfg.AssignedPort,
 				KeyPath:    cfg.KeyPath,
 				SSHUser:    "bastion",
+				OnEvent:    events.Report,
 			})
 		},
 	}
@@ -356,17 +461,20 @@ func heartbeatLoop(ctx context.Context, cfg *clientConfig) {
 	ticker := time.NewTicker(5 * time.Minute)
 	defer ticker.Stop()
 	for {
+		body := map[string]any{"name": cfg.MachineName, "facts": collectFacts()}
+		resp, err := apiRequest(cfg, "POST", "/api/heartbeat", body)
+		if err != nil {
+			log.Printf("Heartbeat failed: %v", err)
+		} else {
+			resp.Body.Close()
+		}
+		// Restricted access keys change rarely; following the heartbeat is enough
+		syncAuthorizedKeys(cfg)
+
 		select {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			body := map[string]string{"name": cfg.MachineName}
-			resp, err := apiRequest(cfg, "POST", "/api/heartbeat", body)
-			if err != nil {
-				log.Printf("Heartbeat failed: %v", err)
-				continue
-			}
-			resp.Body.Close()
 		}
 	}
 }
@@ -522,16 +630,54 @@ func statusCmd() *cobra.Command {
 }
 
 func listCmd() *cobra.Command {
-	return &cobra.Command{
+	var owner, state, search, sort string
+	var tags, labels []string
+	var online, offline bool
+	var limit, offset int
+
+	cmd := &cobra.Command{
 		Use:   "list",
-		Short: "List all registered machines",
+		Short: "List registered machines",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			cfg, err := loadConfig()
 			if err != nil {
 				return err
 			}
+			if online && offline {
+				return fmt.Errorf("--online and --offline are mutually exclusive")
+			}
+
+			query := url.Values{}
+			setParam := func(key, value string) {
+				if value != "" {
+					query.Set(key, value)
+				}
+			}
+			setParam("owner", owner)
+			setParam("state", state)
+			setParam("q", search)
+			setParam("sort", sort)
+			for _, t := range tags {
+				query.Add("tag", t)
+			}
+			for _, l := range labels {
+				query.Add("label", l)
+			}
+			if online || offline {
+				query.Set("online", strconv.FormatBool(online))
+			}
+			if limit > 0 {
+				query.Set("limit", strconv.Itoa(limit))
+			}
+			if offset > 0 {
+				query.Set("offset", strconv.Itoa(offset))
+			}
+			path := "/api/machines"
+			if len(query) > 0 {
+				path += "?" + query.Encode()
+			}
 
-			resp, err := apiRequest(cfg, "GET", "/api/machines", nil)
+			resp, err := apiRequest(cfg, "GET", path, nil)
 			if err != nil {
 				return fmt.Errorf("request failed: %w", err)
 			}
@@ -543,30 +689,85 @@ func listCmd() *cobra.Command {
 			}
 
 			var machines []struct {
-				Name      string  `json:"name"`
-				Owner     string  `json:"owner"`
-				Port      int     `json:"port"`
-				LocalUser string  `json:"local_user"`
-				LastSeen  *string `json:"last_seen,omitempty"`
+				Name       string            `json:"name"`
+				Owner      string            `json:"owner"`
+				Port       int               `json:"port"`
+				LocalUser  string            `json:"local_user"`
+				LocalUsers []string          `json:"local_users"`
+				State      string            `json:"state"`
+				Tags       []string          `json:"tags"`
+				Labels     map[string]string `json:"labels"`
+				LastSeen   *string           `json:"last_seen,omitempty"`
+				Schedule   string            `json:"schedule"`
+				ScheduleTZ string            `json:"schedule_timezone"`
+				Outside    bool              `json:"outside_schedule"`
+				Aliases    []struct {
+					Alias     string     `json:"alias"`
+					ExpiresAt *time.Time `json:"expires_at"`
+				} `json:"aliases"`
 			}
 			json.NewDecoder(resp.Body).Decode(&machines)
 
 			if len(machines) == 0 {
-				fmt.Println("No machines registered.")
+				if len(query) > 0 {
+					fmt.Println("No machines match.")
+				} else {
+					fmt.Println("No machines registered.")
+				}
 				return nil
 			}
 
-			fmt.Printf("%-20s %-10s %-6s %-15s %s\n", "NAME", "OWNER", "PORT", "USER", "LAST SEEN")
+			fmt.Printf("%-20s %-10s %-6s %-15s %-8s %-20s %s\n", "NAME", "OWNER", "PORT", "USER", "STATE", "LAST SEEN", "TAGS")
 			for _, m := range machines {
 				lastSeen := "never"
 				if m.LastSeen != nil {
 					lastSeen = *m.LastSeen
 				}
-				fmt.Printf("%-20s %-10s %-6d %-15s %s\n", m.Name, m.Owner, m.Port, m.LocalUser, lastSeen)
+				fmt.Printf("%-20s %-10s %-6d %-15s %-8s %-20s %s\n", m.Name, m.Owner, m.Port, m.LocalUser, m.State, lastSeen, strings.Join(m.Tags, ","))
+				if len(m.Labels) > 0 {
+					keys := make([]string, 0, len(m.Labels))
+					for k := range m.Labels {
+						keys = append(keys, k)
+					}
+					slices.Sort(keys)
+					pairs := make([]string, len(keys))
+					for i, k := range keys {
+						pairs[i] = k + "=" + m.Labels[k]
+					}
+					fmt.Printf("  labels %s\n", strings.Join(pairs, " "))
+				}
+				for _, a := range m.Aliases {
+					if a.ExpiresAt != nil {
+						fmt.Printf("  alias %s (deprecated, expires %s)\n", a.Alias, a.ExpiresAt.Local().Format("2006-01-02 15:04"))
+					} else {
+						fmt.Printf("  alias %s\n", a.Alias)
+					}
+				}
+				for _, u := range m.LocalUsers {
+					fmt.Printf("  user %s (ssh %s+%s@...)\n", u, u, m.Name)
+				}
+				if m.Schedule != "" {
+					fmt.Printf("  schedule %s\n", describeSchedule(m.Schedule, m.ScheduleTZ, m.Outside))
+				}
+			}
+			if total, _ := strconv.Atoi(resp.Header.Get("X-Total-Count")); total > len(machines) {
+				fmt.Printf("\nShowing %d-%d of %d machines (use --offset for more)\n", offset+1, offset+len(machines), total)
 			}
 			return nil
 		},
 	}
+
+	cmd.Flags().StringVar(&owner, "owner", "", "Only machines with this owner")
+	cmd.Flags().StringArrayVar(&tags, "tag", nil, "Only machines with this tag (repeatable; all must match)")
+	cmd.Flags().StringArrayVar(&labels, "label", nil, "Only machines with this key=value label (repeatable)")
+	cmd.Flags().StringVar(&state, "state", "", "Only machines in this state (active, pending, disabled)")
+	cmd.Flags().BoolVar(&online, "online", false, "Only machines that sent a heartbeat in the last 15 minutes")
+	cmd.Flags().BoolVar(&offline, "offline", false, "Only machines that did not")
+	cmd.Flags().StringVarP(&search, "search", "q", "", "Only machines whose name, owner, alias, tag or label contains this text")
+	cmd.Flags().StringVar(&sort, "sort", "", "Sort by name, owner, port, last-seen or created (prefix - to reverse)")
+	cmd.Flags().IntVar(&limit, "limit", 0, "Show at most this many machines")
+	cmd.Flags().IntVar(&offset, "offset", 0, "Skip this many machines")
+	return cmd
 }
 
 func deleteCmd() *cobra.Command {
@@ -620,7 +821,9 @@ func deleteCmd() *cobra.Command {
 }
 
 func renameCmd() *cobra.Command {
-	return &cobra.Command{
+	var grace string
+
+	cmd := &cobra.Command{
 		Use:   "rename <new-name>",
 		Short: "Rename this machine on the server",
 		Args:  cobra.ExactArgs(1),
@@ -632,6 +835,9 @@ func renameCmd() *cobra.Command {
 
 			newName := args[0]
 			body := map[string]string{"new_name": newName}
+			if grace != "" {
+				body["grace_period"] = grace
+			}
 
 			resp, err := apiRequest(cfg, "PUT", "/api/machines/"+cfg.MachineName+"/rename", body)
 			if err != nil {
@@ -644,6 +850,12 @@ func renameCmd() *cobra.Command {
 				return fmt.Errorf("rename failed (%d): %s", resp.StatusCode, string(respBody))
 			}
 
+			var result struct {
+				Alias          string     `json:"alias"`
+				AliasExpiresAt *time.Time `json:"alias_expires_at"`
+			}
+			json.NewDecoder(resp.Body).Decode(&result)
+
 			oldName := cfg.MachineName
 			cfg.MachineName = newName
 			if err := saveConfig(cfg); err != nil {
@@ -651,9 +863,15 @@ func renameCmd() *cobra.Command {
 			}
 
 			fmt.Printf("Renamed %q -> %q\n", oldName, newName)
+			if result.Alias != "" && result.AliasExpiresAt != nil {
+				fmt.Printf("%q keeps routing to this machine until %s\n", result.Alias, result.AliasExpiresAt.Local().Format("2006-01-02 15:04"))
+			}
 			return nil
 		},
 	}
+
+	cmd.Flags().StringVar(&grace, "grace", "", "Keep the old name routing for this long, e.g. 72h or 7d (defaults to the server setting)")
+	return cmd
 }
 
 func configCmd() *cobra.Command {
@@ -667,6 +885,7 @@ func configCmd() *cobra.Command {
 		"api_key":      true,
 		"machine_name": true,
 		"key_path":     true,
+		"owner_token":  true,
 	}
 	readOnlyKeys := map[string]bool{
 		"assigned_port": true,
@@ -679,7 +898,7 @@ func configCmd() *cobra.Command {
 		RunE: func(cmd *cobra.Command, args []string) error {
 			key := args[0]
 			if !validKeys[key] && !readOnlyKeys[key] {
-				return fmt.Errorf("unknown key %q (valid: server_url, api_key, machine_name, key_path, assigned_port)", key)
+				return fmt.Errorf("unknown key %q (valid: server_url, api_key, machine_name, key_path, owner_token, assigned_port)", key)
 			}
 
 			cfg, err := loadConfig()
@@ -688,7 +907,7 @@ func configCmd() *cobra.Command {
 			}
 
 			val := getConfigValue(cfg, key)
-			if key == "api_key" {
+			if key == "api_key" || key == "owner_token" {
 				val = maskStr(val)
 			}
 			fmt.Println(val)
@@ -706,7 +925,7 @@ func configCmd() *cobra.Command {
 				if readOnlyKeys[key] {
 					return fmt.Errorf("%q is read-only (set by server during register)", key)
 				}
-				return fmt.Errorf("unknown key %q (valid: server_url, api_key, machine_name, key_path)", key)
+				return fmt.Errorf("unknown key %q (valid: server_url, api_key, machine_name, key_path, owner_token)", key)
 			}
 
 			cfg, err := loadConfig()
@@ -735,6 +954,8 @@ func configCmd() *cobra.Command {
 
 			fmt.Printf("%-15s %s\n", "server_url", cfg.ServerURL)
 			fmt.Printf("%-15s %s\n", "api_key", maskStr(cfg.APIKey))
+			fmt.Printf("%-15s %s\n", "machine_token", maskStr(cfg.MachineToken))
+			fmt.Printf("%-15s %s\n", "owner_token", maskStr(cfg.OwnerToken))
 			fmt.Printf("%-15s %s\n", "machine_name", cfg.MachineName)
 			fmt.Printf("%-15s %s\n", "key_path", cfg.KeyPath)
 			fmt.Printf("%-15s %d\n", "assigned_port", cfg.AssignedPort)
@@ -755,6 +976,8 @@ func getConfigValue(cfg *clientConfig, key string) string {
 		return cfg.MachineName
 	case "key_path":
 		return cfg.KeyPath
+	case "owner_token":
+		return cfg.OwnerToken
 	case "assigned_port":
 		return fmt.Sprintf("%d", cfg.AssignedPort)
 	default:
@@ -772,6 +995,8 @@ func setConfigValue(cfg *clientConfig, key, value string) {
 		cfg.MachineName = value
 	case "key_path":
 		cfg.KeyPath = value
+	case "owner_token":
+		cfg.OwnerToken = value
 	}
 }
 
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/sshkey"
+)
+
+// registrationProof fetches a nonce from the server and signs it with the
+// private key at cfg.KeyPath. Servers without the challenge endpoint get an
+// empty proof.
+func registrationProof(cfg *clientConfig, pubKey []byte) (nonce, signature string, err error) {
+	resp, err := apiRequest(cfg, "POST", "/api/register/challenge", nil)
+	if err != nil {
+		return "", "", fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", "", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", "", fmt.Errorf("challenge failed (%d): %s", resp.StatusCode, string(body))
+	}
+	var challenge struct {
+		Nonce string `json:"nonce"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&challenge); err != nil {
+		return "", "", fmt.Errorf("invalid challenge response: %w", err)
+	}
+
+	signer, err := loadSigner(cfg.KeyPath, pubKey)
+	if err != nil {
+		return "", "", err
+	}
+	signature, err = sshkey.SignChallenge(signer, sshkey.PurposeRegister, challenge.Nonce)
+	if err != nil {
+		return "", "", err
+	}
+	return challenge.Nonce, signature, nil
+}
+
+// loadSigner reads the private key at path. Passphrase-protected keys are
+// used through ssh-agent, matched by their public key.
+func loadSigner(path string, pubKey []byte) (ssh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read private key %s: %w", path, err)
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err == nil {
+		return signer, nil
+	}
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		return nil, fmt.Errorf("cannot parse private key %s: %w", path, err)
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(pubKey)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse public key: %w", err)
+	}
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, fmt.Errorf("private key %s is passphrase-protected; add it to ssh-agent", path)
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, fmt.Errorf("connect to ssh-agent: %w", err)
+	}
+	signers, err := agent.NewClient(conn).Signers()
+	if err != nil {
+		return nil, fmt.Errorf("list ssh-agent keys: %w", err)
+	}
+	for _, s := range signers {
+		if bytes.Equal(s.PublicKey().Marshal(), pub.Marshal()) {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("private key %s is passphrase-protected and not loaded in ssh-agent; run ssh-add %s", path, path)
+}
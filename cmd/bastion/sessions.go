@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/recording"
+)
+
+type sshSession struct {
+	ID             int64      `json:"id"`
+	MachineName    string     `json:"machine_name"`
+	Username       string     `json:"username"`
+	LocalUser      string     `json:"local_user"`
+	SourceIP       string     `json:"source_ip"`
+	KeyFingerprint string     `json:"key_fingerprint"`
+	KeyLabel       string     `json:"key_label"`
+	StartedAt      time.Time  `json:"started_at"`
+	EndedAt        *time.Time `json:"ended_at"`
+	EndReason      string     `json:"end_reason"`
+	Recordings     int        `json:"recordings"`
+}
+
+func sessionsCmd() *cobra.Command {
+	var machine, key, since string
+	var active bool
+	var limit int
+	cmd := &cobra.Command{
+		Use:   "sessions",
+		Short: "List SSH sessions through the bastion: who connected to which machine, from where and with which key",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := loadConfig()
+			if err != nil {
+				return err
+			}
+
+			q := url.Values{}
+			if machine != "" {
+				q.Set("machine", machine)
+			}
+			if key != "" {
+				q.Set("fingerprint", key)
+			}
+			if active {
+				q.Set("active", "true")
+			}
+			if since != "" {
+				q.Set("since", since)
+			}
+			if limit > 0 {
+				q.Set("limit", strconv.Itoa(limit))
+			}
+			resp, err := apiRequest(cfg, "GET", "/api/sessions?"+q.Encode(), nil)
+			if err != nil {
+				return fmt.Errorf("request failed: %w", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				body, _ := io.ReadAll(resp.Body)
+				return fmt.Errorf("failed (%d): %s", resp.StatusCode, string(body))
+			}
+
+			var sessions []sshSession
+			json.NewDecoder(resp.Body).Decode(&sessions)
+			if len(sessions) == 0 {
+				fmt.Println("No sessions.")
+				return nil
+			}
+
+			fmt.Printf("%-6s %-17s %-15s %-15s %-20s %-16s %s\n", "ID", "STARTED", "MACHINE", "USER", "FROM", "KEY", "DURATION")
+			for _, s := range sessions {
+				duration := "active"
+				if s.EndedAt != nil {
+					duration = formatUptime(s.EndedAt.Sub(s.StartedAt))
+				}
+				if s.Recordings > 0 {
+					duration += " (recorded)"
+				}
+				fmt.Printf("%-6d %-17s %-15s %-15s %-20s %-16s %s\n", s.ID, s.StartedAt.Local().Format("2006-01-02 15:04"),
+					s.MachineName, s.LocalUser, s.SourceIP, sessionKey(s), duration)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&machine, "machine", "", "Only sessions to this machine")
+	cmd.Flags().StringVar(&key, "key", "", "Only sessions authenticated with this key fingerprint")
+	cmd.Flags().BoolVar(&active, "active", false, "Only sessions that are still open")
+	cmd.Flags().StringVar(&since, "since", "", "Only sessions open within this period, e.g. 24h or 7d")
+	cmd.Flags().IntVar(&limit, "limit", 0, "Maximum sessions to show (server default 100)")
+	cmd.AddCommand(sessionsPlayCmd(), sessionsKillCmd())
+	return cmd
+}
+
+func sessionsKillCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "kill <id>",
+		Short: "Disconnect an open SSH session",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := loadConfig()
+			if err != nil {
+				return err
+			}
+
+			resp, err := apiRequest(cfg, "DELETE", "/api/sessions/"+url.PathEscape(args[0]), nil)
+			if err != nil {
+				return fmt.Errorf("request failed: %w", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				body, _ := io.ReadAll(resp.Body)
+				return fmt.Errorf("failed (%d): %s", resp.StatusCode, string(body))
+			}
+			var s sshSession
+			json.NewDecoder(resp.Body).Decode(&s)
+			fmt.Printf("Disconnected session %d: %s on %s from %s (%s)\n", s.ID, s.LocalUser, s.MachineName, s.SourceIP, sessionKey(s))
+			return nil
+		},
+	}
+}
+
+func sessionsPlayCmd() *cobra.Command {
+	var speed float64
+	var idleLimit time.Duration
+	var n int
+	cmd := &cobra.Command{
+		Use:   "play <id>",
+		Short: "Replay a recorded SSH session in the terminal",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if speed <= 0 {
+				return fmt.Errorf("--speed must be positive")
+			}
+			cfg, err := loadConfig()
+			if err != nil {
+				return err
+			}
+
+			path := fmt.Sprintf("/api/sessions/%s/recording?n=%d", url.PathEscape(args[0]), n)
+			resp, err := apiRequest(cfg, "GET", path, nil)
+			if err != nil {
+				return fmt.Errorf("request failed: %w", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				body, _ := io.ReadAll(resp.Body)
+				return fmt.Errorf("failed (%d): %s", resp.StatusCode, string(body))
+			}
+			if err := recording.Play(os.Stdout, resp.Body, speed, idleLimit); err != nil {
+				return fmt.Errorf("playback failed: %w", err)
+			}
+			if count, _ := strconv.Atoi(resp.Header.Get("X-Recording-Count")); count > n {
+				fmt.Fprintf(os.Stderr, "\nRecording %d of %d; play the next with --n %d\n", n, count, n+1)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().Float64Var(&speed, "speed", 1, "Playback speed multiplier")
+	cmd.Flags().DurationVar(&idleLimit, "idle-limit", 2*time.Second, "Longest pause between output (0 keeps the recorded pauses)")
+	cmd.Flags().IntVar(&n, "n", 1, "Which of the session's recordings to play, for sessions with several shells")
+	return cmd
+}
+
+// sessionKey describes the key a session authenticated with.
+func sessionKey(s sshSession) string {
+	switch {
+	case s.KeyLabel != "":
+		return s.KeyLabel
+	case s.KeyFingerprint != "":
+		return s.KeyFingerprint
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func showCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "show [name]",
+		Short: "Show a machine's details and latest host facts (defaults to this machine)",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := loadConfig()
+			if err != nil {
+				return err
+			}
+			name := cfg.MachineName
+			if len(args) > 0 {
+				name = args[0]
+			}
+
+			resp, err := apiRequest(cfg, "GET", "/api/machines/"+url.PathEscape(name), nil)
+			if err != nil {
+				return fmt.Errorf("request failed: %w", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				body, _ := io.ReadAll(resp.Body)
+				return fmt.Errorf("failed (%d): %s", resp.StatusCode, string(body))
+			}
+
+			var m struct {
+				Name        string            `json:"name"`
+				Owner       string            `json:"owner"`
+				Port        int               `json:"port"`
+				LocalUser   string            `json:"local_user"`
+				LocalUsers  []string          `json:"local_users"`
+				Fingerprint string            `json:"fingerprint"`
+				State       string            `json:"state"`
+				Tags        []string          `json:"tags"`
+				Labels      map[string]string `json:"labels"`
+				CreatedAt   time.Time         `json:"created_at"`
+				LastSeen    *time.Time        `json:"last_seen"`
+				Facts       *hostFacts        `json:"facts"`
+				FactsAt     *time.Time        `json:"facts_at"`
+			}
+			json.NewDecoder(resp.Body).Decode(&m)
+
+			row := func(label, value string) {
+				if value != "" {
+					fmt.Printf("%-16s %s\n", label, value)
+				}
+			}
+			row("Name", m.Name)
+			row("Owner", m.Owner)
+			row("State", m.State)
+			row("Port", fmt.Sprint(m.Port))
+			row("Local user", m.LocalUser)
+			row("Other users", strings.Join(m.LocalUsers, ", "))
+			row("Fingerprint", m.Fingerprint)
+			row("Tags", strings.Join(m.Tags, ", "))
+			for _, k := range slices.Sorted(maps.Keys(m.Labels)) {
+				row("Label "+k, m.Labels[k])
+			}
+			row("Registered", m.CreatedAt.Local().Format("2006-01-02 15:04"))
+			if m.LastSeen != nil {
+				row("Last seen", m.LastSeen.Local().Format("2006-01-02 15:04"))
+			} else {
+				row("Last seen", "never")
+			}
+
+			f := m.Facts
+			if f == nil {
+				fmt.Println("\nNo host facts reported yet.")
+				return nil
+			}
+			fmt.Printf("\nHost facts (reported %s)\n", m.FactsAt.Local().Format("2006-01-02 15:04"))
+			row("Hostname", f.Hostname)
+			row("OS", strings.TrimSpace(f.OS+"/"+f.Arch+" "+f.Kernel))
+			if f.UptimeSeconds > 0 {
+				row("Uptime", formatUptime(time.Duration(f.UptimeSeconds)*time.Second))
+			}
+			if len(f.Load) == 3 {
+				row("Load", fmt.Sprintf("%.2f %.2f %.2f", f.Load[0], f.Load[1], f.Load[2]))
+			}
+			if f.DiskTotalBytes > 0 {
+				row("Disk free", fmt.Sprintf("%s of %s (%.0f%%)", formatBytes(f.DiskFreeBytes), formatBytes(f.DiskTotalBytes),
+					100*float64(f.DiskFreeBytes)/float64(f.DiskTotalBytes)))
+			}
+			row("Client version", f.ClientVersion)
+			row("sshd version", f.SSHDVersion)
+			return nil
+		},
+	}
+}
+
+func formatUptime(d time.Duration) string {
+	days := int(d.Hours()) / 24
+	d -= time.Duration(days) * 24 * time.Hour
+	if days > 0 {
+		return fmt.Sprintf("%dd %dh", days, int(d.Hours()))
+	}
+	return d.Truncate(time.Minute).String()
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
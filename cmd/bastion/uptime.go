@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/tunnel"
+)
+
+// maxPendingEvents bounds how many tunnel events are kept for retry while
+// the server is unreachable. The oldest are dropped first.
+const maxPendingEvents = 100
+
+// eventReporter posts tunnel events to the server without blocking the
+// tunnel. Events that fail to send are retried along with the next one.
+type eventReporter struct {
+	cfg    *clientConfig
+	events chan tunnel.Event
+}
+
+func newEventReporter(cfg *clientConfig) *eventReporter {
+	return &eventReporter{cfg: cfg, events: make(chan tunnel.Event, maxPendingEvents)}
+}
+
+// Report queues an event. It never blocks; if the queue is full the event is
+// dropped and the server closes the session on the next connect.
+func (r *eventReporter) Report(e tunnel.Event) {
+	select {
+	case r.events <- e:
+	default:
+		log.Printf("Dropping tunnel %s event: queue full", e.Type)
+	}
+}
+
+func (r *eventReporter) run(ctx context.Context) {
+	var pending []tunnel.Event
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-r.events:
+			pending = append(pending, e)
+		}
+		if len(pending) > maxPendingEvents {
+			pending = pending[len(pending)-maxPendingEvents:]
+		}
+		for len(pending) > 0 {
+			if err := r.send(pending[0]); err != nil {
+				log.Printf("Tunnel event report failed (%d pending): %v", len(pending), err)
+				break
+			}
+			pending = pending[1:]
+		}
+	}
+}
+
+func (r *eventReporter) send(e tunnel.Event) error {
+	body := map[string]any{"type": e.Type, "time": e.Time.UTC()}
+	if e.Type == tunnel.EventDisconnect {
+		body["duration_seconds"] = e.Duration.Seconds()
+		body["reason"] = e.Reason
+	}
+	resp, err := apiRequest(r.cfg, "POST", "/api/machines/"+url.PathEscape(r.cfg.MachineName)+"/events", body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusCreated:
+		return nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		// Retrying won't help; drop the event
+		log.Printf("Tunnel event rejected (%d)", resp.StatusCode)
+		return nil
+	default:
+		return fmt.Errorf("server returned %d", resp.StatusCode)
+	}
+}
+
+func uptimeCmd() *cobra.Command {
+	var window string
+	cmd := &cobra.Command{
+		Use:   "uptime [name]",
+		Short: "Show a machine's tunnel availability and outages (defaults to this machine)",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := loadConfig()
+			if err != nil {
+				return err
+			}
+			name := cfg.MachineName
+			if len(args) > 0 {
+				name = args[0]
+			}
+
+			path := "/api/machines/" + url.PathEscape(name) + "/uptime?window=" + url.QueryEscape(window)
+			resp, err := apiRequest(cfg, "GET", path, nil)
+			if err != nil {
+				return fmt.Errorf("request failed: %w", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				body, _ := io.ReadAll(resp.Body)
+				return fmt.Errorf("failed (%d): %s", resp.StatusCode, string(body))
+			}
+
+			var report struct {
+				Machine             string    `json:"machine"`
+				From                time.Time `json:"from"`
+				To                  time.Time `json:"to"`
+				AvailabilityPercent float64   `json:"availability_percent"`
+				DownSeconds         int64     `json:"down_seconds"`
+				Sessions            int       `json:"sessions"`
+				Reconnections       int       `json:"reconnections"`
+				Outages             []struct {
+					Start           time.Time `json:"start"`
+					DurationSeconds int64     `json:"duration_seconds"`
+					Ongoing         bool      `json:"ongoing"`
+				} `json:"outages"`
+			}
+			json.NewDecoder(resp.Body).Decode(&report)
+
+			const stamp = "2006-01-02 15:04"
+			fmt.Printf("%s: %.2f%% available from %s to %s\n", report.Machine, report.AvailabilityPercent,
+				report.From.Local().Format(stamp), report.To.Local().Format(stamp))
+			fmt.Printf("%d session(s), %d reconnection(s), %s down\n", report.Sessions, report.Reconnections,
+				formatUptime(time.Duration(report.DownSeconds)*time.Second))
+
+			if len(report.Outages) == 0 {
+				return nil
+			}
+			fmt.Printf("\n%-18s %s\n", "OUTAGE START", "DURATION")
+			for _, o := range report.Outages {
+				d := formatUptime(time.Duration(o.DurationSeconds) * time.Second)
+				if o.Ongoing {
+					d += " (ongoing)"
+				}
+				fmt.Printf("%-18s %s\n", o.Start.Local().Format(stamp), d)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&window, "window", "7d", "Report period, e.g. 24h, 7d, 30d (at most 90d)")
+	return cmd
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/spf13/cobra"
+)
+
+func usersCmd() *cobra.Command {
+	var machine string
+
+	cmd := &cobra.Command{
+		Use:   "users",
+		Short: "Manage the local users reachable on a machine",
+	}
+	cmd.PersistentFlags().StringVar(&machine, "machine", "", "Machine to manage (defaults to this machine)")
+
+	machineName := func(cfg *clientConfig) string {
+		if machine != "" {
+			return machine
+		}
+		return cfg.MachineName
+	}
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "add <user>",
+		Short: "Allow logging into another local account on the machine",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := loadConfig()
+			if err != nil {
+				return err
+			}
+			name := machineName(cfg)
+
+			resp, err := apiRequest(cfg, "POST", "/api/machines/"+name+"/users", map[string]string{"username": args[0]})
+			if err != nil {
+				return fmt.Errorf("request failed: %w", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusCreated {
+				body, _ := io.ReadAll(resp.Body)
+				return fmt.Errorf("add user failed (%d): %s", resp.StatusCode, string(body))
+			}
+			fmt.Printf("%q on %q is reachable as %s+%s\n", args[0], name, args[0], name)
+			return nil
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List the machine's local users",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := loadConfig()
+			if err != nil {
+				return err
+			}
+
+			resp, err := apiRequest(cfg, "GET", "/api/machines/"+machineName(cfg)+"/users", nil)
+			if err != nil {
+				return fmt.Errorf("request failed: %w", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				body, _ := io.ReadAll(resp.Body)
+				return fmt.Errorf("failed (%d): %s", resp.StatusCode, string(body))
+			}
+
+			var users []struct {
+				Username string `json:"username"`
+				Default  bool   `json:"default"`
+				SSHUser  string `json:"ssh_user"`
+			}
+			json.NewDecoder(resp.Body).Decode(&users)
+
+			fmt.Printf("%-15s %s\n", "USER", "SSH AS")
+			for _, u := range users {
+				sshUser := u.SSHUser
+				if u.Default {
+					sshUser += " (default)"
+				}
+				fmt.Printf("%-15s %s\n", u.Username, sshUser)
+			}
+			return nil
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "remove <user>",
+		Short: "Stop routing to a local user",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := loadConfig()
+			if err != nil {
+				return err
+			}
+
+			resp, err := apiRequest(cfg, "DELETE", "/api/machines/"+machineName(cfg)+"/users/"+args[0], nil)
+			if err != nil {
+				return fmt.Errorf("request failed: %w", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				body, _ := io.ReadAll(resp.Body)
+				return fmt.Errorf("remove user failed (%d): %s", resp.StatusCode, string(body))
+			}
+			fmt.Printf("Removed local user %q\n", args[0])
+			return nil
+		},
+	})
+
+	return cmd
+}
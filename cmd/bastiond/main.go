@@ -1,31 +1,79 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
+	"slices"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
+	_ "time/tzdata" // alert rule timezones; the runtime image has no zoneinfo
 
+	"github.com/LipJ01/fly-ssh-bastion/internal/alert"
+	"github.com/LipJ01/fly-ssh-bastion/internal/backup"
 	"github.com/LipJ01/fly-ssh-bastion/internal/config"
 	"github.com/LipJ01/fly-ssh-bastion/internal/db"
+	"github.com/LipJ01/fly-ssh-bastion/internal/piperlog"
+	"github.com/LipJ01/fly-ssh-bastion/internal/relay"
 	"github.com/LipJ01/fly-ssh-bastion/internal/server"
+	"github.com/LipJ01/fly-ssh-bastion/internal/sshkey"
 )
 
+// sshpiperdAddr is where sshpiperd listens behind the relay.
+const sshpiperdAddr = "127.0.0.1:2224"
+
 var (
 	dbPath     = flag.String("db", "/data/db/bastion.db", "SQLite database path")
 	keysDir    = flag.String("keys-dir", "/data/keys", "Directory for machine public keys")
 	configPath = flag.String("config-path", "/data/sshpiper.yaml", "Path to write sshpiper.yaml")
 	serverKey  = flag.String("server-key", "/data/server-key", "Path to server SSH private key")
 	listen     = flag.String("listen", ":8080", "HTTP listen address")
+	sshListen  = flag.String("ssh-listen", ":2223", "Listen address for client SSH connections, relayed to sshpiperd")
+	sshProxy   = flag.Bool("ssh-proxy-protocol", true, "Expect a PROXY protocol header on client SSH connections, as sent by Fly's proxy_proto handler")
+
+	hostKeysDir    = flag.String("host-keys-dir", "/data/host-keys", "Directory of persisted sshd host keys, included in backups")
+	backupDir      = flag.String("backup-dir", "", "Directory for scheduled backups (empty disables them)")
+	backupInterval = flag.Duration("backup-interval", 24*time.Hour, "Time between scheduled backups")
+	backupKeep     = flag.Int("backup-keep", 7, "Number of scheduled backups to keep")
+
+	minRSABits        = flag.Int("min-rsa-bits", sshkey.DefaultPolicy.MinRSABits, "Minimum accepted RSA key size")
+	disallowedKeys    = flag.String("disallowed-key-types", strings.Join(sshkey.DefaultPolicy.DisallowedTypes, ","), "Comma-separated SSH key types to reject")
+	allowCertificates = flag.Bool("allow-certificates", sshkey.DefaultPolicy.AllowCertificates, "Accept OpenSSH certificates as public keys")
+
+	requireApproval = flag.Bool("require-approval", false, "Hold new registrations as pending until approved")
+	requireKeyProof = flag.Bool("require-key-proof", false, "Require registrations to sign a challenge with the machine's private key (a proof that is sent is always checked)")
+	renameGrace     = flag.Duration("rename-grace", 0, "Default time a renamed machine keeps routing under its old name (0 disables)")
+	alertsConfig    = flag.String("alerts-config", "", "YAML file of offline alert rules and sinks (empty disables alerting)")
+
+	recordingsDir      = flag.String("recordings-dir", "/data/recordings", "Directory for SSH session recordings")
+	recordingRetention = flag.Duration("recording-retention", 30*24*time.Hour, "Time session recordings are kept (0 keeps them forever)")
+	recordingsMaxMB    = flag.Int64("recordings-max-mb", 0, "Total size of session recordings to keep, oldest removed first (0 is unlimited)")
 )
 
 func main() {
 	flag.Parse()
 
+	switch flag.Arg(0) {
+	case "migrate":
+		if err := runMigrate(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "restore":
+		if err := runRestore(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	apiSecret := os.Getenv("API_SECRET_KEY")
 	if apiSecret == "" {
 		log.Fatal("API_SECRET_KEY environment variable is required")
@@ -44,35 +92,41 @@ func main() {
 
 	// Config generator
 	gen := config.NewGenerator(*configPath, *keysDir, *serverKey)
+	gen.RecordingsDir = *recordingsDir
+	if err := os.MkdirAll(*recordingsDir, 0700); err != nil {
+		log.Fatalf("Failed to create recordings directory: %v", err)
+	}
+
+	handlers := &server.Handlers{
+		DB:              database,
+		Gen:             gen,
+		ServerURL:       serverURL,
+		KeyPolicy:       keyPolicy(),
+		RenameGrace:     *renameGrace,
+		RequireApproval: *requireApproval,
+		RequireKeyProof: *requireKeyProof,
+		BackupPaths:     backupPaths(),
+
+		RecordingRetention: *recordingRetention,
+		RecordingMaxBytes:  *recordingsMaxMB << 20,
+	}
+	if *alertsConfig != "" {
+		alerts, err := alert.Load(*alertsConfig)
+		if err != nil {
+			log.Fatalf("Failed to load alerts config: %v", err)
+		}
+		log.Printf("Loaded %d alert rules and %d sinks", len(alerts.Rules), len(alerts.Sinks))
+		handlers.Alerts = alerts
+	}
 
 	// Generate initial config from DB state
 	machines, err := database.ListMachines()
 	if err != nil {
 		log.Fatalf("Failed to list machines: %v", err)
 	}
-	// Write all existing keys and build pipe entries
-	var entries []config.PipeEntry
-	for _, m := range machines {
-		if err := gen.WriteKey(m.Name, m.PublicKey); err != nil {
-			log.Printf("Warning: failed to write key for %s: %v", m.Name, err)
-		}
-		accessKeys, err := database.ListAccessKeys(m.Name)
-		if err != nil {
-			log.Printf("Warning: failed to list access keys for %s: %v", m.Name, err)
-		}
-		for _, ak := range accessKeys {
-			if err := gen.WriteAccessKey(m.Name, ak.ID, ak.PublicKey); err != nil {
-				log.Printf("Warning: failed to write access key %d: %v", ak.ID, err)
-			}
-		}
-		entries = append(entries, config.PipeEntry{Machine: m, AccessKeys: accessKeys})
-	}
-	if err := gen.Generate(entries); err != nil {
+	if err := handlers.RegenerateConfig(); err != nil {
 		log.Fatalf("Failed to generate initial config: %v", err)
 	}
-	if err := gen.UpdateAuthorizedKeys(machines); err != nil {
-		log.Printf("Warning: failed to update authorized_keys: %v", err)
-	}
 	log.Printf("Generated sshpiper config for %d machines", len(machines))
 
 	// Start sshd
@@ -81,33 +135,54 @@ func main() {
 	// Give sshd time to start
 	time.Sleep(time.Second)
 
-	// Start sshpiperd
-	sshpiper := startProcess("sshpiperd",
-		"/usr/local/bin/sshpiperd",
-		"-p", "2223",
-		"-i", "/etc/sshpiper/ssh_host_ed25519_key",
-		"--log-level", "info",
-		"yaml", "--config", *configPath, "--no-check-perm",
-	)
+	// Start sshpiperd behind the relay. Sessions left open by a previous run
+	// are gone.
+	handlers.CloseSSHSessions("bastiond restarted")
+	sshListener, err := net.Listen("tcp", *sshListen)
+	if err != nil {
+		log.Fatalf("Failed to listen for SSH on %s: %v", *sshListen, err)
+	}
+	handlers.Relay = relay.New(sshpiperdAddr)
+	handlers.Relay.ProxyProtocol = *sshProxy
+	go handlers.Relay.Serve(sshListener)
+	piperArgs := sshpiperArgs(handlers)
+	sshpiper := startSSHPiper(handlers, piperArgs)
 
-	// Reload function: restart sshpiperd to pick up new config
+	// Reload function: sshpiperd's yaml plugin rereads its config for every
+	// connection, so it is only restarted, dropping all sessions, when its
+	// own options change. Handlers and maintenance call it concurrently, so
+	// piperMu guards piperArgs and sshpiper.
+	var piperMu sync.Mutex
 	reloadConfig := func() {
-		log.Println("Config changed, restarting sshpiperd...")
+		piperMu.Lock()
+		defer piperMu.Unlock()
+		args := sshpiperArgs(handlers)
+		if slices.Equal(args, piperArgs) {
+			return
+		}
+		log.Println("sshpiperd options changed, restarting sshpiperd...")
 		if sshpiper.Process != nil {
 			sshpiper.Process.Signal(syscall.SIGTERM)
 			sshpiper.Wait()
 		}
-		sshpiper = startProcess("sshpiperd",
-			"/usr/local/bin/sshpiperd",
-			"-p", "2223",
-			"-i", "/etc/sshpiper/ssh_host_ed25519_key",
-			"--log-level", "info",
-			"yaml", "--config", *configPath, "--no-check-perm",
-		)
+		handlers.CloseSSHSessions("sshpiperd restarted")
+		piperArgs = args
+		sshpiper = startSSHPiper(handlers, args)
 	}
 
 	// HTTP API
-	router := server.NewRouter(database, gen, apiSecret, serverURL, reloadConfig)
+	handlers.OnChange = reloadConfig
+	router := server.NewRouter(handlers, apiSecret)
+
+	// Expire temporary state such as deprecated aliases
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go handlers.RunMaintenance(ctx, time.Minute)
+
+	if *backupDir != "" {
+		log.Printf("Writing backups to %s every %s, keeping %d", *backupDir, *backupInterval, *backupKeep)
+		go backup.Schedule(ctx, database, handlers.SnapshotPaths(), *backupDir, *backupInterval, *backupKeep)
+	}
 
 	httpServer := &http.Server{
 		Addr:    *listen,
@@ -120,10 +195,13 @@ func main() {
 		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 		<-sig
 		log.Println("Shutting down...")
+		cancel()
 		httpServer.Close()
+		piperMu.Lock()
 		if sshpiper.Process != nil {
 			sshpiper.Process.Signal(syscall.SIGTERM)
 		}
+		piperMu.Unlock()
 		if sshd.Process != nil {
 			sshd.Process.Signal(syscall.SIGTERM)
 		}
@@ -136,10 +214,60 @@ func main() {
 	}
 }
 
+func keyPolicy() sshkey.Policy {
+	policy := sshkey.Policy{
+		MinRSABits:        *minRSABits,
+		AllowCertificates: *allowCertificates,
+	}
+	for _, t := range strings.Split(*disallowedKeys, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			policy.DisallowedTypes = append(policy.DisallowedTypes, t)
+		}
+	}
+	return policy
+}
+
+// sshpiperArgs returns sshpiperd's command line for the current config.
+func sshpiperArgs(handlers *server.Handlers) []string {
+	host, port, _ := net.SplitHostPort(sshpiperdAddr)
+	args := []string{
+		"-l", host,
+		"-p", port,
+		"-i", "/etc/sshpiper/ssh_host_ed25519_key",
+		"--log-level", "info",
+	}
+	// Recording is a global sshpiperd option, so it precedes the plugin
+	args = append(args, handlers.Gen.RecordingArgs()...)
+	return append(args, "yaml", "--config", *configPath, "--no-check-perm")
+}
+
+// startSSHPiper starts sshpiperd and records the connections it logs. Its
+// output is still copied to stdout.
+func startSSHPiper(handlers *server.Handlers, args []string) *exec.Cmd {
+	r, w, err := os.Pipe()
+	if err != nil {
+		log.Fatalf("Failed to create sshpiperd log pipe: %v", err)
+	}
+	go func() {
+		defer r.Close()
+		if err := piperlog.Scan(r, os.Stdout, handlers.RecordPiperEvent); err != nil {
+			log.Printf("error reading sshpiperd log: %v", err)
+		}
+	}()
+	cmd := startProcessOutput("sshpiperd", w, w, "/usr/local/bin/sshpiperd", args...)
+	// The child holds its own copy; closing ours lets Scan see EOF when it exits
+	w.Close()
+	return cmd
+}
+
 func startProcess(name string, path string, args ...string) *exec.Cmd {
+	return startProcessOutput(name, os.Stdout, os.Stderr, path, args...)
+}
+
+func startProcessOutput(name string, stdout, stderr io.Writer, path string, args ...string) *exec.Cmd {
 	cmd := exec.Command(path, args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
 	if err := cmd.Start(); err != nil {
 		log.Fatalf("Failed to start %s: %v", name, err)
 	}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/db"
+)
+
+// runMigrate implements "bastiond migrate status|up".
+func runMigrate(args []string) error {
+	if len(args) != 1 || (args[0] != "status" && args[0] != "up") {
+		return fmt.Errorf("usage: bastiond [flags] migrate status|up")
+	}
+
+	database, err := db.OpenWithoutMigrating(*dbPath)
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	if args[0] == "up" {
+		applied, err := database.Migrate()
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Println("database is up to date")
+		} else {
+			fmt.Printf("applied %d migrations, database is at version %d\n", len(applied), applied[len(applied)-1].Version)
+		}
+		return nil
+	}
+
+	statuses, err := database.MigrationStatus()
+	if err != nil {
+		return err
+	}
+	version, err := database.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("database version %d, binary version %d\n\n", version, db.LatestSchemaVersion())
+	fmt.Printf("%-8s %-30s %s\n", "VERSION", "NAME", "APPLIED")
+	for _, s := range statuses {
+		applied := "pending"
+		if s.AppliedAt != nil {
+			applied = s.AppliedAt.Format("2006-01-02 15:04:05")
+		}
+		if s.Version > db.LatestSchemaVersion() {
+			applied += " (unknown to this binary)"
+		}
+		fmt.Printf("%-8d %-30s %s\n", s.Version, s.Name, applied)
+	}
+	if version > db.LatestSchemaVersion() {
+		fmt.Fprintln(os.Stderr, "\nwarning: database is newer than this binary; upgrade bastiond before starting it")
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/backup"
+	"github.com/LipJ01/fly-ssh-bastion/internal/config"
+	"github.com/LipJ01/fly-ssh-bastion/internal/db"
+	"github.com/LipJ01/fly-ssh-bastion/internal/schedule"
+	"github.com/LipJ01/fly-ssh-bastion/internal/server"
+)
+
+func backupPaths() backup.Paths {
+	return backup.Paths{
+		DB:          *dbPath,
+		KeysDir:     *keysDir,
+		ServerKey:   *serverKey,
+		HostKeysDir: *hostKeysDir,
+		Config:      *configPath,
+	}
+}
+
+// runRestore implements "bastiond restore [--force] <archive>". It replaces
+// the state on disk with the archive and verifies the result by regenerating
+// the sshpiper config from the restored database. bastiond must be stopped
+// first; a server still listening on --listen is taken as running and the
+// restore is refused.
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	force := fs.Bool("force", false, "Overwrite an existing database")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: bastiond [flags] restore [--force] <archive>")
+	}
+
+	// A running server would keep writing to the database and key files
+	// being replaced, and its WAL is removed under it
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return fmt.Errorf("%s is in use, so bastiond looks to be running; stop it before restoring: %w", *listen, err)
+	}
+	l.Close()
+
+	if _, err := os.Stat(*dbPath); err == nil && !*force {
+		return fmt.Errorf("%s already exists; stop the server and pass --force to overwrite it", *dbPath)
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	m, err := backup.Restore(f, backupPaths())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Restored %d files from backup taken %s (schema version %d)\n", len(m.Files), m.CreatedAt.Format("2006-01-02 15:04:05"), m.SchemaVersion)
+
+	database, err := db.Open(*dbPath)
+	if err != nil {
+		return fmt.Errorf("restored database does not open: %w", err)
+	}
+	defer database.Close()
+
+	handlers := &server.Handlers{
+		DB:  database,
+		Gen: config.NewGenerator(*configPath, *keysDir, *serverKey),
+	}
+	if err := handlers.RegenerateConfig(); err != nil {
+		return fmt.Errorf("regenerate config from restored database: %w", err)
+	}
+
+	machines, err := database.ListMachines()
+	if err != nil {
+		return err
+	}
+	generated, err := os.ReadFile(*configPath)
+	if err != nil {
+		return err
+	}
+	fps, err := database.RevokedFingerprints()
+	if err != nil {
+		return err
+	}
+	revoked := config.NewRevoked(fps)
+
+	// Only machines RegenerateConfig routes are expected in the config:
+	// active ones, inside their schedule, whose key is not revoked
+	var missing []string
+	routed := 0
+	now := time.Now()
+	for _, m := range machines {
+		if !m.IsActive() || !schedule.Open(m.Schedule, m.ScheduleTimezone, now) || revoked.Has(m.PublicKey) {
+			continue
+		}
+		routed++
+		_, err := os.Stat(filepath.Join(*keysDir, m.Name+".pub"))
+		if err != nil || !strings.Contains(string(generated), fmt.Sprintf("username: %q", m.Name)) {
+			missing = append(missing, m.Name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("regenerated config has no route for: %s", strings.Join(missing, ", "))
+	}
+	fmt.Printf("Verified: regenerated sshpiper config routes all %d routable machines (%d not routed: pending, disabled, outside their schedule or revoked)\n",
+		routed, len(machines)-routed)
+	return nil
+}
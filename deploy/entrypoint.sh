@@ -3,6 +3,25 @@ set -e
 
 mkdir -p /data/keys /data/db /data/host-keys
 
+set -- \
+    --db /data/db/bastion.db \
+    --keys-dir /data/keys \
+    --config-path /data/sshpiper.yaml \
+    --server-key /data/server-key
+
+# Restore a backup left at /data/restore.tar.gz before bastiond starts, so
+# nothing is writing to the state while it is replaced. The archive is
+# renamed afterwards so the next boot does not restore it again.
+if [ -f /data/restore.tar.gz ]; then
+    echo "Restoring backup /data/restore.tar.gz..."
+    if /usr/local/bin/bastiond "$@" restore --force /data/restore.tar.gz; then
+        mv /data/restore.tar.gz /data/restore.tar.gz.done
+    else
+        mv /data/restore.tar.gz /data/restore.tar.gz.failed
+        echo "Restore failed, see above; starting with the state on disk"
+    fi
+fi
+
 # Generate server keypair on first boot (for upstream SSH auth)
 if [ ! -f /data/server-key ]; then
     echo "Generating server SSH keypair..."
@@ -18,26 +37,16 @@ else
     cp /data/host-keys/* /etc/ssh/
 fi
 
-# Setup bastion user authorized_keys from server public key
-# (machines authenticate with their own keys via sshpiper,
-#  but the bastion user needs to accept tunnel connections)
+# Setup bastion user authorized_keys from server public key only. bastiond
+# adds the active machines' keys, each limited to its own tunnel port, when
+# it starts; copying /data/keys here would let disabled machines and access
+# keys open unrestricted tunnels until then.
 mkdir -p /home/bastion/.ssh
 cp /data/server-key.pub /home/bastion/.ssh/authorized_keys
 
-# Also add any registered machine keys to bastion authorized_keys
-# so machines can establish reverse tunnels
-if [ -d /data/keys ] && ls /data/keys/*.pub 1>/dev/null 2>&1; then
-    cat /data/keys/*.pub >> /home/bastion/.ssh/authorized_keys
-fi
-
 chmod 700 /home/bastion/.ssh
 chmod 600 /home/bastion/.ssh/authorized_keys
 chown -R bastion:bastion /home/bastion/.ssh
 
 echo "Starting bastiond..."
-exec /usr/local/bin/bastiond \
-    --db /data/db/bastion.db \
-    --keys-dir /data/keys \
-    --config-path /data/sshpiper.yaml \
-    --server-key /data/server-key \
-    --listen :8080
+exec /usr/local/bin/bastiond "$@" --listen :8080
@@ -0,0 +1,248 @@
+// Package alert describes offline alerting rules and delivers notifications
+// through webhook, SMTP and command sinks.
+package alert
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/schedule"
+)
+
+// DefaultOfflineFor is used by rules that do not set offline_for.
+const DefaultOfflineFor = 15 * time.Minute
+
+// Config is the alerting configuration: rules and the sinks they notify.
+type Config struct {
+	Rules []Rule       `yaml:"rules"`
+	Sinks []SinkConfig `yaml:"sinks"`
+
+	// AccessRequestSinks names the sinks told about access requests; empty
+	// means all of them.
+	AccessRequestSinks []string `yaml:"access_request_sinks,omitempty"`
+
+	// OwnerSinks names, by owner, the sinks told about access requests for
+	// that owner's machines instead of AccessRequestSinks.
+	OwnerSinks map[string][]string `yaml:"owner_sinks,omitempty"`
+
+	// sinks are built from Sinks by Parse, by name.
+	sinks map[string]Sink
+}
+
+// Rule fires for each machine it matches that has not been seen for longer
+// than OfflineFor. A rule without machines or tags matches every machine.
+type Rule struct {
+	Name       string        `yaml:"name"`
+	Machines   []string      `yaml:"machines,omitempty"`
+	Tags       []string      `yaml:"tags,omitempty"`
+	OfflineFor time.Duration `yaml:"offline_for,omitempty"`
+
+	// Hours limits when the rule fires, as a schedule like "09:00-18:00" or
+	// "mon-fri 09:00-18:00" in Timezone (default UTC). A range that wraps
+	// midnight, like "22:00-06:00", is allowed. Alerts resolve at any time.
+	Hours    string `yaml:"hours,omitempty"`
+	Timezone string `yaml:"timezone,omitempty"`
+
+	// Sinks names the sinks to notify; empty means all of them.
+	Sinks []string `yaml:"sinks,omitempty"`
+
+	hours *schedule.Schedule // parsed from Hours by Parse
+}
+
+// Target is the machine state a rule is evaluated against.
+type Target struct {
+	Name      string
+	Owner     string
+	Tags      []string
+	CreatedAt time.Time
+	LastSeen  *time.Time
+}
+
+// Load reads and parses an alerting config file.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Parse decodes and validates an alerting config and builds its sinks.
+// Unknown fields are rejected so typos do not silently disable alerts.
+func Parse(data []byte) (*Config, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	var c Config
+	if err := dec.Decode(&c); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("parse alerts: %w", err)
+	}
+
+	c.sinks = make(map[string]Sink)
+	for i, sc := range c.Sinks {
+		if sc.Name == "" {
+			return nil, fmt.Errorf("sink %d: name is required", i+1)
+		}
+		if _, ok := c.sinks[sc.Name]; ok {
+			return nil, fmt.Errorf("sink %q is listed twice", sc.Name)
+		}
+		sink, err := sc.build()
+		if err != nil {
+			return nil, fmt.Errorf("sink %q: %w", sc.Name, err)
+		}
+		c.sinks[sc.Name] = sink
+	}
+
+	seen := make(map[string]bool)
+	for i := range c.Rules {
+		r := &c.Rules[i]
+		if r.Name == "" {
+			return nil, fmt.Errorf("rule %d: name is required", i+1)
+		}
+		if seen[r.Name] {
+			return nil, fmt.Errorf("rule %q is listed twice", r.Name)
+		}
+		seen[r.Name] = true
+		if err := r.init(); err != nil {
+			return nil, fmt.Errorf("rule %q: %w", r.Name, err)
+		}
+		for _, s := range r.Sinks {
+			if _, ok := c.sinks[s]; !ok {
+				return nil, fmt.Errorf("rule %q: unknown sink %q", r.Name, s)
+			}
+		}
+	}
+	for _, s := range c.AccessRequestSinks {
+		if _, ok := c.sinks[s]; !ok {
+			return nil, fmt.Errorf("access_request_sinks: unknown sink %q", s)
+		}
+	}
+	for owner, names := range c.OwnerSinks {
+		if len(names) == 0 {
+			return nil, fmt.Errorf("owner_sinks: owner %q has no sinks", owner)
+		}
+		for _, s := range names {
+			if _, ok := c.sinks[s]; !ok {
+				return nil, fmt.Errorf("owner_sinks: owner %q: unknown sink %q", owner, s)
+			}
+		}
+	}
+	return &c, nil
+}
+
+// AddSink registers a sink under name, replacing any sink of that name.
+func (c *Config) AddSink(name string, s Sink) {
+	if c.sinks == nil {
+		c.sinks = make(map[string]Sink)
+	}
+	c.sinks[name] = s
+}
+
+// Rule returns the rule called name, or nil.
+func (c *Config) Rule(name string) *Rule {
+	for i := range c.Rules {
+		if c.Rules[i].Name == name {
+			return &c.Rules[i]
+		}
+	}
+	return nil
+}
+
+// Notify sends n to the rule's sinks and returns every delivery error.
+func (c *Config) Notify(ctx context.Context, r *Rule, n Notification) error {
+	return c.send(ctx, r.Sinks, n)
+}
+
+// NotifyAccessRequest sends an access request notification to the machine
+// owner's sinks, or to the access request sinks for owners without any, and
+// returns every delivery error.
+func (c *Config) NotifyAccessRequest(ctx context.Context, n Notification) error {
+	if names, ok := c.OwnerSinks[n.Owner]; ok {
+		return c.send(ctx, names, n)
+	}
+	return c.send(ctx, c.AccessRequestSinks, n)
+}
+
+// send delivers n to the named sinks, or to every sink if names is empty.
+func (c *Config) send(ctx context.Context, names []string, n Notification) error {
+	if len(names) == 0 {
+		for name := range c.sinks {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+	}
+	var errs []error
+	for _, name := range names {
+		sink, ok := c.sinks[name]
+		if !ok {
+			continue
+		}
+		if err := sink.Send(ctx, n); err != nil {
+			errs = append(errs, fmt.Errorf("sink %q: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (r *Rule) init() error {
+	if r.OfflineFor < 0 {
+		return fmt.Errorf("offline_for must not be negative")
+	}
+	if r.OfflineFor == 0 {
+		r.OfflineFor = DefaultOfflineFor
+	}
+	if r.Hours == "" {
+		if r.Timezone != "" {
+			return fmt.Errorf("timezone needs hours")
+		}
+		return nil
+	}
+	h, err := schedule.Parse(r.Hours, r.Timezone)
+	if err != nil {
+		return fmt.Errorf("hours: %w", err)
+	}
+	r.hours = h
+	return nil
+}
+
+// Matches reports whether the rule applies to t.
+func (r *Rule) Matches(t Target) bool {
+	if len(r.Machines) == 0 && len(r.Tags) == 0 {
+		return true
+	}
+	if slices.Contains(r.Machines, t.Name) {
+		return true
+	}
+	for _, tag := range r.Tags {
+		if slices.Contains(t.Tags, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// OfflineSince returns when t was last seen, or when it registered if it
+// has never been seen.
+func OfflineSince(t Target) time.Time {
+	if t.LastSeen != nil {
+		return *t.LastSeen
+	}
+	return t.CreatedAt
+}
+
+// Offline reports whether t has been offline for longer than the rule allows.
+func (r *Rule) Offline(t Target, now time.Time) bool {
+	return now.Sub(OfflineSince(t)) > r.OfflineFor
+}
+
+// Active reports whether now is within the rule's hours.
+func (r *Rule) Active(now time.Time) bool {
+	return r.hours == nil || r.hours.Contains(now)
+}
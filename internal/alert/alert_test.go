@@ -0,0 +1,297 @@
+package alert
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRejectsInvalid(t *testing.T) {
+	for name, doc := range map[string]string{
+		"unknown field":   "rules:\n  - name: a\n    ofline_for: 5m\n",
+		"missing name":    "rules:\n  - offline_for: 5m\n",
+		"duplicate rule":  "rules:\n  - name: a\n  - name: a\n",
+		"bad hours":       "rules:\n  - name: a\n    hours: 9-5\n",
+		"empty hours":     "rules:\n  - name: a\n    hours: 09:00-09:00\n",
+		"bad timezone":    "rules:\n  - name: a\n    hours: 09:00-17:00\n    timezone: Mars/Olympus\n",
+		"unknown sink":    "rules:\n  - name: a\n    sinks: [pager]\n",
+		"unknown type":    "sinks:\n  - name: s\n    type: carrier-pigeon\n",
+		"webhook no url":  "sinks:\n  - name: s\n    type: webhook\n",
+		"smtp no to":      "sinks:\n  - name: s\n    type: smtp\n    addr: mail:25\n    from: a@b\n",
+		"empty command":   "sinks:\n  - name: s\n    type: command\n",
+		"duplicate sink":  "sinks:\n  - {name: s, type: command, command: [true]}\n  - {name: s, type: command, command: [true]}\n",
+		"negative period": "rules:\n  - name: a\n    offline_for: -5m\n",
+	} {
+		if _, err := Parse([]byte(doc)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestRules(t *testing.T) {
+	c, err := Parse([]byte(`
+rules:
+  - name: all
+  - name: weekdays
+    hours: "mon-fri 09:00-18:00"
+  - name: prod
+    tags: [prod]
+    machines: [nas]
+    offline_for: 5m
+    hours: "22:00-06:00"
+    timezone: America/New_York
+`))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	all, prod := c.Rule("all"), c.Rule("prod")
+	if all.OfflineFor != DefaultOfflineFor {
+		t.Fatalf("expected default offline_for, got %s", all.OfflineFor)
+	}
+
+	nas := Target{Name: "nas"}
+	web := Target{Name: "web", Tags: []string{"prod"}}
+	lab := Target{Name: "lab", Tags: []string{"lab"}}
+	if !all.Matches(lab) || !prod.Matches(nas) || !prod.Matches(web) || prod.Matches(lab) {
+		t.Fatal("unexpected rule matching")
+	}
+
+	now := time.Date(2026, 1, 15, 12, 0, 0, 0, time.UTC)
+	seen := now.Add(-10 * time.Minute)
+	if !prod.Offline(Target{LastSeen: &seen}, now) || all.Offline(Target{LastSeen: &seen}, now) {
+		t.Fatal("unexpected offline result")
+	}
+	if !all.Offline(Target{CreatedAt: now.Add(-time.Hour)}, now) {
+		t.Fatal("expected a machine that never connected to count from registration")
+	}
+
+	// 22:00-06:00 New York is 03:00-11:00 UTC in January
+	for utcHour, want := range map[int]bool{2: false, 3: true, 10: true, 11: false, 12: false} {
+		at := time.Date(2026, 1, 15, utcHour, 30, 0, 0, time.UTC)
+		if got := prod.Active(at); got != want {
+			t.Errorf("Active at %02d:30 UTC = %v, want %v", utcHour, got, want)
+		}
+	}
+	if !all.Active(now) {
+		t.Fatal("a rule without hours is always active")
+	}
+	// Hours take the same schedules as access schedules; January 17 is a Saturday
+	weekdays := c.Rule("weekdays")
+	if !weekdays.Active(now) || weekdays.Active(now.Add(48*time.Hour)) {
+		t.Fatal("expected the rule active on weekdays only")
+	}
+}
+
+func testNotification() Notification {
+	now := time.Date(2026, 1, 15, 12, 0, 0, 0, time.UTC)
+	seen := now.Add(-20 * time.Minute)
+	return Notification{Event: EventFiring, Rule: "offline", Machine: "nas", Owner: "alice",
+		Tags: []string{"prod"}, LastSeen: &seen, OfflineSince: seen, Time: now}
+}
+
+func TestWebhookSink(t *testing.T) {
+	var got map[string]any
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer srv.Close()
+
+	s := &WebhookSink{URL: srv.URL, Headers: map[string]string{"Authorization": "Bearer x"}}
+	if err := s.Send(context.Background(), testNotification()); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if got["machine"] != "nas" || got["event"] != "firing" || got["text"] != "nas is offline: last seen 20m0s ago" || auth != "Bearer x" {
+		t.Fatalf("unexpected webhook body %v (auth %q)", got, auth)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer failing.Close()
+	if err := (&WebhookSink{URL: failing.URL}).Send(context.Background(), testNotification()); err == nil {
+		t.Fatal("expected an error for a 502")
+	}
+}
+
+// fakeSMTP accepts one message and sends it on the returned channel.
+func fakeSMTP(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	messages := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+		reply("220 localhost ESMTP")
+		var envelope, data strings.Builder
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			cmd := strings.ToUpper(strings.TrimSpace(line))
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				reply("250 localhost")
+			case strings.HasPrefix(cmd, "MAIL"), strings.HasPrefix(cmd, "RCPT"):
+				envelope.WriteString(strings.TrimSpace(line) + "\n")
+				reply("250 OK")
+			case cmd == "DATA":
+				reply("354 go ahead")
+				for {
+					l, err := r.ReadString('\n')
+					if err != nil || l == ".\r\n" {
+						break
+					}
+					data.WriteString(l)
+				}
+				reply("250 queued")
+			case cmd == "QUIT":
+				reply("221 bye")
+				messages <- envelope.String() + data.String()
+				return
+			default:
+				reply("502 unsupported")
+			}
+		}
+	}()
+	return ln.Addr().String(), messages
+}
+
+func TestSMTPSink(t *testing.T) {
+	addr, messages := fakeSMTP(t)
+	s := &SMTPSink{Addr: addr, From: "bastion@example.com", To: []string{"ops@example.com", "oncall@example.com"}}
+	if err := s.Send(context.Background(), testNotification()); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	msg := <-messages
+	for _, want := range []string{
+		"MAIL FROM:<bastion@example.com>",
+		"RCPT TO:<oncall@example.com>",
+		"Subject: [bastion] FIRING: nas is offline: last seen 20m0s ago",
+		"Owner:         alice",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("message missing %q:\n%s", want, msg)
+		}
+	}
+
+	// Text from an access request cannot add headers
+	n := Notification{Event: EventAccessRequested, Machine: "nas", Owner: "alice", Requester: "carol", Duration: "1h",
+		RequestID: 1, Reason: "x\r\nBcc: eve@example.com", Time: time.Now()}
+	s.Addr, messages = fakeSMTP(t)
+	if err := s.Send(context.Background(), n); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	msg = <-messages
+	headers, _, _ := strings.Cut(msg, "\r\n\r\n")
+	if strings.Contains(headers, "\r\nBcc:") || !strings.Contains(headers, "Subject: =?utf-8?q?") {
+		t.Fatalf("expected an encoded subject and no injected header:\n%s", headers)
+	}
+}
+
+func TestCommandSink(t *testing.T) {
+	// bastiond's own environment, such as the API key, is not passed on
+	t.Setenv("API_SECRET_KEY", "hunter2")
+	out := filepath.Join(t.TempDir(), "out")
+	s := &CommandSink{Command: []string{"sh", "-c", `echo "$ALERT_EVENT $ALERT_MACHINE$API_SECRET_KEY" > "$0"; cat >> "$0"`, out}}
+	if err := s.Send(context.Background(), testNotification()); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	data, _ := os.ReadFile(out)
+	if !strings.HasPrefix(string(data), "firing nas\n{") || !strings.Contains(string(data), `"owner":"alice"`) {
+		t.Fatalf("unexpected command output %q", data)
+	}
+
+	failing := &CommandSink{Command: []string{"sh", "-c", "echo boom; exit 3"}}
+	if err := failing.Send(context.Background(), testNotification()); err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("expected the command's output in the error, got %v", err)
+	}
+}
+
+type recordingSink struct{ got []Notification }
+
+func (s *recordingSink) Send(_ context.Context, n Notification) error {
+	s.got = append(s.got, n)
+	return nil
+}
+
+func TestNotifyRoutesToRuleSinks(t *testing.T) {
+	c, err := Parse([]byte(`
+rules:
+  - name: everywhere
+  - name: pager-only
+    sinks: [pager]
+sinks:
+  - {name: pager, type: command, command: ["true"]}
+`))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	pager, chat := &recordingSink{}, &recordingSink{}
+	c.AddSink("pager", pager)
+	c.AddSink("chat", chat)
+
+	c.Notify(context.Background(), c.Rule("everywhere"), testNotification())
+	c.Notify(context.Background(), c.Rule("pager-only"), testNotification())
+	if len(pager.got) != 2 || len(chat.got) != 1 {
+		t.Fatalf("expected 2 pager and 1 chat notifications, got %d and %d", len(pager.got), len(chat.got))
+	}
+}
+
+func TestNotifyAccessRequest(t *testing.T) {
+	for _, doc := range []string{"access_request_sinks: [ghost]\n", "owner_sinks: {alice: [ghost]}\n", "owner_sinks: {alice: []}\n"} {
+		if _, err := Parse([]byte(doc)); err == nil {
+			t.Fatalf("%q: expected an unknown or missing sink rejected", doc)
+		}
+	}
+	c, err := Parse([]byte(`
+access_request_sinks: [chat]
+owner_sinks:
+  carol: [pager]
+sinks:
+  - {name: chat, type: command, command: ["true"]}
+  - {name: pager, type: command, command: ["true"]}
+`))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	pager, chat := &recordingSink{}, &recordingSink{}
+	c.AddSink("pager", pager)
+	c.AddSink("chat", chat)
+
+	n := Notification{Event: EventAccessRequested, Machine: "nas", Owner: "alice", RequestID: 4,
+		Requester: "bob", Reason: "restore photos", Duration: "8h0m0s", Time: time.Now()}
+	c.NotifyAccessRequest(context.Background(), n)
+	if len(pager.got) != 0 || len(chat.got) != 1 {
+		t.Fatalf("expected only the chat sink notified, got %d and %d", len(pager.got), len(chat.got))
+	}
+	if s := n.Summary(); s != "bob requests access to nas for 8h0m0s (request 4): restore photos" {
+		t.Fatalf("unexpected summary %q", s)
+	}
+
+	// An owner with sinks of their own is asked there instead
+	n.Owner = "carol"
+	c.NotifyAccessRequest(context.Background(), n)
+	if len(pager.got) != 1 || len(chat.got) != 1 {
+		t.Fatalf("expected only carol's sink notified, got %d and %d", len(pager.got), len(chat.got))
+	}
+}
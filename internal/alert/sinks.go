@@ -0,0 +1,278 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// sendTimeout bounds each delivery so a slow sink cannot stall evaluation.
+const sendTimeout = 30 * time.Second
+
+// Notification events.
+const (
+	EventFiring   = "firing"
+	EventResolved = "resolved"
+	// EventAccessRequested asks a machine's owner to approve an access
+	// request. It carries no rule or offline time.
+	EventAccessRequested = "access_requested"
+)
+
+// Notification is what sinks deliver when an alert fires or resolves, or
+// someone requests access to a machine.
+type Notification struct {
+	Event        string     `json:"event"`
+	Rule         string     `json:"rule"`
+	Machine      string     `json:"machine"`
+	Owner        string     `json:"owner"`
+	Tags         []string   `json:"tags,omitempty"`
+	LastSeen     *time.Time `json:"last_seen,omitempty"`
+	OfflineSince time.Time  `json:"offline_since"`
+	Time         time.Time  `json:"time"`
+
+	RequestID int64  `json:"request_id,omitempty"`
+	Requester string `json:"requester,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	Duration  string `json:"duration,omitempty"`
+}
+
+// Summary is a one-line description of the notification.
+func (n Notification) Summary() string {
+	if n.Event == EventAccessRequested {
+		return fmt.Sprintf("%s requests access to %s for %s (request %d): %s", n.Requester, n.Machine, n.Duration, n.RequestID, n.Reason)
+	}
+	offline := n.Time.Sub(n.OfflineSince).Truncate(time.Minute)
+	if n.Event == EventResolved {
+		return fmt.Sprintf("%s is back online after %s", n.Machine, offline)
+	}
+	if n.LastSeen == nil {
+		return fmt.Sprintf("%s has not connected since it registered %s ago", n.Machine, offline)
+	}
+	return fmt.Sprintf("%s is offline: last seen %s ago", n.Machine, offline)
+}
+
+// Sink delivers notifications.
+type Sink interface {
+	Send(ctx context.Context, n Notification) error
+}
+
+// SinkConfig configures one sink. Type selects which of the other fields
+// apply.
+type SinkConfig struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type"` // webhook, smtp or command
+
+	// webhook
+	URL     string            `yaml:"url,omitempty"`
+	Headers map[string]string `yaml:"headers,omitempty"`
+
+	// smtp
+	Addr        string   `yaml:"addr,omitempty"` // host:port
+	From        string   `yaml:"from,omitempty"`
+	To          []string `yaml:"to,omitempty"`
+	Username    string   `yaml:"username,omitempty"`
+	PasswordEnv string   `yaml:"password_env,omitempty"` // environment variable holding the password
+
+	// command
+	Command []string `yaml:"command,omitempty"`
+}
+
+func (sc SinkConfig) build() (Sink, error) {
+	switch sc.Type {
+	case "webhook":
+		if !strings.HasPrefix(sc.URL, "https://") && !strings.HasPrefix(sc.URL, "http://") {
+			return nil, fmt.Errorf("webhook needs an http(s) url")
+		}
+		return &WebhookSink{URL: sc.URL, Headers: sc.Headers}, nil
+	case "smtp":
+		if _, _, err := net.SplitHostPort(sc.Addr); err != nil {
+			return nil, fmt.Errorf("smtp needs addr as host:port")
+		}
+		if sc.From == "" || len(sc.To) == 0 {
+			return nil, fmt.Errorf("smtp needs from and to")
+		}
+		s := &SMTPSink{Addr: sc.Addr, From: sc.From, To: sc.To, Username: sc.Username}
+		if sc.PasswordEnv != "" {
+			s.Password = os.Getenv(sc.PasswordEnv)
+			if s.Password == "" {
+				return nil, fmt.Errorf("environment variable %s is empty", sc.PasswordEnv)
+			}
+		}
+		return s, nil
+	case "command":
+		if len(sc.Command) == 0 {
+			return nil, fmt.Errorf("command sink needs a command")
+		}
+		return &CommandSink{Command: sc.Command}, nil
+	default:
+		return nil, fmt.Errorf("unknown type %q (want webhook, smtp or command)", sc.Type)
+	}
+}
+
+// WebhookSink POSTs the notification as JSON. The body also carries the
+// summary as "text", which chat webhooks such as Slack's display.
+type WebhookSink struct {
+	URL     string
+	Headers map[string]string
+}
+
+func (s *WebhookSink) Send(ctx context.Context, n Notification) error {
+	body, err := json.Marshal(struct {
+		Notification
+		Text string `json:"text"`
+	}{n, n.Summary()})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, sendTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range s.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// SMTPSink emails the notification. STARTTLS is used when the server offers
+// it; authentication is only attempted when Username is set.
+type SMTPSink struct {
+	Addr     string
+	From     string
+	To       []string
+	Username string
+	Password string
+}
+
+func (s *SMTPSink) Send(ctx context.Context, n Notification) error {
+	ctx, cancel := context.WithTimeout(ctx, sendTimeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	host, _, _ := net.SplitHostPort(s.Addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if s.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.Username, s.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(s.From); err != nil {
+		return err
+	}
+	for _, to := range s.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(s.message(n)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func (s *SMTPSink) message(n Notification) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", s.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(s.To, ", "))
+	// The summary can carry text from unauthenticated access requests, so it
+	// is encoded rather than trusted to be a single header line
+	subject := fmt.Sprintf("[bastion] %s: %s", strings.ToUpper(n.Event), n.Summary())
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", n.Time.Format(time.RFC1123Z))
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&b, "%s\r\n\r\n", n.Summary())
+	if n.Event == EventAccessRequested {
+		fmt.Fprintf(&b, "Request:       %d\r\n", n.RequestID)
+		fmt.Fprintf(&b, "Machine:       %s\r\n", n.Machine)
+		fmt.Fprintf(&b, "Owner:         %s\r\n", n.Owner)
+		fmt.Fprintf(&b, "Requester:     %s\r\n", n.Requester)
+		fmt.Fprintf(&b, "Duration:      %s\r\n", n.Duration)
+		fmt.Fprintf(&b, "Reason:        %s\r\n\r\n", n.Reason)
+		fmt.Fprintf(&b, "Approve with 'bastion access approve %d' or deny with 'bastion access deny %d'.\r\n", n.RequestID, n.RequestID)
+		return b.Bytes()
+	}
+	fmt.Fprintf(&b, "Rule:          %s\r\n", n.Rule)
+	fmt.Fprintf(&b, "Machine:       %s\r\n", n.Machine)
+	fmt.Fprintf(&b, "Owner:         %s\r\n", n.Owner)
+	if len(n.Tags) > 0 {
+		fmt.Fprintf(&b, "Tags:          %s\r\n", strings.Join(n.Tags, ", "))
+	}
+	fmt.Fprintf(&b, "Offline since: %s\r\n", n.OfflineSince.UTC().Format(time.RFC3339))
+	return b.Bytes()
+}
+
+// CommandSink runs a command with the notification as JSON on stdin and its
+// main fields in ALERT_* environment variables. The command gets no other
+// environment than PATH, so it cannot read bastiond's secrets.
+type CommandSink struct {
+	Command []string
+}
+
+func (s *CommandSink) Send(ctx context.Context, n Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, sendTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, s.Command[0], s.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Env = []string{
+		"PATH=" + os.Getenv("PATH"),
+		"ALERT_EVENT=" + n.Event,
+		"ALERT_RULE=" + n.Rule,
+		"ALERT_MACHINE=" + n.Machine,
+		"ALERT_OWNER=" + n.Owner,
+		"ALERT_OFFLINE_SINCE=" + n.OfflineSince.UTC().Format(time.RFC3339),
+		"ALERT_SUMMARY=" + n.Summary(),
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,353 @@
+// Package backup archives and restores the bastion's persistent state: the
+// database, machine and access key files, the server keypair, the sshd host
+// keys and the generated sshpiper config.
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/db"
+)
+
+// Paths locates the state on disk. Archive entries use fixed names so an
+// archive can be restored onto a server with a different layout.
+type Paths struct {
+	DB          string // SQLite database
+	KeysDir     string // machine and access key files, and restricted keys' upstream keys
+	ServerKey   string // server private key; the public key is ServerKey + ".pub"
+	HostKeysDir string // persisted sshd host keys
+	Config      string // generated sshpiper.yaml
+
+	// Lock, if set, is held while the database and files are snapshotted.
+	// The server passes the lock it writes key files and sshpiper.yaml
+	// under, so the files in an archive match its database.
+	Lock sync.Locker
+}
+
+// Manifest is stored as the first archive entry.
+type Manifest struct {
+	CreatedAt     time.Time `json:"created_at"`
+	SchemaVersion int       `json:"schema_version"`
+	Files         []string  `json:"files"`
+}
+
+const (
+	manifestName  = "manifest.json"
+	dbName        = "db/bastion.db"
+	keysPrefix    = "keys/"
+	hostKeyPrefix = "host-keys/"
+	serverKeyName = "server-key"
+	configName    = "sshpiper.yaml"
+)
+
+// Archive is a snapshot of the state, ready to be written. Close removes the
+// snapshot it holds.
+type Archive struct {
+	Manifest *Manifest
+
+	tmp   string
+	files map[string]string // archive name -> snapshot path
+}
+
+// Prepare snapshots the database and copies the files to archive into a
+// temporary directory, together under p.Lock. Nothing is written yet, so a
+// failure here can still be reported to the caller cleanly, and files that
+// change while the archive is streamed do not end up in it.
+func Prepare(database *db.DB, p Paths) (*Archive, error) {
+	tmp, err := os.MkdirTemp("", "bastion-backup-")
+	if err != nil {
+		return nil, err
+	}
+	a := &Archive{tmp: tmp}
+	if p.Lock != nil {
+		p.Lock.Lock()
+		defer p.Lock.Unlock()
+	}
+
+	snapshot := filepath.Join(tmp, "bastion.db")
+	if err := database.Snapshot(snapshot); err != nil {
+		a.Close()
+		return nil, fmt.Errorf("snapshot database: %w", err)
+	}
+	version, err := database.SchemaVersion()
+	if err != nil {
+		a.Close()
+		return nil, err
+	}
+
+	a.files = map[string]string{dbName: snapshot}
+	var copyErr error
+	addFile := func(name, src string) {
+		info, err := os.Stat(src)
+		if copyErr != nil || err != nil || !info.Mode().IsRegular() {
+			return
+		}
+		data, err := os.ReadFile(src)
+		if err != nil {
+			copyErr = fmt.Errorf("read %s: %w", name, err)
+			return
+		}
+		copied := filepath.Join(tmp, "files", filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(copied), 0700); err != nil {
+			copyErr = err
+			return
+		}
+		if err := os.WriteFile(copied, data, 0600); err != nil {
+			copyErr = err
+			return
+		}
+		a.files[name] = copied
+	}
+	addDir := func(prefix, dir string) {
+		entries, _ := os.ReadDir(dir)
+		for _, e := range entries {
+			addFile(prefix+e.Name(), filepath.Join(dir, e.Name()))
+		}
+	}
+	addDir(keysPrefix, p.KeysDir)
+	addDir(hostKeyPrefix, p.HostKeysDir)
+	addFile(serverKeyName, p.ServerKey)
+	addFile(serverKeyName+".pub", p.ServerKey+".pub")
+	addFile(configName, p.Config)
+	if copyErr != nil {
+		a.Close()
+		return nil, copyErr
+	}
+
+	a.Manifest = &Manifest{CreatedAt: time.Now().UTC().Truncate(time.Second), SchemaVersion: version}
+	for name := range a.files {
+		a.Manifest.Files = append(a.Manifest.Files, name)
+	}
+	sort.Strings(a.Manifest.Files)
+	return a, nil
+}
+
+// Write streams the archive to w as a gzipped tar, one file at a time.
+func (a *Archive) Write(w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	manifest, _ := json.MarshalIndent(a.Manifest, "", "  ")
+	if err := writeEntry(tw, manifestName, bytes.NewReader(manifest), int64(len(manifest)), a.Manifest.CreatedAt); err != nil {
+		return err
+	}
+	for _, name := range a.Manifest.Files {
+		if err := writeFileEntry(tw, name, a.files[name], a.Manifest.CreatedAt); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// Close removes the snapshot.
+func (a *Archive) Close() error {
+	return os.RemoveAll(a.tmp)
+}
+
+// Write snapshots the state and streams it to w as a gzipped tar archive.
+func Write(w io.Writer, database *db.DB, p Paths) (*Manifest, error) {
+	a, err := Prepare(database, p)
+	if err != nil {
+		return nil, err
+	}
+	defer a.Close()
+	return a.Manifest, a.Write(w)
+}
+
+func writeFileEntry(tw *tar.Writer, name, src string, modTime time.Time) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("read %s: %w", name, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("read %s: %w", name, err)
+	}
+	return writeEntry(tw, name, f, info.Size(), modTime)
+}
+
+func writeEntry(tw *tar.Writer, name string, r io.Reader, size int64, modTime time.Time) error {
+	hdr := &tar.Header{Name: name, Mode: 0600, Size: size, ModTime: modTime, Typeflag: tar.TypeReg}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := io.CopyN(tw, r, size)
+	return err
+}
+
+// WriteFile writes an archive into dir and returns its path. The file only
+// appears under its final name once complete.
+func WriteFile(dir string, database *db.DB, p Paths) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp(dir, ".bastion-*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+
+	m, err := Write(f, database, p)
+	if err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	dst := filepath.Join(dir, FileName(m.CreatedAt))
+	return dst, os.Rename(f.Name(), dst)
+}
+
+// FileName returns the archive name for a backup taken at t.
+func FileName(t time.Time) string {
+	return "bastion-" + t.UTC().Format("20060102-150405") + ".tar.gz"
+}
+
+// Prune deletes all but the newest keep archives in dir and returns the
+// removed paths.
+func Prune(dir string, keep int) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "bastion-*.tar.gz"))
+	if err != nil {
+		return nil, err
+	}
+	// Names embed the timestamp, so lexical order is chronological
+	sort.Strings(matches)
+	var removed []string
+	for len(matches) > keep {
+		if err := os.Remove(matches[0]); err != nil {
+			return removed, err
+		}
+		removed = append(removed, matches[0])
+		matches = matches[1:]
+	}
+	return removed, nil
+}
+
+// Restore unpacks an archive over the configured paths. The server must not
+// be running: it would keep writing to the replaced database and files. The
+// whole archive is read and checked before anything is replaced. Existing key files that are
+// not in the archive are left alone; regenerating the config from the
+// restored database rewrites the ones still in use.
+func Restore(r io.Reader, p Paths) (*Manifest, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("not a backup archive: %w", err)
+	}
+	tr := tar.NewReader(gz)
+
+	var m *Manifest
+	contents := make(map[string][]byte)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read archive: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", hdr.Name, err)
+		}
+		if hdr.Name == manifestName {
+			m = &Manifest{}
+			if err := json.Unmarshal(data, m); err != nil {
+				return nil, fmt.Errorf("invalid manifest: %w", err)
+			}
+			continue
+		}
+		if _, err := destination(hdr.Name, p); err != nil {
+			return nil, err
+		}
+		contents[hdr.Name] = data
+	}
+	if m == nil {
+		return nil, fmt.Errorf("archive has no %s", manifestName)
+	}
+	for _, name := range m.Files {
+		if _, ok := contents[name]; !ok {
+			return nil, fmt.Errorf("archive is missing %s", name)
+		}
+	}
+	if _, ok := contents[dbName]; !ok {
+		return nil, fmt.Errorf("archive has no database")
+	}
+	if m.SchemaVersion > db.LatestSchemaVersion() {
+		return nil, fmt.Errorf("%w: backup is at version %d, binary supports up to %d", db.ErrSchemaTooNew, m.SchemaVersion, db.LatestSchemaVersion())
+	}
+
+	// Config regeneration writes key files here even if the archive had none
+	if err := os.MkdirAll(p.KeysDir, 0755); err != nil {
+		return nil, err
+	}
+	// Stale WAL files would be replayed over the restored database
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if err := os.Remove(p.DB + suffix); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	for _, name := range m.Files {
+		dst, _ := destination(name, p)
+		if err := writeAtomic(dst, contents[name]); err != nil {
+			return nil, fmt.Errorf("restore %s: %w", name, err)
+		}
+	}
+	return m, nil
+}
+
+// destination maps an archive entry to its path on disk.
+func destination(name string, p Paths) (string, error) {
+	if path.Clean(name) != name || path.IsAbs(name) {
+		return "", fmt.Errorf("invalid archive entry %q", name)
+	}
+	switch {
+	case name == dbName:
+		return p.DB, nil
+	case name == serverKeyName:
+		return p.ServerKey, nil
+	case name == serverKeyName+".pub":
+		return p.ServerKey + ".pub", nil
+	case name == configName:
+		return p.Config, nil
+	case strings.HasPrefix(name, keysPrefix) && !strings.Contains(name[len(keysPrefix):], "/"):
+		return filepath.Join(p.KeysDir, name[len(keysPrefix):]), nil
+	case strings.HasPrefix(name, hostKeyPrefix) && !strings.Contains(name[len(hostKeyPrefix):], "/"):
+		return filepath.Join(p.HostKeysDir, name[len(hostKeyPrefix):]), nil
+	}
+	return "", fmt.Errorf("unexpected archive entry %q", name)
+}
+
+func writeAtomic(dst string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+	// Private keys stay private; everything else is world-readable as before
+	mode := os.FileMode(0644)
+	if !strings.HasSuffix(dst, ".pub") && !strings.HasSuffix(dst, ".yaml") {
+		mode = 0600
+	}
+	tmp := dst + ".restore"
+	if err := os.WriteFile(tmp, data, mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
@@ -0,0 +1,145 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/db"
+)
+
+func testPaths(dir string) Paths {
+	return Paths{
+		DB:          filepath.Join(dir, "db", "bastion.db"),
+		KeysDir:     filepath.Join(dir, "keys"),
+		ServerKey:   filepath.Join(dir, "server-key"),
+		HostKeysDir: filepath.Join(dir, "host-keys"),
+		Config:      filepath.Join(dir, "sshpiper.yaml"),
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	os.MkdirAll(filepath.Dir(path), 0755)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("write %s: %v", path, err)
+	}
+}
+
+func TestWriteAndRestore(t *testing.T) {
+	src := testPaths(t.TempDir())
+	os.MkdirAll(filepath.Dir(src.DB), 0755)
+	database, err := db.Open(src.DB)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer database.Close()
+	database.CreateMachine(&db.Machine{Name: "nas", Owner: "a", LocalUser: "a", PublicKey: "k"})
+
+	writeFile(t, filepath.Join(src.KeysDir, "nas.pub"), "k\n")
+	writeFile(t, src.ServerKey, "private")
+	writeFile(t, src.ServerKey+".pub", "public")
+	writeFile(t, filepath.Join(src.HostKeysDir, "ssh_host_ed25519_key"), "host")
+	writeFile(t, src.Config, "pipes: []\n")
+
+	var mu sync.Mutex
+	src.Lock = &mu
+	a, err := Prepare(database, src)
+	if err != nil {
+		t.Fatalf("prepare: %v", err)
+	}
+	defer a.Close()
+	if !mu.TryLock() {
+		t.Fatal("expected the lock released after the snapshot")
+	}
+	mu.Unlock()
+	// Files are copied with the database snapshot, so later changes do not
+	// reach the archive
+	writeFile(t, filepath.Join(src.KeysDir, "nas.pub"), "changed\n")
+	var buf bytes.Buffer
+	if err := a.Write(&buf); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	m := a.Manifest
+	if m.SchemaVersion != db.LatestSchemaVersion() || len(m.Files) != 6 {
+		t.Fatalf("unexpected manifest %+v", m)
+	}
+
+	dst := testPaths(t.TempDir())
+	// A stale WAL next to the target must not survive the restore
+	writeFile(t, dst.DB+"-wal", "stale")
+	if _, err := Restore(&buf, dst); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if _, err := os.Stat(dst.DB + "-wal"); !os.IsNotExist(err) {
+		t.Fatal("expected stale WAL to be removed")
+	}
+
+	restored, err := db.Open(dst.DB)
+	if err != nil {
+		t.Fatalf("open restored: %v", err)
+	}
+	defer restored.Close()
+	if m, _ := restored.GetMachine("nas"); m == nil {
+		t.Fatal("expected machine in restored database")
+	}
+	for path, want := range map[string]string{
+		filepath.Join(dst.KeysDir, "nas.pub"):                  "k\n",
+		dst.ServerKey:                                          "private",
+		dst.ServerKey + ".pub":                                 "public",
+		filepath.Join(dst.HostKeysDir, "ssh_host_ed25519_key"): "host",
+		dst.Config: "pipes: []\n",
+	} {
+		data, err := os.ReadFile(path)
+		if err != nil || string(data) != want {
+			t.Errorf("%s: got %q (%v), want %q", path, data, err, want)
+		}
+	}
+	if info, _ := os.Stat(dst.ServerKey); info.Mode().Perm() != 0600 {
+		t.Errorf("expected private key to be 0600, got %v", info.Mode().Perm())
+	}
+}
+
+func TestRestoreRejectsUnsafeEntries(t *testing.T) {
+	for _, name := range []string{"../etc/passwd", "/etc/passwd", "keys/../../x", "keys/sub/x.pub", "other"} {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gz)
+		manifest := `{"files":[]}`
+		writeEntry(tw, manifestName, strings.NewReader(manifest), int64(len(manifest)), time.Now())
+		writeEntry(tw, name, strings.NewReader("x"), 1, time.Now())
+		tw.Close()
+		gz.Close()
+
+		if _, err := Restore(&buf, testPaths(t.TempDir())); err == nil {
+			t.Errorf("expected entry %q to be rejected", name)
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		writeFile(t, filepath.Join(dir, FileName(start.Add(time.Duration(i)*time.Hour))), "x")
+	}
+	writeFile(t, filepath.Join(dir, "unrelated.txt"), "x")
+
+	removed, err := Prune(dir, 2)
+	if err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+	if len(removed) != 3 || removed[0] != filepath.Join(dir, FileName(start)) {
+		t.Fatalf("expected the three oldest to be removed, got %v", removed)
+	}
+	left, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(left) != 3 {
+		t.Fatalf("expected two backups and the unrelated file, got %v", left)
+	}
+}
@@ -0,0 +1,36 @@
+package backup
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/db"
+)
+
+// Schedule writes an archive to dir every interval, keeping the newest keep
+// archives. It blocks until ctx is done.
+func Schedule(ctx context.Context, database *db.DB, p Paths, dir string, interval time.Duration, keep int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			path, err := WriteFile(dir, database, p)
+			if err != nil {
+				log.Printf("error writing scheduled backup: %v", err)
+				continue
+			}
+			log.Printf("Wrote backup %s", path)
+			removed, err := Prune(dir, keep)
+			if err != nil {
+				log.Printf("error pruning backups: %v", err)
+			}
+			for _, f := range removed {
+				log.Printf("Removed old backup %s", f)
+			}
+		}
+	}
+}
@@ -1,28 +1,40 @@
 package config
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"text/template"
+	"time"
+
+	"golang.org/x/crypto/ssh"
 
 	"github.com/LipJ01/fly-ssh-bastion/internal/db"
+	"github.com/LipJ01/fly-ssh-bastion/internal/sshkey"
 )
 
 const sshpiperTemplate = `version: "1.0"
 pipes:
-{{- range $entry := .Entries }}
+{{- range $pipe := .Pipes }}
   - from:
-      - username: "{{ $entry.Machine.Name }}"
+{{- range $username := $pipe.Usernames }}
+      - username: "{{ $username }}"
         authorized_keys:
-          - {{ $.KeysDir }}/{{ $entry.Machine.Name }}.pub
-{{- range $entry.AccessKeys }}
-          - {{ $.KeysDir }}/{{ $entry.Machine.Name }}_ak_{{ .ID }}.pub
+{{- range $pipe.KeyFiles }}
+          - {{ . }}
+{{- end }}
 {{- end }}
     to:
-      host: localhost:{{ $entry.Machine.Port }}
-      username: "{{ $entry.Machine.LocalUser }}"
-      private_key: {{ $.ServerKey }}
+      host: localhost:{{ $pipe.Port }}
+      username: "{{ $pipe.User }}"
+      private_key: {{ $pipe.PrivateKey }}
       ignore_hostkey: true
 {{- end }}
 `
@@ -30,18 +42,56 @@ pipes:
 type PipeEntry struct {
 	Machine    db.Machine
 	AccessKeys []db.AccessKey
+	Aliases    []db.Alias
+	LocalUsers []string // additional local users besides Machine.LocalUser
+}
+
+// pipe is a single sshpiper route as rendered into the template.
+type pipe struct {
+	Usernames  []string
+	KeyFiles   []string
+	Port       int
+	User       string
+	PrivateKey string // upstream identity presented to the machine's sshd
 }
 
 type templateData struct {
-	Entries   []PipeEntry
-	KeysDir   string
-	ServerKey string
+	Pipes []pipe
 }
 
 type Generator struct {
 	ConfigPath string
 	KeysDir    string
 	ServerKey  string
+
+	// RecordingsDir is where sshpiperd writes session recordings. Empty
+	// disables recording.
+	RecordingsDir string
+
+	// recording is set by Generate when a routed machine records sessions.
+	recording atomic.Bool
+}
+
+// Revoked is a set of revoked key fingerprints, which are never routed.
+type Revoked map[string]bool
+
+// NewRevoked returns the set of the given fingerprints.
+func NewRevoked(fingerprints []string) Revoked {
+	r := make(Revoked, len(fingerprints))
+	for _, fp := range fingerprints {
+		if fp != "" {
+			r[fp] = true
+		}
+	}
+	return r
+}
+
+// Has reports whether the public key's fingerprint has been revoked.
+func (r Revoked) Has(publicKey string) bool {
+	if len(r) == 0 {
+		return false
+	}
+	return r[sshkey.Fingerprint(publicKey)]
 }
 
 func NewGenerator(configPath, keysDir, serverKey string) *Generator {
@@ -52,7 +102,8 @@ func NewGenerator(configPath, keysDir, serverKey string) *Generator {
 	}
 }
 
-// WriteKey writes a machine's public key to the keys directory.
+// WriteKey writes a machine's public key to the keys directory. Generate
+// removes the file again if the key is revoked.
 func (g *Generator) WriteKey(name, publicKey string) error {
 	path := filepath.Join(g.KeysDir, name+".pub")
 	return os.WriteFile(path, []byte(publicKey+"\n"), 0644)
@@ -64,27 +115,111 @@ func (g *Generator) WriteAccessKey(machineName string, keyID int64, publicKey st
 	return os.WriteFile(path, []byte(publicKey+"\n"), 0644)
 }
 
-// RemoveAccessKey removes an access key file.
+// RemoveAccessKey removes an access key file and its upstream key, if any.
 func (g *Generator) RemoveAccessKey(machineName string, keyID int64) error {
+	os.Remove(g.upstreamKeyPath(machineName, keyID))
 	path := filepath.Join(g.KeysDir, fmt.Sprintf("%s_ak_%d.pub", machineName, keyID))
 	return os.Remove(path)
 }
 
+// upstreamKeyPath is where the private key a restricted access key is piped
+// with is kept.
+func (g *Generator) upstreamKeyPath(machineName string, keyID int64) string {
+	return filepath.Join(g.KeysDir, fmt.Sprintf("%s_ak_%d_upstream", machineName, keyID))
+}
+
+// UpstreamKey returns the public key, in authorized_keys format, that
+// sshpiperd logs into the machine with for a restricted access key. The
+// machine's sshd holds it with the key's restrictions as options, which is
+// how they are enforced. The key pair is created on first use.
+func (g *Generator) UpstreamKey(machineName string, keyID int64) (string, error) {
+	path := g.upstreamKeyPath(machineName, keyID)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		_, private, genErr := ed25519.GenerateKey(rand.Reader)
+		if genErr != nil {
+			return "", genErr
+		}
+		block, genErr := ssh.MarshalPrivateKey(private, fmt.Sprintf("bastion %s access key %d", machineName, keyID))
+		if genErr != nil {
+			return "", genErr
+		}
+		data = pem.EncodeToMemory(block)
+		err = os.WriteFile(path, data, 0600)
+	}
+	if err != nil {
+		return "", err
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return "", fmt.Errorf("upstream key for access key %d: %w", keyID, err)
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))), nil
+}
+
+// AuthorizedKeyOptions renders the key's session restrictions as sshd
+// authorized_keys options, or "" if it has none.
+func AuthorizedKeyOptions(r db.KeyRestrictions) string {
+	if r.SFTPOnly {
+		// sshd serves internal-sftp itself when a key forces it
+		return `command="internal-sftp",no-pty,no-port-forwarding,no-agent-forwarding,no-X11-forwarding`
+	}
+	var opts []string
+	if r.ForceCommand != "" {
+		// sshd unescapes only \" inside an option
+		opts = append(opts, `command="`+strings.ReplaceAll(r.ForceCommand, `"`, `\"`)+`"`)
+	}
+	if r.NoPortForwarding {
+		opts = append(opts, "no-port-forwarding")
+	}
+	if r.NoAgentForwarding {
+		opts = append(opts, "no-agent-forwarding")
+	}
+	return strings.Join(opts, ",")
+}
+
+// accessKeyFiles returns the access key files for a machine keyed by key ID.
+func (g *Generator) accessKeyFiles(machineName string) map[int64]string {
+	files := make(map[int64]string)
+	prefix := machineName + "_ak_"
+	matches, _ := filepath.Glob(filepath.Join(g.KeysDir, prefix+"*.pub"))
+	for _, f := range matches {
+		// Machine names may themselves contain "_ak_", so require a numeric ID
+		idStr := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(f), prefix), ".pub")
+		if id, err := strconv.ParseInt(idStr, 10, 64); err == nil {
+			files[id] = f
+		}
+	}
+	return files
+}
+
 // CleanAccessKeys removes all access key files for a machine.
 func (g *Generator) CleanAccessKeys(machineName string) error {
-	pattern := filepath.Join(g.KeysDir, machineName+"_ak_*.pub")
-	files, _ := filepath.Glob(pattern)
-	for _, f := range files {
+	for id, f := range g.accessKeyFiles(machineName) {
 		os.Remove(f)
+		os.Remove(g.upstreamKeyPath(machineName, id))
 	}
 	return nil
 }
 
-// RenameKey renames a machine's public key file.
+// RenameKey renames a machine's public key file and all of its access key files.
 func (g *Generator) RenameKey(oldName, newName string) error {
 	oldPath := filepath.Join(g.KeysDir, oldName+".pub")
 	newPath := filepath.Join(g.KeysDir, newName+".pub")
-	return os.Rename(oldPath, newPath)
+	if err := os.Rename(oldPath, newPath); err != nil {
+		return err
+	}
+	for id, f := range g.accessKeyFiles(oldName) {
+		dst := filepath.Join(g.KeysDir, fmt.Sprintf("%s_ak_%d.pub", newName, id))
+		if err := os.Rename(f, dst); err != nil {
+			return err
+		}
+		// Keep restricted keys' upstream identities, which the machine holds
+		if err := os.Rename(g.upstreamKeyPath(oldName, id), g.upstreamKeyPath(newName, id)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
 }
 
 // RemoveKey removes a machine's public key file.
@@ -95,7 +230,8 @@ func (g *Generator) RemoveKey(name string) error {
 
 // UpdateAuthorizedKeys rebuilds /home/bastion/.ssh/authorized_keys with all
 // machine public keys plus the server key, so machines can establish reverse tunnels.
-func (g *Generator) UpdateAuthorizedKeys(machines []db.Machine) error {
+// Revoked machine keys are left out.
+func (g *Generator) UpdateAuthorizedKeys(machines []db.Machine, revoked Revoked) error {
 	authKeysPath := "/home/bastion/.ssh/authorized_keys"
 
 	// Start with server public key
@@ -110,6 +246,9 @@ func (g *Generator) UpdateAuthorizedKeys(machines []db.Machine) error {
 
 	// Add machine keys with port restrictions
 	for _, m := range machines {
+		if revoked.Has(m.PublicKey) {
+			continue
+		}
 		entry := fmt.Sprintf("permitlisten=\"localhost:%d\",no-pty,no-agent-forwarding,no-X11-forwarding %s\n", m.Port, m.PublicKey)
 		keys = append(keys, []byte(entry)...)
 	}
@@ -120,26 +259,178 @@ func (g *Generator) UpdateAuthorizedKeys(machines []db.Machine) error {
 	return os.WriteFile(authKeysPath, keys, 0600)
 }
 
-// Generate writes the sshpiper.yaml config from the current machine list and their access keys.
-func (g *Generator) Generate(entries []PipeEntry) error {
+// pruneRevoked deletes key files in KeysDir whose key has been revoked and
+// returns the removed paths.
+func (g *Generator) pruneRevoked(revoked Revoked) map[string]bool {
+	removed := make(map[string]bool)
+	if len(revoked) == 0 {
+		return removed
+	}
+	files, _ := filepath.Glob(filepath.Join(g.KeysDir, "*.pub"))
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil || !revoked.Has(string(data)) {
+			continue
+		}
+		log.Printf("removing revoked key file %s", f)
+		os.Remove(f)
+		removed[f] = true
+	}
+	return removed
+}
+
+// buildPipes turns entries into template pipes, dropping revoked keys. Each
+// machine gets one pipe per local user: the default user answers to the bare
+// machine name and aliases, and every user, default included, answers to
+// "user+name". Access keys with session restrictions get a pipe of their own
+// under the same usernames, which logs in with the key's upstream identity;
+// sshpiperd picks the pipe whose authorized keys hold the client's key.
+func (g *Generator) buildPipes(entries []PipeEntry, revoked Revoked) []pipe {
+	removed := g.pruneRevoked(revoked)
+	now := time.Now()
+	var pipes []pipe
+	for _, e := range entries {
+		names := []string{e.Machine.Name}
+		for _, a := range e.Aliases {
+			if a.ExpiresAt == nil || a.ExpiresAt.After(now) {
+				names = append(names, a.Alias)
+			}
+		}
+
+		users := []string{e.Machine.LocalUser}
+		for _, u := range e.LocalUsers {
+			if u != e.Machine.LocalUser {
+				users = append(users, u)
+			}
+		}
+
+		for i, user := range users {
+			var usernames []string
+			if i == 0 {
+				usernames = append(usernames, names...)
+			}
+			for _, name := range names {
+				usernames = append(usernames, user+"+"+name)
+			}
+			if keyFiles := g.pipeKeyFiles(e, user, revoked, removed); len(keyFiles) > 0 {
+				pipes = append(pipes, pipe{
+					Usernames:  usernames,
+					KeyFiles:   keyFiles,
+					Port:       e.Machine.Port,
+					User:       user,
+					PrivateKey: g.ServerKey,
+				})
+			}
+			for _, ak := range e.AccessKeys {
+				if !ak.LimitsSession() || ak.LimitsSource() || !ak.AllowsUser(user, e.Machine.LocalUser) || revoked.Has(ak.PublicKey) {
+					continue
+				}
+				keyFile := g.accessKeyPath(e.Machine.Name, ak.ID)
+				if removed[keyFile] {
+					continue
+				}
+				// Without its upstream key the restrictions cannot be
+				// enforced, so the key is left out rather than piped as is
+				if _, err := g.UpstreamKey(e.Machine.Name, ak.ID); err != nil {
+					log.Printf("skipping restricted access key %d: %v", ak.ID, err)
+					continue
+				}
+				pipes = append(pipes, pipe{
+					Usernames:  usernames,
+					KeyFiles:   []string{keyFile},
+					Port:       e.Machine.Port,
+					User:       user,
+					PrivateKey: g.upstreamKeyPath(e.Machine.Name, ak.ID),
+				})
+			}
+		}
+	}
+	return pipes
+}
+
+// accessKeyPath is the file an access key is written to.
+func (g *Generator) accessKeyPath(machineName string, keyID int64) string {
+	return filepath.Join(g.KeysDir, fmt.Sprintf("%s_ak_%d.pub", machineName, keyID))
+}
+
+// pipeKeyFiles returns the key files allowed to log into the entry's machine
+// as user with the server key, skipping revoked, pruned and restricted keys
+// and keys limited to source addresses.
+func (g *Generator) pipeKeyFiles(e PipeEntry, user string, revoked Revoked, removed map[string]bool) []string {
+	var keyFiles []string
+	if !revoked.Has(e.Machine.PublicKey) {
+		keyFiles = append(keyFiles, filepath.Join(g.KeysDir, e.Machine.Name+".pub"))
+	}
+	for _, ak := range e.AccessKeys {
+		if revoked.Has(ak.PublicKey) || !ak.AllowsUser(user, e.Machine.LocalUser) || ak.LimitsSession() || ak.LimitsSource() {
+			continue
+		}
+		keyFiles = append(keyFiles, g.accessKeyPath(e.Machine.Name, ak.ID))
+	}
+
+	var allowed []string
+	for _, f := range keyFiles {
+		if !removed[f] {
+			allowed = append(allowed, f)
+		}
+	}
+	return allowed
+}
+
+// Generate writes the sshpiper.yaml config from the current machine list and
+// their access keys, leaving out revoked keys and deleting their files. The
+// config is written to a temporary file and renamed into place, so sshpiperd
+// never reads a partial one.
+func (g *Generator) Generate(entries []PipeEntry, revoked Revoked) error {
 	tmpl, err := template.New("sshpiper").Parse(sshpiperTemplate)
 	if err != nil {
 		return fmt.Errorf("parse template: %w", err)
 	}
 
-	f, err := os.Create(g.ConfigPath)
+	tmp := g.ConfigPath + ".tmp"
+	f, err := os.Create(tmp)
 	if err != nil {
 		return fmt.Errorf("create config: %w", err)
 	}
+	defer os.Remove(tmp)
 	defer f.Close()
 
+	recording := false
+	for _, e := range entries {
+		recording = recording || e.Machine.RecordSessions
+	}
+	g.recording.Store(recording && g.RecordingsDir != "")
+
 	data := templateData{
-		Entries:   entries,
-		KeysDir:   g.KeysDir,
-		ServerKey: g.ServerKey,
+		Pipes: g.buildPipes(entries, revoked),
 	}
 	if err := tmpl.Execute(f, data); err != nil {
 		return fmt.Errorf("execute template: %w", err)
 	}
-	return nil
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("write config: %w", err)
+	}
+	return os.Rename(tmp, g.ConfigPath)
+}
+
+// Recording reports whether the last generated config has a routed machine
+// that records sessions, which turns recording on in sshpiperd.
+func (g *Generator) Recording() bool {
+	return g.recording.Load()
+}
+
+// RecordingArgs returns the sshpiperd flags that enable asciicast session
+// recording, or nil when no routed machine records sessions. sshpiperd
+// records every connection once enabled, one directory per username, so
+// recordings of other machines are discarded when their session ends or
+// when they are indexed.
+func (g *Generator) RecordingArgs() []string {
+	if !g.recording.Load() {
+		return nil
+	}
+	return []string{
+		"--screen-recording-dir", g.RecordingsDir,
+		"--screen-recording-format", "asciicast",
+		"--username-as-recorddir",
+	}
 }
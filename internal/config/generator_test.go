@@ -5,8 +5,10 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/LipJ01/fly-ssh-bastion/internal/db"
+	"github.com/LipJ01/fly-ssh-bastion/internal/sshkey"
 )
 
 func TestGenerateEmpty(t *testing.T) {
@@ -14,7 +16,7 @@ func TestGenerateEmpty(t *testing.T) {
 	configPath := filepath.Join(dir, "sshpiper.yaml")
 	gen := NewGenerator(configPath, filepath.Join(dir, "keys"), "/data/server-key")
 
-	if err := gen.Generate(nil); err != nil {
+	if err := gen.Generate(nil, nil); err != nil {
 		t.Fatalf("generate: %v", err)
 	}
 
@@ -44,7 +46,7 @@ func TestGenerateWithMachines(t *testing.T) {
 		{Machine: db.Machine{Name: "bob-pc", Port: 10023, LocalUser: "bob", PublicKey: "ssh-ed25519 BBBB bob"}},
 	}
 
-	if err := gen.Generate(entries); err != nil {
+	if err := gen.Generate(entries, nil); err != nil {
 		t.Fatalf("generate: %v", err)
 	}
 
@@ -167,7 +169,7 @@ func TestUpdateAuthorizedKeys(t *testing.T) {
 
 	// This will fail in CI/test because /home/bastion doesn't exist,
 	// but we can verify it doesn't panic and returns an error gracefully
-	err := gen.UpdateAuthorizedKeys(machines)
+	err := gen.UpdateAuthorizedKeys(machines, nil)
 	if err == nil {
 		// If it succeeded (e.g., running as root in Docker), that's fine too
 		t.Log("UpdateAuthorizedKeys succeeded (likely running with permissions)")
@@ -175,3 +177,253 @@ func TestUpdateAuthorizedKeys(t *testing.T) {
 		t.Logf("UpdateAuthorizedKeys returned expected error in test env: %v", err)
 	}
 }
+
+func TestGenerateSkipsRevokedKeys(t *testing.T) {
+	dir := t.TempDir()
+	keysDir := filepath.Join(dir, "keys")
+	os.MkdirAll(keysDir, 0755)
+	configPath := filepath.Join(dir, "sshpiper.yaml")
+	gen := NewGenerator(configPath, keysDir, "/data/server-key")
+
+	good := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl good"
+	bad := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHxbUNK9KxLpX7tYc3NzNIw0cMUV4ZpOAcfOlaZ8bCjN bad"
+	gen.WriteKey("m1", good)
+	gen.WriteAccessKey("m1", 1, bad)
+	// A stale file holding the revoked key under a name the DB no longer knows
+	os.WriteFile(filepath.Join(keysDir, "ghost.pub"), []byte(bad+"\n"), 0644)
+
+	revoked := NewRevoked([]string{sshkey.Fingerprint(bad)})
+
+	entries := []PipeEntry{{
+		Machine:    db.Machine{Name: "m1", Port: 10022, LocalUser: "a", PublicKey: good},
+		AccessKeys: []db.AccessKey{{ID: 1, MachineName: "m1", PublicKey: good}},
+	}}
+	if err := gen.Generate(entries, revoked); err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+
+	data, _ := os.ReadFile(configPath)
+	if strings.Contains(string(data), "m1_ak_1.pub") {
+		t.Errorf("revoked access key file should not be routed:\n%s", data)
+	}
+	if !strings.Contains(string(data), "m1.pub") {
+		t.Errorf("expected machine key to remain:\n%s", data)
+	}
+	for _, name := range []string{"m1_ak_1.pub", "ghost.pub"} {
+		if _, err := os.Stat(filepath.Join(keysDir, name)); !os.IsNotExist(err) {
+			t.Errorf("expected revoked file %s to be removed", name)
+		}
+	}
+}
+
+func TestRenameKeyMovesAccessKeys(t *testing.T) {
+	dir := t.TempDir()
+	keysDir := filepath.Join(dir, "keys")
+	os.MkdirAll(keysDir, 0755)
+	gen := NewGenerator("", keysDir, "")
+
+	gen.WriteKey("nas", "ssh-ed25519 AAAA nas")
+	gen.WriteAccessKey("nas", 3, "ssh-ed25519 AAAA phone")
+	gen.WriteAccessKey("nas", 7, "ssh-ed25519 AAAA tablet")
+	// Another machine whose name starts with "nas_ak_" must be left alone
+	gen.WriteKey("nas_ak_box", "ssh-ed25519 AAAA other")
+
+	if err := gen.RenameKey("nas", "storage"); err != nil {
+		t.Fatalf("rename key: %v", err)
+	}
+
+	for _, name := range []string{"storage.pub", "storage_ak_3.pub", "storage_ak_7.pub", "nas_ak_box.pub"} {
+		if _, err := os.Stat(filepath.Join(keysDir, name)); err != nil {
+			t.Errorf("expected %s to exist: %v", name, err)
+		}
+	}
+	for _, name := range []string{"nas.pub", "nas_ak_3.pub", "nas_ak_7.pub"} {
+		if _, err := os.Stat(filepath.Join(keysDir, name)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be gone", name)
+		}
+	}
+}
+
+func TestGenerateAliases(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "sshpiper.yaml")
+	gen := NewGenerator(configPath, filepath.Join(dir, "keys"), "/data/server-key")
+
+	future := time.Now().Add(time.Hour)
+	past := time.Now().Add(-time.Hour)
+	entries := []PipeEntry{{
+		Machine: db.Machine{Name: "nas", Port: 10022, LocalUser: "admin", PublicKey: "ssh-ed25519 AAAA nas"},
+		Aliases: []db.Alias{
+			{Alias: "old-nas", MachineName: "nas", ExpiresAt: &future},
+			{Alias: "older-nas", MachineName: "nas", ExpiresAt: &past},
+		},
+	}}
+	if err := gen.Generate(entries, nil); err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+
+	data, _ := os.ReadFile(configPath)
+	content := string(data)
+	if !strings.Contains(content, `username: "nas"`) || !strings.Contains(content, `username: "old-nas"`) {
+		t.Errorf("expected machine name and alias as usernames:\n%s", content)
+	}
+	if strings.Contains(content, "older-nas") {
+		t.Errorf("expired alias should not be routed:\n%s", content)
+	}
+	if strings.Count(content, "host: localhost:10022") != 1 {
+		t.Errorf("expected aliases to share one pipe:\n%s", content)
+	}
+}
+
+func TestGenerateLocalUsers(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "sshpiper.yaml")
+	keysDir := filepath.Join(dir, "keys")
+	gen := NewGenerator(configPath, keysDir, "/data/server-key")
+
+	entries := []PipeEntry{{
+		Machine: db.Machine{Name: "nas", Port: 10022, LocalUser: "admin", PublicKey: "ssh-ed25519 AAAA nas"},
+		AccessKeys: []db.AccessKey{
+			{ID: 1, MachineName: "nas", PublicKey: "ssh-ed25519 AAAA default"},
+			{ID: 2, MachineName: "nas", PublicKey: "ssh-ed25519 AAAA alice", LocalUsers: []string{"alice"}},
+			{ID: 3, MachineName: "nas", PublicKey: "ssh-ed25519 AAAA any", LocalUsers: []string{db.AllLocalUsers}},
+		},
+		Aliases:    []db.Alias{{Alias: "storage", MachineName: "nas"}},
+		LocalUsers: []string{"alice"},
+	}}
+	if err := gen.Generate(entries, nil); err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+
+	pipes := gen.buildPipes(entries, nil)
+	if len(pipes) != 2 {
+		t.Fatalf("expected one pipe per local user, got %d", len(pipes))
+	}
+	admin, alice := pipes[0], pipes[1]
+	if admin.User != "admin" || alice.User != "alice" {
+		t.Fatalf("unexpected pipe users %q, %q", admin.User, alice.User)
+	}
+	if strings.Join(admin.Usernames, ",") != "nas,storage,admin+nas,admin+storage" {
+		t.Errorf("unexpected default usernames %v", admin.Usernames)
+	}
+	if strings.Join(alice.Usernames, ",") != "alice+nas,alice+storage" {
+		t.Errorf("unexpected alice usernames %v", alice.Usernames)
+	}
+	restricted := filepath.Join(keysDir, "nas_ak_2.pub")
+	for _, f := range admin.KeyFiles {
+		if f == restricted {
+			t.Errorf("key restricted to alice should not reach admin")
+		}
+	}
+	if len(admin.KeyFiles) != 3 || len(alice.KeyFiles) != 3 {
+		t.Errorf("expected the machine key, the unlisted key and the * key for admin, and the machine key, alice's key "+
+			"and the * key for alice, got %v and %v", admin.KeyFiles, alice.KeyFiles)
+	}
+
+	data, _ := os.ReadFile(configPath)
+	if !strings.Contains(string(data), `username: "alice+nas"`) || !strings.Contains(string(data), `username: "alice"`) {
+		t.Errorf("expected alice pipe in config:\n%s", data)
+	}
+}
+
+func TestGenerateRestrictedKeys(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "sshpiper.yaml")
+	keysDir := filepath.Join(dir, "keys")
+	os.MkdirAll(keysDir, 0755)
+	gen := NewGenerator(configPath, keysDir, "/data/server-key")
+
+	entries := []PipeEntry{{
+		Machine: db.Machine{Name: "nas", Port: 10022, LocalUser: "admin", PublicKey: "ssh-ed25519 AAAA nas"},
+		AccessKeys: []db.AccessKey{
+			{ID: 1, MachineName: "nas", PublicKey: "ssh-ed25519 AAAA phone",
+				KeyRestrictions: db.KeyRestrictions{SourceCIDRs: []string{"10.0.0.0/8"}}},
+			{ID: 2, MachineName: "nas", PublicKey: "ssh-ed25519 AAAA backup",
+				KeyRestrictions: db.KeyRestrictions{SFTPOnly: true}},
+		},
+	}}
+	if err := gen.Generate(entries, nil); err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+
+	pipes := gen.buildPipes(entries, nil)
+	if len(pipes) != 2 {
+		t.Fatalf("expected a shared pipe and one for the restricted key, got %+v", pipes)
+	}
+	shared, restricted := pipes[0], pipes[1]
+	// A key limited to source CIDRs is not routed at all
+	if len(shared.KeyFiles) != 1 || shared.KeyFiles[0] != filepath.Join(keysDir, "nas.pub") || shared.PrivateKey != "/data/server-key" {
+		t.Errorf("unexpected shared pipe %+v", shared)
+	}
+	upstream := filepath.Join(keysDir, "nas_ak_2_upstream")
+	if len(restricted.KeyFiles) != 1 || restricted.KeyFiles[0] != filepath.Join(keysDir, "nas_ak_2.pub") ||
+		restricted.PrivateKey != upstream || strings.Join(restricted.Usernames, ",") != strings.Join(shared.Usernames, ",") {
+		t.Errorf("unexpected restricted pipe %+v", restricted)
+	}
+	data, _ := os.ReadFile(configPath)
+	if !strings.Contains(string(data), "private_key: "+upstream) {
+		t.Errorf("expected the upstream key in config:\n%s", data)
+	}
+
+	pub, err := gen.UpstreamKey("nas", 2)
+	if err != nil || !strings.HasPrefix(pub, "ssh-ed25519 ") {
+		t.Fatalf("expected an ed25519 upstream key, got %q, %v", pub, err)
+	}
+	if again, _ := gen.UpstreamKey("nas", 2); again != pub {
+		t.Error("expected the upstream key to be kept")
+	}
+	gen.WriteKey("nas", "ssh-ed25519 AAAA nas")
+	gen.WriteAccessKey("nas", 2, "ssh-ed25519 AAAA backup")
+	if err := gen.RenameKey("nas", "storage"); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	if moved, _ := gen.UpstreamKey("storage", 2); moved != pub {
+		t.Error("expected the upstream key to move with a rename")
+	}
+	gen.RemoveAccessKey("storage", 2)
+	if _, err := os.Stat(filepath.Join(keysDir, "storage_ak_2_upstream")); !os.IsNotExist(err) {
+		t.Error("expected the upstream key removed with its access key")
+	}
+}
+
+func TestAuthorizedKeyOptions(t *testing.T) {
+	for _, tc := range []struct {
+		r    db.KeyRestrictions
+		want string
+	}{
+		{db.KeyRestrictions{}, ""},
+		{db.KeyRestrictions{SourceCIDRs: []string{"10.0.0.0/8"}}, ""},
+		{db.KeyRestrictions{SFTPOnly: true}, `command="internal-sftp",no-pty,no-port-forwarding,no-agent-forwarding,no-X11-forwarding`},
+		{db.KeyRestrictions{ForceCommand: `borg serve --append-only --restrict-to-path "/srv/backup"`, NoPortForwarding: true},
+			`command="borg serve --append-only --restrict-to-path \"/srv/backup\"",no-port-forwarding`},
+		{db.KeyRestrictions{NoAgentForwarding: true}, "no-agent-forwarding"},
+	} {
+		if got := AuthorizedKeyOptions(tc.r); got != tc.want {
+			t.Errorf("%+v: expected %q, got %q", tc.r, tc.want, got)
+		}
+	}
+}
+
+func TestRecordingArgs(t *testing.T) {
+	dir := t.TempDir()
+	gen := NewGenerator(filepath.Join(dir, "sshpiper.yaml"), dir, "/data/server-key")
+	gen.RecordingsDir = "/data/recordings"
+	machine := db.Machine{Name: "nas", Port: 10022, LocalUser: "u", PublicKey: "k"}
+
+	gen.Generate([]PipeEntry{{Machine: machine}}, nil)
+	if args := gen.RecordingArgs(); args != nil {
+		t.Fatalf("expected no recording flags, got %v", args)
+	}
+
+	machine.RecordSessions = true
+	gen.Generate([]PipeEntry{{Machine: machine}}, nil)
+	if args := gen.RecordingArgs(); len(args) == 0 || args[1] != "/data/recordings" {
+		t.Fatalf("expected recording flags, got %v", args)
+	}
+
+	gen.RecordingsDir = ""
+	gen.Generate([]PipeEntry{{Machine: machine}}, nil)
+	if args := gen.RecordingArgs(); args != nil {
+		t.Fatalf("expected recording disabled without a directory, got %v", args)
+	}
+}
@@ -0,0 +1,256 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/sshkey"
+)
+
+// Access request statuses.
+const (
+	AccessRequestPending  = "pending"
+	AccessRequestApproved = "approved"
+	AccessRequestDenied   = "denied"
+	AccessRequestExpired  = "expired" // left undecided too long
+)
+
+// AccessRequest asks a machine's owner for a temporary access key. Approving
+// it adds the key, expiring DurationSeconds later.
+type AccessRequest struct {
+	ID              int64      `json:"id"`
+	MachineName     string     `json:"machine_name"`
+	Requester       string     `json:"requester"`
+	PublicKey       string     `json:"public_key"`
+	Fingerprint     string     `json:"fingerprint"`
+	LocalUsers      []string   `json:"local_users,omitempty"`
+	Reason          string     `json:"reason"`
+	DurationSeconds int64      `json:"duration_seconds"`
+	Status          string     `json:"status"`
+	CreatedAt       time.Time  `json:"created_at"`
+	DecidedAt       *time.Time `json:"decided_at,omitempty"`
+	DecidedBy       string     `json:"decided_by,omitempty"`
+	Note            string     `json:"note,omitempty"`
+	AccessKeyID     *int64     `json:"access_key_id,omitempty"`
+	KeyExpiresAt    *time.Time `json:"key_expires_at,omitempty"`
+}
+
+// ErrAccessRequestDecided is returned when deciding a request that is no
+// longer pending.
+var ErrAccessRequestDecided = errors.New("access request is no longer pending")
+
+// AccessRequestFilter selects access requests. Zero fields match everything.
+type AccessRequestFilter struct {
+	Machine     string
+	Owner       string // owner of the requested machine
+	Fingerprint string
+	Status      string
+	Limit       int
+}
+
+const accessRequestColumns = "id, machine_name, requester, public_key, fingerprint, local_users, reason, duration_seconds, status, " +
+	"created_at, decided_at, decided_by, note, access_key_id, key_expires_at"
+
+func scanAccessRequest(row interface{ Scan(...any) error }, a *AccessRequest) error {
+	var localUsers string
+	if err := row.Scan(&a.ID, &a.MachineName, &a.Requester, &a.PublicKey, &a.Fingerprint, &localUsers, &a.Reason, &a.DurationSeconds,
+		&a.Status, &a.CreatedAt, &a.DecidedAt, &a.DecidedBy, &a.Note, &a.AccessKeyID, &a.KeyExpiresAt); err != nil {
+		return err
+	}
+	if users := splitList(localUsers); len(users) > 0 {
+		a.LocalUsers = users
+	}
+	return nil
+}
+
+// CreateAccessRequest stores a pending request and fills in its ID,
+// fingerprint, status and creation time.
+func (db *DB) CreateAccessRequest(a *AccessRequest) error {
+	a.Fingerprint = sshkey.Fingerprint(a.PublicKey)
+	result, err := db.conn.Exec(
+		"INSERT INTO access_requests (machine_name, requester, public_key, fingerprint, local_users, reason, duration_seconds) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		a.MachineName, a.Requester, a.PublicKey, a.Fingerprint, strings.Join(a.LocalUsers, ","), a.Reason, a.DurationSeconds,
+	)
+	if err != nil {
+		return fmt.Errorf("create access request: %w", err)
+	}
+	a.ID, _ = result.LastInsertId()
+	a.Status = AccessRequestPending
+	a.CreatedAt = time.Now().UTC()
+	return nil
+}
+
+// GetAccessRequest returns the request, or nil if there is none.
+func (db *DB) GetAccessRequest(id int64) (*AccessRequest, error) {
+	a := &AccessRequest{}
+	err := scanAccessRequest(db.conn.QueryRow("SELECT "+accessRequestColumns+" FROM access_requests WHERE id = ?", id), a)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// ListAccessRequests returns matching requests, newest first.
+func (db *DB) ListAccessRequests(f AccessRequestFilter) ([]AccessRequest, error) {
+	var where []string
+	var args []any
+	if f.Machine != "" {
+		where = append(where, "machine_name = ?")
+		args = append(args, f.Machine)
+	}
+	if f.Owner != "" {
+		where = append(where, "machine_name IN (SELECT name FROM machines WHERE owner = ?)")
+		args = append(args, f.Owner)
+	}
+	if f.Fingerprint != "" {
+		where = append(where, "fingerprint = ?")
+		args = append(args, f.Fingerprint)
+	}
+	if f.Status != "" {
+		where = append(where, "status = ?")
+		args = append(args, f.Status)
+	}
+	query := "SELECT " + accessRequestColumns + " FROM access_requests"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id DESC"
+	if f.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, f.Limit)
+	}
+
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	requests := []AccessRequest{}
+	for rows.Next() {
+		var a AccessRequest
+		if err := scanAccessRequest(rows, &a); err != nil {
+			return nil, err
+		}
+		requests = append(requests, a)
+	}
+	return requests, rows.Err()
+}
+
+// ApproveAccessRequest marks a pending request approved and grants its key
+// to the machine as an access key labelled label that expires after
+// duration, in one transaction. It returns the new key, or
+// ErrAccessRequestDecided.
+func (db *DB) ApproveAccessRequest(id int64, decidedBy, note, label string, duration time.Duration) (*AccessKey, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	a := &AccessRequest{}
+	if err := scanAccessRequest(tx.QueryRow("SELECT "+accessRequestColumns+" FROM access_requests WHERE id = ?", id), a); err != nil {
+		return nil, err
+	}
+	if a.Status != AccessRequestPending {
+		return nil, ErrAccessRequestDecided
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	expires := now.Add(duration)
+	result, err := tx.Exec(
+		"INSERT INTO access_keys (machine_name, label, public_key, fingerprint, local_users, expires_at) VALUES (?, ?, ?, ?, ?, ?)",
+		a.MachineName, label, a.PublicKey, a.Fingerprint, strings.Join(a.LocalUsers, ","), sqlTime(expires),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("add access key: %w", err)
+	}
+	keyID, _ := result.LastInsertId()
+	if _, err := tx.Exec(
+		"UPDATE access_requests SET status = ?, decided_at = ?, decided_by = ?, note = ?, duration_seconds = ?, access_key_id = ?, key_expires_at = ? WHERE id = ?",
+		AccessRequestApproved, sqlTime(now), decidedBy, note, int64(duration/time.Second), keyID, sqlTime(expires), id,
+	); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &AccessKey{
+		ID:          keyID,
+		MachineName: a.MachineName,
+		Label:       label,
+		PublicKey:   a.PublicKey,
+		Fingerprint: a.Fingerprint,
+		LocalUsers:  a.LocalUsers,
+		CreatedAt:   now,
+		ExpiresAt:   &expires,
+	}, nil
+}
+
+// DenyAccessRequest marks a pending request denied, or returns
+// ErrAccessRequestDecided.
+func (db *DB) DenyAccessRequest(id int64, decidedBy, note string) error {
+	result, err := db.conn.Exec(
+		"UPDATE access_requests SET status = ?, decided_at = CURRENT_TIMESTAMP, decided_by = ?, note = ? WHERE id = ? AND status = ?",
+		AccessRequestDenied, decidedBy, note, id, AccessRequestPending,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrAccessRequestDecided
+	}
+	return nil
+}
+
+// ExpireAccessRequests marks requests still pending since before as expired
+// and returns how many there were.
+func (db *DB) ExpireAccessRequests(before time.Time) (int64, error) {
+	result, err := db.conn.Exec(
+		"UPDATE access_requests SET status = ?, decided_at = CURRENT_TIMESTAMP WHERE status = ? AND created_at < ?",
+		AccessRequestExpired, AccessRequestPending, sqlTime(before),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// PurgeAccessRequests deletes requests decided before the cutoff.
+func (db *DB) PurgeAccessRequests(before time.Time) (int64, error) {
+	result, err := db.conn.Exec("DELETE FROM access_requests WHERE decided_at IS NOT NULL AND decided_at < ?", sqlTime(before))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// PurgeExpiredAccessKeys deletes access keys whose expiry has passed and
+// returns them.
+func (db *DB) PurgeExpiredAccessKeys(now time.Time) ([]AccessKey, error) {
+	rows, err := db.conn.Query("SELECT "+accessKeyColumns+" FROM access_keys WHERE expires_at IS NOT NULL AND expires_at <= ?", sqlTime(now))
+	if err != nil {
+		return nil, err
+	}
+	var expired []AccessKey
+	for rows.Next() {
+		var k AccessKey
+		if err := scanAccessKey(rows, &k); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		expired = append(expired, k)
+	}
+	rows.Close()
+	for _, k := range expired {
+		if _, err := db.conn.Exec("DELETE FROM access_keys WHERE id = ?", k.ID); err != nil {
+			return nil, err
+		}
+	}
+	return expired, nil
+}
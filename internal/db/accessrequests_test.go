@@ -0,0 +1,75 @@
+package db
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAccessRequestLifecycle(t *testing.T) {
+	db := tempDB(t)
+
+	db.CreateMachine(&Machine{Name: "nas", Owner: "alice", LocalUser: "u", PublicKey: "k"})
+	db.CreateMachine(&Machine{Name: "lab", Owner: "bob", LocalUser: "u", PublicKey: "k"})
+
+	pub := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl carol"
+	a := &AccessRequest{MachineName: "nas", Requester: "carol", PublicKey: pub, LocalUsers: []string{"u"}, Reason: "debugging", DurationSeconds: 3600}
+	if err := db.CreateAccessRequest(a); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	other := &AccessRequest{MachineName: "lab", Requester: "dave", PublicKey: "ssh-ed25519 AAAA dave", Reason: "x", DurationSeconds: 60}
+	db.CreateAccessRequest(other)
+
+	mine, err := db.ListAccessRequests(AccessRequestFilter{Owner: "alice", Status: AccessRequestPending})
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(mine) != 1 || mine[0].ID != a.ID || mine[0].Fingerprint == "" || len(mine[0].LocalUsers) != 1 {
+		t.Fatalf("expected alice's pending request, got %+v", mine)
+	}
+
+	key, err := db.ApproveAccessRequest(a.ID, "alice", "ok", "carol (access request 1)", time.Hour)
+	if err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	if key.ExpiresAt == nil || key.Expired(time.Now()) || !key.Expired(time.Now().Add(2*time.Hour)) {
+		t.Fatalf("expected the key to expire in an hour, got %+v", key)
+	}
+	got, _ := db.GetAccessRequest(a.ID)
+	if got.Status != AccessRequestApproved || got.DecidedBy != "alice" || got.AccessKeyID == nil || *got.AccessKeyID != key.ID {
+		t.Fatalf("unexpected approved request %+v", got)
+	}
+	if _, err := db.ApproveAccessRequest(a.ID, "alice", "", "again", time.Hour); !errors.Is(err, ErrAccessRequestDecided) {
+		t.Fatalf("expected a decided request to be refused, got %v", err)
+	}
+	if err := db.DenyAccessRequest(a.ID, "alice", ""); !errors.Is(err, ErrAccessRequestDecided) {
+		t.Fatalf("expected a decided request to be refused, got %v", err)
+	}
+
+	// Expired keys are removed and returned
+	if expired, _ := db.PurgeExpiredAccessKeys(time.Now()); len(expired) != 0 {
+		t.Fatalf("expected nothing expired yet, got %+v", expired)
+	}
+	expired, err := db.PurgeExpiredAccessKeys(time.Now().Add(2 * time.Hour))
+	if err != nil || len(expired) != 1 || expired[0].ID != key.ID {
+		t.Fatalf("expected the key purged, got %+v %v", expired, err)
+	}
+	if keys, _ := db.ListAccessKeys("nas"); len(keys) != 0 {
+		t.Fatalf("expected no access keys left, got %+v", keys)
+	}
+
+	// Undecided requests expire, then decided ones are purged
+	if n, _ := db.ExpireAccessRequests(time.Now().Add(time.Minute)); n != 1 {
+		t.Fatalf("expected one request expired, got %d", n)
+	}
+	got, _ = db.GetAccessRequest(other.ID)
+	if got.Status != AccessRequestExpired || got.DecidedAt == nil {
+		t.Fatalf("unexpected expired request %+v", got)
+	}
+	if n, _ := db.PurgeAccessRequests(time.Now().Add(time.Minute)); n != 2 {
+		t.Fatalf("expected both requests purged, got %d", n)
+	}
+	if got, _ := db.GetAccessRequest(a.ID); got != nil {
+		t.Fatalf("expected the request gone, got %+v", got)
+	}
+}
@@ -0,0 +1,110 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Alert is one firing of an alert rule for a machine. ResolvedAt is nil while
+// it is firing; a rule fires at most once per machine until it resolves.
+type Alert struct {
+	ID           int64      `json:"id"`
+	Rule         string     `json:"rule"`
+	MachineName  string     `json:"machine_name"`
+	State        string     `json:"state"`
+	OfflineSince time.Time  `json:"offline_since"`
+	FiredAt      time.Time  `json:"fired_at"`
+	ResolvedAt   *time.Time `json:"resolved_at,omitempty"`
+}
+
+// Alert states.
+const (
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+// AlertFilter selects alerts for ListAlerts. Empty fields match everything.
+type AlertFilter struct {
+	State   string // AlertFiring or AlertResolved
+	Machine string
+	Limit   int
+}
+
+// FireAlert records that rule fired for the machine. It reports false, and
+// records nothing, if the rule is already firing for that machine.
+func (db *DB) FireAlert(rule, machineName string, offlineSince, at time.Time) (bool, error) {
+	result, err := db.conn.Exec(
+		"INSERT OR IGNORE INTO alerts (rule, machine_name, offline_since, fired_at) VALUES (?, ?, ?, ?)",
+		rule, machineName, sqlTime(offlineSince), sqlTime(at),
+	)
+	if err != nil {
+		return false, fmt.Errorf("fire alert: %w", err)
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+// ResolveAlert marks a firing alert resolved and reports whether it was firing.
+func (db *DB) ResolveAlert(id int64, at time.Time) (bool, error) {
+	result, err := db.conn.Exec("UPDATE alerts SET resolved_at = ? WHERE id = ? AND resolved_at IS NULL", sqlTime(at), id)
+	if err != nil {
+		return false, fmt.Errorf("resolve alert: %w", err)
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+// ListAlerts returns matching alerts, most recently fired first.
+func (db *DB) ListAlerts(f AlertFilter) ([]Alert, error) {
+	var where []string
+	var args []any
+	switch f.State {
+	case AlertFiring:
+		where = append(where, "resolved_at IS NULL")
+	case AlertResolved:
+		where = append(where, "resolved_at IS NOT NULL")
+	}
+	if f.Machine != "" {
+		where = append(where, "machine_name = ?")
+		args = append(args, f.Machine)
+	}
+	query := "SELECT id, rule, machine_name, offline_since, fired_at, resolved_at FROM alerts"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY fired_at DESC, id DESC"
+	if f.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, f.Limit)
+	}
+
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	alerts := []Alert{}
+	for rows.Next() {
+		var a Alert
+		if err := rows.Scan(&a.ID, &a.Rule, &a.MachineName, &a.OfflineSince, &a.FiredAt, &a.ResolvedAt); err != nil {
+			return nil, err
+		}
+		a.State = AlertFiring
+		if a.ResolvedAt != nil {
+			a.State = AlertResolved
+		}
+		alerts = append(alerts, a)
+	}
+	return alerts, rows.Err()
+}
+
+// PurgeResolvedAlerts deletes alerts resolved before the cutoff and returns
+// how many were removed.
+func (db *DB) PurgeResolvedAlerts(before time.Time) (int64, error) {
+	result, err := db.conn.Exec("DELETE FROM alerts WHERE resolved_at IS NOT NULL AND resolved_at < ?", sqlTime(before))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,58 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAlerts(t *testing.T) {
+	db := tempDB(t)
+	db.CreateMachine(&Machine{Name: "box", Owner: "a", LocalUser: "u", PublicKey: "k"})
+	now := time.Now().Truncate(time.Second)
+
+	fired, err := db.FireAlert("offline", "box", now.Add(-time.Hour), now)
+	if err != nil || !fired {
+		t.Fatalf("expected alert to fire, got %v %v", fired, err)
+	}
+	// Deduplicated while firing
+	if fired, _ := db.FireAlert("offline", "box", now.Add(-time.Hour), now.Add(time.Minute)); fired {
+		t.Fatal("expected a second firing of the same rule to be ignored")
+	}
+	if fired, _ := db.FireAlert("after-hours", "box", now.Add(-time.Hour), now); !fired {
+		t.Fatal("expected a different rule to fire independently")
+	}
+
+	firing, _ := db.ListAlerts(AlertFilter{State: AlertFiring})
+	if len(firing) != 2 || firing[0].State != AlertFiring {
+		t.Fatalf("expected 2 firing alerts, got %+v", firing)
+	}
+	for _, a := range firing {
+		if ok, err := db.ResolveAlert(a.ID, now.Add(time.Hour)); !ok || err != nil {
+			t.Fatalf("resolve: %v %v", ok, err)
+		}
+	}
+	if ok, _ := db.ResolveAlert(firing[0].ID, now.Add(time.Hour)); ok {
+		t.Fatal("expected resolving twice to report false")
+	}
+
+	// Once resolved, the rule can fire again
+	if fired, _ := db.FireAlert("offline", "box", now.Add(2*time.Hour), now.Add(3*time.Hour)); !fired {
+		t.Fatal("expected the rule to fire again after resolving")
+	}
+	resolved, _ := db.ListAlerts(AlertFilter{State: AlertResolved, Machine: "box"})
+	if len(resolved) != 2 || resolved[0].ResolvedAt == nil {
+		t.Fatalf("expected 2 resolved alerts, got %+v", resolved)
+	}
+
+	// Alerts follow a rename
+	if err := db.RenameMachine("box", "crate", 0); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	if all, _ := db.ListAlerts(AlertFilter{Machine: "crate", Limit: 2}); len(all) != 2 || all[0].State != AlertFiring {
+		t.Fatalf("expected newest alerts under the new name, got %+v", all)
+	}
+
+	if n, _ := db.PurgeResolvedAlerts(now.Add(2 * time.Hour)); n != 2 {
+		t.Fatalf("expected 2 purged, got %d", n)
+	}
+}
@@ -0,0 +1,133 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Alias is an additional SSH username that routes to a machine. Aliases left
+// behind by a rename carry an expiry; permanent aliases have none.
+type Alias struct {
+	ID          int64      `json:"id"`
+	Alias       string     `json:"alias"`
+	MachineName string     `json:"machine_name"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// Deprecated reports whether the alias is temporary, i.e. left by a rename.
+func (a Alias) Deprecated() bool {
+	return a.ExpiresAt != nil
+}
+
+// sqlTime formats t the way SQLite's CURRENT_TIMESTAMP does, so stored values
+// compare correctly against it.
+func sqlTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+const aliasColumns = "id, alias, machine_name, expires_at, created_at"
+
+func scanAliases(rows *sql.Rows) ([]Alias, error) {
+	defer rows.Close()
+	var aliases []Alias
+	for rows.Next() {
+		var a Alias
+		if err := rows.Scan(&a.ID, &a.Alias, &a.MachineName, &a.ExpiresAt, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		aliases = append(aliases, a)
+	}
+	return aliases, rows.Err()
+}
+
+// ListAliases returns the unexpired aliases of a machine.
+func (db *DB) ListAliases(machineName string) ([]Alias, error) {
+	rows, err := db.conn.Query(
+		"SELECT "+aliasColumns+" FROM machine_aliases WHERE machine_name = ? AND (expires_at IS NULL OR expires_at > CURRENT_TIMESTAMP) ORDER BY alias",
+		machineName,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanAliases(rows)
+}
+
+// AllAliases returns every unexpired alias grouped by machine name.
+func (db *DB) AllAliases() (map[string][]Alias, error) {
+	rows, err := db.conn.Query(
+		"SELECT " + aliasColumns + " FROM machine_aliases WHERE expires_at IS NULL OR expires_at > CURRENT_TIMESTAMP ORDER BY alias",
+	)
+	if err != nil {
+		return nil, err
+	}
+	aliases, err := scanAliases(rows)
+	if err != nil {
+		return nil, err
+	}
+	byMachine := make(map[string][]Alias)
+	for _, a := range aliases {
+		byMachine[a.MachineName] = append(byMachine[a.MachineName], a)
+	}
+	return byMachine, nil
+}
+
+// PurgeExpiredAliases deletes aliases past their expiry and returns how many were removed.
+func (db *DB) PurgeExpiredAliases() (int64, error) {
+	result, err := db.conn.Exec("DELETE FROM machine_aliases WHERE expires_at IS NOT NULL AND expires_at <= CURRENT_TIMESTAMP")
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// NameTaken reports whether name is already used by a machine or an unexpired alias.
+func (db *DB) NameTaken(name string) (bool, error) {
+	var n int
+	err := db.conn.QueryRow(`
+		SELECT (SELECT COUNT(*) FROM machines WHERE name = ?) +
+		       (SELECT COUNT(*) FROM machine_aliases WHERE alias = ? AND (expires_at IS NULL OR expires_at > CURRENT_TIMESTAMP))`,
+		name, name,
+	).Scan(&n)
+	if err != nil {
+		return false, fmt.Errorf("check name: %w", err)
+	}
+	return n > 0, nil
+}
+
+// AddAlias adds a permanent alias for a machine. An expired alias with the
+// same name that has not been purged yet is replaced.
+func (db *DB) AddAlias(machineName, alias string) (*Alias, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM machine_aliases WHERE alias = ? AND expires_at IS NOT NULL AND expires_at <= CURRENT_TIMESTAMP", alias); err != nil {
+		return nil, err
+	}
+	result, err := tx.Exec("INSERT INTO machine_aliases (alias, machine_name) VALUES (?, ?)", alias, machineName)
+	if err != nil {
+		return nil, fmt.Errorf("add alias: %w", err)
+	}
+	a := &Alias{Alias: alias, MachineName: machineName}
+	a.ID, _ = result.LastInsertId()
+	if err := tx.QueryRow("SELECT created_at FROM machine_aliases WHERE id = ?", a.ID).Scan(&a.CreatedAt); err != nil {
+		return nil, err
+	}
+	return a, tx.Commit()
+}
+
+func (db *DB) DeleteAlias(machineName, alias string) error {
+	result, err := db.conn.Exec("DELETE FROM machine_aliases WHERE machine_name = ? AND alias = ?", machineName, alias)
+	if err != nil {
+		return err
+	}
+	n, _ := result.RowsAffected()
+	if n == 0 {
+		return fmt.Errorf("alias %q not found", alias)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRenameKeepsAliasDuringGrace(t *testing.T) {
+	db := tempDB(t)
+
+	db.CreateMachine(&Machine{Name: "old", Owner: "a", LocalUser: "a", PublicKey: "k"})
+	if err := db.RenameMachine("old", "new", time.Hour); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+
+	aliases, err := db.ListAliases("new")
+	if err != nil {
+		t.Fatalf("list aliases: %v", err)
+	}
+	if len(aliases) != 1 || aliases[0].Alias != "old" || !aliases[0].Deprecated() {
+		t.Fatalf("expected deprecated alias old, got %+v", aliases)
+	}
+	if aliases[0].ExpiresAt.Before(time.Now().Add(50 * time.Minute)) {
+		t.Fatalf("unexpected expiry %v", aliases[0].ExpiresAt)
+	}
+
+	taken, _ := db.NameTaken("old")
+	if !taken {
+		t.Fatal("expected alias to reserve the old name")
+	}
+
+	// Renaming back onto the alias consumes it
+	if err := db.RenameMachine("new", "old", 0); err != nil {
+		t.Fatalf("rename back: %v", err)
+	}
+	if aliases, _ := db.ListAliases("old"); len(aliases) != 0 {
+		t.Fatalf("expected alias to be consumed, got %+v", aliases)
+	}
+}
+
+func TestPurgeExpiredAliases(t *testing.T) {
+	db := tempDB(t)
+
+	db.CreateMachine(&Machine{Name: "m1", Owner: "a", LocalUser: "a", PublicKey: "k"})
+	db.conn.Exec("INSERT INTO machine_aliases (alias, machine_name, expires_at) VALUES ('gone', 'm1', ?)", sqlTime(time.Now().Add(-time.Minute)))
+	db.conn.Exec("INSERT INTO machine_aliases (alias, machine_name, expires_at) VALUES ('soon', 'm1', ?)", sqlTime(time.Now().Add(time.Hour)))
+
+	all, _ := db.AllAliases()
+	if len(all["m1"]) != 1 || all["m1"][0].Alias != "soon" {
+		t.Fatalf("expected only unexpired alias, got %+v", all["m1"])
+	}
+	if taken, _ := db.NameTaken("gone"); taken {
+		t.Fatal("expired alias should not reserve its name")
+	}
+
+	n, err := db.PurgeExpiredAliases()
+	if err != nil {
+		t.Fatalf("purge: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 purged alias, got %d", n)
+	}
+}
+
+func TestAliasesFollowDelete(t *testing.T) {
+	db := tempDB(t)
+
+	db.CreateMachine(&Machine{Name: "old", Owner: "a", LocalUser: "a", PublicKey: "k"})
+	db.RenameMachine("old", "new", time.Hour)
+	if err := db.DeleteMachine("new"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if taken, _ := db.NameTaken("old"); taken {
+		t.Fatal("alias should be removed with its machine")
+	}
+}
+
+func TestAddAliasReplacesExpired(t *testing.T) {
+	db := tempDB(t)
+
+	db.CreateMachine(&Machine{Name: "m1", Owner: "a", LocalUser: "a", PublicKey: "k"})
+	db.conn.Exec("INSERT INTO machine_aliases (alias, machine_name, expires_at) VALUES ('plex', 'm1', ?)", sqlTime(time.Now().Add(-time.Minute)))
+
+	a, err := db.AddAlias("m1", "plex")
+	if err != nil {
+		t.Fatalf("add alias: %v", err)
+	}
+	if a.Deprecated() {
+		t.Fatal("expected permanent alias")
+	}
+	if _, err := db.AddAlias("m1", "plex"); err == nil {
+		t.Fatal("expected duplicate alias to fail")
+	}
+	if err := db.DeleteAlias("m1", "plex"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err := db.DeleteAlias("m1", "plex"); err == nil {
+		t.Fatal("expected error deleting missing alias")
+	}
+}
@@ -2,10 +2,15 @@ package db
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"slices"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/sshkey"
 )
 
 const (
@@ -14,14 +19,48 @@ const (
 )
 
 type Machine struct {
-	ID        int64      `json:"id"`
-	Name      string     `json:"name"`
-	Owner     string     `json:"owner"`
-	Port      int        `json:"port"`
-	LocalUser string     `json:"local_user"`
-	PublicKey string     `json:"public_key"`
-	CreatedAt time.Time  `json:"created_at"`
-	LastSeen  *time.Time `json:"last_seen,omitempty"`
+	ID          int64      `json:"id"`
+	Name        string     `json:"name"`
+	Owner       string     `json:"owner"`
+	Port        int        `json:"port"`
+	LocalUser   string     `json:"local_user"`
+	PublicKey   string     `json:"public_key"`
+	Fingerprint string     `json:"fingerprint"`
+	State       string     `json:"state"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LastSeen    *time.Time `json:"last_seen,omitempty"`
+
+	// Tags and Labels are free-form metadata used to find machines.
+	Tags   []string          `json:"tags,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Facts is the host telemetry from the latest heartbeat that carried it.
+	Facts   *Facts     `json:"facts,omitempty"`
+	FactsAt *time.Time `json:"facts_at,omitempty"`
+
+	// RecordSessions enables recording of SSH sessions to the machine.
+	RecordSessions bool `json:"record_sessions,omitempty"`
+
+	// Schedule limits when the machine is routed, as weekly windows in
+	// ScheduleTimezone (see package schedule). Empty means always.
+	Schedule         string `json:"schedule,omitempty"`
+	ScheduleTimezone string `json:"schedule_timezone,omitempty"`
+
+	// TokenHash is the SHA-256 of the machine's API token. It is written by
+	// CreateMachine and SetMachineToken but not read back.
+	TokenHash string `json:"-"`
+}
+
+// Machine states. Only active machines are routed and may open tunnels.
+const (
+	StateActive   = "active"
+	StatePending  = "pending"  // awaiting admin approval; the port stays reserved
+	StateDisabled = "disabled" // taken out of service; port, keys and metadata are kept
+)
+
+// IsActive reports whether the machine is routed.
+func (m Machine) IsActive() bool {
+	return m.State == StateActive
 }
 
 type AccessKey struct {
@@ -29,33 +68,112 @@ type AccessKey struct {
 	MachineName string    `json:"machine_name"`
 	Label       string    `json:"label"`
 	PublicKey   string    `json:"public_key"`
+	Fingerprint string    `json:"fingerprint"`
+	LocalUsers  []string  `json:"local_users,omitempty"`
 	CreatedAt   time.Time `json:"created_at"`
+
+	// Schedule limits when the key may log in, like Machine.Schedule.
+	Schedule         string `json:"schedule,omitempty"`
+	ScheduleTimezone string `json:"schedule_timezone,omitempty"`
+
+	KeyRestrictions
+
+	// ExpiresAt is set on keys granted by an access request; the key is
+	// removed once it passes.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// Expired reports whether the key has expired at now.
+func (k AccessKey) Expired(now time.Time) bool {
+	return k.ExpiresAt != nil && !k.ExpiresAt.After(now)
+}
+
+// KeyRestrictions narrow what an access key may do once logged in. The zero
+// value is an unrestricted login.
+type KeyRestrictions struct {
+	SourceCIDRs       []string `json:"source_cidrs,omitempty"`  // no longer accepted; keys that have them are not routed
+	ForceCommand      string   `json:"force_command,omitempty"` // run instead of whatever the client asks for
+	SFTPOnly          bool     `json:"sftp_only,omitempty"`
+	NoPortForwarding  bool     `json:"no_port_forwarding,omitempty"`
+	NoAgentForwarding bool     `json:"no_agent_forwarding,omitempty"`
+}
+
+// LimitsSession reports whether the restrictions apply inside the session,
+// which only the machine's sshd can enforce. Source CIDRs do not count.
+func (r KeyRestrictions) LimitsSession() bool {
+	return r.ForceCommand != "" || r.SFTPOnly || r.NoPortForwarding || r.NoAgentForwarding
+}
+
+// Equal reports whether both sets of restrictions are the same.
+func (r KeyRestrictions) Equal(o KeyRestrictions) bool {
+	return slices.Equal(r.SourceCIDRs, o.SourceCIDRs) && r.ForceCommand == o.ForceCommand && r.SFTPOnly == o.SFTPOnly &&
+		r.NoPortForwarding == o.NoPortForwarding && r.NoAgentForwarding == o.NoAgentForwarding
+}
+
+// LimitsSource reports whether the key was limited to client addresses.
+// sshpiperd routes a connection before the bastion could check its address,
+// so such keys are left out of the config rather than routed from anywhere.
+func (r KeyRestrictions) LimitsSource() bool {
+	return len(r.SourceCIDRs) > 0
+}
+
+// AllLocalUsers in an access key's LocalUsers lets it log in as every local
+// user of its machine.
+const AllLocalUsers = "*"
+
+// AllowsUser reports whether the key may log in as user on a machine whose
+// default local user is defaultUser. A key without local users may only log
+// in as the default user.
+func (k AccessKey) AllowsUser(user, defaultUser string) bool {
+	if len(k.LocalUsers) == 0 {
+		return user == defaultUser
+	}
+	return slices.Contains(k.LocalUsers, AllLocalUsers) || slices.Contains(k.LocalUsers, user)
 }
 
 type DB struct {
 	conn *sql.DB
 }
 
+// Open opens the database and applies any pending migrations.
 func Open(path string) (*DB, error) {
-	conn, err := sql.Open("sqlite3", path+"?_journal_mode=WAL&_busy_timeout=5000")
+	db, err := OpenWithoutMigrating(path)
 	if err != nil {
-		return nil, fmt.Errorf("open database: %w", err)
+		return nil, err
 	}
-	db := &DB{conn: conn}
-	if err := migrate(db); err != nil {
-		conn.Close()
+	if _, err := db.Migrate(); err != nil {
+		db.Close()
 		return nil, fmt.Errorf("migrate database: %w", err)
 	}
 	return db, nil
 }
 
+// OpenWithoutMigrating opens the database as is, for inspecting or migrating
+// it explicitly.
+func OpenWithoutMigrating(path string) (*DB, error) {
+	conn, err := sql.Open("sqlite3", path+"?_journal_mode=WAL&_busy_timeout=5000&_foreign_keys=on")
+	if err != nil {
+		return nil, fmt.Errorf("open database: %w", err)
+	}
+	return &DB{conn: conn}, nil
+}
+
 func (db *DB) Close() error {
 	return db.conn.Close()
 }
 
 func (db *DB) AllocatePort() (int, error) {
+	return allocatePort(db.conn)
+}
+
+// querier is the query method shared by *sql.DB and *sql.Tx.
+type querier interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+func allocatePort(q querier) (int, error) {
 	used := make(map[int]bool)
-	rows, err := db.conn.Query("SELECT port FROM machines")
+	rows, err := q.Query("SELECT port FROM machines")
 	if err != nil {
 		return 0, err
 	}
@@ -76,14 +194,33 @@ func (db *DB) AllocatePort() (int, error) {
 }
 
 func (db *DB) CreateMachine(m *Machine) error {
-	port, err := db.AllocatePort()
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := createMachine(tx, m); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func createMachine(tx *sql.Tx, m *Machine) error {
+	port, err := allocatePort(tx)
 	if err != nil {
 		return err
 	}
 	m.Port = port
-	result, err := db.conn.Exec(
-		"INSERT INTO machines (name, owner, port, local_user, public_key) VALUES (?, ?, ?, ?, ?)",
-		m.Name, m.Owner, m.Port, m.LocalUser, m.PublicKey,
+	if m.Fingerprint == "" {
+		m.Fingerprint = sshkey.Fingerprint(m.PublicKey)
+	}
+	if m.State == "" {
+		m.State = StateActive
+	}
+	result, err := tx.Exec(
+		"INSERT INTO machines (name, owner, port, local_user, public_key, fingerprint, state, token_hash, tags, labels) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		m.Name, m.Owner, m.Port, m.LocalUser, m.PublicKey, m.Fingerprint, m.State, m.TokenHash,
+		strings.Join(m.Tags, ","), encodeLabels(m.Labels),
 	)
 	if err != nil {
 		return fmt.Errorf("insert machine: %w", err)
@@ -92,12 +229,54 @@ func (db *DB) CreateMachine(m *Machine) error {
 	return nil
 }
 
+const machineColumns = "id, name, owner, port, local_user, public_key, fingerprint, state, created_at, last_seen, tags, labels, facts, facts_at, record_sessions, schedule, schedule_timezone"
+
+// scanMachine scans a row selected with machineColumns.
+func scanMachine(row interface{ Scan(...any) error }, m *Machine) error {
+	var tags, labels, facts string
+	if err := row.Scan(&m.ID, &m.Name, &m.Owner, &m.Port, &m.LocalUser, &m.PublicKey, &m.Fingerprint, &m.State, &m.CreatedAt, &m.LastSeen, &tags, &labels, &facts, &m.FactsAt, &m.RecordSessions, &m.Schedule, &m.ScheduleTimezone); err != nil {
+		return err
+	}
+	m.Tags = splitList(tags)
+	m.Labels = decodeLabels(labels)
+	m.Facts = decodeFacts(facts)
+	return nil
+}
+
+// encodeLabels stores labels as a JSON object.
+func encodeLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return "{}"
+	}
+	data, _ := json.Marshal(labels)
+	return string(data)
+}
+
+func decodeLabels(s string) map[string]string {
+	labels := map[string]string{}
+	json.Unmarshal([]byte(s), &labels)
+	return labels
+}
+
+// UpdateMachineMetadata replaces a machine's owner, tags and labels.
+func (db *DB) UpdateMachineMetadata(name, owner string, tags []string, labels map[string]string) error {
+	result, err := db.conn.Exec(
+		"UPDATE machines SET owner = ?, tags = ?, labels = ? WHERE name = ?",
+		owner, strings.Join(tags, ","), encodeLabels(labels), name,
+	)
+	if err != nil {
+		return err
+	}
+	n, _ := result.RowsAffected()
+	if n == 0 {
+		return fmt.Errorf("machine %q not found", name)
+	}
+	return nil
+}
+
 func (db *DB) GetMachine(name string) (*Machine, error) {
 	m := &Machine{}
-	err := db.conn.QueryRow(
-		"SELECT id, name, owner, port, local_user, public_key, created_at, last_seen FROM machines WHERE name = ?",
-		name,
-	).Scan(&m.ID, &m.Name, &m.Owner, &m.Port, &m.LocalUser, &m.PublicKey, &m.CreatedAt, &m.LastSeen)
+	err := scanMachine(db.conn.QueryRow("SELECT "+machineColumns+" FROM machines WHERE name = ?", name), m)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -108,9 +287,7 @@ func (db *DB) GetMachine(name string) (*Machine, error) {
 }
 
 func (db *DB) ListMachines() ([]Machine, error) {
-	rows, err := db.conn.Query(
-		"SELECT id, name, owner, port, local_user, public_key, created_at, last_seen FROM machines ORDER BY port",
-	)
+	rows, err := db.conn.Query("SELECT " + machineColumns + " FROM machines ORDER BY port")
 	if err != nil {
 		return nil, err
 	}
@@ -118,7 +295,7 @@ func (db *DB) ListMachines() ([]Machine, error) {
 	var machines []Machine
 	for rows.Next() {
 		var m Machine
-		if err := rows.Scan(&m.ID, &m.Name, &m.Owner, &m.Port, &m.LocalUser, &m.PublicKey, &m.CreatedAt, &m.LastSeen); err != nil {
+		if err := scanMachine(rows, &m); err != nil {
 			return nil, err
 		}
 		machines = append(machines, m)
@@ -138,8 +315,21 @@ func (db *DB) DeleteMachine(name string) error {
 	return nil
 }
 
-func (db *DB) RenameMachine(oldName, newName string) error {
-	result, err := db.conn.Exec("UPDATE machines SET name = ? WHERE name = ?", newName, oldName)
+// RenameMachine renames a machine and every row that refers to it by name in
+// a single transaction. If grace is positive the old name is kept as an alias
+// that expires after grace.
+func (db *DB) RenameMachine(oldName, newName string, grace time.Duration) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("rename machine: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Dependent rows are moved explicitly below; defer the FK check to commit
+	if _, err := tx.Exec("PRAGMA defer_foreign_keys = ON"); err != nil {
+		return fmt.Errorf("rename machine: %w", err)
+	}
+	result, err := tx.Exec("UPDATE machines SET name = ? WHERE name = ?", newName, oldName)
 	if err != nil {
 		return fmt.Errorf("rename machine: %w", err)
 	}
@@ -147,6 +337,126 @@ func (db *DB) RenameMachine(oldName, newName string) error {
 	if n == 0 {
 		return fmt.Errorf("machine %q not found", oldName)
 	}
+	if _, err := tx.Exec("UPDATE access_keys SET machine_name = ? WHERE machine_name = ?", newName, oldName); err != nil {
+		return fmt.Errorf("rename access keys: %w", err)
+	}
+	// Renaming back onto one of the machine's own aliases consumes it
+	if _, err := tx.Exec("DELETE FROM machine_aliases WHERE alias = ? AND machine_name IN (?, ?)", newName, oldName, newName); err != nil {
+		return fmt.Errorf("rename aliases: %w", err)
+	}
+	if _, err := tx.Exec("UPDATE machine_aliases SET machine_name = ? WHERE machine_name = ?", newName, oldName); err != nil {
+		return fmt.Errorf("rename aliases: %w", err)
+	}
+	if _, err := tx.Exec("UPDATE tunnel_sessions SET machine_name = ? WHERE machine_name = ?", newName, oldName); err != nil {
+		return fmt.Errorf("rename machine: %w", err)
+	}
+	if _, err := tx.Exec("UPDATE machine_facts SET machine_name = ? WHERE machine_name = ?", newName, oldName); err != nil {
+		return fmt.Errorf("rename machine: %w", err)
+	}
+	if _, err := tx.Exec("UPDATE alerts SET machine_name = ? WHERE machine_name = ?", newName, oldName); err != nil {
+		return fmt.Errorf("rename machine: %w", err)
+	}
+	if _, err := tx.Exec("UPDATE ssh_sessions SET machine_name = ? WHERE machine_name = ?", newName, oldName); err != nil {
+		return fmt.Errorf("rename machine: %w", err)
+	}
+	if _, err := tx.Exec("UPDATE machine_users SET machine_name = ? WHERE machine_name = ?", newName, oldName); err != nil {
+		return fmt.Errorf("rename local users: %w", err)
+	}
+	if grace > 0 {
+		_, err := tx.Exec(
+			"INSERT INTO machine_aliases (alias, machine_name, expires_at) VALUES (?, ?, ?)",
+			oldName, newName, sqlTime(time.Now().Add(grace)),
+		)
+		if err != nil {
+			return fmt.Errorf("keep old name as alias: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// SetMachineState moves a machine from one state to another and reports
+// whether it was in the expected state.
+func (db *DB) SetMachineState(name, from, to string) (bool, error) {
+	result, err := db.conn.Exec("UPDATE machines SET state = ? WHERE name = ? AND state = ?", to, name, from)
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+// SetMachineToken replaces the hash of a machine's API token.
+func (db *DB) SetMachineToken(name, tokenHash string) error {
+	_, err := db.conn.Exec("UPDATE machines SET token_hash = ? WHERE name = ?", tokenHash, name)
+	return err
+}
+
+// MachineByToken returns the machine whose API token hashes to tokenHash, or nil.
+func (db *DB) MachineByToken(tokenHash string) (*Machine, error) {
+	if tokenHash == "" {
+		return nil, nil
+	}
+	m := &Machine{}
+	err := scanMachine(db.conn.QueryRow("SELECT "+machineColumns+" FROM machines WHERE token_hash = ?", tokenHash), m)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// SetRecordSessions turns session recording for the machine on or off.
+func (db *DB) SetRecordSessions(name string, on bool) error {
+	result, err := db.conn.Exec("UPDATE machines SET record_sessions = ? WHERE name = ?", on, name)
+	if err != nil {
+		return err
+	}
+	n, _ := result.RowsAffected()
+	if n == 0 {
+		return fmt.Errorf("machine %q not found", name)
+	}
+	return nil
+}
+
+// SetMachineSchedule sets or, with an empty schedule, clears the machine's
+// access schedule.
+func (db *DB) SetMachineSchedule(name, schedule, timezone string) error {
+	result, err := db.conn.Exec("UPDATE machines SET schedule = ?, schedule_timezone = ? WHERE name = ?", schedule, timezone, name)
+	if err != nil {
+		return err
+	}
+	n, _ := result.RowsAffected()
+	if n == 0 {
+		return fmt.Errorf("machine %q not found", name)
+	}
+	return nil
+}
+
+// MachineByPort returns the machine assigned the tunnel port, or nil.
+func (db *DB) MachineByPort(port int) (*Machine, error) {
+	m := &Machine{}
+	err := scanMachine(db.conn.QueryRow("SELECT "+machineColumns+" FROM machines WHERE port = ?", port), m)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ReplaceMachineKey changes the public key a machine connects its tunnel with.
+func (db *DB) ReplaceMachineKey(name, publicKey, fingerprint string) error {
+	result, err := db.conn.Exec("UPDATE machines SET public_key = ?, fingerprint = ? WHERE name = ?", publicKey, fingerprint, name)
+	if err != nil {
+		return err
+	}
+	n, _ := result.RowsAffected()
+	if n == 0 {
+		return fmt.Errorf("machine %q not found", name)
+	}
 	return nil
 }
 
@@ -162,28 +472,57 @@ func (db *DB) UpdateLastSeen(name string) error {
 	return nil
 }
 
-func (db *DB) AddAccessKey(machineName, label, publicKey string) (*AccessKey, error) {
+// AddAccessKey grants k.PublicKey access to k.MachineName with the key's
+// local users, schedule and restrictions in one insert, so a key is never
+// stored without them, and fills in its ID, fingerprint and creation time.
+// An empty LocalUsers allows only the machine's default user.
+func (db *DB) AddAccessKey(k *AccessKey) error {
+	k.Fingerprint = sshkey.Fingerprint(k.PublicKey)
 	result, err := db.conn.Exec(
-		"INSERT INTO access_keys (machine_name, label, public_key) VALUES (?, ?, ?)",
-		machineName, label, publicKey,
+		"INSERT INTO access_keys (machine_name, label, public_key, fingerprint, local_users, schedule, schedule_timezone, "+
+			"source_cidrs, force_command, sftp_only, no_port_forwarding, no_agent_forwarding) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		k.MachineName, k.Label, k.PublicKey, k.Fingerprint, strings.Join(k.LocalUsers, ","), k.Schedule, k.ScheduleTimezone,
+		strings.Join(k.SourceCIDRs, ","), k.ForceCommand, k.SFTPOnly, k.NoPortForwarding, k.NoAgentForwarding,
 	)
 	if err != nil {
-		return nil, fmt.Errorf("add access key: %w", err)
+		return fmt.Errorf("add access key: %w", err)
 	}
-	id, _ := result.LastInsertId()
-	return &AccessKey{
-		ID:          id,
-		MachineName: machineName,
-		Label:       label,
-		PublicKey:    publicKey,
-	}, nil
+	k.ID, _ = result.LastInsertId()
+	k.CreatedAt = time.Now().UTC()
+	return nil
+}
+
+const accessKeyColumns = "id, machine_name, label, public_key, fingerprint, local_users, created_at, schedule, schedule_timezone, " +
+	"source_cidrs, force_command, sftp_only, no_port_forwarding, no_agent_forwarding, expires_at"
+
+// scanAccessKey scans a row selected with accessKeyColumns.
+func scanAccessKey(row interface{ Scan(...any) error }, k *AccessKey) error {
+	var localUsers, cidrs string
+	if err := row.Scan(&k.ID, &k.MachineName, &k.Label, &k.PublicKey, &k.Fingerprint, &localUsers, &k.CreatedAt, &k.Schedule, &k.ScheduleTimezone,
+		&cidrs, &k.ForceCommand, &k.SFTPOnly, &k.NoPortForwarding, &k.NoAgentForwarding, &k.ExpiresAt); err != nil {
+		return err
+	}
+	if users := splitList(localUsers); len(users) > 0 {
+		k.LocalUsers = users
+	}
+	if list := splitList(cidrs); len(list) > 0 {
+		k.SourceCIDRs = list
+	}
+	return nil
 }
 
 func (db *DB) ListAccessKeys(machineName string) ([]AccessKey, error) {
-	rows, err := db.conn.Query(
-		"SELECT id, machine_name, label, public_key, created_at FROM access_keys WHERE machine_name = ? ORDER BY id",
-		machineName,
-	)
+	return db.queryAccessKeys("SELECT "+accessKeyColumns+" FROM access_keys WHERE machine_name = ? ORDER BY id", machineName)
+}
+
+// AccessKeysByFingerprint returns the access keys for the fingerprint on
+// every machine.
+func (db *DB) AccessKeysByFingerprint(fingerprint string) ([]AccessKey, error) {
+	return db.queryAccessKeys("SELECT "+accessKeyColumns+" FROM access_keys WHERE fingerprint = ? ORDER BY id", fingerprint)
+}
+
+func (db *DB) queryAccessKeys(query string, args ...any) ([]AccessKey, error) {
+	rows, err := db.conn.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -191,12 +530,12 @@ func (db *DB) ListAccessKeys(machineName string) ([]AccessKey, error) {
 	var keys []AccessKey
 	for rows.Next() {
 		var k AccessKey
-		if err := rows.Scan(&k.ID, &k.MachineName, &k.Label, &k.PublicKey, &k.CreatedAt); err != nil {
+		if err := scanAccessKey(rows, &k); err != nil {
 			return nil, err
 		}
 		keys = append(keys, k)
 	}
-	return keys, nil
+	return keys, rows.Err()
 }
 
 func (db *DB) DeleteAccessKey(id int64) error {
@@ -213,9 +552,7 @@ func (db *DB) DeleteAccessKey(id int64) error {
 
 func (db *DB) GetAccessKey(id int64) (*AccessKey, error) {
 	k := &AccessKey{}
-	err := db.conn.QueryRow(
-		"SELECT id, machine_name, label, public_key, created_at FROM access_keys WHERE id = ?", id,
-	).Scan(&k.ID, &k.MachineName, &k.Label, &k.PublicKey, &k.CreatedAt)
+	err := scanAccessKey(db.conn.QueryRow("SELECT "+accessKeyColumns+" FROM access_keys WHERE id = ?", id), k)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -224,3 +561,39 @@ func (db *DB) GetAccessKey(id int64) (*AccessKey, error) {
 	}
 	return k, nil
 }
+
+// SetAccessKeySchedule sets or, with an empty schedule, clears the key's
+// access schedule.
+func (db *DB) SetAccessKeySchedule(id int64, schedule, timezone string) error {
+	result, err := db.conn.Exec("UPDATE access_keys SET schedule = ?, schedule_timezone = ? WHERE id = ?", schedule, timezone, id)
+	if err != nil {
+		return err
+	}
+	n, _ := result.RowsAffected()
+	if n == 0 {
+		return fmt.Errorf("access key %d not found", id)
+	}
+	return nil
+}
+
+// SetAccessKeyRestrictions replaces the key's restrictions.
+func (db *DB) SetAccessKeyRestrictions(id int64, r KeyRestrictions) error {
+	result, err := db.conn.Exec(
+		"UPDATE access_keys SET source_cidrs = ?, force_command = ?, sftp_only = ?, no_port_forwarding = ?, no_agent_forwarding = ? WHERE id = ?",
+		strings.Join(r.SourceCIDRs, ","), r.ForceCommand, r.SFTPOnly, r.NoPortForwarding, r.NoAgentForwarding, id,
+	)
+	if err != nil {
+		return err
+	}
+	n, _ := result.RowsAffected()
+	if n == 0 {
+		return fmt.Errorf("access key %d not found", id)
+	}
+	return nil
+}
+
+// Snapshot writes a consistent copy of the database to path, which must not exist.
+func (db *DB) Snapshot(path string) error {
+	_, err := db.conn.Exec("VACUUM INTO ?", path)
+	return err
+}
@@ -183,7 +183,7 @@ func TestRenameMachine(t *testing.T) {
 
 	db.CreateMachine(&Machine{Name: "old-name", Owner: "a", LocalUser: "a", PublicKey: "k"})
 
-	if err := db.RenameMachine("old-name", "new-name"); err != nil {
+	if err := db.RenameMachine("old-name", "new-name", 0); err != nil {
 		t.Fatalf("rename: %v", err)
 	}
 
@@ -206,7 +206,7 @@ func TestRenameMachine(t *testing.T) {
 func TestRenameMachineNotFound(t *testing.T) {
 	db := tempDB(t)
 
-	if err := db.RenameMachine("ghost", "new-name"); err == nil {
+	if err := db.RenameMachine("ghost", "new-name", 0); err == nil {
 		t.Fatal("expected error renaming nonexistent machine")
 	}
 }
@@ -217,7 +217,7 @@ func TestRenameMachineDuplicate(t *testing.T) {
 	db.CreateMachine(&Machine{Name: "m1", Owner: "a", LocalUser: "a", PublicKey: "k1"})
 	db.CreateMachine(&Machine{Name: "m2", Owner: "b", LocalUser: "b", PublicKey: "k2"})
 
-	if err := db.RenameMachine("m1", "m2"); err == nil {
+	if err := db.RenameMachine("m1", "m2", 0); err == nil {
 		t.Fatal("expected error renaming to duplicate name")
 	}
 }
@@ -245,3 +245,116 @@ func TestPortExhaustion(t *testing.T) {
 		t.Fatal("expected port exhaustion error")
 	}
 }
+
+func TestFingerprintStored(t *testing.T) {
+	db := tempDB(t)
+
+	key := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl test"
+	m := &Machine{Name: "m1", Owner: "a", LocalUser: "a", PublicKey: key}
+	if err := db.CreateMachine(m); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	got, _ := db.GetMachine("m1")
+	if got.Fingerprint == "" || got.Fingerprint != m.Fingerprint {
+		t.Fatalf("expected fingerprint to be stored, got %q", got.Fingerprint)
+	}
+
+	ak := &AccessKey{MachineName: "m1", Label: "phone", PublicKey: key}
+	if err := db.AddAccessKey(ak); err != nil {
+		t.Fatalf("add access key: %v", err)
+	}
+	keys, _ := db.ListAccessKeys("m1")
+	if len(keys) != 1 || keys[0].Fingerprint != ak.Fingerprint || ak.Fingerprint != got.Fingerprint {
+		t.Fatalf("unexpected access key fingerprint: %+v", keys)
+	}
+}
+
+func TestRenameMachineCarriesAccessKeys(t *testing.T) {
+	db := tempDB(t)
+
+	db.CreateMachine(&Machine{Name: "old-name", Owner: "a", LocalUser: "a", PublicKey: "k"})
+	db.AddAccessKey(&AccessKey{MachineName: "old-name", Label: "phone", PublicKey: "k-phone"})
+	db.AddAccessKey(&AccessKey{MachineName: "old-name", Label: "tablet", PublicKey: "k-tablet"})
+
+	if err := db.RenameMachine("old-name", "new-name", 0); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+
+	keys, err := db.ListAccessKeys("new-name")
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("expected 2 access keys on renamed machine, got %d", len(keys))
+	}
+	if old, _ := db.ListAccessKeys("old-name"); len(old) != 0 {
+		t.Fatalf("expected no access keys left on old name, got %d", len(old))
+	}
+}
+
+func TestMachineMetadata(t *testing.T) {
+	db := tempDB(t)
+
+	db.CreateMachine(&Machine{Name: "nas", Owner: "a", LocalUser: "u", PublicKey: "k",
+		Tags: []string{"home", "storage"}, Labels: map[string]string{"rack": "2"}})
+	m, _ := db.GetMachine("nas")
+	if len(m.Tags) != 2 || m.Tags[1] != "storage" || m.Labels["rack"] != "2" {
+		t.Fatalf("expected tags and labels to round-trip, got %+v", m)
+	}
+
+	if err := db.UpdateMachineMetadata("nas", "b", nil, nil); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	m, _ = db.GetMachine("nas")
+	if m.Owner != "b" || len(m.Tags) != 0 || len(m.Labels) != 0 {
+		t.Fatalf("expected metadata to be replaced, got %+v", m)
+	}
+	if err := db.UpdateMachineMetadata("ghost", "b", nil, nil); err == nil {
+		t.Fatal("expected error for unknown machine")
+	}
+}
+
+func TestAccessKeyRestrictions(t *testing.T) {
+	db := tempDB(t)
+
+	db.CreateMachine(&Machine{Name: "nas", Owner: "a", LocalUser: "u", PublicKey: "k"})
+	ak := &AccessKey{MachineName: "nas", Label: "backup", PublicKey: "k-backup"}
+	db.AddAccessKey(ak)
+	if ak.LimitsSession() {
+		t.Fatal("expected a new key to be unrestricted")
+	}
+
+	r := KeyRestrictions{SourceCIDRs: []string{"10.0.0.0/8", "2001:db8::/32"}, SFTPOnly: true, NoPortForwarding: true}
+	if err := db.SetAccessKeyRestrictions(ak.ID, r); err != nil {
+		t.Fatalf("set restrictions: %v", err)
+	}
+	got, _ := db.GetAccessKey(ak.ID)
+	if len(got.SourceCIDRs) != 2 || got.SourceCIDRs[1] != "2001:db8::/32" || !got.SFTPOnly || !got.NoPortForwarding ||
+		got.NoAgentForwarding || got.ForceCommand != "" || !got.LimitsSession() {
+		t.Fatalf("expected restrictions to round-trip, got %+v", got.KeyRestrictions)
+	}
+	if !got.LimitsSource() {
+		t.Fatal("expected the key limited to its source CIDRs")
+	}
+
+	if err := db.SetAccessKeyRestrictions(ak.ID, KeyRestrictions{}); err != nil {
+		t.Fatalf("clear restrictions: %v", err)
+	}
+	got, _ = db.GetAccessKey(ak.ID)
+	if got.SourceCIDRs != nil || got.SFTPOnly || got.LimitsSource() {
+		t.Fatalf("expected restrictions cleared, got %+v", got.KeyRestrictions)
+	}
+	if err := db.SetAccessKeyRestrictions(999, r); err == nil {
+		t.Fatal("expected error for unknown key")
+	}
+
+	// Restrictions given up front are stored with the key
+	fixed := &AccessKey{MachineName: "nas", Label: "ci", PublicKey: "k-ci", KeyRestrictions: r}
+	if err := db.AddAccessKey(fixed); err != nil {
+		t.Fatalf("add restricted key: %v", err)
+	}
+	got, _ = db.GetAccessKey(fixed.ID)
+	if !got.KeyRestrictions.Equal(r) {
+		t.Fatalf("expected restrictions stored on insert, got %+v", got.KeyRestrictions)
+	}
+}
@@ -0,0 +1,139 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Enrollment is a single-use token that lets a new machine register without
+// the API key. Only a hash of the token is stored.
+type Enrollment struct {
+	ID         int64      `json:"id"`
+	Owner      string     `json:"owner,omitempty"`       // required owner of the machine, if set
+	NamePrefix string     `json:"name_prefix,omitempty"` // required machine name prefix, if set
+	Tags       []string   `json:"tags,omitempty"`        // added to the machine at registration
+	ExpiresAt  time.Time  `json:"expires_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UsedAt     *time.Time `json:"used_at,omitempty"`
+	UsedBy     string     `json:"used_by,omitempty"`
+}
+
+// ErrEnrollmentUnusable is returned when a token is unknown, used or expired.
+var ErrEnrollmentUnusable = errors.New("enrollment token is invalid, expired or already used")
+
+const enrollmentColumns = "id, owner, name_prefix, tags, expires_at, created_at, used_at, used_by"
+
+func scanEnrollment(row interface{ Scan(...any) error }, e *Enrollment) error {
+	var tags string
+	if err := row.Scan(&e.ID, &e.Owner, &e.NamePrefix, &tags, &e.ExpiresAt, &e.CreatedAt, &e.UsedAt, &e.UsedBy); err != nil {
+		return err
+	}
+	e.Tags = splitList(tags)
+	return nil
+}
+
+func (db *DB) CreateEnrollment(tokenHash, owner, namePrefix string, tags []string, expiresAt time.Time) (*Enrollment, error) {
+	result, err := db.conn.Exec(
+		"INSERT INTO enrollment_tokens (token_hash, owner, name_prefix, tags, expires_at) VALUES (?, ?, ?, ?, ?)",
+		tokenHash, owner, namePrefix, strings.Join(tags, ","), sqlTime(expiresAt),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("create enrollment: %w", err)
+	}
+	id, _ := result.LastInsertId()
+	e := &Enrollment{}
+	if err := scanEnrollment(db.conn.QueryRow("SELECT "+enrollmentColumns+" FROM enrollment_tokens WHERE id = ?", id), e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// GetUsableEnrollment returns the unused, unexpired enrollment for a token
+// hash, or ErrEnrollmentUnusable.
+func (db *DB) GetUsableEnrollment(tokenHash string) (*Enrollment, error) {
+	e := &Enrollment{}
+	err := scanEnrollment(db.conn.QueryRow(
+		"SELECT "+enrollmentColumns+" FROM enrollment_tokens WHERE token_hash = ? AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP",
+		tokenHash,
+	), e)
+	if err == sql.ErrNoRows {
+		return nil, ErrEnrollmentUnusable
+	}
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (db *DB) ListEnrollments() ([]Enrollment, error) {
+	rows, err := db.conn.Query("SELECT " + enrollmentColumns + " FROM enrollment_tokens ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var enrollments []Enrollment
+	for rows.Next() {
+		var e Enrollment
+		if err := scanEnrollment(rows, &e); err != nil {
+			return nil, err
+		}
+		enrollments = append(enrollments, e)
+	}
+	return enrollments, rows.Err()
+}
+
+// SetEnrolledMachineToken marks the enrollment token used by name and sets
+// the existing machine's token in one transaction, so re-registering with an
+// enrollment token only uses it up when it succeeds. It returns
+// ErrEnrollmentUnusable when the token is no longer usable.
+func (db *DB) SetEnrolledMachineToken(name, machineTokenHash, tokenHash string) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"UPDATE enrollment_tokens SET used_at = CURRENT_TIMESTAMP, used_by = ? WHERE token_hash = ? AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP",
+		name, tokenHash,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrEnrollmentUnusable
+	}
+	if _, err := tx.Exec("UPDATE machines SET token_hash = ? WHERE name = ?", machineTokenHash, name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CreateEnrolledMachine marks the enrollment token used and creates the
+// machine in one transaction, so a token registers exactly one machine and is
+// not consumed by a registration that fails.
+func (db *DB) CreateEnrolledMachine(m *Machine, tokenHash string) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"UPDATE enrollment_tokens SET used_at = CURRENT_TIMESTAMP, used_by = ? WHERE token_hash = ? AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP",
+		m.Name, tokenHash,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrEnrollmentUnusable
+	}
+	if err := createMachine(tx, m); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,60 @@
+package db
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestEnrollmentSingleUse(t *testing.T) {
+	db := tempDB(t)
+
+	e, err := db.CreateEnrollment("hash1", "alice", "lab-", []string{"lab"}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("create enrollment: %v", err)
+	}
+	if e.Owner != "alice" || e.NamePrefix != "lab-" || len(e.Tags) != 1 || e.UsedAt != nil {
+		t.Fatalf("unexpected enrollment %+v", e)
+	}
+	if _, err := db.GetUsableEnrollment("hash1"); err != nil {
+		t.Fatalf("expected usable enrollment: %v", err)
+	}
+
+	m := &Machine{Name: "lab-1", Owner: "alice", LocalUser: "alice", PublicKey: "k", TokenHash: "mt1"}
+	if err := db.CreateEnrolledMachine(m, "hash1"); err != nil {
+		t.Fatalf("create enrolled machine: %v", err)
+	}
+	if m.Port == 0 {
+		t.Fatal("expected a port to be allocated")
+	}
+	if got, _ := db.MachineByToken("mt1"); got == nil || got.Name != "lab-1" {
+		t.Fatalf("expected machine by token, got %+v", got)
+	}
+
+	// Second use fails and leaves no machine behind
+	err = db.CreateEnrolledMachine(&Machine{Name: "lab-2", Owner: "alice", LocalUser: "alice", PublicKey: "k"}, "hash1")
+	if !errors.Is(err, ErrEnrollmentUnusable) {
+		t.Fatalf("expected ErrEnrollmentUnusable, got %v", err)
+	}
+	if got, _ := db.GetMachine("lab-2"); got != nil {
+		t.Fatal("expected no machine for a reused token")
+	}
+
+	list, _ := db.ListEnrollments()
+	if len(list) != 1 || list[0].UsedAt == nil || list[0].UsedBy != "lab-1" {
+		t.Fatalf("expected enrollment to be marked used, got %+v", list)
+	}
+}
+
+func TestEnrollmentExpired(t *testing.T) {
+	db := tempDB(t)
+
+	db.CreateEnrollment("old", "", "", nil, time.Now().Add(-time.Minute))
+	if _, err := db.GetUsableEnrollment("old"); !errors.Is(err, ErrEnrollmentUnusable) {
+		t.Fatalf("expected expired token to be unusable, got %v", err)
+	}
+	err := db.CreateEnrolledMachine(&Machine{Name: "x", Owner: "a", LocalUser: "a", PublicKey: "k"}, "old")
+	if !errors.Is(err, ErrEnrollmentUnusable) {
+		t.Fatalf("expected ErrEnrollmentUnusable, got %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// MaxFactsHistory is how many heartbeats' worth of facts are kept per
+// machine: a day at the client's five-minute interval.
+const MaxFactsHistory = 288
+
+// Facts is host telemetry reported by the client with its heartbeat.
+type Facts struct {
+	OS             string    `json:"os,omitempty"`
+	Arch           string    `json:"arch,omitempty"`
+	Kernel         string    `json:"kernel,omitempty"`
+	Hostname       string    `json:"hostname,omitempty"`
+	UptimeSeconds  int64     `json:"uptime_seconds,omitempty"`
+	Load           []float64 `json:"load,omitempty"` // 1, 5 and 15 minute load averages
+	DiskFreeBytes  uint64    `json:"disk_free_bytes,omitempty"`
+	DiskTotalBytes uint64    `json:"disk_total_bytes,omitempty"`
+	ClientVersion  string    `json:"client_version,omitempty"`
+	SSHDVersion    string    `json:"sshd_version,omitempty"`
+}
+
+// FactsRecord is one entry of a machine's facts history.
+type FactsRecord struct {
+	Facts      Facts     `json:"facts"`
+	RecordedAt time.Time `json:"recorded_at"`
+}
+
+func decodeFacts(s string) *Facts {
+	if s == "" {
+		return nil
+	}
+	var f Facts
+	if err := json.Unmarshal([]byte(s), &f); err != nil {
+		return nil
+	}
+	return &f
+}
+
+// RecordFacts stores facts as the machine's latest and appends them to its
+// history, dropping entries beyond MaxFactsHistory.
+func (db *DB) RecordFacts(name string, f Facts) error {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE machines SET facts = ?, facts_at = CURRENT_TIMESTAMP WHERE name = ?", string(data), name)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("machine %q not found", name)
+	}
+	if _, err := tx.Exec("INSERT INTO machine_facts (machine_name, facts) VALUES (?, ?)", name, string(data)); err != nil {
+		return fmt.Errorf("record facts: %w", err)
+	}
+	if _, err := tx.Exec(
+		"DELETE FROM machine_facts WHERE machine_name = ? AND id NOT IN (SELECT id FROM machine_facts WHERE machine_name = ? ORDER BY id DESC LIMIT ?)",
+		name, name, MaxFactsHistory,
+	); err != nil {
+		return fmt.Errorf("prune facts: %w", err)
+	}
+	return tx.Commit()
+}
+
+// ListFacts returns up to limit of the machine's most recent facts, newest first.
+func (db *DB) ListFacts(name string, limit int) ([]FactsRecord, error) {
+	rows, err := db.conn.Query(
+		"SELECT facts, recorded_at FROM machine_facts WHERE machine_name = ? ORDER BY id DESC LIMIT ?",
+		name, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var records []FactsRecord
+	for rows.Next() {
+		var data string
+		var r FactsRecord
+		if err := rows.Scan(&data, &r.RecordedAt); err != nil {
+			return nil, err
+		}
+		if f := decodeFacts(data); f != nil {
+			r.Facts = *f
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
@@ -0,0 +1,34 @@
+package db
+
+import "testing"
+
+func TestRecordFacts(t *testing.T) {
+	db := tempDB(t)
+	db.CreateMachine(&Machine{Name: "box", Owner: "a", LocalUser: "u", PublicKey: "k"})
+
+	for i := 0; i < MaxFactsHistory+5; i++ {
+		if err := db.RecordFacts("box", Facts{OS: "linux", UptimeSeconds: int64(i)}); err != nil {
+			t.Fatalf("record: %v", err)
+		}
+	}
+	m, _ := db.GetMachine("box")
+	if m.Facts == nil || m.Facts.UptimeSeconds != MaxFactsHistory+4 || m.FactsAt == nil {
+		t.Fatalf("expected latest facts on the machine, got %+v", m.Facts)
+	}
+
+	history, _ := db.ListFacts("box", 1000)
+	if len(history) != MaxFactsHistory {
+		t.Fatalf("expected history capped at %d, got %d", MaxFactsHistory, len(history))
+	}
+	if history[0].Facts.UptimeSeconds != MaxFactsHistory+4 {
+		t.Fatalf("expected newest first, got %+v", history[0])
+	}
+
+	db.RenameMachine("box", "server", 0)
+	if history, _ := db.ListFacts("server", 1); len(history) != 1 {
+		t.Fatal("expected history to follow rename")
+	}
+	if err := db.RecordFacts("ghost", Facts{}); err == nil {
+		t.Fatal("expected error for unknown machine")
+	}
+}
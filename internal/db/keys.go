@@ -0,0 +1,70 @@
+package db
+
+import (
+	"slices"
+	"time"
+)
+
+// KeyGrant describes one way a key can log into a machine.
+type KeyGrant struct {
+	Machine     string    `json:"machine"`
+	Kind        string    `json:"kind"` // "machine_key" or "access_key"
+	AccessKeyID int64     `json:"access_key_id,omitempty"`
+	Label       string    `json:"label,omitempty"`
+	Owner       string    `json:"owner"`
+	LocalUser   string    `json:"local_user"`
+	LocalUsers  []string  `json:"local_users"` // every local user the key can log in as
+	State       string    `json:"state"`       // the machine's state; only active machines are routed
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// FindKeyGrants lists every machine the fingerprint can reach, either as the
+// machine's own key or as one of its access keys. Grants on pending and
+// disabled machines are included with the machine's state, since they take
+// effect when it is enabled.
+func (db *DB) FindKeyGrants(fingerprint string) ([]KeyGrant, error) {
+	rows, err := db.conn.Query(`
+		SELECT name, 'machine_key', 0, '', owner, local_user, '', state, created_at
+		FROM machines WHERE fingerprint = ?
+		UNION ALL
+		SELECT m.name, 'access_key', k.id, k.label, m.owner, m.local_user, k.local_users, m.state, k.created_at
+		FROM access_keys k JOIN machines m ON m.name = k.machine_name
+		WHERE k.fingerprint = ?
+		ORDER BY 1, 2`,
+		fingerprint, fingerprint,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var grants []KeyGrant
+	for rows.Next() {
+		var g KeyGrant
+		var localUsers string
+		if err := rows.Scan(&g.Machine, &g.Kind, &g.AccessKeyID, &g.Label, &g.Owner, &g.LocalUser, &localUsers, &g.State, &g.CreatedAt); err != nil {
+			return nil, err
+		}
+		g.LocalUsers = splitList(localUsers)
+		grants = append(grants, g)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	// Machine keys and AllLocalUsers reach the default user plus every
+	// additional one; access keys without local users reach only the default
+	extra, err := db.AllMachineUsers()
+	if err != nil {
+		return nil, err
+	}
+	for i, g := range grants {
+		switch {
+		case g.Kind == "machine_key" || slices.Contains(g.LocalUsers, AllLocalUsers):
+			grants[i].LocalUsers = append([]string{g.LocalUser}, extra[g.Machine]...)
+		case len(g.LocalUsers) == 0:
+			grants[i].LocalUsers = []string{g.LocalUser}
+		}
+	}
+	return grants, nil
+}
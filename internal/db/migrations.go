@@ -1,6 +1,29 @@
 package db
 
-const schema = `
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/sshkey"
+)
+
+// migration is one numbered schema change, applied in its own transaction.
+// Databases created before versions were tracked start at version 0 and run
+// every migration, so the early ones must tolerate objects that already exist.
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+}
+
+var migrations = []migration{
+	{1, "initial schema", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
 CREATE TABLE IF NOT EXISTS machines (
     id            INTEGER PRIMARY KEY AUTOINCREMENT,
     name          TEXT NOT NULL UNIQUE,
@@ -19,14 +42,498 @@ CREATE TABLE IF NOT EXISTS access_keys (
     public_key    TEXT NOT NULL,
     created_at    DATETIME DEFAULT CURRENT_TIMESTAMP,
     UNIQUE(machine_name, public_key)
+);`)
+		return err
+	}},
+	{2, "key fingerprints", func(tx *sql.Tx) error {
+		for _, table := range []string{"machines", "access_keys"} {
+			if err := addColumn(tx, table, "fingerprint", "TEXT NOT NULL DEFAULT ''"); err != nil {
+				return err
+			}
+			if err := backfillFingerprints(tx, table); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{3, "revoked keys", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+CREATE TABLE IF NOT EXISTS revoked_keys (
+    id                  INTEGER PRIMARY KEY AUTOINCREMENT,
+    fingerprint         TEXT NOT NULL UNIQUE,
+    reason              TEXT NOT NULL DEFAULT '',
+    removed_machines    TEXT NOT NULL DEFAULT '',
+    removed_access_keys TEXT NOT NULL DEFAULT '',
+    revoked_at          DATETIME DEFAULT CURRENT_TIMESTAMP
+);`)
+		return err
+	}},
+	{4, "access keys follow renames", rebuildAccessKeys},
+	{5, "machine aliases", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+CREATE TABLE IF NOT EXISTS machine_aliases (
+    id            INTEGER PRIMARY KEY AUTOINCREMENT,
+    alias         TEXT NOT NULL UNIQUE,
+    machine_name  TEXT NOT NULL REFERENCES machines(name) ON UPDATE CASCADE ON DELETE CASCADE,
+    expires_at    DATETIME,
+    created_at    DATETIME DEFAULT CURRENT_TIMESTAMP
+);`)
+		return err
+	}},
+	{6, "local users", func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`
+CREATE TABLE IF NOT EXISTS machine_users (
+    id            INTEGER PRIMARY KEY AUTOINCREMENT,
+    machine_name  TEXT NOT NULL REFERENCES machines(name) ON UPDATE CASCADE ON DELETE CASCADE,
+    username      TEXT NOT NULL,
+    created_at    DATETIME DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(machine_name, username)
+);`); err != nil {
+			return err
+		}
+		return addColumn(tx, "access_keys", "local_users", "TEXT NOT NULL DEFAULT ''")
+	}},
+	{7, "machine approval state", func(tx *sql.Tx) error {
+		return addColumn(tx, "machines", "state", "TEXT NOT NULL DEFAULT 'active'")
+	}},
+	{8, "enrollment and machine tokens", func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`
+CREATE TABLE IF NOT EXISTS enrollment_tokens (
+    id            INTEGER PRIMARY KEY AUTOINCREMENT,
+    token_hash    TEXT NOT NULL UNIQUE,
+    owner         TEXT NOT NULL DEFAULT '',
+    name_prefix   TEXT NOT NULL DEFAULT '',
+    expires_at    DATETIME NOT NULL,
+    created_at    DATETIME DEFAULT CURRENT_TIMESTAMP,
+    used_at       DATETIME,
+    used_by       TEXT NOT NULL DEFAULT ''
+);`); err != nil {
+			return err
+		}
+		return addColumn(tx, "machines", "token_hash", "TEXT NOT NULL DEFAULT ''")
+	}},
+	{9, "machine tags and labels", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "machines", "tags", "TEXT NOT NULL DEFAULT ''"); err != nil {
+			return err
+		}
+		if err := addColumn(tx, "machines", "labels", "TEXT NOT NULL DEFAULT '{}'"); err != nil {
+			return err
+		}
+		return addColumn(tx, "enrollment_tokens", "tags", "TEXT NOT NULL DEFAULT ''")
+	}},
+	{10, "host facts", func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`
+CREATE TABLE IF NOT EXISTS machine_facts (
+    id            INTEGER PRIMARY KEY AUTOINCREMENT,
+    machine_name  TEXT NOT NULL REFERENCES machines(name) ON UPDATE CASCADE ON DELETE CASCADE,
+    facts         TEXT NOT NULL,
+    recorded_at   DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_machine_facts_machine ON machine_facts(machine_name, id);`); err != nil {
+			return err
+		}
+		if err := addColumn(tx, "machines", "facts", "TEXT NOT NULL DEFAULT ''"); err != nil {
+			return err
+		}
+		return addColumn(tx, "machines", "facts_at", "DATETIME")
+	}},
+	{11, "tunnel sessions", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+CREATE TABLE IF NOT EXISTS tunnel_sessions (
+    id            INTEGER PRIMARY KEY AUTOINCREMENT,
+    machine_name  TEXT NOT NULL REFERENCES machines(name) ON UPDATE CASCADE ON DELETE CASCADE,
+    started_at    DATETIME NOT NULL,
+    ended_at      DATETIME,
+    end_reason    TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS idx_tunnel_sessions_machine ON tunnel_sessions(machine_name, started_at);`)
+		return err
+	}},
+	{12, "alerts", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+CREATE TABLE IF NOT EXISTS alerts (
+    id             INTEGER PRIMARY KEY AUTOINCREMENT,
+    rule           TEXT NOT NULL,
+    machine_name   TEXT NOT NULL REFERENCES machines(name) ON UPDATE CASCADE ON DELETE CASCADE,
+    offline_since  DATETIME NOT NULL,
+    fired_at       DATETIME NOT NULL,
+    resolved_at    DATETIME
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_alerts_firing ON alerts(rule, machine_name) WHERE resolved_at IS NULL;`)
+		return err
+	}},
+	{13, "ssh sessions", func(tx *sql.Tx) error {
+		// No foreign key: the audit trail outlives deleted machines
+		_, err := tx.Exec(`
+CREATE TABLE IF NOT EXISTS ssh_sessions (
+    id               INTEGER PRIMARY KEY AUTOINCREMENT,
+    machine_name     TEXT NOT NULL,
+    username         TEXT NOT NULL,
+    local_user       TEXT NOT NULL,
+    source_ip        TEXT NOT NULL,
+    source_port      INTEGER NOT NULL,
+    key_fingerprint  TEXT NOT NULL DEFAULT '',
+    key_label        TEXT NOT NULL DEFAULT '',
+    started_at       DATETIME NOT NULL,
+    ended_at         DATETIME,
+    end_reason       TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS idx_ssh_sessions_machine ON ssh_sessions(machine_name, started_at);
+CREATE INDEX IF NOT EXISTS idx_ssh_sessions_source ON ssh_sessions(source_ip, source_port) WHERE ended_at IS NULL;`)
+		return err
+	}},
+	{14, "session recordings", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "machines", "record_sessions", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`
+CREATE TABLE IF NOT EXISTS session_recordings (
+    id          INTEGER PRIMARY KEY AUTOINCREMENT,
+    session_id  INTEGER NOT NULL REFERENCES ssh_sessions(id) ON DELETE CASCADE,
+    path        TEXT NOT NULL UNIQUE,
+    size        INTEGER NOT NULL,
+    started_at  DATETIME NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_session_recordings_session ON session_recordings(session_id);`)
+		return err
+	}},
+	{15, "access schedules", func(tx *sql.Tx) error {
+		for _, table := range []string{"machines", "access_keys"} {
+			if err := addColumn(tx, table, "schedule", "TEXT NOT NULL DEFAULT ''"); err != nil {
+				return err
+			}
+			if err := addColumn(tx, table, "schedule_timezone", "TEXT NOT NULL DEFAULT ''"); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{16, "access key restrictions", func(tx *sql.Tx) error {
+		columns := []struct{ name, def string }{
+			{"source_cidrs", "TEXT NOT NULL DEFAULT ''"},
+			{"force_command", "TEXT NOT NULL DEFAULT ''"},
+			{"sftp_only", "INTEGER NOT NULL DEFAULT 0"},
+			{"no_port_forwarding", "INTEGER NOT NULL DEFAULT 0"},
+			{"no_agent_forwarding", "INTEGER NOT NULL DEFAULT 0"},
+		}
+		for _, c := range columns {
+			if err := addColumn(tx, "access_keys", c.name, c.def); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{17, "access requests", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "access_keys", "expires_at", "DATETIME"); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`
+CREATE TABLE IF NOT EXISTS access_requests (
+    id                INTEGER PRIMARY KEY AUTOINCREMENT,
+    machine_name      TEXT NOT NULL REFERENCES machines(name) ON UPDATE CASCADE ON DELETE CASCADE,
+    requester         TEXT NOT NULL,
+    public_key        TEXT NOT NULL,
+    fingerprint       TEXT NOT NULL,
+    local_users       TEXT NOT NULL DEFAULT '',
+    reason            TEXT NOT NULL,
+    duration_seconds  INTEGER NOT NULL,
+    status            TEXT NOT NULL DEFAULT 'pending',
+    created_at        DATETIME DEFAULT CURRENT_TIMESTAMP,
+    decided_at        DATETIME,
+    decided_by        TEXT NOT NULL DEFAULT '',
+    note              TEXT NOT NULL DEFAULT '',
+    access_key_id     INTEGER,
+    key_expires_at    DATETIME
 );
-`
+CREATE INDEX IF NOT EXISTS idx_access_requests_machine ON access_requests(machine_name, status);`)
+		return err
+	}},
+	{18, "owner tokens", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+CREATE TABLE IF NOT EXISTS owner_tokens (
+    id            INTEGER PRIMARY KEY AUTOINCREMENT,
+    owner         TEXT NOT NULL,
+    token_hash    TEXT NOT NULL UNIQUE,
+    created_at    DATETIME DEFAULT CURRENT_TIMESTAMP,
+    last_used_at  DATETIME
+);`)
+		return err
+	}},
+	{19, "explicit all local users", func(tx *sql.Tx) error {
+		// Access keys without local users now reach only the default user.
+		// Keys added before keep the access they were given.
+		_, err := tx.Exec("UPDATE access_keys SET local_users = '*' WHERE local_users = '' AND expires_at IS NULL")
+		return err
+	}},
+	{20, "orphaned access keys", func(tx *sql.Tx) error {
+		// Databases rebuilt before the rebuild kept its orphans lack the table
+		_, err := tx.Exec(orphanedAccessKeysSchema)
+		return err
+	}},
+}
+
+// ErrSchemaTooNew is returned when the database was migrated by a newer binary.
+var ErrSchemaTooNew = errors.New("database schema is newer than this binary")
+
+// LatestSchemaVersion is the schema version this binary migrates to.
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
 
-func migrate(db *DB) error {
-	// Enable foreign keys
-	if _, err := db.conn.Exec("PRAGMA foreign_keys = ON"); err != nil {
+// MigrationStatus describes a known or applied migration.
+type MigrationStatus struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+}
+
+const migrationsTable = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+    version     INTEGER PRIMARY KEY,
+    name        TEXT NOT NULL,
+    applied_at  DATETIME DEFAULT CURRENT_TIMESTAMP
+);`
+
+// SchemaVersion returns the highest applied migration, or 0 if none are recorded.
+func (db *DB) SchemaVersion() (int, error) {
+	var exists int
+	err := db.conn.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations'").Scan(&exists)
+	if err != nil || exists == 0 {
+		return 0, err
+	}
+	var version int
+	err = db.conn.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	return version, err
+}
+
+// MigrationStatus lists every migration this binary knows about along with
+// any applied migrations it does not know about.
+func (db *DB) MigrationStatus() ([]MigrationStatus, error) {
+	applied := make(map[int]MigrationStatus)
+	version, err := db.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	if version > 0 {
+		rows, err := db.conn.Query("SELECT version, name, applied_at FROM schema_migrations ORDER BY version")
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var s MigrationStatus
+			var appliedAt time.Time
+			if err := rows.Scan(&s.Version, &s.Name, &appliedAt); err != nil {
+				return nil, err
+			}
+			s.AppliedAt = &appliedAt
+			applied[s.Version] = s
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	var statuses []MigrationStatus
+	for _, m := range migrations {
+		s := MigrationStatus{Version: m.version, Name: m.name}
+		if a, ok := applied[m.version]; ok {
+			s.AppliedAt = a.AppliedAt
+			delete(applied, m.version)
+		}
+		statuses = append(statuses, s)
+	}
+	for v := LatestSchemaVersion() + 1; len(applied) > 0; v++ {
+		if a, ok := applied[v]; ok {
+			statuses = append(statuses, a)
+			delete(applied, v)
+		}
+	}
+	return statuses, nil
+}
+
+// Migrate applies every pending migration in order and returns the ones it
+// applied. It refuses to touch a database migrated by a newer binary.
+func (db *DB) Migrate() ([]MigrationStatus, error) {
+	ctx := context.Background()
+	conn, err := db.conn.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, migrationsTable); err != nil {
+		return nil, err
+	}
+	var current int
+	if err := conn.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current); err != nil {
+		return nil, err
+	}
+	if current > LatestSchemaVersion() {
+		return nil, fmt.Errorf("%w: database is at version %d, binary supports up to %d", ErrSchemaTooNew, current, LatestSchemaVersion())
+	}
+
+	// Table rebuilds need foreign keys off, which cannot be changed inside a
+	// transaction, so the whole run happens on one connection with them disabled.
+	if _, err := conn.ExecContext(ctx, "PRAGMA foreign_keys = OFF"); err != nil {
+		return nil, err
+	}
+	defer conn.ExecContext(ctx, "PRAGMA foreign_keys = ON")
+
+	var applied []MigrationStatus
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return applied, err
+		}
+		if err := m.up(tx); err != nil {
+			tx.Rollback()
+			return applied, fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+		if _, err := tx.Exec("INSERT INTO schema_migrations (version, name) VALUES (?, ?)", m.version, m.name); err != nil {
+			tx.Rollback()
+			return applied, fmt.Errorf("record migration %d: %w", m.version, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return applied, fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+		log.Printf("Applied migration %d (%s)", m.version, m.name)
+		now := time.Now().UTC()
+		applied = append(applied, MigrationStatus{Version: m.version, Name: m.name, AppliedAt: &now})
+	}
+	return applied, nil
+}
+
+// addColumn adds a column to a table unless it already exists.
+func addColumn(tx *sql.Tx, table, column, definition string) error {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue any
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
 		return err
 	}
-	_, err := db.conn.Exec(schema)
+	rows.Close()
+
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
 	return err
 }
+
+// backfillFingerprints computes fingerprints for rows stored before they were tracked.
+func backfillFingerprints(tx *sql.Tx, table string) error {
+	rows, err := tx.Query(fmt.Sprintf("SELECT id, public_key FROM %s WHERE fingerprint = ''", table))
+	if err != nil {
+		return err
+	}
+	fingerprints := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var key string
+		if err := rows.Scan(&id, &key); err != nil {
+			rows.Close()
+			return err
+		}
+		if fp := sshkey.Fingerprint(key); fp != "" {
+			fingerprints[id] = fp
+		}
+	}
+	rows.Close()
+
+	for id, fp := range fingerprints {
+		if _, err := tx.Exec(fmt.Sprintf("UPDATE %s SET fingerprint = ? WHERE id = ?", table), fp, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// orphanedAccessKeysSchema holds access keys whose machine was gone when
+// access_keys was rebuilt. They grant nothing until restored to a machine.
+const orphanedAccessKeysSchema = `
+CREATE TABLE IF NOT EXISTS orphaned_access_keys (
+    id            INTEGER PRIMARY KEY,
+    machine_name  TEXT NOT NULL,
+    label         TEXT NOT NULL,
+    public_key    TEXT NOT NULL,
+    fingerprint   TEXT NOT NULL DEFAULT '',
+    created_at    DATETIME,
+    orphaned_at   DATETIME DEFAULT CURRENT_TIMESTAMP
+)`
+
+// rebuildAccessKeys recreates access_keys with ON UPDATE CASCADE on tables
+// created before renames carried access keys along. Keys orphaned by earlier
+// renames or deletions have no record of the machine they belong to now, and
+// attaching them to a guessed machine would grant access to the wrong host,
+// so they are moved to orphaned_access_keys for an admin to restore or
+// delete. It relies on Migrate running with foreign keys off.
+func rebuildAccessKeys(tx *sql.Tx) error {
+	var tableSQL string
+	if err := tx.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'access_keys'").Scan(&tableSQL); err != nil {
+		return err
+	}
+	if strings.Contains(tableSQL, "ON UPDATE CASCADE") {
+		return nil
+	}
+
+	rows, err := tx.Query("SELECT id, machine_name, label, fingerprint FROM access_keys WHERE machine_name NOT IN (SELECT name FROM machines)")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var id int64
+		var machine, label, fingerprint string
+		if err := rows.Scan(&id, &machine, &label, &fingerprint); err != nil {
+			rows.Close()
+			return err
+		}
+		log.Printf("Quarantining orphaned access key %d (%q, %s) for missing machine %q; restore it with 'bastion keys orphaned'", id, label, fingerprint, machine)
+	}
+	rows.Close()
+
+	stmts := []string{
+		orphanedAccessKeysSchema,
+		`INSERT INTO orphaned_access_keys (id, machine_name, label, public_key, fingerprint, created_at)
+    SELECT id, machine_name, label, public_key, fingerprint, created_at FROM access_keys
+    WHERE machine_name NOT IN (SELECT name FROM machines)`,
+		`CREATE TABLE access_keys_new (
+    id            INTEGER PRIMARY KEY AUTOINCREMENT,
+    machine_name  TEXT NOT NULL REFERENCES machines(name) ON UPDATE CASCADE ON DELETE CASCADE,
+    label         TEXT NOT NULL,
+    public_key    TEXT NOT NULL,
+    fingerprint   TEXT NOT NULL DEFAULT '',
+    created_at    DATETIME DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(machine_name, public_key)
+)`,
+		`INSERT INTO access_keys_new (id, machine_name, label, public_key, fingerprint, created_at)
+    SELECT id, machine_name, label, public_key, fingerprint, created_at FROM access_keys
+    WHERE machine_name IN (SELECT name FROM machines)`,
+		"DROP TABLE access_keys",
+		"ALTER TABLE access_keys_new RENAME TO access_keys",
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
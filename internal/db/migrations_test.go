@@ -0,0 +1,193 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// legacySchema is the schema shipped before access keys followed renames.
+const legacySchema = `
+CREATE TABLE machines (
+    id            INTEGER PRIMARY KEY AUTOINCREMENT,
+    name          TEXT NOT NULL UNIQUE,
+    owner         TEXT NOT NULL,
+    port          INTEGER NOT NULL UNIQUE,
+    local_user    TEXT NOT NULL,
+    public_key    TEXT NOT NULL,
+    created_at    DATETIME DEFAULT CURRENT_TIMESTAMP,
+    last_seen     DATETIME
+);
+CREATE TABLE access_keys (
+    id            INTEGER PRIMARY KEY AUTOINCREMENT,
+    machine_name  TEXT NOT NULL REFERENCES machines(name) ON DELETE CASCADE,
+    label         TEXT NOT NULL,
+    public_key    TEXT NOT NULL,
+    created_at    DATETIME DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(machine_name, public_key)
+);
+INSERT INTO machines (name, owner, port, local_user, public_key) VALUES ('renamed', 'a', 10022, 'a', 'k');
+INSERT INTO access_keys (machine_name, label, public_key) VALUES ('renamed', 'kept', 'k1');
+INSERT INTO access_keys (machine_name, label, public_key) VALUES ('before-rename', 'orphan', 'k2');
+`
+
+func TestMigrateRepairsLegacyAccessKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legacy.db")
+	raw, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("open raw: %v", err)
+	}
+	if _, err := raw.Exec(legacySchema); err != nil {
+		t.Fatalf("legacy schema: %v", err)
+	}
+	raw.Close()
+
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer db.Close()
+
+	var tableSQL string
+	db.conn.QueryRow("SELECT sql FROM sqlite_master WHERE name = 'access_keys'").Scan(&tableSQL)
+	if !strings.Contains(tableSQL, "ON UPDATE CASCADE") {
+		t.Fatalf("expected rebuilt access_keys table, got %s", tableSQL)
+	}
+
+	var orphans int
+	db.conn.QueryRow("SELECT COUNT(*) FROM access_keys WHERE machine_name = 'before-rename'").Scan(&orphans)
+	if orphans != 0 {
+		t.Fatalf("expected orphaned access key out of access_keys, got %d", orphans)
+	}
+	quarantined, err := db.ListOrphanedAccessKeys()
+	if err != nil || len(quarantined) != 1 || quarantined[0].MachineName != "before-rename" || quarantined[0].Label != "orphan" {
+		t.Fatalf("expected the orphaned key quarantined, got %+v %v", quarantined, err)
+	}
+
+	keys, _ := db.ListAccessKeys("renamed")
+	if len(keys) != 1 || keys[0].Label != "kept" {
+		t.Fatalf("expected valid access key to survive, got %+v", keys)
+	}
+	// Keys from before local users defaulted to the default user keep
+	// reaching every user
+	if len(keys[0].LocalUsers) != 1 || keys[0].LocalUsers[0] != AllLocalUsers {
+		t.Fatalf("expected the existing key to allow every local user, got %v", keys[0].LocalUsers)
+	}
+
+	// Renames now carry the surviving key along
+	if err := db.RenameMachine("renamed", "renamed-again", 0); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	if keys, _ := db.ListAccessKeys("renamed-again"); len(keys) != 1 {
+		t.Fatalf("expected access key to follow rename, got %d", len(keys))
+	}
+
+	// The orphan is restored where an alias says its machine went
+	orphan := quarantined[0]
+	if _, err := db.RestoreOrphanedAccessKey(orphan.ID, ""); !errors.Is(err, ErrRenameUnknown) {
+		t.Fatalf("expected no machine inferred without an alias, got %v", err)
+	}
+	db.AddAlias("renamed-again", "before-rename")
+	restored, err := db.RestoreOrphanedAccessKey(orphan.ID, "")
+	if err != nil || restored.MachineName != "renamed-again" || restored.Label != "orphan" {
+		t.Fatalf("expected the key restored to renamed-again, got %+v %v", restored, err)
+	}
+	if keys, _ := db.ListAccessKeys("renamed-again"); len(keys) != 2 {
+		t.Fatalf("expected the restored key on the machine, got %+v", keys)
+	}
+	if left, _ := db.ListOrphanedAccessKeys(); len(left) != 0 {
+		t.Fatalf("expected the quarantine emptied, got %+v", left)
+	}
+}
+
+func TestMigrateRecordsVersions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	version, _ := db.SchemaVersion()
+	if version != LatestSchemaVersion() {
+		t.Fatalf("expected version %d, got %d", LatestSchemaVersion(), version)
+	}
+	db.Close()
+
+	// Reopening applies nothing
+	db, err = OpenWithoutMigrating(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer db.Close()
+	applied, err := db.Migrate()
+	if err != nil || len(applied) != 0 {
+		t.Fatalf("expected no pending migrations, got %+v (%v)", applied, err)
+	}
+	statuses, _ := db.MigrationStatus()
+	if len(statuses) != len(migrations) {
+		t.Fatalf("expected %d statuses, got %d", len(migrations), len(statuses))
+	}
+	for _, s := range statuses {
+		if s.AppliedAt == nil {
+			t.Errorf("migration %d not recorded as applied", s.Version)
+		}
+	}
+}
+
+func TestMigrateRefusesNewerSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	db.conn.Exec("INSERT INTO schema_migrations (version, name) VALUES (?, 'from the future')", LatestSchemaVersion()+1)
+	db.Close()
+
+	if _, err := Open(path); !errors.Is(err, ErrSchemaTooNew) {
+		t.Fatalf("expected ErrSchemaTooNew, got %v", err)
+	}
+
+	db, _ = OpenWithoutMigrating(path)
+	defer db.Close()
+	statuses, err := db.MigrationStatus()
+	if err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	if last := statuses[len(statuses)-1]; last.Name != "from the future" || last.AppliedAt == nil {
+		t.Fatalf("expected unknown migration in status, got %+v", last)
+	}
+}
+
+func TestMigrateRollsBackFailedMigration(t *testing.T) {
+	saved := migrations
+	t.Cleanup(func() { migrations = saved })
+	migrations = append(append([]migration{}, saved...), migration{
+		version: LatestSchemaVersion() + 1,
+		name:    "broken",
+		up: func(tx *sql.Tx) error {
+			if _, err := tx.Exec("CREATE TABLE half_done (id INTEGER)"); err != nil {
+				return err
+			}
+			_, err := tx.Exec("ALTER TABLE no_such_table ADD COLUMN x TEXT")
+			return err
+		},
+	})
+
+	path := filepath.Join(t.TempDir(), "test.db")
+	if _, err := Open(path); err == nil {
+		t.Fatal("expected broken migration to fail")
+	}
+
+	db, _ := OpenWithoutMigrating(path)
+	defer db.Close()
+	version, _ := db.SchemaVersion()
+	if want := saved[len(saved)-1].version; version != want {
+		t.Fatalf("expected earlier migrations to stay applied at %d, got %d", want, version)
+	}
+	var n int
+	db.conn.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'half_done'").Scan(&n)
+	if n != 0 {
+		t.Fatal("expected failed migration to be rolled back")
+	}
+}
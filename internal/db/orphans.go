@@ -0,0 +1,122 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// OrphanedAccessKey is an access key whose machine no longer existed when
+// access keys were made to follow renames. MachineName is the name the key
+// was added to. It grants nothing until restored to a machine.
+type OrphanedAccessKey struct {
+	ID          int64      `json:"id"`
+	MachineName string     `json:"machine_name"`
+	Label       string     `json:"label"`
+	PublicKey   string     `json:"public_key"`
+	Fingerprint string     `json:"fingerprint"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
+	OrphanedAt  time.Time  `json:"orphaned_at"`
+}
+
+// ErrRenameUnknown is returned when restoring an orphaned key without a
+// machine and no alias says where its machine went.
+var ErrRenameUnknown = errors.New("no machine has the key's old machine name as an alias; name the machine to restore it to")
+
+const orphanedAccessKeyColumns = "id, machine_name, label, public_key, fingerprint, created_at, orphaned_at"
+
+func scanOrphanedAccessKey(row interface{ Scan(...any) error }, k *OrphanedAccessKey) error {
+	return row.Scan(&k.ID, &k.MachineName, &k.Label, &k.PublicKey, &k.Fingerprint, &k.CreatedAt, &k.OrphanedAt)
+}
+
+func (db *DB) ListOrphanedAccessKeys() ([]OrphanedAccessKey, error) {
+	rows, err := db.conn.Query("SELECT " + orphanedAccessKeyColumns + " FROM orphaned_access_keys ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := []OrphanedAccessKey{}
+	for rows.Next() {
+		var k OrphanedAccessKey
+		if err := scanOrphanedAccessKey(rows, &k); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// GetOrphanedAccessKey returns the orphaned key, or nil if there is none.
+func (db *DB) GetOrphanedAccessKey(id int64) (*OrphanedAccessKey, error) {
+	k := &OrphanedAccessKey{}
+	err := scanOrphanedAccessKey(db.conn.QueryRow("SELECT "+orphanedAccessKeyColumns+" FROM orphaned_access_keys WHERE id = ?", id), k)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// RestoreOrphanedAccessKey moves an orphaned key back into access_keys on
+// machineName in one transaction. With an empty machineName the machine is
+// inferred from an alias matching the key's old machine name, as renames
+// leave, or ErrRenameUnknown is returned. The key may log in as every local
+// user, as keys could before they were orphaned.
+func (db *DB) RestoreOrphanedAccessKey(id int64, machineName string) (*AccessKey, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	o := &OrphanedAccessKey{}
+	if err := scanOrphanedAccessKey(tx.QueryRow("SELECT "+orphanedAccessKeyColumns+" FROM orphaned_access_keys WHERE id = ?", id), o); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("orphaned access key %d not found", id)
+		}
+		return nil, err
+	}
+	if machineName == "" {
+		err := tx.QueryRow("SELECT machine_name FROM machine_aliases WHERE alias = ? AND (expires_at IS NULL OR expires_at > CURRENT_TIMESTAMP)",
+			o.MachineName).Scan(&machineName)
+		if err == sql.ErrNoRows {
+			return nil, ErrRenameUnknown
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	k := &AccessKey{MachineName: machineName, Label: o.Label, PublicKey: o.PublicKey, Fingerprint: o.Fingerprint,
+		LocalUsers: []string{AllLocalUsers}, CreatedAt: time.Now().UTC()}
+	result, err := tx.Exec(
+		"INSERT INTO access_keys (machine_name, label, public_key, fingerprint, local_users) VALUES (?, ?, ?, ?, ?)",
+		k.MachineName, k.Label, k.PublicKey, k.Fingerprint, AllLocalUsers,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("restore access key: %w", err)
+	}
+	k.ID, _ = result.LastInsertId()
+	if _, err := tx.Exec("DELETE FROM orphaned_access_keys WHERE id = ?", id); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// DeleteOrphanedAccessKey discards an orphaned key for good.
+func (db *DB) DeleteOrphanedAccessKey(id int64) error {
+	result, err := db.conn.Exec("DELETE FROM orphaned_access_keys WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("orphaned access key %d not found", id)
+	}
+	return nil
+}
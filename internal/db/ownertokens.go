@@ -0,0 +1,81 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// OwnerToken lets a machine owner decide access requests for their machines
+// without the API key. Only a hash of the token is stored.
+type OwnerToken struct {
+	ID         int64      `json:"id"`
+	Owner      string     `json:"owner"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+const ownerTokenColumns = "id, owner, created_at, last_used_at"
+
+func scanOwnerToken(row interface{ Scan(...any) error }, t *OwnerToken) error {
+	return row.Scan(&t.ID, &t.Owner, &t.CreatedAt, &t.LastUsedAt)
+}
+
+func (db *DB) CreateOwnerToken(tokenHash, owner string) (*OwnerToken, error) {
+	result, err := db.conn.Exec("INSERT INTO owner_tokens (token_hash, owner) VALUES (?, ?)", tokenHash, owner)
+	if err != nil {
+		return nil, fmt.Errorf("create owner token: %w", err)
+	}
+	id, _ := result.LastInsertId()
+	t := &OwnerToken{}
+	if err := scanOwnerToken(db.conn.QueryRow("SELECT "+ownerTokenColumns+" FROM owner_tokens WHERE id = ?", id), t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// OwnerByToken returns the owner a token hash belongs to, recording the use,
+// or "" if there is none.
+func (db *DB) OwnerByToken(tokenHash string) (string, error) {
+	var owner string
+	err := db.conn.QueryRow("SELECT owner FROM owner_tokens WHERE token_hash = ?", tokenHash).Scan(&owner)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if _, err := db.conn.Exec("UPDATE owner_tokens SET last_used_at = CURRENT_TIMESTAMP WHERE token_hash = ?", tokenHash); err != nil {
+		return "", err
+	}
+	return owner, nil
+}
+
+func (db *DB) ListOwnerTokens() ([]OwnerToken, error) {
+	rows, err := db.conn.Query("SELECT " + ownerTokenColumns + " FROM owner_tokens ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tokens := []OwnerToken{}
+	for rows.Next() {
+		var t OwnerToken
+		if err := scanOwnerToken(rows, &t); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// DeleteOwnerToken revokes an owner token.
+func (db *DB) DeleteOwnerToken(id int64) error {
+	result, err := db.conn.Exec("DELETE FROM owner_tokens WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("owner token %d not found", id)
+	}
+	return nil
+}
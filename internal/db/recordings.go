@@ -0,0 +1,106 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+// Recording is an indexed session recording. Path is relative to the
+// recordings directory.
+type Recording struct {
+	ID        int64     `json:"id"`
+	SessionID int64     `json:"session_id"`
+	Path      string    `json:"-"`
+	Size      int64     `json:"size"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// AddRecording indexes a recording of the session.
+func (db *DB) AddRecording(sessionID int64, path string, size int64, startedAt time.Time) error {
+	_, err := db.conn.Exec(
+		"INSERT INTO session_recordings (session_id, path, size, started_at) VALUES (?, ?, ?, ?)",
+		sessionID, path, size, sqlTime(startedAt),
+	)
+	if err != nil {
+		return fmt.Errorf("add recording: %w", err)
+	}
+	return nil
+}
+
+// SetRecordingSize updates the size of a recording that is still growing.
+func (db *DB) SetRecordingSize(path string, size int64) error {
+	_, err := db.conn.Exec("UPDATE session_recordings SET size = ? WHERE path = ?", size, path)
+	return err
+}
+
+// IndexedRecordings returns the size of every indexed recording by path.
+func (db *DB) IndexedRecordings() (map[string]int64, error) {
+	rows, err := db.conn.Query("SELECT path, size FROM session_recordings")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sizes := make(map[string]int64)
+	for rows.Next() {
+		var path string
+		var size int64
+		if err := rows.Scan(&path, &size); err != nil {
+			return nil, err
+		}
+		sizes[path] = size
+	}
+	return sizes, rows.Err()
+}
+
+// ListRecordings returns the session's recordings, oldest first.
+func (db *DB) ListRecordings(sessionID int64) ([]Recording, error) {
+	rows, err := db.conn.Query(
+		"SELECT id, session_id, path, size, started_at FROM session_recordings WHERE session_id = ? ORDER BY started_at, id",
+		sessionID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var recordings []Recording
+	for rows.Next() {
+		var r Recording
+		if err := rows.Scan(&r.ID, &r.SessionID, &r.Path, &r.Size, &r.StartedAt); err != nil {
+			return nil, err
+		}
+		recordings = append(recordings, r)
+	}
+	return recordings, rows.Err()
+}
+
+// DeleteRecording removes a recording from the index.
+func (db *DB) DeleteRecording(path string) error {
+	_, err := db.conn.Exec("DELETE FROM session_recordings WHERE path = ?", path)
+	return err
+}
+
+// SessionsForRecording returns the sessions under username that had started
+// by the time a recording started at and were still open then, latest first.
+// sshpiperd names recordings by username and time only, so a recording can
+// only be attributed when exactly one session is returned.
+func (db *DB) SessionsForRecording(username string, at time.Time) ([]SSHSession, error) {
+	// Times are stored to the second; allow for the recording being named
+	// in the second before the session was logged
+	rows, err := db.conn.Query(
+		"SELECT "+sshSessionColumns+", 0 FROM ssh_sessions WHERE username = ? AND started_at <= ? AND (ended_at IS NULL OR ended_at >= ?) ORDER BY started_at DESC, id DESC",
+		username, sqlTime(at.Add(time.Second)), sqlTime(at),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var sessions []SSHSession
+	for rows.Next() {
+		s, err := scanSSHSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, *s)
+	}
+	return sessions, rows.Err()
+}
@@ -0,0 +1,70 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecordings(t *testing.T) {
+	db := tempDB(t)
+	db.CreateMachine(&Machine{Name: "box", Owner: "a", LocalUser: "u", PublicKey: "k"})
+	if err := db.SetRecordSessions("box", true); err != nil {
+		t.Fatalf("set record sessions: %v", err)
+	}
+	if m, _ := db.GetMachine("box"); !m.RecordSessions {
+		t.Fatal("expected recording enabled")
+	}
+	if err := db.SetRecordSessions("ghost", true); err == nil {
+		t.Fatal("expected an error for an unknown machine")
+	}
+
+	now := time.Now().Truncate(time.Second)
+	older := &SSHSession{MachineName: "box", Username: "box", LocalUser: "u", SourceIP: "203.0.113.7", SourcePort: 1, StartedAt: now.Add(-time.Hour)}
+	newer := &SSHSession{MachineName: "box", Username: "box", LocalUser: "u", SourceIP: "203.0.113.7", SourcePort: 2, StartedAt: now.Add(-10 * time.Minute)}
+	db.StartSSHSession(older)
+	db.EndSSHSession("203.0.113.7", 1, now.Add(-30*time.Minute), "EOF")
+	db.StartSSHSession(newer)
+
+	// Recordings are attributed to the session open when they started
+	for at, want := range map[time.Time]int64{
+		now.Add(-50 * time.Minute): older.ID,
+		now.Add(-5 * time.Minute):  newer.ID,
+		now.Add(-20 * time.Minute): 0,
+	} {
+		sessions, err := db.SessionsForRecording("box", at)
+		if err != nil {
+			t.Fatalf("find session: %v", err)
+		}
+		if (len(sessions) != 0 || want != 0) && (len(sessions) != 1 || sessions[0].ID != want) {
+			t.Errorf("recording at %v: expected session %d, got %+v", at, want, sessions)
+		}
+	}
+	if sessions, _ := db.SessionsForRecording("bob+box", now); len(sessions) != 0 {
+		t.Fatalf("expected no session for another username, got %+v", sessions)
+	}
+	// A second session under the same username makes the match ambiguous
+	concurrent := &SSHSession{MachineName: "box", Username: "box", LocalUser: "u", SourceIP: "198.51.100.9", SourcePort: 3, StartedAt: now.Add(-8 * time.Minute)}
+	db.StartSSHSession(concurrent)
+	if sessions, _ := db.SessionsForRecording("box", now.Add(-5*time.Minute)); len(sessions) != 2 || sessions[0].ID != concurrent.ID {
+		t.Fatalf("expected both open sessions, latest first, got %+v", sessions)
+	}
+
+	db.AddRecording(newer.ID, "box/1-shell.cast", 100, now.Add(-5*time.Minute))
+	if err := db.AddRecording(newer.ID, "box/1-shell.cast", 100, now); err == nil {
+		t.Fatal("expected a recording to be indexed once")
+	}
+	db.SetRecordingSize("box/1-shell.cast", 250)
+	if sizes, _ := db.IndexedRecordings(); len(sizes) != 1 || sizes["box/1-shell.cast"] != 250 {
+		t.Fatalf("expected the size updated in place, got %v", sizes)
+	}
+	if s, _ := db.GetSSHSession(newer.ID); s == nil || s.Recordings != 1 {
+		t.Fatalf("expected the session to count its recording, got %+v", s)
+	}
+	if recs, _ := db.ListRecordings(newer.ID); len(recs) != 1 || recs[0].Size != 250 {
+		t.Fatalf("unexpected recordings %+v", recs)
+	}
+	db.DeleteRecording("box/1-shell.cast")
+	if recs, _ := db.ListRecordings(newer.ID); len(recs) != 0 {
+		t.Fatalf("expected the recording removed, got %+v", recs)
+	}
+}
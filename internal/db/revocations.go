@@ -0,0 +1,186 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type RevokedKey struct {
+	ID                int64     `json:"id"`
+	Fingerprint       string    `json:"fingerprint"`
+	Reason            string    `json:"reason"`
+	RemovedMachines   []string  `json:"removed_machines"`
+	RemovedAccessKeys []int64   `json:"removed_access_keys"`
+	RevokedAt         time.Time `json:"revoked_at"`
+}
+
+// ErrAlreadyRevoked is returned by RevokeKey when the fingerprint is already on the list.
+var ErrAlreadyRevoked = fmt.Errorf("key already revoked")
+
+// RevokeKey adds a fingerprint to the revocation list and, in the same
+// transaction, deletes every machine and access key using it. Deleted access
+// keys are returned with their machine names so callers can clean up files.
+func (db *DB) RevokeKey(fingerprint, reason string) (*RevokedKey, []AccessKey, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	var exists int
+	err = tx.QueryRow("SELECT 1 FROM revoked_keys WHERE fingerprint = ?", fingerprint).Scan(&exists)
+	if err == nil {
+		return nil, nil, ErrAlreadyRevoked
+	}
+	if err != sql.ErrNoRows {
+		return nil, nil, err
+	}
+
+	rk := &RevokedKey{Fingerprint: fingerprint, Reason: reason, RemovedMachines: []string{}, RemovedAccessKeys: []int64{}}
+
+	rows, err := tx.Query("SELECT name FROM machines WHERE fingerprint = ?", fingerprint)
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		rk.RemovedMachines = append(rk.RemovedMachines, name)
+	}
+	rows.Close()
+
+	// Access keys that match directly, plus those attached to machines being removed
+	var removedKeys []AccessKey
+	rows, err = tx.Query(
+		"SELECT "+accessKeyColumns+" FROM access_keys WHERE fingerprint = ? OR machine_name IN (SELECT name FROM machines WHERE fingerprint = ?)",
+		fingerprint, fingerprint,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var k AccessKey
+		if err := scanAccessKey(rows, &k); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		if k.Fingerprint == fingerprint {
+			rk.RemovedAccessKeys = append(rk.RemovedAccessKeys, k.ID)
+		}
+		removedKeys = append(removedKeys, k)
+	}
+	rows.Close()
+
+	if _, err := tx.Exec("DELETE FROM access_keys WHERE fingerprint = ?", fingerprint); err != nil {
+		return nil, nil, fmt.Errorf("delete access keys: %w", err)
+	}
+	if _, err := tx.Exec("DELETE FROM access_keys WHERE machine_name IN (SELECT name FROM machines WHERE fingerprint = ?)", fingerprint); err != nil {
+		return nil, nil, fmt.Errorf("delete machine access keys: %w", err)
+	}
+	if _, err := tx.Exec("DELETE FROM machines WHERE fingerprint = ?", fingerprint); err != nil {
+		return nil, nil, fmt.Errorf("delete machines: %w", err)
+	}
+
+	result, err := tx.Exec(
+		"INSERT INTO revoked_keys (fingerprint, reason, removed_machines, removed_access_keys) VALUES (?, ?, ?, ?)",
+		fingerprint, reason, strings.Join(rk.RemovedMachines, ","), joinIDs(rk.RemovedAccessKeys),
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("record revocation: %w", err)
+	}
+	rk.ID, _ = result.LastInsertId()
+	if err := tx.QueryRow("SELECT revoked_at FROM revoked_keys WHERE id = ?", rk.ID).Scan(&rk.RevokedAt); err != nil {
+		return nil, nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+	return rk, removedKeys, nil
+}
+
+func (db *DB) IsRevoked(fingerprint string) (bool, error) {
+	var exists int
+	err := db.conn.QueryRow("SELECT 1 FROM revoked_keys WHERE fingerprint = ?", fingerprint).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (db *DB) ListRevokedKeys() ([]RevokedKey, error) {
+	rows, err := db.conn.Query(
+		"SELECT id, fingerprint, reason, removed_machines, removed_access_keys, revoked_at FROM revoked_keys ORDER BY id",
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []RevokedKey
+	for rows.Next() {
+		var k RevokedKey
+		var machines, accessKeys string
+		if err := rows.Scan(&k.ID, &k.Fingerprint, &k.Reason, &machines, &accessKeys, &k.RevokedAt); err != nil {
+			return nil, err
+		}
+		k.RemovedMachines = splitList(machines)
+		k.RemovedAccessKeys = splitIDs(accessKeys)
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// RevokedFingerprints returns every revoked fingerprint.
+func (db *DB) RevokedFingerprints() ([]string, error) {
+	rows, err := db.conn.Query("SELECT fingerprint FROM revoked_keys")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var fps []string
+	for rows.Next() {
+		var fp string
+		if err := rows.Scan(&fp); err != nil {
+			return nil, err
+		}
+		fps = append(fps, fp)
+	}
+	return fps, nil
+}
+
+func joinIDs(ids []int64) string {
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = fmt.Sprintf("%d", id)
+	}
+	return strings.Join(parts, ",")
+}
+
+func splitIDs(s string) []int64 {
+	ids := []int64{}
+	for _, part := range splitList(s) {
+		var id int64
+		if _, err := fmt.Sscanf(part, "%d", &id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func splitList(s string) []string {
+	items := []string{}
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			items = append(items, part)
+		}
+	}
+	return items
+}
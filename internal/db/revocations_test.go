@@ -0,0 +1,56 @@
+package db
+
+import "testing"
+
+func TestRevokeKeyRemovesMatches(t *testing.T) {
+	db := tempDB(t)
+
+	db.CreateMachine(&Machine{Name: "m1", Owner: "a", LocalUser: "a", PublicKey: "k1", Fingerprint: "SHA256:bad"})
+	db.CreateMachine(&Machine{Name: "m2", Owner: "b", LocalUser: "b", PublicKey: "k2", Fingerprint: "SHA256:good"})
+	db.conn.Exec("INSERT INTO access_keys (machine_name, label, public_key, fingerprint) VALUES ('m1', 'other', 'k3', 'SHA256:other')")
+	db.conn.Exec("INSERT INTO access_keys (machine_name, label, public_key, fingerprint) VALUES ('m2', 'laptop', 'k4', 'SHA256:bad')")
+	db.conn.Exec("INSERT INTO access_keys (machine_name, label, public_key, fingerprint) VALUES ('m2', 'phone', 'k5', 'SHA256:ok')")
+
+	rk, removed, err := db.RevokeKey("SHA256:bad", "laptop stolen")
+	if err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+	if len(rk.RemovedMachines) != 1 || rk.RemovedMachines[0] != "m1" {
+		t.Fatalf("expected m1 removed, got %v", rk.RemovedMachines)
+	}
+	if len(rk.RemovedAccessKeys) != 1 {
+		t.Fatalf("expected 1 matching access key, got %v", rk.RemovedAccessKeys)
+	}
+	// The matching key on m2 and m1's own access key both need file cleanup
+	if len(removed) != 2 {
+		t.Fatalf("expected 2 deleted access keys, got %d", len(removed))
+	}
+
+	if m, _ := db.GetMachine("m1"); m != nil {
+		t.Fatal("expected m1 to be deleted")
+	}
+	keys, _ := db.ListAccessKeys("m2")
+	if len(keys) != 1 || keys[0].Label != "phone" {
+		t.Fatalf("expected only phone key left on m2, got %+v", keys)
+	}
+
+	revoked, _ := db.IsRevoked("SHA256:bad")
+	if !revoked {
+		t.Fatal("expected fingerprint to be revoked")
+	}
+	list, _ := db.ListRevokedKeys()
+	if len(list) != 1 || list[0].Reason != "laptop stolen" || len(list[0].RemovedMachines) != 1 {
+		t.Fatalf("unexpected revocation list: %+v", list)
+	}
+}
+
+func TestRevokeKeyTwice(t *testing.T) {
+	db := tempDB(t)
+
+	if _, _, err := db.RevokeKey("SHA256:x", ""); err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+	if _, _, err := db.RevokeKey("SHA256:x", ""); err != ErrAlreadyRevoked {
+		t.Fatalf("expected ErrAlreadyRevoked, got %v", err)
+	}
+}
@@ -0,0 +1,143 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+// TunnelSession is one period during which a machine's tunnel was connected,
+// as reported by the client. EndedAt is nil while it is connected.
+type TunnelSession struct {
+	ID          int64      `json:"id"`
+	MachineName string     `json:"machine_name"`
+	StartedAt   time.Time  `json:"started_at"`
+	EndedAt     *time.Time `json:"ended_at,omitempty"`
+	EndReason   string     `json:"end_reason,omitempty"`
+}
+
+// StartTunnelSession records a connect. Any session the machine left open
+// (its disconnect was never reported) is closed at the new start.
+func (db *DB) StartTunnelSession(name string, at time.Time) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(
+		"UPDATE tunnel_sessions SET ended_at = ?, end_reason = 'superseded' WHERE machine_name = ? AND ended_at IS NULL",
+		sqlTime(at), name,
+	); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO tunnel_sessions (machine_name, started_at) VALUES (?, ?)", name, sqlTime(at)); err != nil {
+		return fmt.Errorf("start tunnel session: %w", err)
+	}
+	return tx.Commit()
+}
+
+// StaleTunnelReason ends a session closed by CloseStaleTunnelSessions.
+const StaleTunnelReason = "heartbeats stopped"
+
+// EndTunnelSession records a disconnect. It closes the open session, or the
+// latest one if CloseStaleTunnelSessions closed it, or, if the connect was
+// never reported, records the whole session from its duration.
+func (db *DB) EndTunnelSession(name string, at time.Time, duration time.Duration, reason string) error {
+	result, err := db.conn.Exec(`
+		UPDATE tunnel_sessions SET ended_at = ?, end_reason = ?
+		WHERE id = (SELECT id FROM tunnel_sessions WHERE machine_name = ? ORDER BY started_at DESC LIMIT 1)
+		AND (ended_at IS NULL OR end_reason = ?)`,
+		sqlTime(at), reason, name, StaleTunnelReason,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		return nil
+	}
+	_, err = db.conn.Exec(
+		"INSERT INTO tunnel_sessions (machine_name, started_at, ended_at, end_reason) VALUES (?, ?, ?, ?)",
+		name, sqlTime(at.Add(-duration)), sqlTime(at), reason,
+	)
+	if err != nil {
+		return fmt.Errorf("end tunnel session: %w", err)
+	}
+	return nil
+}
+
+// CloseStaleTunnelSessions ends open sessions whose machine has sent no
+// heartbeat since before: the client died without reporting a disconnect.
+// Each ends grace after the later of the last heartbeat and its start, with
+// StaleTunnelReason. It returns how many were closed.
+func (db *DB) CloseStaleTunnelSessions(before time.Time, grace time.Duration) (int64, error) {
+	rows, err := db.conn.Query(`
+		SELECT s.id, s.started_at, m.last_seen FROM tunnel_sessions s
+		LEFT JOIN machines m ON m.name = s.machine_name
+		WHERE s.ended_at IS NULL`)
+	if err != nil {
+		return 0, err
+	}
+	ends := make(map[int64]time.Time)
+	for rows.Next() {
+		var id int64
+		var started time.Time
+		var lastSeen *time.Time
+		if err := rows.Scan(&id, &started, &lastSeen); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		last := started
+		if lastSeen != nil && lastSeen.After(started) {
+			last = *lastSeen
+		}
+		if last.Before(before) {
+			ends[id] = last.Add(grace)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for id, end := range ends {
+		if _, err := db.conn.Exec("UPDATE tunnel_sessions SET ended_at = ?, end_reason = ? WHERE id = ? AND ended_at IS NULL",
+			sqlTime(end), StaleTunnelReason, id); err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(ends)), nil
+}
+
+// ListTunnelSessions returns the machine's sessions that were connected at or
+// after since, oldest first.
+func (db *DB) ListTunnelSessions(name string, since time.Time) ([]TunnelSession, error) {
+	rows, err := db.conn.Query(`
+		SELECT id, machine_name, started_at, ended_at, end_reason FROM tunnel_sessions
+		WHERE machine_name = ? AND (ended_at IS NULL OR ended_at >= ?)
+		ORDER BY started_at`,
+		name, sqlTime(since),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var sessions []TunnelSession
+	for rows.Next() {
+		var s TunnelSession
+		if err := rows.Scan(&s.ID, &s.MachineName, &s.StartedAt, &s.EndedAt, &s.EndReason); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// PurgeTunnelSessions deletes sessions that ended before the cutoff and
+// returns how many were removed.
+func (db *DB) PurgeTunnelSessions(before time.Time) (int64, error) {
+	result, err := db.conn.Exec("DELETE FROM tunnel_sessions WHERE ended_at IS NOT NULL AND ended_at < ?", sqlTime(before))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,63 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTunnelSessions(t *testing.T) {
+	db := tempDB(t)
+	db.CreateMachine(&Machine{Name: "box", Owner: "a", LocalUser: "u", PublicKey: "k"})
+	t0 := time.Now().Add(-10 * time.Hour).Truncate(time.Second)
+
+	db.StartTunnelSession("box", t0)
+	db.EndTunnelSession("box", t0.Add(time.Hour), time.Hour, "exit status 255")
+	// Disconnect whose connect was lost
+	db.EndTunnelSession("box", t0.Add(3*time.Hour), 30*time.Minute, "exit status 255")
+	// Connect whose disconnect was lost, then another connect
+	db.StartTunnelSession("box", t0.Add(4*time.Hour))
+	db.StartTunnelSession("box", t0.Add(6*time.Hour))
+
+	sessions, err := db.ListTunnelSessions("box", t0)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(sessions) != 4 {
+		t.Fatalf("expected 4 sessions, got %+v", sessions)
+	}
+	if !sessions[1].StartedAt.Equal(t0.Add(150 * time.Minute)) {
+		t.Fatalf("expected start derived from duration, got %v", sessions[1].StartedAt)
+	}
+	if sessions[2].EndReason != "superseded" || !sessions[2].EndedAt.Equal(t0.Add(6*time.Hour)) {
+		t.Fatalf("expected open session to be superseded, got %+v", sessions[2])
+	}
+	if sessions[3].EndedAt != nil {
+		t.Fatal("expected the latest session to be open")
+	}
+
+	// The client dies: its session ends a heartbeat interval after it was
+	// last seen, and a late disconnect report still corrects the end
+	if n, _ := db.CloseStaleTunnelSessions(t0.Add(6*time.Hour), 5*time.Minute); n != 0 {
+		t.Fatalf("expected a session started after the cutoff left open, got %d", n)
+	}
+	if n, err := db.CloseStaleTunnelSessions(time.Now(), 5*time.Minute); n != 1 || err != nil {
+		t.Fatalf("expected the open session closed, got %d %v", n, err)
+	}
+	sessions, _ = db.ListTunnelSessions("box", t0)
+	if s := sessions[3]; s.EndReason != StaleTunnelReason || s.EndedAt == nil || !s.EndedAt.Equal(t0.Add(6*time.Hour+5*time.Minute)) {
+		t.Fatalf("expected the session capped, got %+v", s)
+	}
+	db.EndTunnelSession("box", t0.Add(7*time.Hour), time.Hour, "exit status 255")
+	sessions, _ = db.ListTunnelSessions("box", t0)
+	if len(sessions) != 4 || !sessions[3].EndedAt.Equal(t0.Add(7*time.Hour)) || sessions[3].EndReason != "exit status 255" {
+		t.Fatalf("expected the late report to close the capped session, got %+v", sessions)
+	}
+
+	if n, _ := db.PurgeTunnelSessions(t0.Add(2 * time.Hour)); n != 1 {
+		t.Fatalf("expected 1 purged session, got %d", n)
+	}
+	db.RenameMachine("box", "server", 0)
+	if sessions, _ := db.ListTunnelSessions("server", t0); len(sessions) != 3 {
+		t.Fatalf("expected sessions to follow rename, got %d", len(sessions))
+	}
+}
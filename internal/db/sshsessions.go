@@ -0,0 +1,158 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SSHSession is one connection piped through the bastion to a machine.
+// EndedAt is nil while it is open. KeyFingerprint and KeyLabel are empty when
+// the authenticating key could not be determined.
+type SSHSession struct {
+	ID             int64      `json:"id"`
+	MachineName    string     `json:"machine_name"`
+	Username       string     `json:"username"`   // the SSH username the client asked for
+	LocalUser      string     `json:"local_user"` // the user logged into on the machine
+	SourceIP       string     `json:"source_ip"`
+	SourcePort     int        `json:"source_port"`
+	KeyFingerprint string     `json:"key_fingerprint,omitempty"`
+	KeyLabel       string     `json:"key_label,omitempty"`
+	StartedAt      time.Time  `json:"started_at"`
+	EndedAt        *time.Time `json:"ended_at,omitempty"`
+	EndReason      string     `json:"end_reason,omitempty"`
+	Recordings     int        `json:"recordings,omitempty"` // number of indexed recordings
+}
+
+// SSHSessionFilter selects sessions for ListSSHSessions. Empty fields match
+// everything.
+type SSHSessionFilter struct {
+	Machine     string
+	Fingerprint string
+	SourceIP    string
+	Active      bool      // only open sessions
+	Since       time.Time // sessions open at or after this time
+	Limit       int
+}
+
+const sshSessionColumns = "id, machine_name, username, local_user, source_ip, source_port, key_fingerprint, key_label, started_at, ended_at, end_reason"
+
+// recordingCount counts a session's recordings as the last selected column.
+const recordingCount = "(SELECT COUNT(*) FROM session_recordings r WHERE r.session_id = ssh_sessions.id)"
+
+func scanSSHSession(row interface{ Scan(...any) error }) (*SSHSession, error) {
+	var s SSHSession
+	err := row.Scan(&s.ID, &s.MachineName, &s.Username, &s.LocalUser, &s.SourceIP, &s.SourcePort,
+		&s.KeyFingerprint, &s.KeyLabel, &s.StartedAt, &s.EndedAt, &s.EndReason, &s.Recordings)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// StartSSHSession records a new session and sets its ID.
+func (db *DB) StartSSHSession(s *SSHSession) error {
+	result, err := db.conn.Exec(`
+		INSERT INTO ssh_sessions (machine_name, username, local_user, source_ip, source_port, key_fingerprint, key_label, started_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		s.MachineName, s.Username, s.LocalUser, s.SourceIP, s.SourcePort, s.KeyFingerprint, s.KeyLabel, sqlTime(s.StartedAt),
+	)
+	if err != nil {
+		return fmt.Errorf("start ssh session: %w", err)
+	}
+	s.ID, _ = result.LastInsertId()
+	return nil
+}
+
+// GetSSHSession returns a session by ID, or nil.
+func (db *DB) GetSSHSession(id int64) (*SSHSession, error) {
+	s, err := scanSSHSession(db.conn.QueryRow("SELECT "+sshSessionColumns+", "+recordingCount+" FROM ssh_sessions WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return s, err
+}
+
+// EndSSHSession closes the open session from the source address and reports
+// whether there was one.
+func (db *DB) EndSSHSession(sourceIP string, sourcePort int, at time.Time, reason string) (bool, error) {
+	result, err := db.conn.Exec(
+		"UPDATE ssh_sessions SET ended_at = ?, end_reason = ? WHERE source_ip = ? AND source_port = ? AND ended_at IS NULL",
+		sqlTime(at), reason, sourceIP, sourcePort,
+	)
+	if err != nil {
+		return false, fmt.Errorf("end ssh session: %w", err)
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+// CloseOpenSSHSessions ends every open session, for when the connections are
+// known to be gone, and returns how many were closed.
+func (db *DB) CloseOpenSSHSessions(at time.Time, reason string) (int64, error) {
+	result, err := db.conn.Exec("UPDATE ssh_sessions SET ended_at = ?, end_reason = ? WHERE ended_at IS NULL", sqlTime(at), reason)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// ListSSHSessions returns matching sessions, newest first.
+func (db *DB) ListSSHSessions(f SSHSessionFilter) ([]SSHSession, error) {
+	var where []string
+	var args []any
+	if f.Machine != "" {
+		where = append(where, "machine_name = ?")
+		args = append(args, f.Machine)
+	}
+	if f.Fingerprint != "" {
+		where = append(where, "key_fingerprint = ?")
+		args = append(args, f.Fingerprint)
+	}
+	if f.SourceIP != "" {
+		where = append(where, "source_ip = ?")
+		args = append(args, f.SourceIP)
+	}
+	if f.Active {
+		where = append(where, "ended_at IS NULL")
+	}
+	if !f.Since.IsZero() {
+		where = append(where, "(ended_at IS NULL OR ended_at >= ?)")
+		args = append(args, sqlTime(f.Since))
+	}
+	query := "SELECT " + sshSessionColumns + ", " + recordingCount + " FROM ssh_sessions"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY started_at DESC, id DESC"
+	if f.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, f.Limit)
+	}
+
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := []SSHSession{}
+	for rows.Next() {
+		s, err := scanSSHSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, *s)
+	}
+	return sessions, rows.Err()
+}
+
+// PurgeSSHSessions deletes sessions that ended before the cutoff and returns
+// how many were removed.
+func (db *DB) PurgeSSHSessions(before time.Time) (int64, error) {
+	result, err := db.conn.Exec("DELETE FROM ssh_sessions WHERE ended_at IS NOT NULL AND ended_at < ?", sqlTime(before))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,55 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSSHSessions(t *testing.T) {
+	db := tempDB(t)
+	db.CreateMachine(&Machine{Name: "box", Owner: "a", LocalUser: "u", PublicKey: "k"})
+	now := time.Now().Truncate(time.Second)
+
+	first := &SSHSession{MachineName: "box", Username: "box", LocalUser: "u", SourceIP: "203.0.113.7", SourcePort: 5000,
+		KeyFingerprint: "SHA256:phone", KeyLabel: "phone", StartedAt: now.Add(-2 * time.Hour)}
+	second := &SSHSession{MachineName: "box", Username: "bob+box", LocalUser: "bob", SourceIP: "198.51.100.1", SourcePort: 6000,
+		StartedAt: now.Add(-time.Hour)}
+	for _, s := range []*SSHSession{first, second} {
+		if err := db.StartSSHSession(s); err != nil || s.ID == 0 {
+			t.Fatalf("start: %v", err)
+		}
+	}
+
+	if ok, _ := db.EndSSHSession("203.0.113.7", 5000, now.Add(-90*time.Minute), "EOF"); !ok {
+		t.Fatal("expected the session to end")
+	}
+	if ok, _ := db.EndSSHSession("203.0.113.7", 5000, now, "EOF"); ok {
+		t.Fatal("expected no open session from that address")
+	}
+
+	active, _ := db.ListSSHSessions(SSHSessionFilter{Active: true})
+	if len(active) != 1 || active[0].ID != second.ID {
+		t.Fatalf("expected only the second session active, got %+v", active)
+	}
+	byKey, _ := db.ListSSHSessions(SSHSessionFilter{Fingerprint: "SHA256:phone"})
+	if len(byKey) != 1 || byKey[0].KeyLabel != "phone" || byKey[0].EndReason != "EOF" || byKey[0].EndedAt == nil {
+		t.Fatalf("unexpected sessions by key %+v", byKey)
+	}
+	if recent, _ := db.ListSSHSessions(SSHSessionFilter{Since: now.Add(-80 * time.Minute)}); len(recent) != 1 {
+		t.Fatalf("expected only the open session since, got %+v", recent)
+	}
+
+	// History follows a rename and survives the machine's deletion
+	db.RenameMachine("box", "crate", 0)
+	db.DeleteMachine("crate")
+	if all, _ := db.ListSSHSessions(SSHSessionFilter{Machine: "crate"}); len(all) != 2 || all[0].ID != second.ID {
+		t.Fatalf("expected both sessions under the new name, newest first, got %+v", all)
+	}
+
+	if n, _ := db.CloseOpenSSHSessions(now, "restart"); n != 1 {
+		t.Fatalf("expected 1 session closed, got %d", n)
+	}
+	if n, _ := db.PurgeSSHSessions(now.Add(-time.Minute)); n != 1 {
+		t.Fatalf("expected 1 session purged, got %d", n)
+	}
+}
@@ -0,0 +1,79 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+// MachineUser is an additional local account that can be reached on a machine
+// besides its default local_user.
+type MachineUser struct {
+	ID          int64     `json:"id"`
+	MachineName string    `json:"machine_name"`
+	Username    string    `json:"username"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func (db *DB) AddMachineUser(machineName, username string) (*MachineUser, error) {
+	result, err := db.conn.Exec("INSERT INTO machine_users (machine_name, username) VALUES (?, ?)", machineName, username)
+	if err != nil {
+		return nil, fmt.Errorf("add local user: %w", err)
+	}
+	u := &MachineUser{MachineName: machineName, Username: username}
+	u.ID, _ = result.LastInsertId()
+	if err := db.conn.QueryRow("SELECT created_at FROM machine_users WHERE id = ?", u.ID).Scan(&u.CreatedAt); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// ListMachineUsers returns the additional local users of a machine.
+func (db *DB) ListMachineUsers(machineName string) ([]MachineUser, error) {
+	rows, err := db.conn.Query(
+		"SELECT id, machine_name, username, created_at FROM machine_users WHERE machine_name = ? ORDER BY username",
+		machineName,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var users []MachineUser
+	for rows.Next() {
+		var u MachineUser
+		if err := rows.Scan(&u.ID, &u.MachineName, &u.Username, &u.CreatedAt); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// AllMachineUsers returns the additional local user names grouped by machine name.
+func (db *DB) AllMachineUsers() (map[string][]string, error) {
+	rows, err := db.conn.Query("SELECT machine_name, username FROM machine_users ORDER BY username")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	byMachine := make(map[string][]string)
+	for rows.Next() {
+		var machine, username string
+		if err := rows.Scan(&machine, &username); err != nil {
+			return nil, err
+		}
+		byMachine[machine] = append(byMachine[machine], username)
+	}
+	return byMachine, rows.Err()
+}
+
+func (db *DB) DeleteMachineUser(machineName, username string) error {
+	result, err := db.conn.Exec("DELETE FROM machine_users WHERE machine_name = ? AND username = ?", machineName, username)
+	if err != nil {
+		return err
+	}
+	n, _ := result.RowsAffected()
+	if n == 0 {
+		return fmt.Errorf("local user %q not found", username)
+	}
+	return nil
+}
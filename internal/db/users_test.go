@@ -0,0 +1,53 @@
+package db
+
+import "testing"
+
+func TestMachineUsers(t *testing.T) {
+	db := tempDB(t)
+
+	key := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl"
+	db.CreateMachine(&Machine{Name: "box", Owner: "a", LocalUser: "admin", PublicKey: "k"})
+	if _, err := db.AddMachineUser("box", "alice"); err != nil {
+		t.Fatalf("add user: %v", err)
+	}
+	if _, err := db.AddMachineUser("box", "alice"); err == nil {
+		t.Fatal("expected duplicate local user to fail")
+	}
+	ak := &AccessKey{MachineName: "box", Label: "alice-laptop", PublicKey: key, LocalUsers: []string{"alice"}}
+	if err := db.AddAccessKey(ak); err != nil {
+		t.Fatalf("add access key: %v", err)
+	}
+	if !ak.AllowsUser("alice", "admin") || ak.AllowsUser("admin", "admin") {
+		t.Fatalf("unexpected restriction on %+v", ak)
+	}
+	if k := (AccessKey{}); !k.AllowsUser("admin", "admin") || k.AllowsUser("alice", "admin") {
+		t.Fatal("expected a key without local users limited to the default user")
+	}
+	if k := (AccessKey{LocalUsers: []string{AllLocalUsers}}); !k.AllowsUser("alice", "admin") {
+		t.Fatal("expected * to allow every local user")
+	}
+
+	if err := db.RenameMachine("box", "server", 0); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	all, _ := db.AllMachineUsers()
+	if len(all["server"]) != 1 || all["server"][0] != "alice" {
+		t.Fatalf("expected local users to follow rename, got %+v", all)
+	}
+	keys, _ := db.ListAccessKeys("server")
+	if len(keys) != 1 || len(keys[0].LocalUsers) != 1 || keys[0].LocalUsers[0] != "alice" {
+		t.Fatalf("expected restriction to be stored, got %+v", keys)
+	}
+
+	grants, _ := db.FindKeyGrants(ak.Fingerprint)
+	if len(grants) != 1 || len(grants[0].LocalUsers) != 1 || grants[0].LocalUsers[0] != "alice" {
+		t.Fatalf("unexpected grants %+v", grants)
+	}
+
+	if err := db.DeleteMachineUser("server", "alice"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err := db.DeleteMachineUser("server", "alice"); err == nil {
+		t.Fatal("expected deleting a missing user to fail")
+	}
+}
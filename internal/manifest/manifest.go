@@ -0,0 +1,395 @@
+// Package manifest describes machine access policy as YAML and computes the
+// changes needed to bring a server in line with it.
+package manifest
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/schedule"
+	"github.com/LipJ01/fly-ssh-bastion/internal/sshkey"
+)
+
+type Manifest struct {
+	Machines []Machine `yaml:"machines"`
+}
+
+// Machine is the desired policy for one registered machine. Machines are
+// registered from the machine itself, so a manifest never creates them.
+type Machine struct {
+	Name       string            `yaml:"name"`
+	Owner      string            `yaml:"owner,omitempty"` // left as it is when empty
+	Tags       []string          `yaml:"tags,omitempty"`
+	Labels     map[string]string `yaml:"labels,omitempty"`
+	Aliases    []string          `yaml:"aliases,omitempty"`
+	Users      []string          `yaml:"users,omitempty"` // additional local users
+	AccessKeys []AccessKey       `yaml:"access_keys,omitempty"`
+}
+
+type AccessKey struct {
+	Label      string   `yaml:"label"`
+	PublicKey  string   `yaml:"public_key"`
+	LocalUsers []string `yaml:"local_users,omitempty"` // default user only when empty, "*" for all
+
+	// Schedule limits when the key may log in, e.g. "mon-fri 09:00-18:00".
+	Schedule         string `yaml:"schedule,omitempty"`
+	ScheduleTimezone string `yaml:"schedule_timezone,omitempty"`
+
+	Restrictions `yaml:",inline"`
+}
+
+// Restrictions limit what an access key may do once logged in.
+type Restrictions struct {
+	SourceCIDRs       []string `yaml:"source_cidrs,omitempty" json:"source_cidrs"` // live keys only; refused in manifests
+	ForceCommand      string   `yaml:"force_command,omitempty" json:"force_command"`
+	SFTPOnly          bool     `yaml:"sftp_only,omitempty" json:"sftp_only"`
+	NoPortForwarding  bool     `yaml:"no_port_forwarding,omitempty" json:"no_port_forwarding"`
+	NoAgentForwarding bool     `yaml:"no_agent_forwarding,omitempty" json:"no_agent_forwarding"`
+}
+
+func (r Restrictions) equal(o Restrictions) bool {
+	return sameSet(r.SourceCIDRs, o.SourceCIDRs) && r.ForceCommand == o.ForceCommand && r.SFTPOnly == o.SFTPOnly &&
+		r.NoPortForwarding == o.NoPortForwarding && r.NoAgentForwarding == o.NoAgentForwarding
+}
+
+// Parse decodes and validates a manifest. Unknown fields are rejected so typos
+// do not silently drop policy.
+func Parse(data []byte) (*Manifest, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	var m Manifest
+	if err := dec.Decode(&m); err != nil {
+		return nil, fmt.Errorf("parse manifest: %w", err)
+	}
+
+	seen := make(map[string]bool)
+	for i := range m.Machines {
+		machine := &m.Machines[i]
+		if machine.Name == "" {
+			return nil, fmt.Errorf("machine %d: name is required", i+1)
+		}
+		if seen[machine.Name] {
+			return nil, fmt.Errorf("machine %q is listed twice", machine.Name)
+		}
+		seen[machine.Name] = true
+
+		fingerprints := make(map[string]string)
+		for j := range machine.AccessKeys {
+			k := &machine.AccessKeys[j]
+			if k.Label == "" {
+				return nil, fmt.Errorf("machine %q: every access key needs a label", machine.Name)
+			}
+			key, err := sshkey.Parse(k.PublicKey)
+			if err != nil {
+				return nil, fmt.Errorf("machine %q, key %q: %w", machine.Name, k.Label, err)
+			}
+			if k.Schedule != "" {
+				if _, err := schedule.Parse(k.Schedule, k.ScheduleTimezone); err != nil {
+					return nil, fmt.Errorf("machine %q, key %q: %w", machine.Name, k.Label, err)
+				}
+			} else if k.ScheduleTimezone != "" {
+				return nil, fmt.Errorf("machine %q, key %q: schedule_timezone needs a schedule", machine.Name, k.Label)
+			}
+			// The server refuses them, see errSourceCIDRs in internal/server
+			if len(k.SourceCIDRs) > 0 {
+				return nil, fmt.Errorf("machine %q, key %q: source_cidrs is not supported", machine.Name, k.Label)
+			}
+			if k.SFTPOnly && k.ForceCommand != "" {
+				return nil, fmt.Errorf("machine %q, key %q: sftp_only and force_command cannot be combined", machine.Name, k.Label)
+			}
+			if other, ok := fingerprints[key.Fingerprint]; ok {
+				return nil, fmt.Errorf("machine %q: keys %q and %q are the same key", machine.Name, other, k.Label)
+			}
+			fingerprints[key.Fingerprint] = k.Label
+		}
+	}
+	return &m, nil
+}
+
+// Marshal encodes a manifest as YAML.
+func Marshal(m *Manifest) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(m); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), enc.Close()
+}
+
+// Live is the server's current state of one machine.
+type Live struct {
+	Name       string
+	Owner      string
+	LocalUser  string
+	Tags       []string
+	Labels     map[string]string
+	Aliases    []string // permanent aliases; aliases left by renames expire on their own
+	Users      []string // additional local users
+	AccessKeys []LiveKey
+}
+
+type LiveKey struct {
+	ID          int64
+	Label       string
+	PublicKey   string
+	Fingerprint string
+	LocalUsers  []string
+
+	Schedule         string
+	ScheduleTimezone string
+
+	Restrictions
+}
+
+// Export builds a manifest describing the live state.
+func Export(live []Live) *Manifest {
+	m := &Manifest{}
+	for _, l := range live {
+		machine := Machine{
+			Name:    l.Name,
+			Owner:   l.Owner,
+			Tags:    l.Tags,
+			Labels:  l.Labels,
+			Aliases: l.Aliases,
+			Users:   l.Users,
+		}
+		for _, k := range l.AccessKeys {
+			machine.AccessKeys = append(machine.AccessKeys, AccessKey{
+				Label:      k.Label,
+				PublicKey:  k.PublicKey,
+				LocalUsers: k.LocalUsers,
+
+				Schedule:         k.Schedule,
+				ScheduleTimezone: k.ScheduleTimezone,
+
+				Restrictions: k.Restrictions,
+			})
+		}
+		m.Machines = append(m.Machines, machine)
+	}
+	sort.Slice(m.Machines, func(i, j int) bool { return m.Machines[i].Name < m.Machines[j].Name })
+	return m
+}
+
+type Action string
+
+const (
+	Add    Action = "add"
+	Remove Action = "remove"
+	Set    Action = "set" // change the owner or a label's value
+)
+
+// Change is one API call needed to apply a manifest.
+type Change struct {
+	Machine string
+	Action  Action
+	Kind    string // "owner", "tag", "label", "user", "alias" or "access_key"
+	Name    string // owner, tag, label key, user name, alias or key label
+	Value   string // label value to add or set
+
+	Key   *AccessKey // access key to add
+	KeyID int64      // access key to remove
+	// Fingerprint identifies access keys in plan output
+	Fingerprint string
+}
+
+func (c Change) String() string {
+	sign := "+"
+	switch c.Action {
+	case Remove:
+		sign = "-"
+	case Set:
+		sign = "~"
+	}
+	switch c.Kind {
+	case "owner":
+		return fmt.Sprintf("%s %s: owner %q", sign, c.Machine, c.Name)
+	case "tag":
+		return fmt.Sprintf("%s %s: tag %q", sign, c.Machine, c.Name)
+	case "label":
+		if c.Action == Remove {
+			return fmt.Sprintf("%s %s: label %q", sign, c.Machine, c.Name)
+		}
+		return fmt.Sprintf("%s %s: label %s=%q", sign, c.Machine, c.Name, c.Value)
+	case "access_key":
+		s := fmt.Sprintf("%s %s: access key %q (%s)", sign, c.Machine, c.Name, c.Fingerprint)
+		if c.Key != nil && len(c.Key.LocalUsers) > 0 {
+			s += " as " + strings.Join(c.Key.LocalUsers, ",")
+		}
+		return s
+	case "alias":
+		return fmt.Sprintf("%s %s: alias %q", sign, c.Machine, c.Name)
+	default:
+		return fmt.Sprintf("%s %s: local user %q", sign, c.Machine, c.Name)
+	}
+}
+
+// Plan is the set of changes that brings the server in line with a manifest,
+// plus differences that cannot or will not be applied.
+type Plan struct {
+	Changes  []Change
+	Warnings []string
+}
+
+// Diff compares a manifest with the live state. Keys are matched by
+// fingerprint; a managed key whose label, local users, schedule or
+// restrictions differ is replaced. An owner given in the manifest is set.
+// Tags, labels, keys, aliases and users missing from the manifest are only
+// removed when prune is set.
+func Diff(m *Manifest, live []Live, prune bool) *Plan {
+	byName := make(map[string]Live, len(live))
+	for _, l := range live {
+		byName[l.Name] = l
+	}
+
+	plan := &Plan{}
+	for _, desired := range m.Machines {
+		current, ok := byName[desired.Name]
+		if !ok {
+			plan.Warnings = append(plan.Warnings, fmt.Sprintf("%s: not registered; run `bastion register` on the machine first", desired.Name))
+			continue
+		}
+		plan.diffMachine(desired, current, prune)
+	}
+	return plan
+}
+
+func (p *Plan) diffMachine(desired Machine, current Live, prune bool) {
+	name := desired.Name
+	var metadata, removeMetadata, addUsers, removeUsers, addAliases, removeAliases, addKeys, removeKeys []Change
+
+	if desired.Owner != "" && desired.Owner != current.Owner {
+		metadata = append(metadata, Change{Machine: name, Action: Set, Kind: "owner", Name: desired.Owner})
+	}
+	for _, t := range missing(desired.Tags, current.Tags) {
+		metadata = append(metadata, Change{Machine: name, Action: Add, Kind: "tag", Name: t})
+	}
+	for _, t := range missing(current.Tags, desired.Tags) {
+		if prune {
+			removeMetadata = append(removeMetadata, Change{Machine: name, Action: Remove, Kind: "tag", Name: t})
+		} else {
+			p.Warnings = append(p.Warnings, fmt.Sprintf("%s: tag %q is not in the manifest (use --prune to remove)", name, t))
+		}
+	}
+	for _, k := range sortedKeys(desired.Labels) {
+		v := desired.Labels[k]
+		if live, ok := current.Labels[k]; !ok {
+			metadata = append(metadata, Change{Machine: name, Action: Add, Kind: "label", Name: k, Value: v})
+		} else if live != v {
+			metadata = append(metadata, Change{Machine: name, Action: Set, Kind: "label", Name: k, Value: v})
+		}
+	}
+	for _, k := range sortedKeys(current.Labels) {
+		if _, ok := desired.Labels[k]; ok {
+			continue
+		}
+		if prune {
+			removeMetadata = append(removeMetadata, Change{Machine: name, Action: Remove, Kind: "label", Name: k})
+		} else {
+			p.Warnings = append(p.Warnings, fmt.Sprintf("%s: label %q is not in the manifest (use --prune to remove)", name, k))
+		}
+	}
+
+	users := without(desired.Users, current.LocalUser)
+	for _, u := range missing(users, current.Users) {
+		addUsers = append(addUsers, Change{Machine: name, Action: Add, Kind: "user", Name: u})
+	}
+	for _, u := range missing(current.Users, users) {
+		if prune {
+			removeUsers = append(removeUsers, Change{Machine: name, Action: Remove, Kind: "user", Name: u})
+		} else {
+			p.Warnings = append(p.Warnings, fmt.Sprintf("%s: local user %q is not in the manifest (use --prune to remove)", name, u))
+		}
+	}
+
+	for _, a := range missing(desired.Aliases, current.Aliases) {
+		addAliases = append(addAliases, Change{Machine: name, Action: Add, Kind: "alias", Name: a})
+	}
+	for _, a := range missing(current.Aliases, desired.Aliases) {
+		if prune {
+			removeAliases = append(removeAliases, Change{Machine: name, Action: Remove, Kind: "alias", Name: a})
+		} else {
+			p.Warnings = append(p.Warnings, fmt.Sprintf("%s: alias %q is not in the manifest (use --prune to remove)", name, a))
+		}
+	}
+
+	liveKeys := make(map[string]LiveKey)
+	for _, k := range current.AccessKeys {
+		liveKeys[k.Fingerprint] = k
+	}
+	wanted := make(map[string]bool)
+	for i := range desired.AccessKeys {
+		k := &desired.AccessKeys[i]
+		fp := sshkey.Fingerprint(k.PublicKey)
+		wanted[fp] = true
+		live, ok := liveKeys[fp]
+		if ok && live.Label == k.Label && sameSet(live.LocalUsers, k.LocalUsers) &&
+			live.Schedule == k.Schedule && live.ScheduleTimezone == k.ScheduleTimezone && live.Restrictions.equal(k.Restrictions) {
+			continue
+		}
+		if ok {
+			// Replace the key to change its label, users, schedule or restrictions
+			removeKeys = append(removeKeys, Change{Machine: name, Action: Remove, Kind: "access_key", Name: live.Label, KeyID: live.ID, Fingerprint: fp})
+		}
+		addKeys = append(addKeys, Change{Machine: name, Action: Add, Kind: "access_key", Name: k.Label, Key: k, Fingerprint: fp})
+	}
+	for _, k := range current.AccessKeys {
+		if wanted[k.Fingerprint] {
+			continue
+		}
+		if prune {
+			removeKeys = append(removeKeys, Change{Machine: name, Action: Remove, Kind: "access_key", Name: k.Label, KeyID: k.ID, Fingerprint: k.Fingerprint})
+		} else {
+			p.Warnings = append(p.Warnings, fmt.Sprintf("%s: access key %q (%s) is not in the manifest (use --prune to remove)", name, k.Label, k.Fingerprint))
+		}
+	}
+
+	// Users exist before keys refer to them, and keys are removed before a
+	// replacement with the same public key is added.
+	for _, group := range [][]Change{metadata, addUsers, removeKeys, addKeys, addAliases, removeAliases, removeUsers, removeMetadata} {
+		p.Changes = append(p.Changes, group...)
+	}
+}
+
+// missing returns the items of a that are not in b.
+func missing(a, b []string) []string {
+	in := make(map[string]bool, len(b))
+	for _, s := range b {
+		in[s] = true
+	}
+	var out []string
+	for _, s := range a {
+		if !in[s] {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func without(items []string, drop string) []string {
+	var out []string
+	for _, s := range items {
+		if s != drop {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func sameSet(a, b []string) bool {
+	return len(missing(a, b)) == 0 && len(missing(b, a)) == 0
+}
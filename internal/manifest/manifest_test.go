@@ -0,0 +1,166 @@
+package manifest
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/sshkey"
+)
+
+const (
+	phoneKey  = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl"
+	laptopKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHxbUNK9KxLpX7tYc3NzNIw0cMUV4ZpOAcfOlaZ8bCjN"
+)
+
+func TestParseRejectsInvalid(t *testing.T) {
+	for name, doc := range map[string]string{
+		"unknown field":  "machines:\n  - name: nas\n    acess_keys: []\n",
+		"missing name":   "machines:\n  - owner: alice\n",
+		"duplicate":      "machines:\n  - name: nas\n  - name: nas\n",
+		"bad key":        "machines:\n  - name: nas\n    access_keys:\n      - label: x\n        public_key: ssh-ed25519 nope\n",
+		"missing label":  "machines:\n  - name: nas\n    access_keys:\n      - public_key: " + phoneKey + "\n",
+		"same key twice": "machines:\n  - name: nas\n    access_keys:\n      - {label: a, public_key: " + phoneKey + "}\n      - {label: b, public_key: " + phoneKey + "}\n",
+		"source cidrs":   "machines:\n  - name: nas\n    access_keys:\n      - {label: a, public_key: " + phoneKey + ", source_cidrs: [10.0.0.0/8]}\n",
+		"sftp command":   "machines:\n  - name: nas\n    access_keys:\n      - {label: a, public_key: " + phoneKey + ", sftp_only: true, force_command: ls}\n",
+	} {
+		if _, err := Parse([]byte(doc)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	m, err := Parse([]byte(`
+machines:
+  - name: nas
+    owner: alice
+    tags: [prod, storage]
+    labels: {env: prod, rack: a1}
+    aliases: [storage]
+    users: [admin, bob]
+    access_keys:
+      - label: phone
+        public_key: ` + phoneKey + `
+      - label: laptop
+        public_key: ` + laptopKey + `
+        local_users: [bob]
+  - name: ghost
+`))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	live := []Live{{
+		Name:      "nas",
+		Owner:     "carol",
+		LocalUser: "admin",
+		Tags:      []string{"prod", "old"},
+		Labels:    map[string]string{"env": "dev", "team": "ops"},
+		Aliases:   []string{"old-alias"},
+		Users:     []string{"eve"},
+		AccessKeys: []LiveKey{
+			{ID: 1, Label: "phone", PublicKey: phoneKey, Fingerprint: sshkey.Fingerprint(phoneKey)},
+			{ID: 2, Label: "laptop", PublicKey: laptopKey, Fingerprint: sshkey.Fingerprint(laptopKey)},
+			{ID: 3, Label: "stale", PublicKey: "x", Fingerprint: "SHA256:stale"},
+		},
+	}}
+
+	plan := Diff(m, live, false)
+	var got []string
+	for _, c := range plan.Changes {
+		got = append(got, c.String())
+	}
+	want := []string{
+		`~ nas: owner "alice"`,
+		`+ nas: tag "storage"`,
+		`~ nas: label env="prod"`,
+		`+ nas: label rack="a1"`,
+		`+ nas: local user "bob"`,
+		`- nas: access key "laptop" (` + sshkey.Fingerprint(laptopKey) + `)`,
+		`+ nas: access key "laptop" (` + sshkey.Fingerprint(laptopKey) + `) as bob`,
+		`+ nas: alias "storage"`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected plan:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	warnings := strings.Join(plan.Warnings, "\n")
+	for _, w := range []string{"ghost: not registered", `tag "old"`, `label "team"`, `alias "old-alias"`, `local user "eve"`, `access key "stale"`} {
+		if !strings.Contains(warnings, w) {
+			t.Errorf("expected warning containing %q in:\n%s", w, warnings)
+		}
+	}
+
+	pruned := Diff(m, live, true)
+	removes := 0
+	for _, c := range pruned.Changes {
+		if c.Action == Remove {
+			removes++
+		}
+	}
+	// laptop replacement, stale key, old alias, eve, the old tag and team
+	if removes != 6 {
+		t.Fatalf("expected 6 removals with prune, got %d: %+v", removes, pruned.Changes)
+	}
+	if last := pruned.Changes[len(pruned.Changes)-3]; last.Kind != "user" || last.Action != Remove {
+		t.Fatalf("expected users to be removed after keys and aliases, got %+v", last)
+	}
+}
+
+func TestExportRoundTrip(t *testing.T) {
+	live := []Live{
+		{Name: "nas", Owner: "alice", LocalUser: "admin", Tags: []string{"prod"}, Labels: map[string]string{"env": "prod"}, AccessKeys: []LiveKey{
+			{ID: 1, Label: "phone", PublicKey: phoneKey, Fingerprint: sshkey.Fingerprint(phoneKey), LocalUsers: []string{"admin"},
+				Schedule: "mon-fri 09:00-18:00", ScheduleTimezone: "Europe/London",
+				Restrictions: Restrictions{SFTPOnly: true}},
+		}},
+		{Name: "box", Owner: "bob", LocalUser: "bob", Aliases: []string{"server"}, Users: []string{"deploy"}},
+	}
+	data, err := Marshal(Export(live))
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	m, err := Parse(data)
+	if err != nil {
+		t.Fatalf("parse exported manifest: %v\n%s", err, data)
+	}
+	if m.Machines[0].Name != "box" {
+		t.Fatalf("expected machines sorted by name, got %s", m.Machines[0].Name)
+	}
+	if plan := Diff(m, live, true); len(plan.Changes) != 0 || len(plan.Warnings) != 0 {
+		t.Fatalf("expected exported manifest to match live state, got %+v", plan)
+	}
+	for _, want := range []string{"sftp_only: true", "tags:\n      - prod", "env: prod"} {
+		if !strings.Contains(string(data), want) {
+			t.Fatalf("expected %q exported:\n%s", want, data)
+		}
+	}
+}
+
+func TestDiffRestrictions(t *testing.T) {
+	m, err := Parse([]byte(`
+machines:
+  - name: nas
+    access_keys:
+      - label: backup
+        public_key: ` + phoneKey + `
+        force_command: borg serve
+`))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	live := []Live{{Name: "nas", AccessKeys: []LiveKey{{ID: 1, Label: "backup", PublicKey: phoneKey, Fingerprint: sshkey.Fingerprint(phoneKey),
+		Restrictions: Restrictions{ForceCommand: "borg serve"}}}}}
+	if plan := Diff(m, live, false); len(plan.Changes) != 0 {
+		t.Fatalf("expected no changes, got %+v", plan.Changes)
+	}
+	live[0].AccessKeys[0].ForceCommand = ""
+	if plan := Diff(m, live, false); len(plan.Changes) != 2 || plan.Changes[1].Key.ForceCommand != "borg serve" {
+		t.Fatalf("expected the key replaced to restore its forced command, got %+v", plan.Changes)
+	}
+
+	// A live key still limited to source CIDRs is replaced without them
+	live[0].AccessKeys[0].Restrictions = Restrictions{SourceCIDRs: []string{"10.1.2.3/32"}, ForceCommand: "borg serve"}
+	if plan := Diff(m, live, false); len(plan.Changes) != 2 || plan.Changes[1].Key.SourceCIDRs != nil {
+		t.Fatalf("expected the key replaced without its source CIDRs, got %+v", plan.Changes)
+	}
+}
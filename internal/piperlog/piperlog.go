@@ -0,0 +1,124 @@
+// Package piperlog parses sshpiperd's log output into connection events.
+package piperlog
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/sshkey"
+)
+
+// Event types.
+const (
+	// EventAuth carries the key fingerprint a downstream connection
+	// authenticated with, when sshpiperd or a plugin logs it.
+	EventAuth = "auth"
+	// EventOpen is logged once the pipe to the upstream sshd is established.
+	EventOpen = "open"
+	// EventClose is logged when a piped connection ends.
+	EventClose = "close"
+)
+
+// Event is one connection event from the log.
+type Event struct {
+	Type         string
+	Time         time.Time
+	Remote       string // downstream client address, "ip:port"
+	User         string // username the client asked for (open only)
+	Upstream     string // upstream sshd address (open only)
+	UpstreamUser string // local user on the machine (open only)
+	Fingerprint  string // auth only
+	Reason       string // close only
+}
+
+var (
+	// logrus text format: time="..." level=info msg="..."
+	logrusTime = regexp.MustCompile(`\btime="([^"]*)"`)
+	logrusMsg  = regexp.MustCompile(`\bmsg=("(?:[^"\\]|\\.)*"|\S+)`)
+
+	pipeCreated = regexp.MustCompile(`ssh connection pipe created (\S+) \(username \[([^\]]*)\]\) -> (\S+) \(username \[([^\]]*)\]\)`)
+	connClosed  = regexp.MustCompile(`connection from (\S+) closed(?: reason: (.*))?$`)
+
+	address     = regexp.MustCompile(`(?:\d{1,3}(?:\.\d{1,3}){3}|\[[0-9a-fA-F:.%]+\]):\d+`)
+	fingerprint = regexp.MustCompile(`SHA256:[A-Za-z0-9+/]{43}`)
+	publicKey   = regexp.MustCompile(`(?:ssh|ecdsa|sk)-[a-z0-9@.-]+ AAAA[A-Za-z0-9+/]+=*`)
+)
+
+// ParseLine parses one log line and reports whether it was a connection
+// event. Lines in logrus text format and plain messages are both accepted;
+// the event time is the line's time, or now if it has none.
+func ParseLine(line string) (Event, bool) {
+	msg, at := message(line)
+	ev := Event{Time: at}
+
+	if m := pipeCreated.FindStringSubmatch(msg); m != nil {
+		ev.Type, ev.Remote, ev.User, ev.Upstream, ev.UpstreamUser = EventOpen, m[1], m[2], m[3], m[4]
+		return ev, true
+	}
+	if m := connClosed.FindStringSubmatch(msg); m != nil {
+		ev.Type, ev.Remote, ev.Reason = EventClose, m[1], strings.TrimSpace(m[2])
+		return ev, true
+	}
+
+	// Anything else naming both a client address and a key says which key
+	// that connection authenticated with
+	remote := address.FindString(msg)
+	if remote == "" {
+		return ev, false
+	}
+	fp := fingerprint.FindString(msg)
+	if fp == "" {
+		if key := publicKey.FindString(msg); key != "" {
+			fp = sshkey.Fingerprint(key)
+		}
+	}
+	if fp == "" {
+		return ev, false
+	}
+	ev.Type, ev.Remote, ev.Fingerprint = EventAuth, remote, fp
+	return ev, true
+}
+
+// message extracts the message and time from a log line.
+func message(line string) (string, time.Time) {
+	line = strings.TrimSpace(line)
+	at := time.Now()
+	m := logrusMsg.FindStringSubmatch(line)
+	if m == nil {
+		return line, at
+	}
+	msg := m[1]
+	if strings.HasPrefix(msg, `"`) {
+		if s, err := strconv.Unquote(msg); err == nil {
+			msg = s
+		}
+	}
+	if t := logrusTime.FindStringSubmatch(line); t != nil {
+		if parsed, err := time.Parse(time.RFC3339, t[1]); err == nil {
+			at = parsed
+		}
+	}
+	return msg, at
+}
+
+// Scan reads log lines from r until EOF, copies each to echo (if not nil) so
+// the log stays visible, and calls fn for every connection event.
+func Scan(r io.Reader, echo io.Writer, fn func(Event)) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		line := sc.Text()
+		if echo != nil {
+			fmt.Fprintln(echo, line)
+		}
+		if ev, ok := ParseLine(line); ok {
+			fn(ev)
+		}
+	}
+	return sc.Err()
+}
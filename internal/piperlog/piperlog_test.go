@@ -0,0 +1,63 @@
+package piperlog
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/sshkey"
+)
+
+const phoneKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl"
+
+func TestParseLine(t *testing.T) {
+	open, ok := ParseLine(`time="2026-10-18T09:15:02Z" level=info msg="ssh connection pipe created 203.0.113.7:51234 (username [bob+nas]) -> 127.0.0.1:10024 (username [bob])"`)
+	if !ok || open.Type != EventOpen || open.Remote != "203.0.113.7:51234" || open.User != "bob+nas" ||
+		open.Upstream != "127.0.0.1:10024" || open.UpstreamUser != "bob" {
+		t.Fatalf("unexpected open event %+v", open)
+	}
+	if !open.Time.Equal(time.Date(2026, 10, 18, 9, 15, 2, 0, time.UTC)) {
+		t.Fatalf("expected the line's time, got %v", open.Time)
+	}
+
+	closed, ok := ParseLine(`time="2026-10-18T09:45:00Z" level=info msg="connection from 203.0.113.7:51234 closed reason: EOF"`)
+	if !ok || closed.Type != EventClose || closed.Remote != "203.0.113.7:51234" || closed.Reason != "EOF" {
+		t.Fatalf("unexpected close event %+v", closed)
+	}
+
+	fp := sshkey.Fingerprint(phoneKey)
+	auth, ok := ParseLine(`level=debug msg="public key from [2001:db8::1]:40000 accepted: ` + fp + `"`)
+	if !ok || auth.Type != EventAuth || auth.Remote != "[2001:db8::1]:40000" || auth.Fingerprint != fp {
+		t.Fatalf("unexpected auth event %+v", auth)
+	}
+	auth, ok = ParseLine("203.0.113.7:51234 authenticated with " + phoneKey)
+	if !ok || auth.Fingerprint != fp {
+		t.Fatalf("expected a fingerprint from a logged public key, got %+v", auth)
+	}
+
+	for _, line := range []string{
+		`time="2026-10-18T09:00:00Z" level=info msg="sshpiperd is listening on: [::]:2223"`,
+		`level=info msg="connection from 203.0.113.7:51234 establishing failed reason: no matching pipe"`,
+		"",
+	} {
+		if ev, ok := ParseLine(line); ok {
+			t.Errorf("expected %q to be ignored, got %+v", line, ev)
+		}
+	}
+}
+
+func TestScanEchoesLines(t *testing.T) {
+	input := "starting\nssh connection pipe created 1.2.3.4:5 (username [nas]) -> 127.0.0.1:10022 (username [u])\nconnection from 1.2.3.4:5 closed reason: EOF\n"
+	var echo bytes.Buffer
+	var events []Event
+	if err := Scan(strings.NewReader(input), &echo, func(e Event) { events = append(events, e) }); err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if echo.String() != input {
+		t.Fatalf("expected every line echoed, got %q", echo.String())
+	}
+	if len(events) != 2 || events[0].Type != EventOpen || events[1].Type != EventClose {
+		t.Fatalf("unexpected events %+v", events)
+	}
+}
@@ -0,0 +1,156 @@
+// Package recording finds sshpiperd's asciicast session recordings and plays
+// them back.
+package recording
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// File is one recording found on disk. sshpiperd, run with
+// --username-as-recorddir, writes each session's recordings to
+// <dir>/<username>/<unix time>-<channel>.cast.
+type File struct {
+	Path     string // relative to the recordings directory
+	Username string // the SSH username the client asked for
+	Start    time.Time
+	Size     int64
+	ModTime  time.Time
+}
+
+// Header is the first line of an asciicast v2 file.
+type Header struct {
+	Version   int   `json:"version"`
+	Width     int   `json:"width"`
+	Height    int   `json:"height"`
+	Timestamp int64 `json:"timestamp,omitempty"`
+}
+
+// Scan returns the recordings under dir. A missing dir has none.
+func Scan(dir string) ([]File, error) {
+	var files []File
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) && path == dir {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(d.Name(), ".cast") {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		username, _, ok := strings.Cut(filepath.ToSlash(rel), "/")
+		if !ok {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil // removed while scanning
+		}
+		files = append(files, File{
+			Path:     rel,
+			Username: username,
+			Start:    startTime(path, d.Name(), info.ModTime()),
+			Size:     info.Size(),
+			ModTime:  info.ModTime(),
+		})
+		return nil
+	})
+	return files, err
+}
+
+// startTime reads when a recording started from its name, then its header,
+// falling back to its modification time.
+func startTime(path, name string, modTime time.Time) time.Time {
+	if prefix, _, ok := strings.Cut(name, "-"); ok {
+		if sec, err := strconv.ParseInt(prefix, 10, 64); err == nil && sec > 0 {
+			return time.Unix(sec, 0)
+		}
+	}
+	if f, err := os.Open(path); err == nil {
+		defer f.Close()
+		if h, err := ReadHeader(bufio.NewReader(f)); err == nil && h.Timestamp > 0 {
+			return time.Unix(h.Timestamp, 0)
+		}
+	}
+	return modTime
+}
+
+// ReadHeader reads and checks the asciicast header line.
+func ReadHeader(r *bufio.Reader) (*Header, error) {
+	line, err := r.ReadBytes('\n')
+	if err != nil && len(line) == 0 {
+		return nil, fmt.Errorf("read recording header: %w", err)
+	}
+	var h Header
+	if err := json.Unmarshal(line, &h); err != nil {
+		return nil, fmt.Errorf("invalid recording header: %w", err)
+	}
+	if h.Version != 2 {
+		return nil, fmt.Errorf("unsupported asciicast version %d", h.Version)
+	}
+	return &h, nil
+}
+
+// sleep is replaced in tests.
+var sleep = time.Sleep
+
+// Play writes the recording's output to w in real time divided by speed.
+// Pauses longer than idleLimit are shortened to it; zero keeps them.
+func Play(w io.Writer, r io.Reader, speed float64, idleLimit time.Duration) error {
+	if speed <= 0 {
+		return fmt.Errorf("speed must be positive")
+	}
+	br := bufio.NewReaderSize(r, 64*1024)
+	if _, err := ReadHeader(br); err != nil {
+		return err
+	}
+
+	var last float64
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(strings.TrimSpace(string(line))) > 0 {
+			var ev []json.RawMessage
+			if jerr := json.Unmarshal(line, &ev); jerr != nil || len(ev) < 3 {
+				return fmt.Errorf("invalid recording event: %s", strings.TrimSpace(string(line)))
+			}
+			var at float64
+			var code, data string
+			if json.Unmarshal(ev[0], &at) != nil || json.Unmarshal(ev[1], &code) != nil || json.Unmarshal(ev[2], &data) != nil {
+				return fmt.Errorf("invalid recording event: %s", strings.TrimSpace(string(line)))
+			}
+			if code == "o" {
+				delay := time.Duration((at - last) / speed * float64(time.Second))
+				if idleLimit > 0 && delay > idleLimit {
+					delay = idleLimit
+				}
+				if delay > 0 {
+					sleep(delay)
+				}
+				last = at
+				if _, werr := io.WriteString(w, data); werr != nil {
+					return werr
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
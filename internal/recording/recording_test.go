@@ -0,0 +1,73 @@
+package recording
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const cast = `{"version": 2, "width": 80, "height": 24, "timestamp": 1760778000}
+[0.5, "o", "$ "]
+[1.0, "i", "l"]
+[1.5, "o", "ls\r\n"]
+[31.5, "o", "file.txt\r\n"]
+`
+
+func TestPlay(t *testing.T) {
+	var delays []time.Duration
+	sleep = func(d time.Duration) { delays = append(delays, d) }
+	defer func() { sleep = time.Sleep }()
+
+	var out bytes.Buffer
+	if err := Play(&out, strings.NewReader(cast), 2, 5*time.Second); err != nil {
+		t.Fatalf("play: %v", err)
+	}
+	if out.String() != "$ ls\r\nfile.txt\r\n" {
+		t.Fatalf("unexpected output %q", out.String())
+	}
+	want := []time.Duration{250 * time.Millisecond, 500 * time.Millisecond, 5 * time.Second}
+	if len(delays) != len(want) {
+		t.Fatalf("expected delays %v, got %v", want, delays)
+	}
+	for i := range want {
+		if delays[i] != want[i] {
+			t.Fatalf("expected delays %v, got %v", want, delays)
+		}
+	}
+
+	if err := Play(&out, strings.NewReader(`{"version": 1}`+"\n"), 1, 0); err == nil {
+		t.Fatal("expected an error for asciicast v1")
+	}
+	if err := Play(&out, strings.NewReader(`{"version": 2}`+"\nnot json\n"), 1, 0); err == nil {
+		t.Fatal("expected an error for a bad event")
+	}
+}
+
+func TestScan(t *testing.T) {
+	dir := t.TempDir()
+	if files, err := Scan(filepath.Join(dir, "missing")); err != nil || len(files) != 0 {
+		t.Fatalf("expected no recordings in a missing dir, got %v %v", files, err)
+	}
+
+	os.MkdirAll(filepath.Join(dir, "bob+nas"), 0700)
+	os.WriteFile(filepath.Join(dir, "bob+nas", "1760778000-shell-0.cast"), []byte(cast), 0600)
+	os.WriteFile(filepath.Join(dir, "bob+nas", "channel-1.cast"), []byte(cast), 0600)
+	os.WriteFile(filepath.Join(dir, "bob+nas", "notes.txt"), []byte("x"), 0600)
+	os.WriteFile(filepath.Join(dir, "stray.cast"), []byte(cast), 0600)
+
+	files, err := Scan(dir)
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected 2 recordings, got %+v", files)
+	}
+	for _, f := range files {
+		if f.Username != "bob+nas" || !f.Start.Equal(time.Unix(1760778000, 0)) || f.Size != int64(len(cast)) {
+			t.Fatalf("unexpected recording %+v", f)
+		}
+	}
+}
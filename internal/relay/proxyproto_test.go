@@ -0,0 +1,135 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func proxyV2(cmd, family byte, addrs []byte) []byte {
+	b := append([]byte{}, proxyV2Signature...)
+	b = append(b, 0x20|cmd, family)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(addrs)))
+	return append(b, addrs...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := append(net.ParseIP("203.0.113.7").To4(), net.ParseIP("10.0.0.1").To4()...)
+	v4 = binary.BigEndian.AppendUint16(v4, 51000)
+	v4 = binary.BigEndian.AppendUint16(v4, 22)
+	v6 := append(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")...)
+	v6 = binary.BigEndian.AppendUint16(v6, 40000)
+	v6 = binary.BigEndian.AppendUint16(v6, 22)
+
+	tests := []struct {
+		name   string
+		header []byte
+		want   string // empty when the header carries no address
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 51000 22\r\n"), "203.0.113.7:51000"},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 40000 22\r\n"), "[2001:db8::1]:40000"},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), ""},
+		{"v2 tcp4", proxyV2(1, 0x11, v4), "203.0.113.7:51000"},
+		{"v2 tcp6", proxyV2(1, 0x21, v6), "[2001:db8::1]:40000"},
+		{"v2 tcp4 with tlvs", proxyV2(1, 0x11, append(bytes.Clone(v4), 0x04, 0x00, 0x01, 0xff)), "203.0.113.7:51000"},
+		{"v2 local", proxyV2(0, 0x00, nil), ""},
+	}
+	for _, tt := range tests {
+		r := bufio.NewReader(io.MultiReader(bytes.NewReader(tt.header), strings.NewReader("SSH-2.0-client\r\n")))
+		addr, err := readProxyHeader(r)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != tt.want {
+			t.Errorf("%s: got address %q, want %q", tt.name, got, tt.want)
+		}
+		// The client's own bytes follow the header untouched
+		if rest, _ := r.ReadString('\n'); rest != "SSH-2.0-client\r\n" {
+			t.Errorf("%s: expected the stream after the header, got %q", tt.name, rest)
+		}
+	}
+
+	for name, header := range map[string][]byte{
+		"none":          []byte("SSH-2.0-client\r\n"),
+		"v1 bad family": []byte("PROXY UDP4 203.0.113.7 10.0.0.1 51000 22\r\n"),
+		"v1 bad ip":     []byte("PROXY TCP4 2001:db8::1 10.0.0.1 51000 22\r\n"),
+		"v1 bad port":   []byte("PROXY TCP4 203.0.113.7 10.0.0.1 99999 22\r\n"),
+		"v1 too long":   []byte("PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n"),
+		"v2 short":      proxyV2(1, 0x11, v4[:6]),
+		"v2 bad family": proxyV2(1, 0x31, v4),
+	} {
+		if addr, err := readProxyHeader(bufio.NewReader(bytes.NewReader(header))); err == nil {
+			t.Errorf("%s: expected an error, got %v", name, addr)
+		}
+	}
+}
+
+func TestRelayProxyProtocol(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	received := make(chan string, 1)
+	go func() {
+		for {
+			c, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			line, _ := bufio.NewReader(c).ReadString('\n')
+			received <- line
+		}
+	}()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	r := New(upstream.Addr().String())
+	r.ProxyProtocol = true
+	go r.Serve(l)
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 51000 22\r\nSSH-2.0-client\r\n"))
+
+	// sshpiperd gets the stream without the header, and the connection is
+	// known by the address in it
+	if line := <-received; line != "SSH-2.0-client\r\n" {
+		t.Fatalf("expected the header stripped, got %q", line)
+	}
+	if open := r.Open(); len(open) != 1 || open["203.0.113.7:51000"].IsZero() {
+		t.Fatalf("expected the connection known by its proxied address, got %v", open)
+	}
+
+	// A connection without a header is refused
+	bare, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bare.Close()
+	bare.Write([]byte("SSH-2.0-client\r\n"))
+	if _, err := bufio.NewReader(bare).ReadString('\n'); err == nil {
+		t.Fatal("expected a connection without a PROXY header closed")
+	}
+	select {
+	case line := <-received:
+		t.Fatalf("expected nothing relayed without a header, got %q", line)
+	default:
+	}
+}
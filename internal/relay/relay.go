@@ -0,0 +1,209 @@
+// Package relay forwards SSH connections to sshpiperd and keeps track of them,
+// so that a single client connection can be closed on demand.
+package relay
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// proxyHeaderTimeout is how long a client may take to send its PROXY header.
+const proxyHeaderTimeout = 10 * time.Second
+
+// closedLinger is how long a closed connection's address mapping is kept, so
+// that sshpiperd's log of the close can still be translated.
+const closedLinger = time.Minute
+
+// Relay accepts client connections and pipes each to Upstream. sshpiperd sees
+// the relay's side of every connection, so Client maps the addresses it logs
+// back to the real clients. The zero value is not usable; use New.
+type Relay struct {
+	Upstream    string
+	DialTimeout time.Duration
+
+	// ProxyProtocol makes every connection start with a PROXY protocol
+	// header, as sent by a load balancer such as Fly's proxy. The client
+	// address is taken from the header, and connections without one are
+	// closed, so that clients cannot claim an address of their choosing.
+	ProxyProtocol bool
+
+	mu       sync.Mutex
+	byClient map[string]*conn
+	byLocal  map[string]*conn // by the relay's address on the upstream connection
+}
+
+type conn struct {
+	client   string
+	local    string
+	down, up net.Conn
+	openedAt time.Time
+	closedAt time.Time
+}
+
+// New returns a relay to the upstream address.
+func New(upstream string) *Relay {
+	return &Relay{
+		Upstream:    upstream,
+		DialTimeout: 10 * time.Second,
+		byClient:    make(map[string]*conn),
+		byLocal:     make(map[string]*conn),
+	}
+}
+
+// Serve accepts connections on l until it is closed. Other accept errors,
+// such as running out of file descriptors, are logged and retried with a
+// growing delay, as net/http does, so that they do not stop the relay.
+func (r *Relay) Serve(l net.Listener) {
+	var delay time.Duration
+	for {
+		down, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else {
+				delay = min(2*delay, time.Second)
+			}
+			log.Printf("relay: accept: %v; retrying in %s", err, delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		go r.handle(down)
+	}
+}
+
+func (r *Relay) handle(down net.Conn) {
+	if r.ProxyProtocol {
+		proxied, err := readProxied(down)
+		if err != nil {
+			log.Printf("relay: connection from %s: %v", down.RemoteAddr(), err)
+			down.Close()
+			return
+		}
+		down = proxied
+	}
+
+	up, err := net.DialTimeout("tcp", r.Upstream, r.DialTimeout)
+	if err != nil {
+		log.Printf("relay: dial %s for %s: %v", r.Upstream, down.RemoteAddr(), err)
+		down.Close()
+		return
+	}
+	c := &conn{client: down.RemoteAddr().String(), local: up.LocalAddr().String(), down: down, up: up, openedAt: time.Now()}
+	r.add(c)
+
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		// Either side ending ends the connection
+		dst.Close()
+		src.Close()
+		done <- struct{}{}
+	}
+	go pipe(up, down)
+	go pipe(down, up)
+	<-done
+	<-done
+	r.closed(c)
+}
+
+// readProxied reads the PROXY header that starts down and returns the
+// connection as seen from the client.
+func readProxied(down net.Conn) (net.Conn, error) {
+	down.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	br := bufio.NewReader(down)
+	remote, err := readProxyHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	down.SetReadDeadline(time.Time{})
+	if remote == nil {
+		remote = down.RemoteAddr()
+	}
+	return &proxiedConn{Conn: down, r: br, remote: remote}, nil
+}
+
+func (r *Relay) add(c *conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for _, old := range r.byLocal {
+		if !old.closedAt.IsZero() && now.Sub(old.closedAt) > closedLinger {
+			r.remove(old)
+		}
+	}
+	if old, ok := r.byClient[c.client]; ok {
+		r.remove(old)
+	}
+	if old, ok := r.byLocal[c.local]; ok {
+		r.remove(old)
+	}
+	r.byClient[c.client] = c
+	r.byLocal[c.local] = c
+}
+
+// remove drops c from both maps. r.mu must be held.
+func (r *Relay) remove(c *conn) {
+	if r.byClient[c.client] == c {
+		delete(r.byClient, c.client)
+	}
+	if r.byLocal[c.local] == c {
+		delete(r.byLocal, c.local)
+	}
+}
+
+func (r *Relay) closed(c *conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c.closedAt = time.Now()
+}
+
+// Client returns the client address of the connection the relay made from
+// local, the address sshpiperd reports as the remote. It reports false for
+// addresses the relay does not know, including connections that closed more
+// than a minute ago.
+func (r *Relay) Client(local string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.byLocal[local]
+	if !ok || (!c.closedAt.IsZero() && time.Since(c.closedAt) > closedLinger) {
+		return "", false
+	}
+	return c.client, true
+}
+
+// Open returns when each open connection was made, by client address.
+func (r *Relay) Open() map[string]time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	open := make(map[string]time.Time)
+	for client, c := range r.byClient {
+		if c.closedAt.IsZero() {
+			open[client] = c.openedAt
+		}
+	}
+	return open
+}
+
+// Disconnect closes the open connection from the client address and reports
+// whether there was one.
+func (r *Relay) Disconnect(client string) bool {
+	r.mu.Lock()
+	c, ok := r.byClient[client]
+	open := ok && c.closedAt.IsZero()
+	r.mu.Unlock()
+	if !open {
+		return false
+	}
+	c.down.Close()
+	c.up.Close()
+	return true
+}
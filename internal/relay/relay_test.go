@@ -0,0 +1,147 @@
+package relay
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRelay(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	remotes := make(chan string, 1)
+	go func() {
+		for {
+			c, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			remotes <- c.RemoteAddr().String()
+			go func() {
+				defer c.Close()
+				s := bufio.NewScanner(c)
+				for s.Scan() {
+					c.Write([]byte(s.Text() + "\n"))
+				}
+			}()
+		}
+	}()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	r := New(upstream.Addr().String())
+	go r.Serve(l)
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte("hello\n"))
+	reader := bufio.NewReader(client)
+	if line, err := reader.ReadString('\n'); err != nil || line != "hello\n" {
+		t.Fatalf("expected the echo piped back, got %q, %v", line, err)
+	}
+
+	// What sshpiperd sees as the remote maps back to the client
+	seen := <-remotes
+	if addr, ok := r.Client(seen); !ok || addr != client.LocalAddr().String() {
+		t.Fatalf("expected %s to map to %s, got %q %v", seen, client.LocalAddr(), addr, ok)
+	}
+	if _, ok := r.Client("127.0.0.1:1"); ok {
+		t.Fatal("expected an unknown address not to map")
+	}
+
+	if open := r.Open(); len(open) != 1 || open[client.LocalAddr().String()].IsZero() {
+		t.Fatalf("expected the client's connection open, got %v", open)
+	}
+
+	if r.Disconnect("203.0.113.7:22") {
+		t.Fatal("expected no connection from an unknown client")
+	}
+	if !r.Disconnect(client.LocalAddr().String()) {
+		t.Fatal("expected the client disconnected")
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := reader.ReadString('\n'); err == nil {
+		t.Fatal("expected the client connection closed")
+	}
+
+	// The mapping outlives the connection briefly, for sshpiperd's close log
+	time.Sleep(50 * time.Millisecond)
+	if _, ok := r.Client(seen); !ok {
+		t.Fatal("expected the closed connection still mapped")
+	}
+	if r.Disconnect(client.LocalAddr().String()) {
+		t.Fatal("expected a closed connection not to be disconnected again")
+	}
+	if open := r.Open(); len(open) != 0 {
+		t.Fatalf("expected no open connections, got %v", open)
+	}
+}
+
+// flakyListener fails its first accepts with errors other than a timeout.
+type flakyListener struct {
+	net.Listener
+	failures int
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures > 0 {
+		l.failures--
+		return nil, errors.New("accept: too many open files")
+	}
+	return l.Listener.Accept()
+}
+
+func TestServeSurvivesAcceptErrors(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	accepted := make(chan struct{}, 1)
+	go func() {
+		if c, err := upstream.Accept(); err == nil {
+			accepted <- struct{}{}
+			c.Close()
+		}
+	}()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		New(upstream.Addr().String()).Serve(&flakyListener{Listener: l, failures: 3})
+		close(done)
+	}()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	select {
+	case <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the relay to keep accepting after errors")
+	}
+
+	// Closing the listener is the only way out
+	l.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Serve to return once the listener is closed")
+	}
+}
@@ -0,0 +1,151 @@
+// Package schedule parses weekly access windows such as
+// "mon-fri 09:00-18:00; sat 10:00-14:00" and tests times against them.
+package schedule
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Schedule is a set of weekly windows in a location. A time is inside the
+// schedule when it falls in any window.
+type Schedule struct {
+	windows []window
+	loc     *time.Location
+}
+
+// window is a time-of-day range on some weekdays. A range that ends before
+// it starts runs past midnight into the next day.
+type window struct {
+	days       [7]bool // indexed by time.Weekday
+	start, end int     // minutes after midnight
+}
+
+var dayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// Parse parses a schedule: windows separated by ";", each an optional list
+// of days ("mon", "mon-fri", "sat,sun"; default every day) and an optional
+// time range ("09:00-18:00"; default all day). Times are read in the IANA
+// timezone tz, or UTC if it is empty.
+func Parse(spec, tz string) (*Schedule, error) {
+	s := &Schedule{loc: time.UTC}
+	if tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return nil, fmt.Errorf("unknown timezone %q", tz)
+		}
+		s.loc = loc
+	}
+	for _, part := range strings.Split(spec, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		w, err := parseWindow(part)
+		if err != nil {
+			return nil, err
+		}
+		s.windows = append(s.windows, w)
+	}
+	if len(s.windows) == 0 {
+		return nil, fmt.Errorf("schedule %q has no windows", spec)
+	}
+	return s, nil
+}
+
+func parseWindow(s string) (window, error) {
+	w := window{start: 0, end: 24 * 60}
+	fields := strings.Fields(strings.ToLower(s))
+	if len(fields) > 2 {
+		return w, fmt.Errorf("window %q: expected days and a time range, like \"mon-fri 09:00-18:00\"", s)
+	}
+	var days, times string
+	for _, f := range fields {
+		if strings.Contains(f, ":") {
+			times = f
+		} else {
+			days = f
+		}
+	}
+	if len(fields) == 2 && (days == "" || times == "") {
+		return w, fmt.Errorf("window %q: expected days and a time range, like \"mon-fri 09:00-18:00\"", s)
+	}
+
+	if days == "" {
+		for d := range w.days {
+			w.days[d] = true
+		}
+	} else {
+		for _, r := range strings.Split(days, ",") {
+			from, to, isRange := strings.Cut(r, "-")
+			first, ok := dayNames[from]
+			last := first
+			if isRange {
+				var okTo bool
+				last, okTo = dayNames[to]
+				ok = ok && okTo
+			}
+			if !ok {
+				return w, fmt.Errorf("window %q: unknown day %q", s, r)
+			}
+			// Ranges may wrap, as in fri-mon
+			for d := first; ; d = (d + 1) % 7 {
+				w.days[d] = true
+				if d == last {
+					break
+				}
+			}
+		}
+	}
+
+	if times != "" {
+		var sh, sm, eh, em int
+		if n, err := fmt.Sscanf(times, "%d:%d-%d:%d", &sh, &sm, &eh, &em); err != nil || n != 4 {
+			return w, fmt.Errorf("window %q: time range must look like 09:00-18:00", s)
+		}
+		if sh < 0 || sh > 23 || sm < 0 || sm > 59 || eh < 0 || eh > 24 || em < 0 || em > 59 || (eh == 24 && em != 0) {
+			return w, fmt.Errorf("window %q: invalid time", s)
+		}
+		w.start, w.end = sh*60+sm, eh*60+em
+		if w.start == w.end {
+			return w, fmt.Errorf("window %q is empty", s)
+		}
+	}
+	return w, nil
+}
+
+// Contains reports whether t is inside the schedule.
+func (s *Schedule) Contains(t time.Time) bool {
+	t = t.In(s.loc)
+	day, m := t.Weekday(), t.Hour()*60+t.Minute()
+	for _, w := range s.windows {
+		if w.start < w.end {
+			if w.days[day] && m >= w.start && m < w.end {
+				return true
+			}
+			continue
+		}
+		// Past midnight the window belongs to the day it started on
+		if (w.days[day] && m >= w.start) || (w.days[(day+6)%7] && m < w.end) {
+			return true
+		}
+	}
+	return false
+}
+
+// Open reports whether t is inside the schedule spec in timezone tz. An
+// empty spec is always open; an invalid one is never open.
+func Open(spec, tz string, t time.Time) bool {
+	if spec == "" {
+		return true
+	}
+	s, err := Parse(spec, tz)
+	if err != nil {
+		return false
+	}
+	return s.Contains(t)
+}
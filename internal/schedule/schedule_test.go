@@ -0,0 +1,80 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestContains(t *testing.T) {
+	london, _ := time.LoadLocation("Europe/London")
+	at := func(s string) time.Time {
+		t.Helper()
+		v, err := time.ParseInLocation("Mon 2006-01-02 15:04", s, london)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	s, err := Parse("mon-fri 09:00-18:00; sat 10:00-12:00", "Europe/London")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for when, want := range map[string]bool{
+		"Mon 2026-10-19 09:00": true,
+		"Mon 2026-10-19 08:59": false,
+		"Fri 2026-10-23 17:59": true,
+		"Fri 2026-10-23 18:00": false,
+		"Sat 2026-10-24 11:00": true,
+		"Sat 2026-10-24 12:00": false,
+		"Sun 2026-10-25 11:00": false,
+	} {
+		if got := s.Contains(at(when)); got != want {
+			t.Errorf("%s: expected %v, got %v", when, want, got)
+		}
+	}
+	// The timezone applies, including across DST: 09:30 in London is 08:30 UTC in summer
+	if !s.Contains(time.Date(2026, 7, 6, 8, 30, 0, 0, time.UTC)) {
+		t.Error("expected the window read in London time")
+	}
+}
+
+func TestWrappingWindows(t *testing.T) {
+	s, err := Parse("fri-mon 22:00-06:00", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for when, want := range map[time.Time]bool{
+		time.Date(2026, 10, 23, 23, 0, 0, 0, time.UTC): true,  // Friday night
+		time.Date(2026, 10, 24, 5, 59, 0, 0, time.UTC): true,  // early Saturday, Friday's window
+		time.Date(2026, 10, 27, 5, 0, 0, 0, time.UTC):  true,  // early Tuesday, Monday's window
+		time.Date(2026, 10, 27, 23, 0, 0, 0, time.UTC): false, // Tuesday night
+		time.Date(2026, 10, 23, 5, 0, 0, 0, time.UTC):  false, // early Friday, Thursday's window
+	} {
+		if got := s.Contains(when); got != want {
+			t.Errorf("%s: expected %v, got %v", when.Format(time.RFC1123), want, got)
+		}
+	}
+
+	weekend, _ := Parse("sat,sun", "")
+	if !weekend.Contains(time.Date(2026, 10, 25, 3, 0, 0, 0, time.UTC)) || weekend.Contains(time.Date(2026, 10, 26, 3, 0, 0, 0, time.UTC)) {
+		t.Error("expected a days-only window to cover whole days")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, spec := range []string{"", ";", "mon-fry 09:00-17:00", "mon 9-17", "mon 25:00-26:00", "mon 09:00-09:00", "mon tue 09:00-17:00"} {
+		if _, err := Parse(spec, ""); err == nil {
+			t.Errorf("expected an error for %q", spec)
+		}
+	}
+	if _, err := Parse("mon", "Mars/Olympus"); err == nil {
+		t.Error("expected an error for an unknown timezone")
+	}
+	if Open("mon", "Mars/Olympus", time.Now()) {
+		t.Error("expected an invalid schedule never to be open")
+	}
+	if !Open("", "", time.Now()) {
+		t.Error("expected no schedule to be always open")
+	}
+}
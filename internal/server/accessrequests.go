@@ -0,0 +1,399 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/alert"
+	"github.com/LipJ01/fly-ssh-bastion/internal/db"
+)
+
+const (
+	// maxAccessDuration caps how long an approved request grants access.
+	maxAccessDuration = 30 * 24 * time.Hour
+	// accessRequestTTL is how long a request waits for a decision.
+	accessRequestTTL = 7 * 24 * time.Hour
+	// accessRequestRetention is how long decided requests are kept.
+	accessRequestRetention = 90 * 24 * time.Hour
+	// maxPendingAccessRequests limits the requests waiting on one machine,
+	// since anyone can submit them.
+	maxPendingAccessRequests = 20
+
+	maxRequesterLength    = 100
+	maxAccessReasonLength = 1000
+)
+
+// CreateAccessRequest asks a machine's owner for temporary access with a
+// public key. It needs no credentials: the request does nothing until the
+// owner or an admin approves it. Every well-formed request gets the same
+// response, so that it reveals nothing about which machines exist, their
+// state or their keys; requests that cannot be granted are logged and
+// dropped. The request is checked, stored and notified only after the
+// response is written, so that its timing gives nothing away either.
+func (h *Handlers) CreateAccessRequest(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Requester  string   `json:"requester"`
+		PublicKey  string   `json:"public_key"`
+		LocalUsers []string `json:"local_users"`
+		Reason     string   `json:"reason"`
+		Duration   string   `json:"duration"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	// Both end up in notification emails, so they are kept to one line
+	req.Requester = strings.Join(strings.Fields(req.Requester), " ")
+	req.Reason = strings.Join(strings.Fields(req.Reason), " ")
+	if strings.IndexFunc(req.Requester+req.Reason, unicode.IsControl) >= 0 {
+		jsonError(w, "requester and reason must not contain control characters", http.StatusBadRequest)
+		return
+	}
+	if req.Requester == "" || req.Reason == "" || req.PublicKey == "" || req.Duration == "" {
+		jsonError(w, "requester, reason, public_key and duration are required", http.StatusBadRequest)
+		return
+	}
+	if len(req.Requester) > maxRequesterLength || len(req.Reason) > maxAccessReasonLength {
+		jsonError(w, fmt.Sprintf("requester is limited to %d bytes and reason to %d", maxRequesterLength, maxAccessReasonLength), http.StatusBadRequest)
+		return
+	}
+	duration, err := parseAccessDuration(req.Duration)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	parsed, err := h.validatePublicKey(req.PublicKey)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	a := &db.AccessRequest{
+		MachineName:     chi.URLParam(r, "name"),
+		Requester:       req.Requester,
+		PublicKey:       strings.TrimSpace(req.PublicKey),
+		Fingerprint:     parsed.Fingerprint,
+		LocalUsers:      req.LocalUsers,
+		Reason:          req.Reason,
+		DurationSeconds: int64(duration / time.Second),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(`{"status":"submitted"}`))
+
+	// A requester who disconnects must not stop the owner being asked
+	ctx := context.WithoutCancel(r.Context())
+	h.accessRequests.Add(1)
+	go func() {
+		defer h.accessRequests.Done()
+		h.accessRequestsMu.Lock()
+		defer h.accessRequestsMu.Unlock()
+		if err := h.submitAccessRequest(ctx, a); err != nil {
+			log.Printf("Access request from %s for %q dropped: %v", a.Requester, a.MachineName, err)
+		}
+	}()
+}
+
+// submitAccessRequest stores a request and notifies the machine's owner, or
+// returns why the request cannot be granted.
+func (h *Handlers) submitAccessRequest(ctx context.Context, a *db.AccessRequest) error {
+	m, err := h.DB.GetMachine(a.MachineName)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return errors.New("machine not found")
+	}
+	if !m.IsActive() {
+		return errors.New("machine is " + m.State)
+	}
+	revoked, err := h.DB.IsRevoked(a.Fingerprint)
+	if err != nil {
+		return err
+	}
+	if revoked {
+		return errors.New("key has been revoked")
+	}
+	if err := h.checkLocalUsers(m, a.LocalUsers); err != nil {
+		return err
+	}
+	keys, err := h.DB.ListAccessKeys(m.Name)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if k.Fingerprint == a.Fingerprint {
+			return errors.New("key already has access")
+		}
+	}
+	pending, err := h.DB.ListAccessRequests(db.AccessRequestFilter{Machine: m.Name, Status: db.AccessRequestPending})
+	if err != nil {
+		return err
+	}
+	for _, p := range pending {
+		if p.Fingerprint == a.Fingerprint {
+			return fmt.Errorf("key already has a pending request (%d)", p.ID)
+		}
+	}
+	if len(pending) >= maxPendingAccessRequests {
+		return errors.New("too many pending access requests")
+	}
+
+	if err := h.DB.CreateAccessRequest(a); err != nil {
+		return err
+	}
+	duration := time.Duration(a.DurationSeconds) * time.Second
+	log.Printf("Access request %d: %s requests %s on %s", a.ID, a.Requester, duration, m.Name)
+
+	if h.Alerts != nil {
+		n := alert.Notification{Event: alert.EventAccessRequested, Machine: m.Name, Owner: m.Owner, Tags: m.Tags,
+			Time: a.CreatedAt, RequestID: a.ID, Requester: a.Requester, Reason: a.Reason, Duration: duration.String()}
+		if err := h.Alerts.NotifyAccessRequest(ctx, n); err != nil {
+			log.Printf("error sending access request notification: %v", err)
+		}
+	}
+	return nil
+}
+
+// parseAccessDuration parses a requested access duration.
+func parseAccessDuration(s string) (time.Duration, error) {
+	d, err := parseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	if d < time.Minute || d > maxAccessDuration {
+		return 0, fmt.Errorf("duration must be between 1m and %s", maxAccessDuration)
+	}
+	return d.Truncate(time.Second), nil
+}
+
+// accessDecider returns who decides a request for a machine owned by owner:
+// "admin" for the API key, or the owner for their owner token. It returns ""
+// for anyone else.
+func accessDecider(r *http.Request, owner string) string {
+	c := callerFrom(r)
+	switch {
+	case c.admin:
+		return "admin"
+	case c.owner != "" && c.owner == owner:
+		return c.owner
+	}
+	return ""
+}
+
+// ListAccessRequests lists access requests, newest first: all of them for
+// the API key, or those for the owner's machines for an owner token.
+// ?status= and ?machine= filter them.
+func (h *Handlers) ListAccessRequests(w http.ResponseWriter, r *http.Request) {
+	f := db.AccessRequestFilter{
+		Machine: r.URL.Query().Get("machine"),
+		Status:  r.URL.Query().Get("status"),
+	}
+	switch f.Status {
+	case "", db.AccessRequestPending, db.AccessRequestApproved, db.AccessRequestDenied, db.AccessRequestExpired:
+	default:
+		jsonError(w, "invalid status", http.StatusBadRequest)
+		return
+	}
+	if c := callerFrom(r); !c.admin {
+		f.Owner = c.owner
+	}
+
+	requests, err := h.DB.ListAccessRequests(f)
+	if err != nil {
+		log.Printf("error listing access requests: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(requests)
+}
+
+// pendingRequest loads the request named in the URL and checks that the
+// caller may decide it. It writes an error and returns nil otherwise.
+func (h *Handlers) pendingRequest(w http.ResponseWriter, r *http.Request) (*db.AccessRequest, *db.Machine, string) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		jsonError(w, "invalid request id", http.StatusBadRequest)
+		return nil, nil, ""
+	}
+	a, err := h.DB.GetAccessRequest(id)
+	if err != nil {
+		log.Printf("error getting access request: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return nil, nil, ""
+	}
+	if a == nil {
+		jsonError(w, "access request not found", http.StatusNotFound)
+		return nil, nil, ""
+	}
+	m, err := h.DB.GetMachine(a.MachineName)
+	if err != nil {
+		log.Printf("error getting machine: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return nil, nil, ""
+	}
+	// Requests for another owner's machines are not theirs to know about
+	decider := ""
+	if m != nil {
+		decider = accessDecider(r, m.Owner)
+	}
+	if decider == "" {
+		jsonError(w, "access request not found", http.StatusNotFound)
+		return nil, nil, ""
+	}
+	if a.Status != db.AccessRequestPending {
+		jsonError(w, "access request is already "+a.Status, http.StatusConflict)
+		return nil, nil, ""
+	}
+	return a, m, decider
+}
+
+// ApproveAccessRequest grants a pending request's key to its machine as an
+// access key that expires after the requested duration, or the one given.
+func (h *Handlers) ApproveAccessRequest(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Duration string `json:"duration"`
+		Note     string `json:"note"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			jsonError(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+	}
+	a, m, decider := h.pendingRequest(w, r)
+	if a == nil {
+		return
+	}
+	if !m.IsActive() {
+		jsonError(w, "machine is not active", http.StatusConflict)
+		return
+	}
+	duration := time.Duration(a.DurationSeconds) * time.Second
+	if req.Duration != "" {
+		d, err := parseAccessDuration(req.Duration)
+		if err != nil {
+			jsonError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		duration = d
+	}
+	// The key may have been revoked while the request waited
+	if h.rejectRevoked(w, a.Fingerprint) {
+		return
+	}
+
+	label := fmt.Sprintf("%s (access request %d)", a.Requester, a.ID)
+	key, err := h.DB.ApproveAccessRequest(a.ID, decider, strings.TrimSpace(req.Note), label, duration)
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrAccessRequestDecided):
+			jsonError(w, err.Error(), http.StatusConflict)
+		case strings.Contains(err.Error(), "UNIQUE"):
+			jsonError(w, "key already added to this machine", http.StatusConflict)
+		default:
+			log.Printf("error approving access request: %v", err)
+			jsonError(w, "failed to approve access request", http.StatusInternalServerError)
+		}
+		return
+	}
+	log.Printf("Access request %d approved by %s: %s on %s until %s", a.ID, decider, a.Requester, a.MachineName,
+		key.ExpiresAt.Format(time.RFC3339))
+
+	if err := h.Gen.WriteAccessKey(a.MachineName, key.ID, key.PublicKey); err != nil {
+		log.Printf("error writing access key file: %v", err)
+	}
+	if err := h.RegenerateConfig(); err != nil {
+		log.Printf("error regenerating config: %v", err)
+	}
+
+	a, err = h.DB.GetAccessRequest(a.ID)
+	if err != nil || a == nil {
+		log.Printf("error getting access request: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"request": a, "key": key})
+}
+
+// DenyAccessRequest turns down a pending request.
+func (h *Handlers) DenyAccessRequest(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Note string `json:"note"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			jsonError(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+	}
+	a, _, decider := h.pendingRequest(w, r)
+	if a == nil {
+		return
+	}
+	if err := h.DB.DenyAccessRequest(a.ID, decider, strings.TrimSpace(req.Note)); err != nil {
+		if errors.Is(err, db.ErrAccessRequestDecided) {
+			jsonError(w, err.Error(), http.StatusConflict)
+			return
+		}
+		log.Printf("error denying access request: %v", err)
+		jsonError(w, "failed to deny access request", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Access request %d denied by %s", a.ID, decider)
+
+	a, err := h.DB.GetAccessRequest(a.ID)
+	if err != nil || a == nil {
+		log.Printf("error getting access request: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a)
+}
+
+// expireAccess ends pending requests nobody decided, drops old decided ones
+// and removes access keys whose time is up, closing their sessions.
+func (h *Handlers) expireAccess(now time.Time) {
+	if n, err := h.DB.ExpireAccessRequests(now.Add(-accessRequestTTL)); err != nil {
+		log.Printf("error expiring access requests: %v", err)
+	} else if n > 0 {
+		log.Printf("Expired %d access requests left undecided for %s", n, accessRequestTTL)
+	}
+	if n, err := h.DB.PurgeAccessRequests(now.Add(-accessRequestRetention)); err != nil {
+		log.Printf("error purging access requests: %v", err)
+	} else if n > 0 {
+		log.Printf("Removed %d access requests decided more than %s ago", n, accessRequestRetention)
+	}
+
+	keys, err := h.DB.PurgeExpiredAccessKeys(now)
+	if err != nil {
+		log.Printf("error purging expired access keys: %v", err)
+		return
+	}
+	if len(keys) == 0 {
+		return
+	}
+	log.Printf("Removed %d expired access keys", len(keys))
+	for _, k := range keys {
+		_ = h.Gen.RemoveAccessKey(k.MachineName, k.ID)
+	}
+	if err := h.RegenerateConfig(); err != nil {
+		log.Printf("error regenerating config: %v", err)
+	}
+	for i := range keys {
+		h.disconnectKeySessions(&keys[i], "access key expired")
+	}
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/alert"
+	"github.com/LipJ01/fly-ssh-bastion/internal/db"
+)
+
+// requestAccess submits an access request without credentials.
+func requestAccess(t *testing.T, url, machine string, body map[string]any) *http.Response {
+	t.Helper()
+	var buf bytes.Buffer
+	json.NewEncoder(&buf).Encode(body)
+	resp, err := http.Post(url+"/api/machines/"+machine+"/access-requests", "application/json", &buf)
+	if err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func createOwnerToken(t *testing.T, url, owner string) string {
+	t.Helper()
+	resp := authRequest(t, "POST", url+"/api/owner-tokens", map[string]string{"owner": owner})
+	defer resp.Body.Close()
+	var result ownerTokenResponse
+	json.NewDecoder(resp.Body).Decode(&result)
+	if resp.StatusCode != http.StatusCreated || result.Token == "" {
+		t.Fatalf("expected an owner token, got %d", resp.StatusCode)
+	}
+	return result.Token
+}
+
+func TestAccessRequestApproval(t *testing.T) {
+	alerts, err := alert.Parse([]byte("rules: []\n"))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	sink := &recordingSink{}
+	alerts.AddSink("test", sink)
+
+	var h *Handlers
+	srv, database := setupTestServerWith(t, func(handlers *Handlers) {
+		handlers.Alerts = alerts
+		h = handlers
+	})
+	_, nas := registerMachine(t, srv.URL, map[string]any{"name": "nas", "owner": "alice", "local_user": "u", "public_key": testKey(t)})
+	registerMachine(t, srv.URL, map[string]any{"name": "pi", "owner": "bob", "local_user": "u", "public_key": testKey(t)})
+	alice, bob := createOwnerToken(t, srv.URL, "alice"), createOwnerToken(t, srv.URL, "bob")
+
+	pub := testKey(t)
+	for _, body := range []map[string]any{
+		{"requester": "carol", "public_key": pub, "duration": "1h"},
+		{"requester": "carol", "public_key": pub, "reason": "x", "duration": "90d"},
+	} {
+		if resp := requestAccess(t, srv.URL, "nas", body); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%v: expected 400, got %d", body, resp.StatusCode)
+		}
+	}
+
+	// A duplicate request and one for a machine that does not exist get the
+	// same answer as a real one, and store nothing
+	body := map[string]any{"requester": "carol", "public_key": pub, "reason": "fix the backups", "duration": "2h"}
+	for _, machine := range []string{"nas", "nas", "ghost"} {
+		if resp := requestAccess(t, srv.URL, machine, body); resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("%s: expected 202, got %d", machine, resp.StatusCode)
+		}
+	}
+	h.accessRequests.Wait()
+	requests, _ := database.ListAccessRequests(db.AccessRequestFilter{})
+	if len(requests) != 1 || requests[0].MachineName != "nas" || requests[0].Status != db.AccessRequestPending || requests[0].DurationSeconds != 7200 {
+		t.Fatalf("expected one pending request, got %+v", requests)
+	}
+	a := requests[0]
+	if len(sink.got) != 1 || sink.got[0].Event != alert.EventAccessRequested || sink.got[0].RequestID != a.ID ||
+		sink.got[0].Owner != "alice" || sink.got[0].Requester != "carol" {
+		t.Fatalf("expected the owner notified, got %+v", sink.got)
+	}
+
+	// A machine token decides nothing, even for its own owner's machines
+	resp := tokenRequest(t, "GET", srv.URL+"/api/access-requests", "X-Machine-Token", nas.MachineToken, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected a machine token to be refused, got %d", resp.StatusCode)
+	}
+
+	// Another owner can neither see nor decide the request
+	resp = tokenRequest(t, "GET", srv.URL+"/api/access-requests", "X-Owner-Token", bob, nil)
+	var list []db.AccessRequest
+	json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if len(list) != 0 {
+		t.Fatalf("expected bob to see no requests, got %+v", list)
+	}
+	approveURL := fmt.Sprintf("%s/api/access-requests/%d/approve", srv.URL, a.ID)
+	resp = tokenRequest(t, "POST", approveURL, "X-Owner-Token", bob, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for another owner, got %d", resp.StatusCode)
+	}
+
+	// The owner approves with their owner token
+	resp = tokenRequest(t, "GET", srv.URL+"/api/access-requests?status=pending", "X-Owner-Token", alice, nil)
+	json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if len(list) != 1 || list[0].ID != a.ID {
+		t.Fatalf("expected alice to see the request, got %+v", list)
+	}
+	resp = tokenRequest(t, "POST", approveURL, "X-Owner-Token", alice, map[string]any{"duration": "1h", "note": "go ahead"})
+	var approved struct {
+		Request db.AccessRequest `json:"request"`
+		Key     db.AccessKey     `json:"key"`
+	}
+	json.NewDecoder(resp.Body).Decode(&approved)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || approved.Request.Status != db.AccessRequestApproved || approved.Request.DecidedBy != "alice" ||
+		approved.Key.ExpiresAt == nil || time.Until(*approved.Key.ExpiresAt) > time.Hour {
+		t.Fatalf("expected the request approved for an hour, got %d %+v", resp.StatusCode, approved)
+	}
+	data, _ := os.ReadFile(h.Gen.ConfigPath)
+	if !strings.Contains(string(data), fmt.Sprintf("nas_ak_%d", approved.Key.ID)) {
+		t.Fatalf("expected the granted key in the config:\n%s", data)
+	}
+	resp = authRequest(t, "POST", approveURL, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected approving twice to conflict, got %d", resp.StatusCode)
+	}
+
+	// Once the key expires, maintenance removes it from the config
+	h.expireAccess(approved.Key.ExpiresAt.Add(time.Second))
+	if keys, _ := database.ListAccessKeys("nas"); len(keys) != 0 {
+		t.Fatalf("expected the expired key removed, got %+v", keys)
+	}
+	data, _ = os.ReadFile(h.Gen.ConfigPath)
+	if strings.Contains(string(data), fmt.Sprintf("nas_ak_%d", approved.Key.ID)) {
+		t.Fatalf("expected the expired key out of the config:\n%s", data)
+	}
+}
+
+func TestAccessRequestDenial(t *testing.T) {
+	var h *Handlers
+	srv, database := setupTestServerWith(t, func(handlers *Handlers) { h = handlers })
+	registerMachine(t, srv.URL, map[string]any{"name": "nas", "owner": "alice", "local_user": "u", "public_key": testKey(t)})
+
+	requestAccess(t, srv.URL, "nas", map[string]any{"requester": "carol", "public_key": testKey(t), "reason": "x", "duration": "1d"})
+	h.accessRequests.Wait()
+	requests, _ := database.ListAccessRequests(db.AccessRequestFilter{})
+	if len(requests) != 1 {
+		t.Fatalf("expected one request, got %+v", requests)
+	}
+	a := requests[0]
+	resp := authRequest(t, "POST", fmt.Sprintf("%s/api/access-requests/%d/deny", srv.URL, a.ID), map[string]any{"note": "not today"})
+	var denied db.AccessRequest
+	json.NewDecoder(resp.Body).Decode(&denied)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || denied.Status != db.AccessRequestDenied || denied.DecidedBy != "admin" || denied.Note != "not today" {
+		t.Fatalf("expected the request denied, got %d %+v", resp.StatusCode, denied)
+	}
+	if keys, _ := database.ListAccessKeys("nas"); len(keys) != 0 {
+		t.Fatalf("expected no key granted, got %+v", keys)
+	}
+	resp = authRequest(t, "POST", fmt.Sprintf("%s/api/access-requests/%d/approve", srv.URL, a.ID), nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected a denied request not to be approved, got %d", resp.StatusCode)
+	}
+}
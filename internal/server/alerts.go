@@ -0,0 +1,134 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/alert"
+	"github.com/LipJ01/fly-ssh-bastion/internal/db"
+)
+
+// alertRetention is how long resolved alerts are kept.
+const alertRetention = 90 * 24 * time.Hour
+
+func alertKey(rule, machine string) string {
+	return rule + "\x00" + machine
+}
+
+// evaluateAlerts fires alerts for matching machines that have been offline
+// too long and resolves alerts whose machine is back. Alerts are recorded
+// before they are sent, so a rule notifies once per outage.
+func (h *Handlers) evaluateAlerts(ctx context.Context, now time.Time) {
+	if h.Alerts == nil {
+		return
+	}
+	machines, err := h.DB.ListMachines()
+	if err != nil {
+		log.Printf("error listing machines for alerts: %v", err)
+		return
+	}
+	alerts, err := h.DB.ListAlerts(db.AlertFilter{State: db.AlertFiring})
+	if err != nil {
+		log.Printf("error listing alerts: %v", err)
+		return
+	}
+	firing := make(map[string]db.Alert, len(alerts))
+	for _, a := range alerts {
+		firing[alertKey(a.Rule, a.MachineName)] = a
+	}
+
+	for i := range h.Alerts.Rules {
+		rule := &h.Alerts.Rules[i]
+		for _, m := range machines {
+			if !m.IsActive() {
+				continue
+			}
+			target := alert.Target{Name: m.Name, Owner: m.Owner, Tags: m.Tags, CreatedAt: m.CreatedAt, LastSeen: m.LastSeen}
+			if !rule.Matches(target) {
+				continue
+			}
+			key := alertKey(rule.Name, m.Name)
+			offline := rule.Offline(target, now)
+			n := alert.Notification{Rule: rule.Name, Machine: m.Name, Owner: m.Owner, Tags: m.Tags,
+				LastSeen: m.LastSeen, OfflineSince: alert.OfflineSince(target), Time: now}
+
+			if a, ok := firing[key]; ok {
+				delete(firing, key)
+				if offline {
+					continue
+				}
+				if ok, err := h.DB.ResolveAlert(a.ID, now); err != nil || !ok {
+					if err != nil {
+						log.Printf("error resolving alert: %v", err)
+					}
+					continue
+				}
+				n.Event, n.OfflineSince = alert.EventResolved, a.OfflineSince
+				log.Printf("Alert %q resolved for %s", rule.Name, m.Name)
+				if err := h.Alerts.Notify(ctx, rule, n); err != nil {
+					log.Printf("error sending alert: %v", err)
+				}
+				continue
+			}
+
+			if !offline || !rule.Active(now) {
+				continue
+			}
+			fired, err := h.DB.FireAlert(rule.Name, m.Name, n.OfflineSince, now)
+			if err != nil {
+				log.Printf("error recording alert: %v", err)
+				continue
+			}
+			if !fired {
+				continue
+			}
+			n.Event = alert.EventFiring
+			log.Printf("Alert %q firing for %s", rule.Name, m.Name)
+			if err := h.Alerts.Notify(ctx, rule, n); err != nil {
+				log.Printf("error sending alert: %v", err)
+			}
+		}
+	}
+
+	// The rest no longer apply: the rule was removed, the machine stopped
+	// matching it or is no longer active. Resolve them without notifying.
+	for _, a := range firing {
+		if _, err := h.DB.ResolveAlert(a.ID, now); err != nil {
+			log.Printf("error resolving alert: %v", err)
+			continue
+		}
+		log.Printf("Alert %q for %s no longer applies; resolved", a.Rule, a.MachineName)
+	}
+}
+
+// ListAlerts returns alerts, most recent first, optionally filtered by
+// ?state=firing|resolved and ?machine=.
+func (h *Handlers) ListAlerts(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := db.AlertFilter{State: q.Get("state"), Machine: q.Get("machine"), Limit: 100}
+	if filter.State != "" && filter.State != db.AlertFiring && filter.State != db.AlertResolved {
+		jsonError(w, `state must be "firing" or "resolved"`, http.StatusBadRequest)
+		return
+	}
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			jsonError(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		filter.Limit = min(n, 1000)
+	}
+
+	alerts, err := h.DB.ListAlerts(filter)
+	if err != nil {
+		log.Printf("error listing alerts: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(alerts)
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/alert"
+	"github.com/LipJ01/fly-ssh-bastion/internal/db"
+)
+
+type recordingSink struct{ got []alert.Notification }
+
+func (s *recordingSink) Send(_ context.Context, n alert.Notification) error {
+	s.got = append(s.got, n)
+	return nil
+}
+
+func TestOfflineAlerts(t *testing.T) {
+	alerts, err := alert.Parse([]byte(`
+rules:
+  - name: prod-offline
+    tags: [prod]
+    offline_for: 15m
+`))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	sink := &recordingSink{}
+	alerts.AddSink("test", sink)
+
+	var h *Handlers
+	srv, _ := setupTestServerWith(t, func(handlers *Handlers) {
+		handlers.Alerts = alerts
+		h = handlers
+	})
+	_, reg := registerMachine(t, srv.URL, map[string]any{"name": "nas", "owner": "a", "local_user": "u", "public_key": testKey(t), "tags": []string{"prod"}})
+	registerMachine(t, srv.URL, map[string]any{"name": "lab", "owner": "a", "local_user": "u", "public_key": testKey(t)})
+
+	// Nothing fires until the machine has been quiet for 15 minutes
+	h.evaluateAlerts(context.Background(), time.Now())
+	if len(sink.got) != 0 {
+		t.Fatalf("expected no alerts yet, got %+v", sink.got)
+	}
+
+	later := time.Now().Add(time.Hour)
+	h.evaluateAlerts(context.Background(), later)
+	h.evaluateAlerts(context.Background(), later.Add(time.Minute))
+	if len(sink.got) != 1 || sink.got[0].Event != alert.EventFiring || sink.got[0].Machine != "nas" {
+		t.Fatalf("expected one firing alert for nas, got %+v", sink.got)
+	}
+
+	resp := authRequest(t, "GET", srv.URL+"/api/alerts?state=firing", nil)
+	var listed []db.Alert
+	json.NewDecoder(resp.Body).Decode(&listed)
+	resp.Body.Close()
+	if len(listed) != 1 || listed[0].Rule != "prod-offline" || listed[0].MachineName != "nas" {
+		t.Fatalf("unexpected firing alerts %+v", listed)
+	}
+
+	// A heartbeat brings the machine back and resolves the alert
+	resp = tokenRequest(t, "POST", srv.URL+"/api/heartbeat", "X-Machine-Token", reg.MachineToken, map[string]any{"name": "nas"})
+	resp.Body.Close()
+	h.evaluateAlerts(context.Background(), time.Now())
+	if len(sink.got) != 2 || sink.got[1].Event != alert.EventResolved {
+		t.Fatalf("expected a resolved notification, got %+v", sink.got)
+	}
+
+	resp = authRequest(t, "GET", srv.URL+"/api/alerts?state=resolved", nil)
+	json.NewDecoder(resp.Body).Decode(&listed)
+	resp.Body.Close()
+	if len(listed) != 1 || listed[0].ResolvedAt == nil {
+		t.Fatalf("unexpected resolved alerts %+v", listed)
+	}
+
+	resp = authRequest(t, "GET", srv.URL+"/api/alerts?state=bogus", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown state, got %d", resp.StatusCode)
+	}
+}
+
+func TestAlertsOutsideHoursAndStaleRules(t *testing.T) {
+	alerts, _ := alert.Parse([]byte(`
+rules:
+  - name: office
+    hours: "09:00-18:00"
+`))
+	sink := &recordingSink{}
+	alerts.AddSink("test", sink)
+
+	var h *Handlers
+	srv, _ := setupTestServerWith(t, func(handlers *Handlers) {
+		handlers.Alerts = alerts
+		h = handlers
+	})
+	registerMachine(t, srv.URL, map[string]any{"name": "nas", "owner": "a", "local_user": "u", "public_key": testKey(t)})
+
+	night := time.Now().UTC().Add(48 * time.Hour).Truncate(24 * time.Hour).Add(2 * time.Hour)
+	h.evaluateAlerts(context.Background(), night)
+	if len(sink.got) != 0 {
+		t.Fatalf("expected no alert outside hours, got %+v", sink.got)
+	}
+	h.evaluateAlerts(context.Background(), night.Add(8*time.Hour))
+	if len(sink.got) != 1 {
+		t.Fatalf("expected an alert in hours, got %+v", sink.got)
+	}
+
+	// Dropping the rule resolves its alerts quietly
+	alerts.Rules = nil
+	h.evaluateAlerts(context.Background(), night.Add(9*time.Hour))
+	firing, _ := h.DB.ListAlerts(db.AlertFilter{State: db.AlertFiring})
+	if len(firing) != 0 || len(sink.got) != 1 {
+		t.Fatalf("expected the stale alert resolved without notifying, got %+v", firing)
+	}
+}
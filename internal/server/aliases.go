@@ -0,0 +1,113 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/db"
+)
+
+func (h *Handlers) AddAlias(w http.ResponseWriter, r *http.Request) {
+	machineName := chi.URLParam(r, "name")
+
+	machine, err := h.DB.GetMachine(machineName)
+	if err != nil {
+		log.Printf("error getting machine: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if machine == nil {
+		jsonError(w, "machine not found", http.StatusNotFound)
+		return
+	}
+
+	var req struct {
+		Alias string `json:"alias"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if req.Alias == "" {
+		jsonError(w, "alias is required", http.StatusBadRequest)
+		return
+	}
+	if !validName.MatchString(req.Alias) {
+		jsonError(w, "invalid alias: must be alphanumeric with optional dots, hyphens, underscores (max 64 chars)", http.StatusBadRequest)
+		return
+	}
+	taken, err := h.DB.NameTaken(req.Alias)
+	if err != nil {
+		log.Printf("error checking name: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		jsonError(w, fmt.Sprintf("name %q is already used by a machine or alias", req.Alias), http.StatusConflict)
+		return
+	}
+
+	alias, err := h.DB.AddAlias(machineName, req.Alias)
+	if err != nil {
+		log.Printf("error adding alias: %v", err)
+		jsonError(w, "failed to add alias", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.RegenerateConfig(); err != nil {
+		log.Printf("error regenerating config: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(alias)
+}
+
+func (h *Handlers) ListAliases(w http.ResponseWriter, r *http.Request) {
+	machineName := chi.URLParam(r, "name")
+
+	machine, err := h.DB.GetMachine(machineName)
+	if err != nil {
+		log.Printf("error getting machine: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if machine == nil {
+		jsonError(w, "machine not found", http.StatusNotFound)
+		return
+	}
+
+	aliases, err := h.DB.ListAliases(machineName)
+	if err != nil {
+		log.Printf("error listing aliases: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if aliases == nil {
+		aliases = []db.Alias{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(aliases)
+}
+
+func (h *Handlers) DeleteAlias(w http.ResponseWriter, r *http.Request) {
+	machineName := chi.URLParam(r, "name")
+	alias := chi.URLParam(r, "alias")
+
+	if err := h.DB.DeleteAlias(machineName, alias); err != nil {
+		jsonError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if err := h.RegenerateConfig(); err != nil {
+		log.Printf("error regenerating config: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"ok":true}`))
+}
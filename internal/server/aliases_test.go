@@ -0,0 +1,131 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestRenameWithGracePeriod(t *testing.T) {
+	srv, database := setupTestServer(t)
+
+	resp := authRequest(t, "POST", srv.URL+"/api/register", map[string]string{
+		"name": "old-name", "owner": "test", "local_user": "test", "public_key": testKey(t),
+	})
+	resp.Body.Close()
+
+	resp = authRequest(t, "PUT", srv.URL+"/api/machines/old-name/rename", map[string]string{
+		"new_name": "new-name", "grace_period": "7d",
+	})
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var result map[string]any
+	json.NewDecoder(resp.Body).Decode(&result)
+	if result["alias"] != "old-name" || result["alias_expires_at"] == nil {
+		t.Fatalf("expected alias in response, got %v", result)
+	}
+
+	aliases, _ := database.ListAliases("new-name")
+	if len(aliases) != 1 || aliases[0].Alias != "old-name" {
+		t.Fatalf("expected old-name alias, got %+v", aliases)
+	}
+
+	// The old name stays reserved while the alias routes
+	resp2 := authRequest(t, "POST", srv.URL+"/api/register", map[string]string{
+		"name": "old-name", "owner": "test", "local_user": "test", "public_key": testKey(t),
+	})
+	resp2.Body.Close()
+	if resp2.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409 registering over alias, got %d", resp2.StatusCode)
+	}
+
+	// Listed with the machine
+	resp3 := authRequest(t, "GET", srv.URL+"/api/machines", nil)
+	defer resp3.Body.Close()
+	var machines []struct {
+		Name    string `json:"name"`
+		Aliases []struct {
+			Alias     string  `json:"alias"`
+			ExpiresAt *string `json:"expires_at"`
+		} `json:"aliases"`
+	}
+	json.NewDecoder(resp3.Body).Decode(&machines)
+	if len(machines) != 1 || len(machines[0].Aliases) != 1 || machines[0].Aliases[0].ExpiresAt == nil {
+		t.Fatalf("expected deprecated alias in list, got %+v", machines)
+	}
+}
+
+func TestRenameInvalidGracePeriod(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	resp := authRequest(t, "POST", srv.URL+"/api/register", map[string]string{
+		"name": "m1", "owner": "test", "local_user": "test", "public_key": testKey(t),
+	})
+	resp.Body.Close()
+
+	resp = authRequest(t, "PUT", srv.URL+"/api/machines/m1/rename", map[string]string{
+		"new_name": "m2", "grace_period": "soon",
+	})
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", resp.StatusCode)
+	}
+}
+
+func TestAddAlias(t *testing.T) {
+	srv, database := setupTestServer(t)
+
+	for _, name := range []string{"nas", "laptop"} {
+		resp := authRequest(t, "POST", srv.URL+"/api/register", map[string]string{
+			"name": name, "owner": "test", "local_user": "test", "public_key": testKey(t),
+		})
+		resp.Body.Close()
+	}
+
+	for _, alias := range []string{"plex", "homeserver"} {
+		resp := authRequest(t, "POST", srv.URL+"/api/machines/nas/aliases", map[string]string{"alias": alias})
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("add alias %s: expected 201, got %d", alias, resp.StatusCode)
+		}
+	}
+
+	// Collisions with machine names and other aliases are rejected
+	for _, alias := range []string{"laptop", "plex", "nas"} {
+		resp := authRequest(t, "POST", srv.URL+"/api/machines/nas/aliases", map[string]string{"alias": alias})
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusConflict {
+			t.Errorf("alias %s: expected 409, got %d", alias, resp.StatusCode)
+		}
+	}
+	resp := authRequest(t, "POST", srv.URL+"/api/machines/nas/aliases", map[string]string{"alias": "bad name"})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for invalid alias, got %d", resp.StatusCode)
+	}
+
+	resp = authRequest(t, "GET", srv.URL+"/api/machines/nas/aliases", nil)
+	var aliases []map[string]any
+	json.NewDecoder(resp.Body).Decode(&aliases)
+	resp.Body.Close()
+	if len(aliases) != 2 {
+		t.Fatalf("expected 2 aliases, got %v", aliases)
+	}
+
+	resp = authRequest(t, "DELETE", srv.URL+"/api/machines/nas/aliases/plex", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("delete alias: expected 200, got %d", resp.StatusCode)
+	}
+	if remaining, _ := database.ListAliases("nas"); len(remaining) != 1 || remaining[0].Alias != "homeserver" {
+		t.Fatalf("expected homeserver to remain, got %+v", remaining)
+	}
+
+	resp = authRequest(t, "DELETE", srv.URL+"/api/machines/laptop/aliases/homeserver", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 deleting another machine's alias, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/db"
+)
+
+// ApproveMachine makes a pending machine routable.
+func (h *Handlers) ApproveMachine(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	if !h.requirePending(w, name) {
+		return
+	}
+	ok, err := h.DB.SetMachineState(name, db.StatePending, db.StateActive)
+	if err != nil {
+		log.Printf("error approving machine: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		jsonError(w, "machine is not pending approval", http.StatusConflict)
+		return
+	}
+	log.Printf("Machine %q approved", name)
+
+	if err := h.RegenerateConfig(); err != nil {
+		log.Printf("error regenerating config: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"name": name, "state": db.StateActive})
+}
+
+// RejectMachine deletes a pending registration and frees its port and name.
+func (h *Handlers) RejectMachine(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	if !h.requirePending(w, name) {
+		return
+	}
+	if err := h.DB.DeleteMachine(name); err != nil {
+		jsonError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	log.Printf("Machine %q rejected", name)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"ok":true}`))
+}
+
+// requirePending writes an error and returns false unless the machine exists
+// and is pending approval.
+func (h *Handlers) requirePending(w http.ResponseWriter, name string) bool {
+	m, err := h.DB.GetMachine(name)
+	if err != nil {
+		log.Printf("error getting machine: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return false
+	}
+	if m == nil {
+		jsonError(w, "machine not found", http.StatusNotFound)
+		return false
+	}
+	if m.State != db.StatePending {
+		jsonError(w, "machine is not pending approval", http.StatusConflict)
+		return false
+	}
+	return true
+}
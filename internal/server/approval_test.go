@@ -0,0 +1,84 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRegisterRequiresApproval(t *testing.T) {
+	var h *Handlers
+	srv, _ := setupTestServerWith(t, func(handlers *Handlers) {
+		handlers.RequireApproval = true
+		h = handlers
+	})
+
+	resp := authRequest(t, "POST", srv.URL+"/api/register", map[string]string{
+		"name": "nas", "owner": "test", "local_user": "test", "public_key": testKey(t),
+	})
+	var reg registerResponse
+	json.NewDecoder(resp.Body).Decode(&reg)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted || reg.Status != "pending" || reg.Port == 0 {
+		t.Fatalf("expected 202 pending with a reserved port, got %d %+v", resp.StatusCode, reg)
+	}
+
+	// Not routed while pending
+	data, _ := os.ReadFile(h.Gen.ConfigPath)
+	if strings.Contains(string(data), `"nas"`) {
+		t.Fatalf("pending machine should not be in the config:\n%s", data)
+	}
+
+	resp = authRequest(t, "GET", srv.URL+"/api/machines/nas", nil)
+	var entry machineListEntry
+	json.NewDecoder(resp.Body).Decode(&entry)
+	resp.Body.Close()
+	if entry.State != "pending" {
+		t.Fatalf("expected pending state, got %+v", entry)
+	}
+
+	resp = authRequest(t, "POST", srv.URL+"/api/machines/nas/approve", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 approving, got %d", resp.StatusCode)
+	}
+	data, _ = os.ReadFile(h.Gen.ConfigPath)
+	if !strings.Contains(string(data), `username: "nas"`) {
+		t.Fatalf("approved machine should be routed:\n%s", data)
+	}
+
+	// Only pending machines can be approved or rejected
+	for _, action := range []string{"approve", "reject"} {
+		resp = authRequest(t, "POST", srv.URL+"/api/machines/nas/"+action, nil)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusConflict {
+			t.Fatalf("expected 409 for %s of active machine, got %d", action, resp.StatusCode)
+		}
+	}
+}
+
+func TestRejectPendingMachine(t *testing.T) {
+	srv, database := setupTestServerWith(t, func(h *Handlers) { h.RequireApproval = true })
+
+	resp := authRequest(t, "POST", srv.URL+"/api/register", map[string]string{
+		"name": "intruder", "owner": "test", "local_user": "test", "public_key": testKey(t),
+	})
+	resp.Body.Close()
+
+	resp = authRequest(t, "POST", srv.URL+"/api/machines/intruder/reject", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if m, _ := database.GetMachine("intruder"); m != nil {
+		t.Fatal("expected rejected machine to be deleted")
+	}
+
+	resp = authRequest(t, "GET", srv.URL+"/api/machines/intruder", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 after rejection, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/backup"
+)
+
+// SnapshotPaths returns BackupPaths with the lock RegenerateConfig writes
+// key files and sshpiper.yaml under, so a backup does not catch them
+// half-regenerated.
+func (h *Handlers) SnapshotPaths() backup.Paths {
+	p := h.BackupPaths
+	p.Lock = &h.configMu
+	return p
+}
+
+// Backup streams a gzipped tar archive of the full bastion state.
+func (h *Handlers) Backup(w http.ResponseWriter, r *http.Request) {
+	if h.BackupPaths.DB == "" {
+		jsonError(w, "backups are not configured", http.StatusNotFound)
+		return
+	}
+
+	// The database is snapshotted to a temporary file first, so that failure
+	// is still reported as an error. After that the archive is streamed; a
+	// later failure can only cut the download short, which leaves an
+	// invalid gzip that restore rejects.
+	a, err := backup.Prepare(h.DB, h.SnapshotPaths())
+	if err != nil {
+		log.Printf("error preparing backup: %v", err)
+		jsonError(w, "failed to create backup", http.StatusInternalServerError)
+		return
+	}
+	defer a.Close()
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+backup.FileName(a.Manifest.CreatedAt)+`"`)
+	if err := a.Write(w); err != nil {
+		log.Printf("error streaming backup: %v", err)
+		return
+	}
+	log.Printf("Backup downloaded (%d files, schema version %d)", len(a.Manifest.Files), a.Manifest.SchemaVersion)
+}
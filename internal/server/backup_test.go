@@ -0,0 +1,66 @@
+package server
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/backup"
+	"github.com/LipJ01/fly-ssh-bastion/internal/db"
+)
+
+func TestBackupEndpoint(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	resp := authRequest(t, "POST", srv.URL+"/api/register", map[string]string{
+		"name": "nas", "owner": "test", "local_user": "test", "public_key": testKey(t),
+	})
+	resp.Body.Close()
+
+	resp = authRequest(t, "GET", srv.URL+"/api/admin/backup", nil)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/gzip" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+
+	dir := t.TempDir()
+	paths := backup.Paths{
+		DB:          filepath.Join(dir, "db", "bastion.db"),
+		KeysDir:     filepath.Join(dir, "keys"),
+		ServerKey:   filepath.Join(dir, "server-key"),
+		HostKeysDir: filepath.Join(dir, "host-keys"),
+		Config:      filepath.Join(dir, "sshpiper.yaml"),
+	}
+	m, err := backup.Restore(resp.Body, paths)
+	if err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if len(m.Files) < 3 {
+		t.Fatalf("expected database, key file and config in backup, got %v", m.Files)
+	}
+
+	restored, err := db.Open(paths.DB)
+	if err != nil {
+		t.Fatalf("open restored: %v", err)
+	}
+	defer restored.Close()
+	if machine, _ := restored.GetMachine("nas"); machine == nil {
+		t.Fatal("expected registered machine in backup")
+	}
+}
+
+func TestBackupRequiresAuth(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	resp, err := http.Get(srv.URL + "/api/admin/backup")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", resp.StatusCode)
+	}
+}
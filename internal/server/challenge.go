@@ -0,0 +1,119 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/sshkey"
+)
+
+const (
+	// challengeTTL is how long a client has to sign and use a nonce.
+	challengeTTL = 5 * time.Minute
+	// maxChallenges bounds the outstanding nonces kept in memory.
+	maxChallenges = 10000
+)
+
+// challengeStore holds outstanding single-use nonces. The zero value is ready
+// to use. Nonces live only in memory, so a restart invalidates them.
+type challengeStore struct {
+	mu      sync.Mutex
+	nonces  map[string]time.Time // nonce -> expiry
+	timeNow func() time.Time     // for tests; time.Now when nil
+}
+
+func (s *challengeStore) now() time.Time {
+	if s.timeNow != nil {
+		return s.timeNow()
+	}
+	return time.Now()
+}
+
+// issue returns a fresh nonce, or an empty string if too many are outstanding.
+func (s *challengeStore) issue() (string, time.Time, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", time.Time{}, err
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(b)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if s.nonces == nil {
+		s.nonces = make(map[string]time.Time)
+	}
+	for n, exp := range s.nonces {
+		if now.After(exp) {
+			delete(s.nonces, n)
+		}
+	}
+	if len(s.nonces) >= maxChallenges {
+		return "", time.Time{}, nil
+	}
+	expires := now.Add(challengeTTL)
+	s.nonces[nonce] = expires
+	return nonce, expires, nil
+}
+
+// consume removes the nonce and reports whether it was outstanding and
+// unexpired. A nonce can be consumed once, whether or not the signature that
+// came with it turns out to be valid.
+func (s *challengeStore) consume(nonce string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	exp, ok := s.nonces[nonce]
+	if !ok {
+		return false
+	}
+	delete(s.nonces, nonce)
+	return !s.now().After(exp)
+}
+
+// RegisterChallenge issues a nonce for the client to sign with the private
+// key of the public key it is about to register.
+func (h *Handlers) RegisterChallenge(w http.ResponseWriter, r *http.Request) {
+	// machineAuth lets any enrollment token through; only hand out nonces
+	// for one that can still be used.
+	if c := callerFrom(r); !c.admin && c.machine == "" {
+		if _, err := h.DB.GetUsableEnrollment(hashToken(c.enrollment)); err != nil {
+			jsonError(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	nonce, expires, err := h.challenges.issue()
+	if err != nil {
+		log.Printf("error generating challenge: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if nonce == "" {
+		jsonError(w, "too many outstanding challenges, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"nonce": nonce, "expires_at": expires})
+}
+
+// checkKeyProof writes an error and returns false unless signature is the
+// key's signature over an outstanding nonce.
+func (h *Handlers) checkKeyProof(w http.ResponseWriter, key *sshkey.Key, nonce, signature string) bool {
+	if nonce == "" || signature == "" {
+		jsonError(w, "nonce and signature are required: sign a nonce from /api/register/challenge with the machine's private key", http.StatusBadRequest)
+		return false
+	}
+	if !h.challenges.consume(nonce) {
+		jsonError(w, "challenge nonce is unknown, expired or already used", http.StatusBadRequest)
+		return false
+	}
+	if err := key.VerifyChallenge(sshkey.PurposeRegister, nonce, signature); err != nil {
+		jsonError(w, err.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/sshkey"
+)
+
+func testSigner(t *testing.T) (ssh.Signer, string) {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("signer: %v", err)
+	}
+	return signer, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+}
+
+func getChallenge(t *testing.T, url string) string {
+	t.Helper()
+	resp := authRequest(t, "POST", url+"/api/register/challenge", nil)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 for challenge, got %d", resp.StatusCode)
+	}
+	var c struct {
+		Nonce string `json:"nonce"`
+	}
+	json.NewDecoder(resp.Body).Decode(&c)
+	return c.Nonce
+}
+
+func TestRegisterRequiresKeyProof(t *testing.T) {
+	srv, _ := setupTestServerWith(t, func(h *Handlers) { h.RequireKeyProof = true })
+	signer, pubKey := testSigner(t)
+
+	register := func(name, nonce, signature string) int {
+		resp := authRequest(t, "POST", srv.URL+"/api/register", map[string]string{
+			"name": name, "owner": "test", "local_user": "test", "public_key": pubKey,
+			"nonce": nonce, "signature": signature,
+		})
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := register("box", "", ""); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 without proof, got %d", code)
+	}
+
+	// A key we do not hold cannot be registered
+	nonce := getChallenge(t, srv.URL)
+	other, _ := testSigner(t)
+	forged, _ := sshkey.SignChallenge(other, sshkey.PurposeRegister, nonce)
+	if code := register("box", nonce, forged); code != http.StatusForbidden {
+		t.Fatalf("expected 403 for another key's signature, got %d", code)
+	}
+
+	nonce = getChallenge(t, srv.URL)
+	sig, _ := sshkey.SignChallenge(signer, sshkey.PurposeRegister, nonce)
+	if code := register("box", nonce, sig); code != http.StatusCreated {
+		t.Fatalf("expected 201 with a valid proof, got %d", code)
+	}
+
+	// Nonces are single use
+	if code := register("box2", nonce, sig); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 reusing a nonce, got %d", code)
+	}
+}
+
+func TestRegisterChecksOptionalKeyProof(t *testing.T) {
+	srv, _ := setupTestServer(t)
+	signer, pubKey := testSigner(t)
+
+	register := func(name, nonce, signature string) int {
+		resp := authRequest(t, "POST", srv.URL+"/api/register", map[string]string{
+			"name": name, "owner": "test", "local_user": "test", "public_key": pubKey,
+			"nonce": nonce, "signature": signature,
+		})
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Without the flag a proof is optional, but one that is sent must hold
+	nonce := getChallenge(t, srv.URL)
+	other, _ := testSigner(t)
+	forged, _ := sshkey.SignChallenge(other, sshkey.PurposeRegister, nonce)
+	if code := register("box", nonce, forged); code != http.StatusForbidden {
+		t.Fatalf("expected 403 for another key's signature, got %d", code)
+	}
+	if code := register("box", "", forged); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a signature without a nonce, got %d", code)
+	}
+	if code := register("box", "", ""); code != http.StatusCreated {
+		t.Fatalf("expected 201 without a proof, got %d", code)
+	}
+	nonce = getChallenge(t, srv.URL)
+	sig, _ := sshkey.SignChallenge(signer, sshkey.PurposeRegister, nonce)
+	if code := register("box2", nonce, sig); code != http.StatusCreated {
+		t.Fatalf("expected 201 with a valid proof, got %d", code)
+	}
+}
+
+func TestChallengeRequiresUsableEnrollment(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	resp := tokenRequest(t, "POST", srv.URL+"/api/register/challenge", "X-Enrollment-Token", "enr_bogus", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for unknown enrollment token, got %d", resp.StatusCode)
+	}
+
+	e := createEnrollment(t, srv.URL, map[string]string{})
+	resp = tokenRequest(t, "POST", srv.URL+"/api/register/challenge", "X-Enrollment-Token", e.Token, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 for usable enrollment token, got %d", resp.StatusCode)
+	}
+}
+
+func TestChallengeStoreExpiry(t *testing.T) {
+	now := time.Now()
+	s := &challengeStore{timeNow: func() time.Time { return now }}
+
+	nonce, _, err := s.issue()
+	if err != nil || nonce == "" {
+		t.Fatalf("issue: %q %v", nonce, err)
+	}
+	now = now.Add(challengeTTL + time.Second)
+	if s.consume(nonce) {
+		t.Fatal("expected expired nonce to be rejected")
+	}
+
+	nonce, _, _ = s.issue()
+	if !s.consume(nonce) {
+		t.Fatal("expected fresh nonce to be accepted")
+	}
+	if s.consume(nonce) {
+		t.Fatal("expected nonce to be single use")
+	}
+}
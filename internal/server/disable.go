@@ -0,0 +1,65 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/db"
+)
+
+// DisableMachine takes an active machine out of service: it is dropped from
+// the sshpiper config and authorized_keys and its open SSH sessions are
+// closed, but it keeps its port, keys and metadata.
+func (h *Handlers) DisableMachine(w http.ResponseWriter, r *http.Request) {
+	h.setMachineState(w, chi.URLParam(r, "name"), db.StateActive, db.StateDisabled)
+}
+
+// EnableMachine returns a disabled machine to service.
+func (h *Handlers) EnableMachine(w http.ResponseWriter, r *http.Request) {
+	h.setMachineState(w, chi.URLParam(r, "name"), db.StateDisabled, db.StateActive)
+}
+
+func (h *Handlers) setMachineState(w http.ResponseWriter, name, from, to string) {
+	m, err := h.DB.GetMachine(name)
+	if err != nil {
+		log.Printf("error getting machine: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if m == nil {
+		jsonError(w, "machine not found", http.StatusNotFound)
+		return
+	}
+	if m.State == to {
+		// Already there; repeating the request is harmless
+		writeMachineState(w, name, to)
+		return
+	}
+	ok, err := h.DB.SetMachineState(name, from, to)
+	if err != nil {
+		log.Printf("error setting machine state: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		jsonError(w, "machine is not "+from, http.StatusConflict)
+		return
+	}
+	log.Printf("Machine %q %s", name, to)
+
+	if err := h.RegenerateConfig(); err != nil {
+		log.Printf("error regenerating config: %v", err)
+	}
+	if to == db.StateDisabled {
+		h.disconnectMachineSessions(name, "machine disabled")
+	}
+	writeMachineState(w, name, to)
+}
+
+func writeMachineState(w http.ResponseWriter, name, state string) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"name": name, "state": state})
+}
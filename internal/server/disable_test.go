@@ -0,0 +1,89 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/db"
+	"github.com/LipJ01/fly-ssh-bastion/internal/piperlog"
+)
+
+func TestDisableMachine(t *testing.T) {
+	var h *Handlers
+	srv, database := setupTestServerWith(t, func(handlers *Handlers) { h = handlers })
+	key := testKey(t)
+	registerMachine(t, srv.URL, map[string]any{"name": "nas", "owner": "a", "local_user": "admin", "public_key": key, "tags": []string{"prod"}})
+	resp := authRequest(t, "POST", srv.URL+"/api/machines/nas/keys", map[string]any{"label": "phone", "public_key": testKey(t)})
+	resp.Body.Close()
+	before, _ := database.GetMachine("nas")
+	h.RecordPiperEvent(piperlog.Event{Type: piperlog.EventOpen, Time: time.Now(), Remote: "203.0.113.7:5000",
+		User: "nas", Upstream: fmt.Sprintf("127.0.0.1:%d", before.Port), UpstreamUser: "admin"})
+
+	resp = authRequest(t, "POST", srv.URL+"/api/machines/nas/disable", nil)
+	var result map[string]string
+	json.NewDecoder(resp.Body).Decode(&result)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || result["state"] != db.StateDisabled {
+		t.Fatalf("expected disabled, got %d %v", resp.StatusCode, result)
+	}
+	data, _ := os.ReadFile(h.Gen.ConfigPath)
+	if strings.Contains(string(data), `"nas"`) {
+		t.Fatalf("disabled machine should not be routed:\n%s", data)
+	}
+	after, _ := database.GetMachine("nas")
+	keys, _ := database.ListAccessKeys("nas")
+	if after.Port != before.Port || after.PublicKey != key || len(after.Tags) != 1 || len(keys) != 1 {
+		t.Fatalf("expected port, keys and metadata kept, got %+v with %d keys", after, len(keys))
+	}
+	if sessions, _ := database.ListSSHSessions(db.SSHSessionFilter{Active: true}); len(sessions) != 0 {
+		t.Fatalf("expected open sessions closed, got %+v", sessions)
+	}
+
+	// Disabling twice is harmless; pending machines cannot be enabled
+	resp = authRequest(t, "POST", srv.URL+"/api/machines/nas/disable", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 disabling again, got %d", resp.StatusCode)
+	}
+	resp = authRequest(t, "GET", srv.URL+"/api/machines?state=disabled", nil)
+	var entries []machineListEntry
+	json.NewDecoder(resp.Body).Decode(&entries)
+	resp.Body.Close()
+	if len(entries) != 1 || entries[0].State != db.StateDisabled {
+		t.Fatalf("expected the machine listed as disabled, got %+v", entries)
+	}
+
+	resp = authRequest(t, "POST", srv.URL+"/api/machines/nas/enable", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 enabling, got %d", resp.StatusCode)
+	}
+	data, _ = os.ReadFile(h.Gen.ConfigPath)
+	if !strings.Contains(string(data), `username: "nas"`) {
+		t.Fatalf("enabled machine should be routed:\n%s", data)
+	}
+
+	resp = authRequest(t, "POST", srv.URL+"/api/machines/ghost/disable", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestEnablePendingMachine(t *testing.T) {
+	srv, _ := setupTestServerWith(t, func(h *Handlers) { h.RequireApproval = true })
+	registerMachine(t, srv.URL, map[string]any{"name": "nas", "owner": "a", "local_user": "admin", "public_key": testKey(t)})
+
+	for _, action := range []string{"enable", "disable"} {
+		resp := authRequest(t, "POST", srv.URL+"/api/machines/nas/"+action, nil)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusConflict {
+			t.Fatalf("expected 409 for %s of a pending machine, got %d", action, resp.StatusCode)
+		}
+	}
+}
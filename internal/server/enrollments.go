@@ -0,0 +1,109 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/db"
+)
+
+// defaultEnrollmentTTL is how long an enrollment token stays valid when the
+// request does not say.
+const defaultEnrollmentTTL = 24 * time.Hour
+
+// newToken returns a random token with the given prefix and its stored hash.
+func newToken(prefix string) (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = prefix + base64.RawURLEncoding.EncodeToString(b)
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+type enrollmentResponse struct {
+	Token string `json:"token"`
+	db.Enrollment
+}
+
+// CreateEnrollment mints a single-use enrollment token. The token is only
+// returned here; the server keeps a hash.
+func (h *Handlers) CreateEnrollment(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Owner      string   `json:"owner"`
+		NamePrefix string   `json:"name_prefix"`
+		Tags       []string `json:"tags"`
+		ExpiresIn  string   `json:"expires_in"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if req.Owner != "" && !validName.MatchString(req.Owner) {
+		jsonError(w, "invalid owner: must be alphanumeric with optional dots, hyphens, underscores (max 64 chars)", http.StatusBadRequest)
+		return
+	}
+	if req.NamePrefix != "" && !validName.MatchString(req.NamePrefix) {
+		jsonError(w, "invalid name_prefix: must be alphanumeric with optional dots, hyphens, underscores (max 64 chars)", http.StatusBadRequest)
+		return
+	}
+	tags, err := checkTags(req.Tags)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ttl := defaultEnrollmentTTL
+	if req.ExpiresIn != "" {
+		d, err := parseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 {
+			jsonError(w, "invalid expires_in: use a duration such as 24h or 7d", http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	}
+
+	token, hash, err := newToken("enr_")
+	if err != nil {
+		log.Printf("error generating enrollment token: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	e, err := h.DB.CreateEnrollment(hash, req.Owner, req.NamePrefix, tags, time.Now().Add(ttl))
+	if err != nil {
+		log.Printf("error creating enrollment: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Enrollment token %d created (owner %q, prefix %q, expires %s)", e.ID, e.Owner, e.NamePrefix, e.ExpiresAt.Format(time.RFC3339))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(enrollmentResponse{Token: token, Enrollment: *e})
+}
+
+// ListEnrollments returns all enrollment tokens, used or not, without the
+// tokens themselves.
+func (h *Handlers) ListEnrollments(w http.ResponseWriter, r *http.Request) {
+	enrollments, err := h.DB.ListEnrollments()
+	if err != nil {
+		log.Printf("error listing enrollments: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if enrollments == nil {
+		enrollments = []db.Enrollment{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(enrollments)
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// tokenRequest is authRequest with a token header instead of the API key.
+func tokenRequest(t *testing.T, method, url, header, token string, body any) *http.Response {
+	t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&buf).Encode(body)
+	}
+	req, err := http.NewRequest(method, url, &buf)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(header, token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("do: %v", err)
+	}
+	return resp
+}
+
+func createEnrollment(t *testing.T, url string, body map[string]string) enrollmentResponse {
+	t.Helper()
+	resp := authRequest(t, "POST", url+"/api/enrollments", body)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201 creating enrollment, got %d", resp.StatusCode)
+	}
+	var e enrollmentResponse
+	json.NewDecoder(resp.Body).Decode(&e)
+	if e.Token == "" {
+		t.Fatal("expected a token")
+	}
+	return e
+}
+
+func TestRegisterWithEnrollmentToken(t *testing.T) {
+	srv, _ := setupTestServer(t)
+	e := createEnrollment(t, srv.URL, map[string]string{"owner": "alice", "name_prefix": "lab-", "expires_in": "1h"})
+
+	// Bindings are enforced without consuming the token
+	resp := tokenRequest(t, "POST", srv.URL+"/api/register", "X-Enrollment-Token", e.Token, map[string]string{
+		"name": "prod-1", "local_user": "alice", "public_key": testKey(t),
+	})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for wrong prefix, got %d", resp.StatusCode)
+	}
+	resp = tokenRequest(t, "POST", srv.URL+"/api/register", "X-Enrollment-Token", e.Token, map[string]string{
+		"name": "lab-1", "owner": "bob", "local_user": "alice", "public_key": testKey(t),
+	})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for wrong owner, got %d", resp.StatusCode)
+	}
+
+	// Owner comes from the token
+	resp = tokenRequest(t, "POST", srv.URL+"/api/register", "X-Enrollment-Token", e.Token, map[string]string{
+		"name": "lab-1", "local_user": "alice", "public_key": testKey(t),
+	})
+	var reg registerResponse
+	json.NewDecoder(resp.Body).Decode(&reg)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || reg.MachineToken == "" {
+		t.Fatalf("expected 201 with a machine token, got %d %+v", resp.StatusCode, reg)
+	}
+
+	resp = authRequest(t, "GET", srv.URL+"/api/machines/lab-1", nil)
+	var entry machineListEntry
+	json.NewDecoder(resp.Body).Decode(&entry)
+	resp.Body.Close()
+	if entry.Owner != "alice" {
+		t.Fatalf("expected owner from token, got %+v", entry)
+	}
+
+	// Single use
+	resp = tokenRequest(t, "POST", srv.URL+"/api/register", "X-Enrollment-Token", e.Token, map[string]string{
+		"name": "lab-2", "local_user": "alice", "public_key": testKey(t),
+	})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 reusing token, got %d", resp.StatusCode)
+	}
+
+	resp = authRequest(t, "GET", srv.URL+"/api/enrollments", nil)
+	var list []map[string]any
+	json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if len(list) != 1 || list[0]["used_by"] != "lab-1" || list[0]["token"] != nil {
+		t.Fatalf("unexpected enrollment list %+v", list)
+	}
+}
+
+func TestEnrollmentTokenCannotManage(t *testing.T) {
+	srv, _ := setupTestServer(t)
+	e := createEnrollment(t, srv.URL, map[string]string{})
+
+	for _, path := range []string{"/api/machines", "/api/enrollments"} {
+		resp := tokenRequest(t, "GET", srv.URL+path, "X-Enrollment-Token", e.Token, nil)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("expected 401 for %s, got %d", path, resp.StatusCode)
+		}
+	}
+
+	resp := tokenRequest(t, "POST", srv.URL+"/api/register", "X-Enrollment-Token", "enr_bogus", map[string]string{
+		"name": "x", "owner": "a", "local_user": "a", "public_key": testKey(t),
+	})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for unknown token, got %d", resp.StatusCode)
+	}
+}
+
+func TestMachineTokenScope(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	tokens := map[string]string{}
+	for _, name := range []string{"one", "two"} {
+		resp := authRequest(t, "POST", srv.URL+"/api/register", map[string]string{
+			"name": name, "owner": "test", "local_user": "test", "public_key": testKey(t),
+		})
+		var reg registerResponse
+		json.NewDecoder(resp.Body).Decode(&reg)
+		resp.Body.Close()
+		tokens[name] = reg.MachineToken
+	}
+
+	resp := tokenRequest(t, "POST", srv.URL+"/api/heartbeat", "X-Machine-Token", tokens["one"], map[string]string{"name": "one"})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 for own heartbeat, got %d", resp.StatusCode)
+	}
+	resp = tokenRequest(t, "GET", srv.URL+"/api/machines/two", "X-Machine-Token", tokens["one"], nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for another machine, got %d", resp.StatusCode)
+	}
+	resp = tokenRequest(t, "DELETE", srv.URL+"/api/machines/one", "X-Machine-Token", tokens["one"], nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for admin endpoint, got %d", resp.StatusCode)
+	}
+	resp = tokenRequest(t, "POST", srv.URL+"/api/register", "X-Machine-Token", tokens["one"], map[string]string{
+		"name": "three", "owner": "test", "local_user": "test", "public_key": testKey(t),
+	})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 registering another machine with a machine token, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/uptime"
+)
+
+const (
+	// tunnelSessionRetention is how long tunnel sessions are kept, and so
+	// the longest uptime window.
+	tunnelSessionRetention = 90 * 24 * time.Hour
+	defaultUptimeWindow    = 7 * 24 * time.Hour
+	// maxClockSkew is how far in the future a client's event time may be
+	// before it is replaced by the server's clock.
+	maxClockSkew    = 5 * time.Minute
+	maxReasonLength = 256
+	// heartbeatInterval is how often clients send a heartbeat. A tunnel
+	// session left open by a machine offline for onlineWindow is closed
+	// this long after its last heartbeat.
+	heartbeatInterval = 5 * time.Minute
+)
+
+type tunnelEvent struct {
+	Type            string    `json:"type"` // connect or disconnect
+	Time            time.Time `json:"time"`
+	DurationSeconds float64   `json:"duration_seconds"` // disconnect only
+	Reason          string    `json:"reason"`           // disconnect only
+}
+
+// TunnelEvent records a tunnel connect or disconnect reported by the machine.
+func (h *Handlers) TunnelEvent(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if !authorizeMachine(w, r, name) {
+		return
+	}
+	if !h.requireMachine(w, name) {
+		return
+	}
+
+	var ev tunnelEvent
+	if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+		jsonError(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	if ev.Time.IsZero() || ev.Time.After(now.Add(maxClockSkew)) {
+		ev.Time = now
+	}
+	reason := strings.ReplaceAll(strings.TrimSpace(ev.Reason), "\n", " ")
+	if len(reason) > maxReasonLength {
+		reason = reason[:maxReasonLength]
+	}
+
+	var err error
+	switch ev.Type {
+	case "connect":
+		err = h.DB.StartTunnelSession(name, ev.Time)
+	case "disconnect":
+		if ev.DurationSeconds < 0 {
+			jsonError(w, "duration_seconds must not be negative", http.StatusBadRequest)
+			return
+		}
+		err = h.DB.EndTunnelSession(name, ev.Time, time.Duration(ev.DurationSeconds*float64(time.Second)), reason)
+	default:
+		jsonError(w, `type must be "connect" or "disconnect"`, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("error recording tunnel event: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(`{"ok":true}`))
+}
+
+type uptimeResponse struct {
+	Machine string `json:"machine"`
+	Window  string `json:"window"`
+	uptime.Report
+}
+
+// Uptime reports tunnel availability over ?window= (default 7d, at most the
+// 90 days of retained sessions). Time before the machine registered is not
+// counted.
+func (h *Handlers) Uptime(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if !authorizeMachine(w, r, name) {
+		return
+	}
+	m, err := h.DB.GetMachine(name)
+	if err != nil {
+		log.Printf("error getting machine: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if m == nil {
+		jsonError(w, "machine not found", http.StatusNotFound)
+		return
+	}
+
+	window := defaultUptimeWindow
+	if s := r.URL.Query().Get("window"); s != "" {
+		d, err := parseDuration(s)
+		if err != nil || d <= 0 || d > tunnelSessionRetention {
+			jsonError(w, "invalid window: use a duration such as 24h or 7d, at most 90d", http.StatusBadRequest)
+			return
+		}
+		window = d
+	}
+	to := time.Now().UTC()
+	from := to.Add(-window)
+	if m.CreatedAt.After(from) {
+		from = m.CreatedAt
+	}
+
+	records, err := h.DB.ListTunnelSessions(name, from)
+	if err != nil {
+		log.Printf("error listing tunnel sessions: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	sessions := make([]uptime.Session, len(records))
+	for i, s := range records {
+		sessions[i] = uptime.Session{Start: s.StartedAt, End: s.EndedAt}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(uptimeResponse{
+		Machine: name,
+		Window:  window.String(),
+		Report:  uptime.Compute(sessions, from, to),
+	})
+}
+
+// requireMachine writes an error and returns false unless the machine exists.
+func (h *Handlers) requireMachine(w http.ResponseWriter, name string) bool {
+	m, err := h.DB.GetMachine(name)
+	if err != nil {
+		log.Printf("error getting machine: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return false
+	}
+	if m == nil {
+		jsonError(w, "machine not found", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// closeStaleTunnels ends the tunnel sessions of machines whose client stopped
+// sending heartbeats without reporting a disconnect, so they do not count as
+// connected until the next connect.
+func (h *Handlers) closeStaleTunnels(now time.Time) {
+	n, err := h.DB.CloseStaleTunnelSessions(now.Add(-onlineWindow), heartbeatInterval)
+	if err != nil {
+		log.Printf("error closing stale tunnel sessions: %v", err)
+	} else if n > 0 {
+		log.Printf("Closed %d tunnel sessions of machines that stopped sending heartbeats", n)
+	}
+}
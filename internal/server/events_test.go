@@ -0,0 +1,57 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestTunnelEventsAndUptime(t *testing.T) {
+	srv, database := setupTestServer(t)
+	_, reg := registerMachine(t, srv.URL, map[string]any{"name": "nas", "owner": "a", "local_user": "u", "public_key": testKey(t)})
+
+	now := time.Now().UTC()
+	post := func(ev map[string]any) int {
+		resp := tokenRequest(t, "POST", srv.URL+"/api/machines/nas/events", "X-Machine-Token", reg.MachineToken, ev)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := post(map[string]any{"type": "disconnect", "time": now, "duration_seconds": 60, "reason": "exit status 255"}); code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", code)
+	}
+	if code := post(map[string]any{"type": "connect", "time": now}); code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", code)
+	}
+	if code := post(map[string]any{"type": "bogus"}); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unknown type, got %d", code)
+	}
+
+	sessions, _ := database.ListTunnelSessions("nas", now.Add(-time.Hour))
+	if len(sessions) != 2 || sessions[0].EndReason != "exit status 255" || sessions[1].EndedAt != nil {
+		t.Fatalf("unexpected sessions %+v", sessions)
+	}
+
+	// The window starts no earlier than the registration
+	resp := tokenRequest(t, "GET", srv.URL+"/api/machines/nas/uptime?window=1h", "X-Machine-Token", reg.MachineToken, nil)
+	var report uptimeResponse
+	json.NewDecoder(resp.Body).Decode(&report)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if report.Machine != "nas" || report.Window != "1h0m0s" || report.From.Before(now.Add(-time.Minute)) {
+		t.Fatalf("unexpected report %+v", report)
+	}
+
+	resp = authRequest(t, "GET", srv.URL+"/api/machines/nas/uptime?window=365d", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a window beyond retention, got %d", resp.StatusCode)
+	}
+	resp = authRequest(t, "POST", srv.URL+"/api/machines/ghost/events", map[string]any{"type": "connect"})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown machine, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/db"
+)
+
+const (
+	// maxHeartbeatBytes bounds a heartbeat body, facts included.
+	maxHeartbeatBytes = 16 << 10
+	maxFactLen        = 256
+)
+
+// checkFacts rejects facts with oversized or multi-line values.
+func checkFacts(f *db.Facts) error {
+	for name, v := range map[string]string{
+		"os": f.OS, "arch": f.Arch, "kernel": f.Kernel, "hostname": f.Hostname,
+		"client_version": f.ClientVersion, "sshd_version": f.SSHDVersion,
+	} {
+		if len(v) > maxFactLen || strings.ContainsAny(v, "\r\n") {
+			return fmt.Errorf("invalid fact %s: must be a single line of at most %d bytes", name, maxFactLen)
+		}
+	}
+	if len(f.Load) > 3 {
+		return fmt.Errorf("invalid fact load: expected at most 3 values")
+	}
+	if f.UptimeSeconds < 0 {
+		return fmt.Errorf("invalid fact uptime_seconds: must not be negative")
+	}
+	return nil
+}
+
+// ListFacts returns a machine's recent facts, newest first. ?limit= defaults
+// to 50.
+func (h *Handlers) ListFacts(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	machine, err := h.DB.GetMachine(name)
+	if err != nil {
+		log.Printf("error getting machine: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if machine == nil {
+		jsonError(w, "machine not found", http.StatusNotFound)
+		return
+	}
+
+	limit := 50
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			jsonError(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, db.MaxFactsHistory)
+	}
+	records, err := h.DB.ListFacts(name, limit)
+	if err != nil {
+		log.Printf("error listing facts: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if records == nil {
+		records = []db.FactsRecord{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(records)
+}
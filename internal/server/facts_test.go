@@ -0,0 +1,51 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/db"
+)
+
+func TestHeartbeatFacts(t *testing.T) {
+	srv, _ := setupTestServer(t)
+	_, reg := registerMachine(t, srv.URL, map[string]any{"name": "nas", "owner": "a", "local_user": "u", "public_key": testKey(t)})
+
+	facts := db.Facts{OS: "linux", Arch: "arm64", Kernel: "6.1.0", ClientVersion: "1.4.0",
+		SSHDVersion: "OpenSSH_9.2p1", UptimeSeconds: 3600, Load: []float64{0.5, 0.4, 0.3}, DiskFreeBytes: 1 << 30}
+	resp := tokenRequest(t, "POST", srv.URL+"/api/heartbeat", "X-Machine-Token", reg.MachineToken,
+		map[string]any{"name": "nas", "facts": facts})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+
+	// A heartbeat without facts keeps the latest ones
+	resp = tokenRequest(t, "POST", srv.URL+"/api/heartbeat", "X-Machine-Token", reg.MachineToken, map[string]any{"name": "nas"})
+	resp.Body.Close()
+
+	resp = authRequest(t, "GET", srv.URL+"/api/machines/nas", nil)
+	var entry machineListEntry
+	json.NewDecoder(resp.Body).Decode(&entry)
+	resp.Body.Close()
+	if entry.Facts == nil || entry.Facts.ClientVersion != "1.4.0" || len(entry.Facts.Load) != 3 || entry.FactsAt == nil {
+		t.Fatalf("expected latest facts on the machine, got %+v", entry.Facts)
+	}
+
+	resp = authRequest(t, "GET", srv.URL+"/api/machines/nas/facts", nil)
+	var history []db.FactsRecord
+	json.NewDecoder(resp.Body).Decode(&history)
+	resp.Body.Close()
+	if len(history) != 1 || history[0].Facts.Kernel != "6.1.0" {
+		t.Fatalf("expected one history entry, got %+v", history)
+	}
+
+	resp = tokenRequest(t, "POST", srv.URL+"/api/heartbeat", "X-Machine-Token", reg.MachineToken,
+		map[string]any{"name": "nas", "facts": map[string]any{"hostname": strings.Repeat("x", 300)}})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for oversized fact, got %d", resp.StatusCode)
+	}
+}
@@ -2,43 +2,34 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 
+	"github.com/LipJ01/fly-ssh-bastion/internal/alert"
+	"github.com/LipJ01/fly-ssh-bastion/internal/backup"
 	"github.com/LipJ01/fly-ssh-bastion/internal/config"
 	"github.com/LipJ01/fly-ssh-bastion/internal/db"
+	"github.com/LipJ01/fly-ssh-bastion/internal/relay"
+	"github.com/LipJ01/fly-ssh-bastion/internal/schedule"
+	"github.com/LipJ01/fly-ssh-bastion/internal/sshkey"
 )
 
 var validName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,63}$`)
 
-func validatePublicKey(key string) error {
-	key = strings.TrimSpace(key)
-	if strings.Contains(key, "\n") {
-		return fmt.Errorf("public key must be a single line")
-	}
-	if len(key) > 2048 {
-		return fmt.Errorf("public key too large")
-	}
-	parts := strings.Fields(key)
-	if len(parts) < 2 {
-		return fmt.Errorf("invalid SSH public key format")
-	}
-	validTypes := map[string]bool{
-		"ssh-rsa": true, "ssh-ed25519": true,
-		"ecdsa-sha2-nistp256": true, "ecdsa-sha2-nistp384": true, "ecdsa-sha2-nistp521": true,
-		"ssh-dss": true,
-	}
-	if !validTypes[parts[0]] {
-		return fmt.Errorf("unsupported key type: %s", parts[0])
-	}
-	return nil
+// validatePublicKey parses the key and checks it against the configured policy.
+func (h *Handlers) validatePublicKey(key string) (*sshkey.Key, error) {
+	return h.KeyPolicy.Validate(key)
 }
 
 func jsonError(w http.ResponseWriter, msg string, code int) {
@@ -52,22 +43,91 @@ type Handlers struct {
 	Gen       *config.Generator
 	OnChange  func() // called after config regeneration (e.g. reload sshpiperd)
 	ServerURL string
+	KeyPolicy sshkey.Policy
+
+	// RenameGrace is how long a renamed machine keeps answering to its old
+	// name when the request does not specify a grace period.
+	RenameGrace time.Duration
+
+	// RequireApproval puts new registrations in the pending state until an
+	// admin approves them.
+	RequireApproval bool
+
+	// BackupPaths locates the state served by the backup endpoint. Backups
+	// are disabled when BackupPaths.DB is empty.
+	BackupPaths backup.Paths
+
+	// RequireKeyProof makes registration prove possession of the private
+	// key by signing a nonce from the challenge endpoint. A proof that is
+	// sent is checked either way.
+	RequireKeyProof bool
+
+	// Alerts holds the offline alerting rules evaluated by RunMaintenance.
+	// Nil disables alerting.
+	Alerts *alert.Config
+
+	// RecordingRetention and RecordingMaxBytes limit the session recordings
+	// kept in Gen.RecordingsDir by age and total size. Zero means no limit.
+	RecordingRetention time.Duration
+	RecordingMaxBytes  int64
+
+	// Relay carries client SSH connections to sshpiperd. It translates the
+	// addresses sshpiperd logs and closes sessions on demand; nil disables
+	// forced disconnects.
+	Relay *relay.Relay
+
+	challenges challengeStore
+	piperAuths pendingAuths
+
+	// configMu serializes RegenerateConfig, which handlers and maintenance
+	// call concurrently, so key files and sshpiper.yaml are written by one
+	// caller at a time.
+	configMu sync.Mutex
+
+	// recordingsMu serializes indexRecordings between maintenance and
+	// session ends.
+	recordingsMu sync.Mutex
+
+	// accessRequests tracks access requests still being submitted after
+	// their response, and accessRequestsMu serializes them so that the
+	// duplicate and pending limit checks hold.
+	accessRequests   sync.WaitGroup
+	accessRequestsMu sync.Mutex
+
+	// scheduleClosed is what applySchedules last found outside its schedule.
+	scheduleClosed map[string]bool
 }
 
 type registerRequest struct {
-	Name      string `json:"name"`
-	Owner     string `json:"owner"`
-	LocalUser string `json:"local_user"`
-	PublicKey string `json:"public_key"`
+	Name      string            `json:"name"`
+	Owner     string            `json:"owner"`
+	LocalUser string            `json:"local_user"`
+	PublicKey string            `json:"public_key"`
+	Tags      []string          `json:"tags,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+
+	// Nonce and Signature prove possession of the private key; see
+	// RegisterChallenge.
+	Nonce     string `json:"nonce,omitempty"`
+	Signature string `json:"signature,omitempty"`
+
+	// Reclaim replaces the key of an existing machine with this name. It
+	// needs the API key or the machine's token.
+	Reclaim bool `json:"reclaim,omitempty"`
 }
 
 type registerResponse struct {
 	Name            string `json:"name"`
+	Status          string `json:"status"`
 	Port            int    `json:"port"`
 	Server          string `json:"server"`
 	TunnelPort      int    `json:"tunnel_port"`
 	SSHUser         string `json:"ssh_user"`
 	ServerPublicKey string `json:"server_public_key"`
+
+	// MachineToken lets the machine call its own endpoints (heartbeat,
+	// status) without the API key. It is only returned at registration.
+	MachineToken string `json:"machine_token,omitempty"`
 }
 
 func (h *Handlers) Register(w http.ResponseWriter, r *http.Request) {
@@ -76,6 +136,51 @@ func (h *Handlers) Register(w http.ResponseWriter, r *http.Request) {
 		jsonError(w, "invalid json", http.StatusBadRequest)
 		return
 	}
+
+	// Without the API key, registration needs an enrollment token, whose
+	// bindings constrain the request, or the machine's own token to
+	// re-register it.
+	c := callerFrom(r)
+	var enrollment *db.Enrollment
+	switch {
+	case c.admin:
+	case c.machine != "":
+		if req.Name != c.machine {
+			jsonError(w, "machine token does not belong to "+req.Name, http.StatusForbidden)
+			return
+		}
+		if req.Owner == "" {
+			if m, err := h.DB.GetMachine(c.machine); err == nil && m != nil {
+				req.Owner = m.Owner
+			}
+		}
+	default:
+		e, err := h.DB.GetUsableEnrollment(hashToken(c.enrollment))
+		if errors.Is(err, db.ErrEnrollmentUnusable) {
+			jsonError(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			log.Printf("error checking enrollment: %v", err)
+			jsonError(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if e.Owner != "" {
+			if req.Owner == "" {
+				req.Owner = e.Owner
+			} else if req.Owner != e.Owner {
+				jsonError(w, fmt.Sprintf("enrollment token is bound to owner %q", e.Owner), http.StatusForbidden)
+				return
+			}
+		}
+		if !strings.HasPrefix(req.Name, e.NamePrefix) {
+			jsonError(w, fmt.Sprintf("enrollment token requires a machine name starting with %q", e.NamePrefix), http.StatusForbidden)
+			return
+		}
+		req.Tags = append(req.Tags, e.Tags...)
+		enrollment = e
+	}
+
 	if req.Name == "" || req.Owner == "" || req.LocalUser == "" || req.PublicKey == "" {
 		jsonError(w, "name, owner, local_user, and public_key are required", http.StatusBadRequest)
 		return
@@ -92,10 +197,33 @@ func (h *Handlers) Register(w http.ResponseWriter, r *http.Request) {
 		jsonError(w, "invalid local_user: must be alphanumeric with optional dots, hyphens, underscores (max 64 chars)", http.StatusBadRequest)
 		return
 	}
-	if err := validatePublicKey(req.PublicKey); err != nil {
+	tags, err := checkTags(req.Tags)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkLabels(req.Labels); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key, err := h.validatePublicKey(req.PublicKey)
+	if err != nil {
 		jsonError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	req.PublicKey = strings.TrimSpace(req.PublicKey)
+	if h.rejectRevoked(w, key.Fingerprint) {
+		return
+	}
+	// A proof that is sent is always checked, so a bad one is refused
+	// rather than ignored while the flag is off
+	proven := false
+	if h.RequireKeyProof || req.Nonce != "" || req.Signature != "" {
+		if !h.checkKeyProof(w, key, req.Nonce, req.Signature) {
+			return
+		}
+		proven = true
+	}
 
 	// Check if already exists
 	existing, err := h.DB.GetMachine(req.Name)
@@ -105,30 +233,74 @@ func (h *Handlers) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if existing != nil {
-		jsonError(w, "machine already registered", http.StatusConflict)
+		h.reregister(w, c, existing, key, req, proven)
+		return
+	}
+	if taken, err := h.DB.NameTaken(req.Name); err != nil {
+		log.Printf("error checking name: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	} else if taken {
+		jsonError(w, fmt.Sprintf("name %q is in use as an alias", req.Name), http.StatusConflict)
 		return
 	}
 
+	machineToken, tokenHash, err := newToken("mt_")
+	if err != nil {
+		log.Printf("error generating machine token: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
 	m := &db.Machine{
-		Name:      req.Name,
-		Owner:     req.Owner,
-		LocalUser: req.LocalUser,
-		PublicKey:  req.PublicKey,
+		Name:        req.Name,
+		Owner:       req.Owner,
+		LocalUser:   req.LocalUser,
+		PublicKey:   req.PublicKey,
+		Fingerprint: key.Fingerprint,
+		State:       db.StateActive,
+		Tags:        tags,
+		Labels:      req.Labels,
+		TokenHash:   tokenHash,
 	}
-	if err := h.DB.CreateMachine(m); err != nil {
+	if h.RequireApproval {
+		m.State = db.StatePending
+	}
+	if enrollment != nil {
+		err = h.DB.CreateEnrolledMachine(m, hashToken(c.enrollment))
+	} else {
+		err = h.DB.CreateMachine(m)
+	}
+	if errors.Is(err, db.ErrEnrollmentUnusable) {
+		jsonError(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
 		log.Printf("error creating machine: %v", err)
 		jsonError(w, "failed to register machine", http.StatusInternalServerError)
 		return
 	}
-
-	if err := h.Gen.WriteKey(m.Name, m.PublicKey); err != nil {
-		log.Printf("error writing key: %v", err)
+	if enrollment != nil {
+		log.Printf("Machine %q registered with enrollment token %d", m.Name, enrollment.ID)
 	}
 
-	if err := h.regenerateConfig(); err != nil {
-		log.Printf("error regenerating config: %v", err)
+	status := http.StatusCreated
+	if m.IsActive() {
+		if err := h.Gen.WriteKey(m.Name, m.PublicKey); err != nil {
+			log.Printf("error writing key: %v", err)
+		}
+		if err := h.RegenerateConfig(); err != nil {
+			log.Printf("error regenerating config: %v", err)
+		}
+	} else {
+		log.Printf("Machine %q registered by %s, awaiting approval", m.Name, m.Owner)
+		status = http.StatusAccepted
 	}
 
+	h.writeRegistration(w, status, m, machineToken)
+}
+
+// writeRegistration sends the machine's assignment in a register response.
+func (h *Handlers) writeRegistration(w http.ResponseWriter, status int, m *db.Machine, machineToken string) {
 	// Read server public key to include in response
 	var serverPubKey string
 	if pubKeyData, err := os.ReadFile(h.Gen.ServerKey + ".pub"); err == nil {
@@ -136,46 +308,146 @@ func (h *Handlers) Register(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
+	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(registerResponse{
 		Name:            m.Name,
+		Status:          m.State,
 		Port:            m.Port,
 		Server:          h.ServerURL,
 		TunnelPort:      2222,
 		SSHUser:         "bastion",
 		ServerPublicKey: serverPubKey,
+		MachineToken:    machineToken,
 	})
 }
 
 type machineListEntry struct {
-	Name      string     `json:"name"`
-	Owner     string     `json:"owner"`
-	Port      int        `json:"port"`
-	LocalUser string     `json:"local_user"`
-	LastSeen  *time.Time `json:"last_seen,omitempty"`
+	Name        string            `json:"name"`
+	Owner       string            `json:"owner"`
+	Port        int               `json:"port"`
+	LocalUser   string            `json:"local_user"`
+	LocalUsers  []string          `json:"local_users,omitempty"`
+	Fingerprint string            `json:"fingerprint"`
+	State       string            `json:"state"`
+	Tags        []string          `json:"tags,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Aliases     []db.Alias        `json:"aliases,omitempty"`
+	CreatedAt   time.Time         `json:"created_at"`
+	LastSeen    *time.Time        `json:"last_seen,omitempty"`
+	Facts       *db.Facts         `json:"facts,omitempty"`
+	FactsAt     *time.Time        `json:"facts_at,omitempty"`
+
+	RecordSessions bool `json:"record_sessions,omitempty"`
+
+	Schedule         string `json:"schedule,omitempty"`
+	ScheduleTimezone string `json:"schedule_timezone,omitempty"`
+	OutsideSchedule  bool   `json:"outside_schedule,omitempty"` // not routed until the schedule opens
 }
 
+// ListMachines lists machines, filtered, sorted and paged by the query
+// parameters described by machineQuery. X-Total-Count holds the number of
+// matches before paging.
 func (h *Handlers) ListMachines(w http.ResponseWriter, r *http.Request) {
+	query, err := parseMachineQuery(r.URL.Query())
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	machines, err := h.DB.ListMachines()
 	if err != nil {
 		log.Printf("error listing machines: %v", err)
 		jsonError(w, "internal error", http.StatusInternalServerError)
 		return
 	}
-	result := make([]machineListEntry, len(machines))
+	aliases, err := h.DB.AllAliases()
+	if err != nil {
+		log.Printf("error listing aliases: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	users, err := h.DB.AllMachineUsers()
+	if err != nil {
+		log.Printf("error listing local users: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	entries := make([]machineListEntry, len(machines))
 	for i, m := range machines {
-		result[i] = machineListEntry{
-			Name:      m.Name,
-			Owner:     m.Owner,
-			Port:      m.Port,
-			LocalUser: m.LocalUser,
-			LastSeen:  m.LastSeen,
-		}
+		entries[i] = newMachineListEntry(m, aliases[m.Name], users[m.Name])
 	}
+	result, total := query.apply(entries, time.Now())
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
 	json.NewEncoder(w).Encode(result)
 }
 
+func newMachineListEntry(m db.Machine, aliases []db.Alias, users []string) machineListEntry {
+	return machineListEntry{
+		Name:        m.Name,
+		Owner:       m.Owner,
+		Port:        m.Port,
+		LocalUser:   m.LocalUser,
+		LocalUsers:  users,
+		Fingerprint: m.Fingerprint,
+		State:       m.State,
+		Tags:        m.Tags,
+		Labels:      m.Labels,
+		Aliases:     aliases,
+		CreatedAt:   m.CreatedAt,
+		LastSeen:    m.LastSeen,
+		Facts:       m.Facts,
+		FactsAt:     m.FactsAt,
+
+		RecordSessions: m.RecordSessions,
+
+		Schedule:         m.Schedule,
+		ScheduleTimezone: m.ScheduleTimezone,
+		OutsideSchedule:  !schedule.Open(m.Schedule, m.ScheduleTimezone, time.Now()),
+	}
+}
+
+func (h *Handlers) GetMachine(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if !authorizeMachine(w, r, name) {
+		return
+	}
+
+	m, err := h.DB.GetMachine(name)
+	if err != nil {
+		log.Printf("error getting machine: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if m == nil {
+		jsonError(w, "machine not found", http.StatusNotFound)
+		return
+	}
+	h.writeMachine(w, m)
+}
+
+// writeMachine sends a machine with its aliases and local users.
+func (h *Handlers) writeMachine(w http.ResponseWriter, m *db.Machine) {
+	aliases, err := h.DB.ListAliases(m.Name)
+	if err != nil {
+		log.Printf("error listing aliases: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	users, err := h.DB.ListMachineUsers(m.Name)
+	if err != nil {
+		log.Printf("error listing local users: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	var usernames []string
+	for _, u := range users {
+		usernames = append(usernames, u.Username)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newMachineListEntry(*m, aliases, usernames))
+}
+
 func (h *Handlers) DeleteMachine(w http.ResponseWriter, r *http.Request) {
 	name := chi.URLParam(r, "name")
 	if err := h.DB.DeleteMachine(name); err != nil {
@@ -185,7 +457,7 @@ func (h *Handlers) DeleteMachine(w http.ResponseWriter, r *http.Request) {
 
 	_ = h.Gen.RemoveKey(name)
 
-	if err := h.regenerateConfig(); err != nil {
+	if err := h.RegenerateConfig(); err != nil {
 		log.Printf("error regenerating config: %v", err)
 	}
 
@@ -197,7 +469,8 @@ func (h *Handlers) RenameMachine(w http.ResponseWriter, r *http.Request) {
 	oldName := chi.URLParam(r, "name")
 
 	var req struct {
-		NewName string `json:"new_name"`
+		NewName     string `json:"new_name"`
+		GracePeriod string `json:"grace_period"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		jsonError(w, "invalid json", http.StatusBadRequest)
@@ -211,6 +484,15 @@ func (h *Handlers) RenameMachine(w http.ResponseWriter, r *http.Request) {
 		jsonError(w, "invalid new name: must be alphanumeric with optional dots, hyphens, underscores (max 64 chars)", http.StatusBadRequest)
 		return
 	}
+	grace := h.RenameGrace
+	if req.GracePeriod != "" {
+		d, err := parseDuration(req.GracePeriod)
+		if err != nil || d < 0 {
+			jsonError(w, "invalid grace_period: use a duration such as 72h or 7d", http.StatusBadRequest)
+			return
+		}
+		grace = d
+	}
 
 	// Check if new name already taken
 	existing, err := h.DB.GetMachine(req.NewName)
@@ -223,8 +505,22 @@ func (h *Handlers) RenameMachine(w http.ResponseWriter, r *http.Request) {
 		jsonError(w, fmt.Sprintf("machine %q already exists", req.NewName), http.StatusConflict)
 		return
 	}
+	if ownAlias, err := h.isAliasOf(req.NewName, oldName); err != nil {
+		log.Printf("error checking aliases: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	} else if !ownAlias {
+		if taken, err := h.DB.NameTaken(req.NewName); err != nil {
+			log.Printf("error checking name: %v", err)
+			jsonError(w, "internal error", http.StatusInternalServerError)
+			return
+		} else if taken {
+			jsonError(w, fmt.Sprintf("name %q is in use as an alias", req.NewName), http.StatusConflict)
+			return
+		}
+	}
 
-	if err := h.DB.RenameMachine(oldName, req.NewName); err != nil {
+	if err := h.DB.RenameMachine(oldName, req.NewName, grace); err != nil {
 		jsonError(w, err.Error(), http.StatusNotFound)
 		return
 	}
@@ -233,12 +529,31 @@ func (h *Handlers) RenameMachine(w http.ResponseWriter, r *http.Request) {
 		log.Printf("warning: failed to rename key file: %v", err)
 	}
 
-	if err := h.regenerateConfig(); err != nil {
+	if err := h.RegenerateConfig(); err != nil {
 		log.Printf("error regenerating config: %v", err)
 	}
 
+	resp := map[string]any{"name": req.NewName}
+	if grace > 0 {
+		resp["alias"] = oldName
+		resp["alias_expires_at"] = time.Now().Add(grace).UTC().Truncate(time.Second)
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"name": req.NewName})
+	json.NewEncoder(w).Encode(resp)
+}
+
+// isAliasOf reports whether name is currently an alias of machineName.
+func (h *Handlers) isAliasOf(name, machineName string) (bool, error) {
+	aliases, err := h.DB.ListAliases(machineName)
+	if err != nil {
+		return false, err
+	}
+	for _, a := range aliases {
+		if a.Alias == name {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
 func (h *Handlers) Status(w http.ResponseWriter, r *http.Request) {
@@ -254,18 +569,36 @@ func (h *Handlers) Status(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// Heartbeat marks the machine as seen and records the host facts it reports,
+// if any.
 func (h *Handlers) Heartbeat(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		Name string `json:"name"`
+		Name  string    `json:"name"`
+		Facts *db.Facts `json:"facts"`
 	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxHeartbeatBytes)
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
 		jsonError(w, "name is required", http.StatusBadRequest)
 		return
 	}
+	if !authorizeMachine(w, r, req.Name) {
+		return
+	}
+	if req.Facts != nil {
+		if err := checkFacts(req.Facts); err != nil {
+			jsonError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 	if err := h.DB.UpdateLastSeen(req.Name); err != nil {
 		jsonError(w, err.Error(), http.StatusNotFound)
 		return
 	}
+	if req.Facts != nil {
+		if err := h.DB.RecordFacts(req.Name, *req.Facts); err != nil {
+			log.Printf("error recording facts for %s: %v", req.Name, err)
+		}
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.Write([]byte(`{"ok":true}`))
 }
@@ -285,8 +618,14 @@ func (h *Handlers) AddAccessKey(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req struct {
-		Label     string `json:"label"`
-		PublicKey string `json:"public_key"`
+		Label      string   `json:"label"`
+		PublicKey  string   `json:"public_key"`
+		LocalUsers []string `json:"local_users"`
+
+		Schedule         string `json:"schedule"`
+		ScheduleTimezone string `json:"schedule_timezone"`
+
+		db.KeyRestrictions
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		jsonError(w, "invalid json", http.StatusBadRequest)
@@ -296,14 +635,38 @@ func (h *Handlers) AddAccessKey(w http.ResponseWriter, r *http.Request) {
 		jsonError(w, "label and public_key are required", http.StatusBadRequest)
 		return
 	}
-	if err := validatePublicKey(req.PublicKey); err != nil {
+	if err := checkSchedule(req.Schedule, req.ScheduleTimezone); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkRestrictions(&req.KeyRestrictions); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	parsed, err := h.validatePublicKey(req.PublicKey)
+	if err != nil {
 		jsonError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	req.PublicKey = strings.TrimSpace(req.PublicKey)
+	if h.rejectRevoked(w, parsed.Fingerprint) {
+		return
+	}
+	if err := h.checkLocalUsers(machine, req.LocalUsers); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	key, err := h.DB.AddAccessKey(machineName, req.Label, req.PublicKey)
-	if err != nil {
+	key := &db.AccessKey{
+		MachineName:      machineName,
+		Label:            req.Label,
+		PublicKey:        req.PublicKey,
+		LocalUsers:       req.LocalUsers,
+		Schedule:         req.Schedule,
+		ScheduleTimezone: req.ScheduleTimezone,
+		KeyRestrictions:  req.KeyRestrictions,
+	}
+	if err := h.DB.AddAccessKey(key); err != nil {
 		if strings.Contains(err.Error(), "UNIQUE") {
 			jsonError(w, "key already added to this machine", http.StatusConflict)
 			return
@@ -317,7 +680,7 @@ func (h *Handlers) AddAccessKey(w http.ResponseWriter, r *http.Request) {
 		log.Printf("error writing access key file: %v", err)
 	}
 
-	if err := h.regenerateConfig(); err != nil {
+	if err := h.RegenerateConfig(); err != nil {
 		log.Printf("error regenerating config: %v", err)
 	}
 
@@ -354,6 +717,8 @@ func (h *Handlers) ListAccessKeys(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(keys)
 }
 
+// DeleteAccessKey removes an access key. With ?disconnect=true it also closes
+// the open SSH sessions that may have used the key.
 func (h *Handlers) DeleteAccessKey(w http.ResponseWriter, r *http.Request) {
 	machineName := chi.URLParam(r, "name")
 	keyIDStr := chi.URLParam(r, "keyID")
@@ -382,40 +747,89 @@ func (h *Handlers) DeleteAccessKey(w http.ResponseWriter, r *http.Request) {
 
 	_ = h.Gen.RemoveAccessKey(machineName, keyID)
 
-	if err := h.regenerateConfig(); err != nil {
+	if err := h.RegenerateConfig(); err != nil {
 		log.Printf("error regenerating config: %v", err)
 	}
 
+	if disconnect, _ := strconv.ParseBool(r.URL.Query().Get("disconnect")); disconnect {
+		n := h.disconnectKeySessions(key, "access key removed")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"ok": true, "disconnected": n})
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.Write([]byte(`{"ok":true}`))
 }
 
-func (h *Handlers) regenerateConfig() error {
+// RegenerateConfig rewrites key files, sshpiper.yaml and authorized_keys from
+// the database and then calls OnChange.
+func (h *Handlers) RegenerateConfig() error {
+	h.configMu.Lock()
+	defer h.configMu.Unlock()
+
 	machines, err := h.DB.ListMachines()
 	if err != nil {
 		return err
 	}
+	revoked, err := h.revokedKeys()
+	if err != nil {
+		return err
+	}
+	aliases, err := h.DB.AllAliases()
+	if err != nil {
+		return err
+	}
+	users, err := h.DB.AllMachineUsers()
+	if err != nil {
+		return err
+	}
 
-	// Build pipe entries with access keys for each machine
+	// Build pipe entries with access keys for each routable machine
+	now := time.Now()
 	var entries []config.PipeEntry
+	var active []db.Machine
 	for _, m := range machines {
+		if !m.IsActive() {
+			continue
+		}
+		active = append(active, m)
+		if !revoked.Has(m.PublicKey) {
+			if err := h.Gen.WriteKey(m.Name, m.PublicKey); err != nil {
+				log.Printf("warning: failed to write key for %s: %v", m.Name, err)
+			}
+		}
 		accessKeys, err := h.DB.ListAccessKeys(m.Name)
 		if err != nil {
 			log.Printf("warning: failed to list access keys for %s: %v", m.Name, err)
 		}
 		// Write access key files
 		for _, ak := range accessKeys {
+			if revoked.Has(ak.PublicKey) {
+				continue
+			}
 			if err := h.Gen.WriteAccessKey(m.Name, ak.ID, ak.PublicKey); err != nil {
 				log.Printf("warning: failed to write access key %d: %v", ak.ID, err)
 			}
 		}
-		entries = append(entries, config.PipeEntry{Machine: m, AccessKeys: accessKeys})
-	}
-
-	if err := h.Gen.Generate(entries); err != nil {
+		// Out of its schedule a machine keeps its tunnel but is not routed
+		if !schedule.Open(m.Schedule, m.ScheduleTimezone, now) {
+			continue
+		}
+		accessKeys = slices.DeleteFunc(accessKeys, func(k db.AccessKey) bool {
+			return k.Expired(now) || !schedule.Open(k.Schedule, k.ScheduleTimezone, now)
+		})
+		entries = append(entries, config.PipeEntry{
+			Machine:    m,
+			AccessKeys: accessKeys,
+			Aliases:    aliases[m.Name],
+			LocalUsers: users[m.Name],
+		})
+	}
+
+	if err := h.Gen.Generate(entries, revoked); err != nil {
 		return err
 	}
-	if err := h.Gen.UpdateAuthorizedKeys(machines); err != nil {
+	if err := h.Gen.UpdateAuthorizedKeys(active, revoked); err != nil {
 		log.Printf("warning: failed to update authorized_keys: %v", err)
 	}
 	if h.OnChange != nil {
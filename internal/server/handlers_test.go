@@ -2,18 +2,32 @@ package server
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
+	"golang.org/x/crypto/ssh"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/backup"
 	"github.com/LipJ01/fly-ssh-bastion/internal/config"
 	"github.com/LipJ01/fly-ssh-bastion/internal/db"
+	"github.com/LipJ01/fly-ssh-bastion/internal/sshkey"
 )
 
 func setupTestServer(t *testing.T) (*httptest.Server, *db.DB) {
+	t.Helper()
+	return setupTestServerWith(t, nil)
+}
+
+// setupTestServerWith is setupTestServer with a hook to adjust the handlers
+// before the server starts.
+func setupTestServerWith(t *testing.T, configure func(h *Handlers)) (*httptest.Server, *db.DB) {
 	t.Helper()
 	dir := t.TempDir()
 	database, err := db.Open(filepath.Join(dir, "test.db"))
@@ -31,13 +45,42 @@ func setupTestServer(t *testing.T) (*httptest.Server, *db.DB) {
 		filepath.Join(dir, "server-key"),
 	)
 
-	router := NewRouter(database, gen, "test-secret", "test.example.com", nil)
-	server := httptest.NewServer(router)
+	h := &Handlers{
+		DB:        database,
+		Gen:       gen,
+		ServerURL: "test.example.com",
+		KeyPolicy: sshkey.DefaultPolicy,
+		BackupPaths: backup.Paths{
+			DB:          filepath.Join(dir, "test.db"),
+			KeysDir:     keysDir,
+			ServerKey:   gen.ServerKey,
+			HostKeysDir: filepath.Join(dir, "host-keys"),
+			Config:      gen.ConfigPath,
+		},
+	}
+	if configure != nil {
+		configure(h)
+	}
+	server := httptest.NewServer(NewRouter(h, "test-secret"))
 	t.Cleanup(server.Close)
 
 	return server, database
 }
 
+// testKey returns a freshly generated ed25519 public key in authorized_keys format.
+func testKey(t *testing.T) string {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("ssh key: %v", err)
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub)))
+}
+
 func TestStatusEndpoint(t *testing.T) {
 	srv, _ := setupTestServer(t)
 
@@ -119,7 +162,7 @@ func TestRegisterSuccess(t *testing.T) {
 		"name":       "alice-mac",
 		"owner":      "alice",
 		"local_user": "alice",
-		"public_key": "ssh-ed25519 AAAA alice",
+		"public_key": testKey(t),
 	}
 	resp := authRequest(t, "POST", srv.URL+"/api/register", body)
 	defer resp.Body.Close()
@@ -152,7 +195,7 @@ func TestRegisterDuplicate(t *testing.T) {
 		"name":       "dup",
 		"owner":      "alice",
 		"local_user": "alice",
-		"public_key": "ssh-ed25519 AAAA",
+		"public_key": testKey(t),
 	}
 
 	resp := authRequest(t, "POST", srv.URL+"/api/register", body)
@@ -161,6 +204,8 @@ func TestRegisterDuplicate(t *testing.T) {
 		t.Fatalf("first register failed: %d", resp.StatusCode)
 	}
 
+	// Same name with another key is still a conflict
+	body["public_key"] = testKey(t)
 	resp = authRequest(t, "POST", srv.URL+"/api/register", body)
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusConflict {
@@ -206,7 +251,7 @@ func TestListAfterRegister(t *testing.T) {
 	// Register two machines
 	for _, name := range []string{"m1", "m2"} {
 		body := map[string]string{
-			"name": name, "owner": "test", "local_user": "test", "public_key": "ssh-ed25519 AAAA " + name,
+			"name": name, "owner": "test", "local_user": "test", "public_key": testKey(t),
 		}
 		resp := authRequest(t, "POST", srv.URL+"/api/register", body)
 		resp.Body.Close()
@@ -227,7 +272,7 @@ func TestDeleteMachine(t *testing.T) {
 
 	// Register
 	body := map[string]string{
-		"name": "to-delete", "owner": "test", "local_user": "test", "public_key": "ssh-ed25519 AAAA test",
+		"name": "to-delete", "owner": "test", "local_user": "test", "public_key": testKey(t),
 	}
 	resp := authRequest(t, "POST", srv.URL+"/api/register", body)
 	resp.Body.Close()
@@ -267,7 +312,7 @@ func TestRenameMachine(t *testing.T) {
 
 	// Register a machine
 	body := map[string]string{
-		"name": "old-name", "owner": "test", "local_user": "test", "public_key": "ssh-ed25519 AAAA test",
+		"name": "old-name", "owner": "test", "local_user": "test", "public_key": testKey(t),
 	}
 	resp := authRequest(t, "POST", srv.URL+"/api/register", body)
 	resp.Body.Close()
@@ -318,7 +363,7 @@ func TestRenameDuplicate(t *testing.T) {
 	// Register two machines
 	for _, name := range []string{"m1", "m2"} {
 		body := map[string]string{
-			"name": name, "owner": "test", "local_user": "test", "public_key": "ssh-ed25519 AAAA " + name,
+			"name": name, "owner": "test", "local_user": "test", "public_key": testKey(t),
 		}
 		resp := authRequest(t, "POST", srv.URL+"/api/register", body)
 		resp.Body.Close()
@@ -339,7 +384,7 @@ func TestRenameInvalidName(t *testing.T) {
 
 	// Register a machine
 	regBody := map[string]string{
-		"name": "valid", "owner": "test", "local_user": "test", "public_key": "ssh-ed25519 AAAA test",
+		"name": "valid", "owner": "test", "local_user": "test", "public_key": testKey(t),
 	}
 	resp := authRequest(t, "POST", srv.URL+"/api/register", regBody)
 	resp.Body.Close()
@@ -359,7 +404,7 @@ func TestHeartbeat(t *testing.T) {
 
 	// Register first
 	regBody := map[string]string{
-		"name": "hb-test", "owner": "test", "local_user": "test", "public_key": "ssh-ed25519 AAAA test",
+		"name": "hb-test", "owner": "test", "local_user": "test", "public_key": testKey(t),
 	}
 	resp := authRequest(t, "POST", srv.URL+"/api/register", regBody)
 	resp.Body.Close()
@@ -420,3 +465,81 @@ func TestStatusIsPublic(t *testing.T) {
 		t.Fatalf("expected 200, got %d", resp.StatusCode)
 	}
 }
+
+func TestRegisterMalformedKey(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	for _, key := range []string{"ssh-ed25519 AAAA alice", "ssh-dss AAAAB3NzaC1kc3M= bob", "not a key"} {
+		body := map[string]string{
+			"name": "bad-key", "owner": "test", "local_user": "test", "public_key": key,
+		}
+		resp := authRequest(t, "POST", srv.URL+"/api/register", body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected 400 for %q, got %d", key, resp.StatusCode)
+		}
+	}
+}
+
+func TestListIncludesFingerprints(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	machineKey := testKey(t)
+	body := map[string]string{
+		"name": "fp", "owner": "test", "local_user": "test", "public_key": machineKey,
+	}
+	resp := authRequest(t, "POST", srv.URL+"/api/register", body)
+	resp.Body.Close()
+
+	resp = authRequest(t, "GET", srv.URL+"/api/machines", nil)
+	var machines []map[string]any
+	json.NewDecoder(resp.Body).Decode(&machines)
+	resp.Body.Close()
+	if len(machines) != 1 || machines[0]["fingerprint"] != sshkey.Fingerprint(machineKey) {
+		t.Fatalf("expected machine fingerprint, got %v", machines)
+	}
+
+	accessKey := testKey(t)
+	resp = authRequest(t, "POST", srv.URL+"/api/machines/fp/keys", map[string]string{
+		"label": "phone", "public_key": accessKey,
+	})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("add access key: expected 201, got %d", resp.StatusCode)
+	}
+
+	resp = authRequest(t, "GET", srv.URL+"/api/machines/fp/keys", nil)
+	var keys []map[string]any
+	json.NewDecoder(resp.Body).Decode(&keys)
+	resp.Body.Close()
+	if len(keys) != 1 || keys[0]["fingerprint"] != sshkey.Fingerprint(accessKey) {
+		t.Fatalf("expected access key fingerprint, got %v", keys)
+	}
+}
+
+func TestRenameMachineKeepsAccessKeys(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	resp := authRequest(t, "POST", srv.URL+"/api/register", map[string]string{
+		"name": "old-name", "owner": "test", "local_user": "test", "public_key": testKey(t),
+	})
+	resp.Body.Close()
+	resp = authRequest(t, "POST", srv.URL+"/api/machines/old-name/keys", map[string]string{
+		"label": "phone", "public_key": testKey(t),
+	})
+	resp.Body.Close()
+
+	resp = authRequest(t, "PUT", srv.URL+"/api/machines/old-name/rename", map[string]string{"new_name": "new-name"})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("rename: expected 200, got %d", resp.StatusCode)
+	}
+
+	resp = authRequest(t, "GET", srv.URL+"/api/machines/new-name/keys", nil)
+	defer resp.Body.Close()
+	var keys []map[string]any
+	json.NewDecoder(resp.Body).Decode(&keys)
+	if len(keys) != 1 || keys[0]["machine_name"] != "new-name" {
+		t.Fatalf("expected access key to follow rename, got %v", keys)
+	}
+}
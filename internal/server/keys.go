@@ -0,0 +1,57 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/db"
+	"github.com/LipJ01/fly-ssh-bastion/internal/sshkey"
+)
+
+type keyAccessResponse struct {
+	Fingerprint string        `json:"fingerprint"`
+	Revoked     bool          `json:"revoked"`
+	Grants      []db.KeyGrant `json:"grants"`
+}
+
+// KeyAccess lists every machine a key fingerprint can log into.
+func (h *Handlers) KeyAccess(w http.ResponseWriter, r *http.Request) {
+	// Fingerprints contain '/' and '+', so clients path-escape them
+	raw, err := url.PathUnescape(chi.URLParam(r, "fingerprint"))
+	if err != nil {
+		jsonError(w, "invalid fingerprint", http.StatusBadRequest)
+		return
+	}
+	fingerprint := sshkey.NormalizeFingerprint(raw)
+	if fingerprint == "" {
+		jsonError(w, "fingerprint is required", http.StatusBadRequest)
+		return
+	}
+
+	grants, err := h.DB.FindKeyGrants(fingerprint)
+	if err != nil {
+		log.Printf("error finding key grants: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if grants == nil {
+		grants = []db.KeyGrant{}
+	}
+	revoked, err := h.DB.IsRevoked(fingerprint)
+	if err != nil {
+		log.Printf("error checking revocation: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keyAccessResponse{
+		Fingerprint: fingerprint,
+		Revoked:     revoked,
+		Grants:      grants,
+	})
+}
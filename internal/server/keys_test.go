@@ -0,0 +1,84 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/sshkey"
+)
+
+func TestKeyAccess(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	shared := testKey(t)
+	resp := authRequest(t, "POST", srv.URL+"/api/register", map[string]string{
+		"name": "laptop", "owner": "alice", "local_user": "alice", "public_key": shared,
+	})
+	resp.Body.Close()
+	resp = authRequest(t, "POST", srv.URL+"/api/register", map[string]string{
+		"name": "nas", "owner": "bob", "local_user": "bob", "public_key": testKey(t),
+	})
+	resp.Body.Close()
+	resp = authRequest(t, "POST", srv.URL+"/api/machines/nas/keys", map[string]string{
+		"label": "alice-laptop", "public_key": shared,
+	})
+	resp.Body.Close()
+
+	fp := sshkey.Fingerprint(shared)
+	resp = authRequest(t, "GET", srv.URL+"/api/keys/"+url.PathEscape(fp)+"/access", nil)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Fingerprint string `json:"fingerprint"`
+		Grants      []struct {
+			Machine string `json:"machine"`
+			Kind    string `json:"kind"`
+			Label   string `json:"label"`
+			State   string `json:"state"`
+		} `json:"grants"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if result.Fingerprint != fp {
+		t.Fatalf("expected fingerprint %s, got %s", fp, result.Fingerprint)
+	}
+	if len(result.Grants) != 2 {
+		t.Fatalf("expected 2 grants, got %+v", result.Grants)
+	}
+	if result.Grants[0].Machine != "laptop" || result.Grants[0].Kind != "machine_key" {
+		t.Errorf("unexpected first grant: %+v", result.Grants[0])
+	}
+	if result.Grants[1].Machine != "nas" || result.Grants[1].Kind != "access_key" || result.Grants[1].Label != "alice-laptop" {
+		t.Errorf("unexpected second grant: %+v", result.Grants[1])
+	}
+
+	// A disabled machine's grants are still listed, with its state, since
+	// enabling it brings them back
+	resp = authRequest(t, "POST", srv.URL+"/api/machines/nas/disable", nil)
+	resp.Body.Close()
+	resp = authRequest(t, "GET", srv.URL+"/api/keys/"+url.PathEscape(fp)+"/access", nil)
+	defer resp.Body.Close()
+	json.NewDecoder(resp.Body).Decode(&result)
+	if len(result.Grants) != 2 || result.Grants[0].State != "active" || result.Grants[1].State != "disabled" {
+		t.Fatalf("expected the disabled machine's grant listed with its state, got %+v", result.Grants)
+	}
+}
+
+func TestKeyAccessUnknown(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	resp := authRequest(t, "GET", srv.URL+"/api/keys/nothing-here/access", nil)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var result map[string]any
+	json.NewDecoder(resp.Body).Decode(&result)
+	if grants, _ := result["grants"].([]any); len(grants) != 0 {
+		t.Fatalf("expected no grants, got %v", result["grants"])
+	}
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"cmp"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// onlineWindow is how recently a machine must have sent a heartbeat to count
+// as online. Clients send one every five minutes.
+const onlineWindow = 15 * time.Minute
+
+// machineQuery is the filtering, sorting and paging of GET /api/machines.
+type machineQuery struct {
+	Owner  string
+	State  string
+	Tags   []string          // all must be present
+	Labels map[string]string // all must match
+	Online *bool
+	Text   string // substring of name, owner, alias, tag or label value
+
+	Sort   string // name, owner, port, last-seen or created
+	Desc   bool
+	Limit  int // 0 means no limit
+	Offset int
+}
+
+var machineSorts = []string{"name", "owner", "port", "last-seen", "created"}
+
+func parseMachineQuery(v url.Values) (machineQuery, error) {
+	q := machineQuery{
+		Owner:  v.Get("owner"),
+		State:  v.Get("state"),
+		Tags:   v["tag"],
+		Labels: map[string]string{},
+		Text:   strings.ToLower(v.Get("q")),
+		Sort:   "port",
+	}
+	for _, l := range v["label"] {
+		k, val, ok := strings.Cut(l, "=")
+		if !ok {
+			return q, fmt.Errorf("invalid label filter %q: use key=value", l)
+		}
+		q.Labels[k] = val
+	}
+	if s := v.Get("online"); s != "" {
+		online, err := strconv.ParseBool(s)
+		if err != nil {
+			return q, fmt.Errorf("invalid online filter %q: use true or false", s)
+		}
+		q.Online = &online
+	}
+	if s := v.Get("sort"); s != "" {
+		q.Sort, q.Desc = strings.CutPrefix(s, "-")
+		if !slices.Contains(machineSorts, q.Sort) {
+			return q, fmt.Errorf("invalid sort %q: use one of %s, optionally prefixed with -", s, strings.Join(machineSorts, ", "))
+		}
+	}
+	for name, dst := range map[string]*int{"limit": &q.Limit, "offset": &q.Offset} {
+		if s := v.Get(name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				return q, fmt.Errorf("invalid %s %q", name, s)
+			}
+			*dst = n
+		}
+	}
+	return q, nil
+}
+
+func (q machineQuery) matches(e machineListEntry, now time.Time) bool {
+	if q.Owner != "" && e.Owner != q.Owner {
+		return false
+	}
+	if q.State != "" && e.State != q.State {
+		return false
+	}
+	for _, t := range q.Tags {
+		if !slices.Contains(e.Tags, t) {
+			return false
+		}
+	}
+	for k, v := range q.Labels {
+		if got, ok := e.Labels[k]; !ok || got != v {
+			return false
+		}
+	}
+	if q.Online != nil && isOnline(e.LastSeen, now) != *q.Online {
+		return false
+	}
+	if q.Text != "" && !e.containsText(q.Text) {
+		return false
+	}
+	return true
+}
+
+func isOnline(lastSeen *time.Time, now time.Time) bool {
+	return lastSeen != nil && now.Sub(*lastSeen) <= onlineWindow
+}
+
+func (e machineListEntry) containsText(text string) bool {
+	fields := []string{e.Name, e.Owner}
+	fields = append(fields, e.Tags...)
+	for _, a := range e.Aliases {
+		fields = append(fields, a.Alias)
+	}
+	for _, v := range e.Labels {
+		fields = append(fields, v)
+	}
+	for _, f := range fields {
+		if strings.Contains(strings.ToLower(f), text) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply filters, sorts and pages the entries, returning the page and the
+// number of entries that matched before paging.
+func (q machineQuery) apply(entries []machineListEntry, now time.Time) ([]machineListEntry, int) {
+	matched := []machineListEntry{}
+	for _, e := range entries {
+		if q.matches(e, now) {
+			matched = append(matched, e)
+		}
+	}
+
+	slices.SortStableFunc(matched, func(a, b machineListEntry) int {
+		var c int
+		switch q.Sort {
+		case "name":
+			c = cmp.Compare(a.Name, b.Name)
+		case "owner":
+			c = cmp.Or(cmp.Compare(a.Owner, b.Owner), cmp.Compare(a.Name, b.Name))
+		case "last-seen":
+			// Never-seen machines sort as the oldest
+			c = cmp.Or(lastSeenTime(a).Compare(lastSeenTime(b)), cmp.Compare(a.Name, b.Name))
+		case "created":
+			c = a.CreatedAt.Compare(b.CreatedAt)
+		default:
+			c = cmp.Compare(a.Port, b.Port)
+		}
+		if q.Desc {
+			return -c
+		}
+		return c
+	})
+
+	total := len(matched)
+	start := min(q.Offset, total)
+	end := total
+	if q.Limit > 0 {
+		end = min(start+q.Limit, total)
+	}
+	return matched[start:end], total
+}
+
+func lastSeenTime(e machineListEntry) time.Time {
+	if e.LastSeen == nil {
+		return time.Time{}
+	}
+	return *e.LastSeen
+}
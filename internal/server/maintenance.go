@@ -0,0 +1,66 @@
+package server
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// RunMaintenance periodically removes expired state, regenerates the
+// sshpiper config when anything routable changed or an access schedule
+// opened or closed, expires access requests and temporary access keys,
+// closes tunnel sessions of machines that stopped sending heartbeats,
+// evaluates alert rules and indexes session recordings.
+// It blocks until ctx is done.
+func (h *Handlers) RunMaintenance(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if h.expireState() {
+				if err := h.RegenerateConfig(); err != nil {
+					log.Printf("error regenerating config: %v", err)
+				}
+			}
+			h.applySchedules(time.Now())
+			h.expireAccess(time.Now())
+			h.closeStaleTunnels(time.Now())
+			h.evaluateAlerts(ctx, time.Now())
+			h.indexRecordings(time.Now())
+		}
+	}
+}
+
+// expireState deletes expired rows and reports whether the config needs regenerating.
+func (h *Handlers) expireState() bool {
+	if n, err := h.DB.PurgeTunnelSessions(time.Now().Add(-tunnelSessionRetention)); err != nil {
+		log.Printf("error purging tunnel sessions: %v", err)
+	} else if n > 0 {
+		log.Printf("Removed %d tunnel sessions older than %s", n, tunnelSessionRetention)
+	}
+
+	if n, err := h.DB.PurgeSSHSessions(time.Now().Add(-sshSessionRetention)); err != nil {
+		log.Printf("error purging ssh sessions: %v", err)
+	} else if n > 0 {
+		log.Printf("Removed %d ssh sessions older than %s", n, sshSessionRetention)
+	}
+
+	if n, err := h.DB.PurgeResolvedAlerts(time.Now().Add(-alertRetention)); err != nil {
+		log.Printf("error purging alerts: %v", err)
+	} else if n > 0 {
+		log.Printf("Removed %d alerts resolved more than %s ago", n, alertRetention)
+	}
+
+	n, err := h.DB.PurgeExpiredAliases()
+	if err != nil {
+		log.Printf("error purging expired aliases: %v", err)
+		return false
+	}
+	if n > 0 {
+		log.Printf("Removed %d expired machine aliases", n)
+	}
+	return n > 0
+}
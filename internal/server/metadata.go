@@ -0,0 +1,184 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	maxTags          = 32
+	maxLabels        = 32
+	maxLabelValueLen = 256
+)
+
+var (
+	validTag      = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._:/-]{0,63}$`)
+	validLabelKey = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._/-]{0,63}$`)
+)
+
+// checkTags validates tags and returns them sorted without duplicates.
+func checkTags(tags []string) ([]string, error) {
+	out := []string{}
+	for _, t := range tags {
+		t = strings.TrimSpace(t)
+		if !validTag.MatchString(t) {
+			return nil, fmt.Errorf("invalid tag %q: must be alphanumeric with optional dots, colons, slashes, hyphens, underscores (max 64 chars)", t)
+		}
+		if !slices.Contains(out, t) {
+			out = append(out, t)
+		}
+	}
+	if len(out) > maxTags {
+		return nil, fmt.Errorf("too many tags (max %d)", maxTags)
+	}
+	slices.Sort(out)
+	return out, nil
+}
+
+func checkLabels(labels map[string]string) error {
+	if len(labels) > maxLabels {
+		return fmt.Errorf("too many labels (max %d)", maxLabels)
+	}
+	for k, v := range labels {
+		if !validLabelKey.MatchString(k) {
+			return fmt.Errorf("invalid label key %q: must be alphanumeric with optional dots, slashes, hyphens, underscores (max 64 chars)", k)
+		}
+		if len(v) > maxLabelValueLen || strings.ContainsAny(v, "\r\n") {
+			return fmt.Errorf("invalid value for label %q: must be a single line of at most %d bytes", k, maxLabelValueLen)
+		}
+	}
+	return nil
+}
+
+// UpdateMachine changes a machine's owner, tags, labels, session recording
+// and access schedule. Fields left out of the request are unchanged; "tags"
+// replaces the tag set, "add_tags" and "remove_tags" edit it, a null label
+// value deletes the label and an empty "schedule" removes the schedule.
+func (h *Handlers) UpdateMachine(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	m, err := h.DB.GetMachine(name)
+	if err != nil {
+		log.Printf("error getting machine: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if m == nil {
+		jsonError(w, "machine not found", http.StatusNotFound)
+		return
+	}
+
+	var req struct {
+		Owner      *string            `json:"owner"`
+		Tags       *[]string          `json:"tags"`
+		AddTags    []string           `json:"add_tags"`
+		RemoveTags []string           `json:"remove_tags"`
+		Labels     map[string]*string `json:"labels"`
+
+		RecordSessions *bool `json:"record_sessions"`
+		// ConfirmRecording accepts the sshpiperd restart that turning
+		// recording on for the first machine, or off for the last, causes
+		ConfirmRecording bool `json:"confirm_recording"`
+
+		Schedule         *string `json:"schedule"`
+		ScheduleTimezone *string `json:"schedule_timezone"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+
+	if req.Owner != nil {
+		if !validName.MatchString(*req.Owner) {
+			jsonError(w, "invalid owner: must be alphanumeric with optional dots, hyphens, underscores (max 64 chars)", http.StatusBadRequest)
+			return
+		}
+		m.Owner = *req.Owner
+	}
+	tags := m.Tags
+	if req.Tags != nil {
+		tags = *req.Tags
+	}
+	tags = append(slices.Clone(tags), req.AddTags...)
+	tags = slices.DeleteFunc(tags, func(t string) bool { return slices.Contains(req.RemoveTags, t) })
+	if m.Tags, err = checkTags(tags); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for k, v := range req.Labels {
+		if v == nil {
+			delete(m.Labels, k)
+		} else {
+			m.Labels[k] = *v
+		}
+	}
+	if err := checkLabels(m.Labels); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	schedule, timezone := m.Schedule, m.ScheduleTimezone
+	if req.Schedule != nil {
+		schedule = *req.Schedule
+	}
+	if req.ScheduleTimezone != nil {
+		timezone = *req.ScheduleTimezone
+	}
+	if schedule == "" && req.ScheduleTimezone == nil {
+		timezone = ""
+	}
+	if err := checkSchedule(schedule, timezone); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.RecordSessions != nil && *req.RecordSessions != m.RecordSessions && !req.ConfirmRecording {
+		warning, err := h.recordingRestartWarning(m, *req.RecordSessions)
+		if err != nil {
+			log.Printf("error checking session recording: %v", err)
+			jsonError(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if warning != "" {
+			jsonError(w, warning, http.StatusConflict)
+			return
+		}
+	}
+
+	if err := h.DB.UpdateMachineMetadata(name, m.Owner, m.Tags, m.Labels); err != nil {
+		log.Printf("error updating machine: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if req.RecordSessions != nil && *req.RecordSessions != m.RecordSessions {
+		if err := h.DB.SetRecordSessions(name, *req.RecordSessions); err != nil {
+			log.Printf("error updating machine: %v", err)
+			jsonError(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		m.RecordSessions = *req.RecordSessions
+		// sshpiperd is restarted with or without recording
+		if err := h.RegenerateConfig(); err != nil {
+			log.Printf("error regenerating config: %v", err)
+		}
+	}
+	if schedule != m.Schedule || timezone != m.ScheduleTimezone {
+		if err := h.DB.SetMachineSchedule(name, schedule, timezone); err != nil {
+			log.Printf("error updating machine: %v", err)
+			jsonError(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		m.Schedule, m.ScheduleTimezone = schedule, timezone
+		if err := h.RegenerateConfig(); err != nil {
+			log.Printf("error regenerating config: %v", err)
+		}
+	}
+
+	h.writeMachine(w, m)
+}
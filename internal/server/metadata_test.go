@@ -0,0 +1,158 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func listMachines(t *testing.T, base, query string) ([]machineListEntry, string) {
+	t.Helper()
+	resp := authRequest(t, "GET", base+"/api/machines?"+query, nil)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 for %q, got %d", query, resp.StatusCode)
+	}
+	var entries []machineListEntry
+	json.NewDecoder(resp.Body).Decode(&entries)
+	return entries, resp.Header.Get("X-Total-Count")
+}
+
+func entryNames(entries []machineListEntry) []string {
+	names := []string{}
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+	return names
+}
+
+func TestMachineTagsAndFilters(t *testing.T) {
+	srv, _ := setupTestServer(t)
+	for _, m := range []map[string]any{
+		{"name": "web-1", "owner": "alice", "tags": []string{"prod", "web"}, "labels": map[string]string{"region": "eu"}},
+		{"name": "web-2", "owner": "bob", "tags": []string{"prod", "web"}, "labels": map[string]string{"region": "us"}},
+		{"name": "dev-box", "owner": "alice", "tags": []string{"dev"}},
+	} {
+		m["local_user"] = "u"
+		m["public_key"] = testKey(t)
+		if code, _ := registerMachine(t, srv.URL, m); code != http.StatusCreated {
+			t.Fatalf("register %s: %d", m["name"], code)
+		}
+	}
+
+	for query, want := range map[string]string{
+		"tag=prod":                  "web-1,web-2",
+		"tag=prod&owner=alice":      "web-1",
+		"label=region%3Dus":         "web-2",
+		"q=DEV":                     "dev-box",
+		"sort=-name":                "web-2,web-1,dev-box",
+		"sort=owner":                "dev-box,web-1,web-2",
+		"tag=web&sort=name&limit=1": "web-1",
+		"online=false&sort=name":    "dev-box,web-1,web-2",
+		"online=true":               "",
+	} {
+		entries, _ := listMachines(t, srv.URL, query)
+		got := ""
+		for i, n := range entryNames(entries) {
+			if i > 0 {
+				got += ","
+			}
+			got += n
+		}
+		if got != want {
+			t.Errorf("%s: expected %q, got %q", query, want, got)
+		}
+	}
+
+	entries, total := listMachines(t, srv.URL, "sort=name&limit=2&offset=2")
+	if total != "3" || len(entries) != 1 || entries[0].Name != "web-2" {
+		t.Fatalf("expected last page with total 3, got %v total %s", entryNames(entries), total)
+	}
+
+	resp := authRequest(t, "GET", srv.URL+"/api/machines?sort=colour", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unknown sort, got %d", resp.StatusCode)
+	}
+}
+
+func TestUpdateMachineMetadata(t *testing.T) {
+	srv, _ := setupTestServer(t)
+	registerMachine(t, srv.URL, map[string]any{
+		"name": "nas", "owner": "alice", "local_user": "u", "public_key": testKey(t),
+		"tags": []string{"home"}, "labels": map[string]string{"rack": "a", "os": "linux"},
+	})
+
+	resp := authRequest(t, "PATCH", srv.URL+"/api/machines/nas", map[string]any{
+		"owner":       "bob",
+		"add_tags":    []string{"storage", "home"},
+		"remove_tags": []string{"missing"},
+		"labels":      map[string]any{"rack": nil, "os": "freebsd"},
+	})
+	var entry machineListEntry
+	json.NewDecoder(resp.Body).Decode(&entry)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if entry.Owner != "bob" || len(entry.Tags) != 2 || entry.Tags[0] != "home" || entry.Tags[1] != "storage" {
+		t.Fatalf("unexpected owner/tags %+v", entry)
+	}
+	if len(entry.Labels) != 1 || entry.Labels["os"] != "freebsd" {
+		t.Fatalf("unexpected labels %+v", entry.Labels)
+	}
+
+	// tags replaces the set; omitted fields are unchanged
+	resp = authRequest(t, "PATCH", srv.URL+"/api/machines/nas", map[string]any{"tags": []string{}})
+	entry = machineListEntry{}
+	json.NewDecoder(resp.Body).Decode(&entry)
+	resp.Body.Close()
+	if len(entry.Tags) != 0 || entry.Owner != "bob" || entry.Labels["os"] != "freebsd" {
+		t.Fatalf("unexpected entry after replacing tags %+v", entry)
+	}
+
+	for _, body := range []map[string]any{
+		{"add_tags": []string{"bad,tag"}},
+		{"labels": map[string]string{"bad key": "x"}},
+		{"owner": ""},
+	} {
+		resp = authRequest(t, "PATCH", srv.URL+"/api/machines/nas", body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected 400 for %v, got %d", body, resp.StatusCode)
+		}
+	}
+
+	resp = authRequest(t, "PATCH", srv.URL+"/api/machines/ghost", map[string]any{"owner": "x"})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestMachineQueryOnline(t *testing.T) {
+	now := time.Now()
+	recent, stale := now.Add(-time.Minute), now.Add(-time.Hour)
+	entries := []machineListEntry{
+		{Name: "a", Port: 3, LastSeen: &stale},
+		{Name: "b", Port: 1, LastSeen: &recent},
+		{Name: "c", Port: 2},
+	}
+
+	q, err := parseMachineQuery(url.Values{"online": {"true"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, total := q.apply(entries, now)
+	if total != 1 || got[0].Name != "b" {
+		t.Fatalf("expected only b online, got %v", entryNames(got))
+	}
+
+	q, _ = parseMachineQuery(url.Values{"sort": {"-last-seen"}})
+	got, _ = q.apply(entries, now)
+	if names := entryNames(got); names[0] != "b" || names[1] != "a" || names[2] != "c" {
+		t.Fatalf("expected most recent first and never-seen last, got %v", names)
+	}
+}
@@ -1,15 +1,18 @@
 package server
 
 import (
+	"context"
 	"crypto/subtle"
+	"log"
 	"net/http"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/db"
 )
 
 func apiKeyAuth(secret string) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			key := r.Header.Get("X-API-Key")
-			if key == "" || subtle.ConstantTimeCompare([]byte(key), []byte(secret)) != 1 {
+			if !validAPIKey(r, secret) {
 				jsonError(w, "unauthorized", http.StatusUnauthorized)
 				return
 			}
@@ -17,3 +20,101 @@ func apiKeyAuth(secret string) func(http.Handler) http.Handler {
 		})
 	}
 }
+
+func validAPIKey(r *http.Request, secret string) bool {
+	key := r.Header.Get("X-API-Key")
+	return key != "" && subtle.ConstantTimeCompare([]byte(key), []byte(secret)) == 1
+}
+
+// caller describes who made a request on the routes that machines can use
+// without the API key.
+type caller struct {
+	admin      bool   // authenticated with the API key
+	machine    string // authenticated with this machine's token
+	enrollment string // unverified enrollment token, checked by Register
+	owner      string // authenticated with an owner token for this owner
+}
+
+// authorizeMachine writes an error and returns false unless the caller used
+// the API key or the named machine's own token.
+func authorizeMachine(w http.ResponseWriter, r *http.Request, name string) bool {
+	c := callerFrom(r)
+	switch {
+	case c.admin || (c.machine != "" && c.machine == name):
+		return true
+	case c.machine == "":
+		jsonError(w, "unauthorized", http.StatusUnauthorized)
+	default:
+		jsonError(w, "machine token does not belong to "+name, http.StatusForbidden)
+	}
+	return false
+}
+
+type callerKey struct{}
+
+func callerFrom(r *http.Request) caller {
+	c, _ := r.Context().Value(callerKey{}).(caller)
+	return c
+}
+
+// machineAuth accepts the API key, a machine token (X-Machine-Token) or an
+// enrollment token (X-Enrollment-Token), recording which in the request
+// context. Handlers behind it must check callerFrom before acting.
+func machineAuth(secret string, database *db.DB) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var c caller
+			if validAPIKey(r, secret) {
+				c.admin = true
+			} else if token := r.Header.Get("X-Machine-Token"); token != "" {
+				m, err := database.MachineByToken(hashToken(token))
+				if err != nil {
+					log.Printf("error looking up machine token: %v", err)
+					jsonError(w, "internal error", http.StatusInternalServerError)
+					return
+				}
+				if m != nil {
+					c.machine = m.Name
+				}
+			}
+			// A stale machine token left in a client config must not hide
+			// an enrollment token sent alongside it
+			if !c.admin && c.machine == "" {
+				c.enrollment = r.Header.Get("X-Enrollment-Token")
+			}
+			if !c.admin && c.machine == "" && c.enrollment == "" {
+				jsonError(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), callerKey{}, c)))
+		})
+	}
+}
+
+// ownerAuth accepts the API key or an owner token (X-Owner-Token), recording
+// which in the request context. Machine tokens are not accepted: a machine's
+// owner is whatever its registrant typed, so it proves nothing about who
+// holds the token.
+func ownerAuth(secret string, database *db.DB) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var c caller
+			if validAPIKey(r, secret) {
+				c.admin = true
+			} else if token := r.Header.Get("X-Owner-Token"); token != "" {
+				owner, err := database.OwnerByToken(hashToken(token))
+				if err != nil {
+					log.Printf("error looking up owner token: %v", err)
+					jsonError(w, "internal error", http.StatusInternalServerError)
+					return
+				}
+				c.owner = owner
+			}
+			if !c.admin && c.owner == "" {
+				jsonError(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), callerKey{}, c)))
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/db"
+)
+
+// ListOrphanedAccessKeys returns the access keys quarantined because their
+// machine was missing when access keys were made to follow renames.
+func (h *Handlers) ListOrphanedAccessKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := h.DB.ListOrphanedAccessKeys()
+	if err != nil {
+		log.Printf("error listing orphaned access keys: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+// RestoreOrphanedAccessKey adds an orphaned key back to a machine: the one
+// named in the body, or else the one whose alias is the key's old machine
+// name.
+func (h *Handlers) RestoreOrphanedAccessKey(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		jsonError(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		Machine string `json:"machine"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			jsonError(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+	}
+
+	orphan, err := h.DB.GetOrphanedAccessKey(id)
+	if err != nil {
+		log.Printf("error getting orphaned access key: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if orphan == nil {
+		jsonError(w, "orphaned access key not found", http.StatusNotFound)
+		return
+	}
+	if req.Machine != "" {
+		m, err := h.DB.GetMachine(req.Machine)
+		if err != nil {
+			log.Printf("error getting machine: %v", err)
+			jsonError(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if m == nil {
+			jsonError(w, "machine not found", http.StatusNotFound)
+			return
+		}
+	}
+	if h.rejectRevoked(w, orphan.Fingerprint) {
+		return
+	}
+
+	key, err := h.DB.RestoreOrphanedAccessKey(id, req.Machine)
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrRenameUnknown):
+			jsonError(w, err.Error(), http.StatusConflict)
+		case strings.Contains(err.Error(), "UNIQUE"):
+			jsonError(w, "key already added to this machine", http.StatusConflict)
+		default:
+			log.Printf("error restoring orphaned access key: %v", err)
+			jsonError(w, "internal error", http.StatusInternalServerError)
+		}
+		return
+	}
+	log.Printf("Restored orphaned access key %d (%q) from %q to %s as access key %d", id, key.Label, orphan.MachineName, key.MachineName, key.ID)
+
+	if err := h.Gen.WriteAccessKey(key.MachineName, key.ID, key.PublicKey); err != nil {
+		log.Printf("error writing access key file: %v", err)
+	}
+	if err := h.RegenerateConfig(); err != nil {
+		log.Printf("error regenerating config: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(key)
+}
+
+// DeleteOrphanedAccessKey discards an orphaned key.
+func (h *Handlers) DeleteOrphanedAccessKey(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		jsonError(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	if err := h.DB.DeleteOrphanedAccessKey(id); err != nil {
+		jsonError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"ok":true}`))
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type ownerTokenResponse struct {
+	Token string `json:"token"`
+	ID    int64  `json:"id"`
+	Owner string `json:"owner"`
+}
+
+// CreateOwnerToken mints a token that decides access requests for the named
+// owner's machines. The token is only returned here; the server keeps a
+// hash.
+func (h *Handlers) CreateOwnerToken(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Owner string `json:"owner"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if !validName.MatchString(req.Owner) {
+		jsonError(w, "invalid owner: must be alphanumeric with optional dots, hyphens, underscores (max 64 chars)", http.StatusBadRequest)
+		return
+	}
+
+	token, hash, err := newToken("own_")
+	if err != nil {
+		log.Printf("error generating owner token: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	t, err := h.DB.CreateOwnerToken(hash, req.Owner)
+	if err != nil {
+		log.Printf("error creating owner token: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Owner token %d created for %q", t.ID, t.Owner)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(ownerTokenResponse{Token: token, ID: t.ID, Owner: t.Owner})
+}
+
+// ListOwnerTokens returns all owner tokens without the tokens themselves.
+func (h *Handlers) ListOwnerTokens(w http.ResponseWriter, r *http.Request) {
+	tokens, err := h.DB.ListOwnerTokens()
+	if err != nil {
+		log.Printf("error listing owner tokens: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func (h *Handlers) DeleteOwnerToken(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		jsonError(w, "invalid token id", http.StatusBadRequest)
+		return
+	}
+	if err := h.DB.DeleteOwnerToken(id); err != nil {
+		jsonError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	log.Printf("Owner token %d revoked", id)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"ok":true}`))
+}
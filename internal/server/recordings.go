@@ -0,0 +1,213 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/db"
+	"github.com/LipJ01/fly-ssh-bastion/internal/recording"
+)
+
+// unmatchedRecordingGrace is how long a recording may wait for its session
+// to be logged before it is discarded as unattributable.
+const unmatchedRecordingGrace = 10 * time.Minute
+
+// indexRecordings attributes new recordings to their SSH sessions, discards
+// recordings of machines that do not record sessions, and enforces the
+// retention limits. A recording is attributed only when one session matches
+// its username and start; see SessionsForRecording.
+func (h *Handlers) indexRecordings(now time.Time) {
+	dir := h.Gen.RecordingsDir
+	if dir == "" {
+		return
+	}
+	h.recordingsMu.Lock()
+	defer h.recordingsMu.Unlock()
+	files, err := recording.Scan(dir)
+	if err != nil {
+		log.Printf("error scanning recordings: %v", err)
+		return
+	}
+	indexed, err := h.DB.IndexedRecordings()
+	if err != nil {
+		log.Printf("error listing recordings: %v", err)
+		return
+	}
+
+	remove := func(f recording.File, why string) {
+		if err := os.Remove(filepath.Join(dir, f.Path)); err != nil && !os.IsNotExist(err) {
+			log.Printf("error removing recording %s: %v", f.Path, err)
+			return
+		}
+		if err := h.DB.DeleteRecording(f.Path); err != nil {
+			log.Printf("error unindexing recording %s: %v", f.Path, err)
+		}
+		log.Printf("Removed recording %s: %s", f.Path, why)
+	}
+
+	var kept []recording.File
+	var total int64
+	for _, f := range files {
+		if h.RecordingRetention > 0 && now.Sub(f.ModTime) > h.RecordingRetention {
+			remove(f, "past retention")
+			continue
+		}
+		if size, ok := indexed[f.Path]; ok {
+			if size != f.Size {
+				if err := h.DB.SetRecordingSize(f.Path, f.Size); err != nil {
+					log.Printf("error updating recording size: %v", err)
+				}
+			}
+		} else {
+			sessions, err := h.DB.SessionsForRecording(f.Username, f.Start)
+			if err != nil {
+				log.Printf("error finding session for recording: %v", err)
+				continue
+			}
+			if len(sessions) == 0 {
+				if now.Sub(f.ModTime) > unmatchedRecordingGrace {
+					remove(f, "no matching session")
+				}
+				continue
+			}
+			recorded, err := h.anyRecorded(sessions)
+			if err != nil {
+				log.Printf("error getting machine: %v", err)
+				continue
+			}
+			if !recorded {
+				remove(f, "machine does not record sessions")
+				continue
+			}
+			if len(sessions) > 1 {
+				// Concurrent sessions under one username: the recording
+				// could be any of theirs, so it stays on disk, subject to
+				// the retention limits, without being served as either's
+				kept = append(kept, f)
+				total += f.Size
+				continue
+			}
+			session := sessions[0]
+			if err := h.DB.AddRecording(session.ID, f.Path, f.Size, f.Start); err != nil {
+				log.Printf("error indexing recording: %v", err)
+				continue
+			}
+		}
+		kept = append(kept, f)
+		total += f.Size
+	}
+
+	// Over the size limit, drop the oldest recordings first
+	if h.RecordingMaxBytes > 0 && total > h.RecordingMaxBytes {
+		sort.Slice(kept, func(i, j int) bool { return kept[i].ModTime.Before(kept[j].ModTime) })
+		for _, f := range kept {
+			if total <= h.RecordingMaxBytes {
+				break
+			}
+			remove(f, "recordings over size limit")
+			total -= f.Size
+		}
+	}
+}
+
+// anyRecorded reports whether any of sessions is to a machine that records
+// its sessions.
+func (h *Handlers) anyRecorded(sessions []db.SSHSession) (bool, error) {
+	for _, s := range sessions {
+		m, err := h.DB.GetMachine(s.MachineName)
+		if err != nil {
+			return false, err
+		}
+		if m != nil && m.RecordSessions {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// recordingRestartWarning explains what changing m's session recording to on
+// does beyond m, or returns "" when it does nothing more. sshpiperd records
+// every connection or none, so turning recording on for the first machine,
+// or off for the last, restarts sshpiperd and drops every open session.
+func (h *Handlers) recordingRestartWarning(m *db.Machine, on bool) (string, error) {
+	if h.Gen.RecordingsDir == "" {
+		return "", nil
+	}
+	machines, err := h.DB.ListMachines()
+	if err != nil {
+		return "", err
+	}
+	for _, other := range machines {
+		if other.Name != m.Name && other.RecordSessions && other.IsActive() {
+			return "", nil
+		}
+	}
+	open, err := h.DB.ListSSHSessions(db.SSHSessionFilter{Active: true})
+	if err != nil {
+		return "", err
+	}
+	restart := fmt.Sprintf("restarts sshpiperd, which drops all %d open SSH sessions to every machine", len(open))
+	if on {
+		return "turning on the first recording machine " + restart + ". sshpiperd then records every connection; recordings of " +
+			"machines that do not record are deleted when their session ends. Resend with confirm_recording to go ahead", nil
+	}
+	return "turning off the last recording machine " + restart + ". Resend with confirm_recording to go ahead", nil
+}
+
+// SessionRecording serves a session's recording as asciicast. A session with
+// several recordings (one per shell channel) takes ?n= (default 1).
+func (h *Handlers) SessionRecording(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		jsonError(w, "invalid session id", http.StatusBadRequest)
+		return
+	}
+	n := 1
+	if s := r.URL.Query().Get("n"); s != "" {
+		if n, err = strconv.Atoi(s); err != nil || n < 1 {
+			jsonError(w, "invalid n", http.StatusBadRequest)
+			return
+		}
+	}
+
+	session, err := h.DB.GetSSHSession(id)
+	if err != nil {
+		log.Printf("error getting ssh session: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if session == nil {
+		jsonError(w, "session not found", http.StatusNotFound)
+		return
+	}
+	recordings, err := h.DB.ListRecordings(id)
+	if err != nil {
+		log.Printf("error listing recordings: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if n > len(recordings) {
+		jsonError(w, "recording not found", http.StatusNotFound)
+		return
+	}
+	rec := recordings[n-1]
+
+	f, err := os.Open(filepath.Join(h.Gen.RecordingsDir, rec.Path))
+	if err != nil {
+		log.Printf("error opening recording: %v", err)
+		jsonError(w, "recording not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/x-asciicast")
+	w.Header().Set("X-Recording-Count", strconv.Itoa(len(recordings)))
+	http.ServeContent(w, r, filepath.Base(rec.Path), rec.StartedAt, f)
+}
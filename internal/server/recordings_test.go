@@ -0,0 +1,152 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/piperlog"
+)
+
+func TestSessionRecordings(t *testing.T) {
+	recordings := t.TempDir()
+	var h *Handlers
+	srv, database := setupTestServerWith(t, func(handlers *Handlers) {
+		handlers.Gen.RecordingsDir = recordings
+		handlers.RecordingRetention = 24 * time.Hour
+		h = handlers
+	})
+	registerMachine(t, srv.URL, map[string]any{"name": "vault", "owner": "a", "local_user": "u", "public_key": testKey(t)})
+	registerMachine(t, srv.URL, map[string]any{"name": "lab", "owner": "a", "local_user": "u", "public_key": testKey(t)})
+
+	if args := h.Gen.RecordingArgs(); args != nil {
+		t.Fatalf("expected recording off, got %v", args)
+	}
+	// The first recording machine restarts sshpiperd, so it must be confirmed
+	resp := authRequest(t, "PATCH", srv.URL+"/api/machines/vault", map[string]any{"record_sessions": true})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict || h.Gen.RecordingArgs() != nil {
+		t.Fatalf("expected an unconfirmed change refused, got %d", resp.StatusCode)
+	}
+	resp = authRequest(t, "PATCH", srv.URL+"/api/machines/vault", map[string]any{"record_sessions": true, "confirm_recording": true})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if args := h.Gen.RecordingArgs(); args == nil {
+		t.Fatal("expected sshpiperd recording enabled")
+	}
+
+	// One session to each machine; sshpiperd records both
+	start := time.Now().Truncate(time.Second)
+	for i, name := range []string{"vault", "lab"} {
+		m, _ := database.GetMachine(name)
+		h.RecordPiperEvent(piperlog.Event{Type: piperlog.EventOpen, Time: start, Remote: fmt.Sprintf("203.0.113.7:%d", 5000+i),
+			User: name, Upstream: fmt.Sprintf("127.0.0.1:%d", m.Port), UpstreamUser: "u"})
+		os.MkdirAll(filepath.Join(recordings, name), 0700)
+		cast := fmt.Sprintf("{\"version\": 2, \"width\": 80, \"height\": 24}\n[0.1, \"o\", \"hello %s\"]\n", name)
+		os.WriteFile(filepath.Join(recordings, name, fmt.Sprintf("%d-shell-0.cast", start.Unix())), []byte(cast), 0600)
+	}
+
+	// The unwanted recording is deleted as soon as its session ends
+	h.RecordPiperEvent(piperlog.Event{Type: piperlog.EventClose, Time: time.Now(), Remote: "203.0.113.7:5001", Reason: "EOF"})
+	if _, err := os.Stat(filepath.Join(recordings, "lab", fmt.Sprintf("%d-shell-0.cast", start.Unix()))); !os.IsNotExist(err) {
+		t.Fatal("expected the recording of a machine that does not record to be removed")
+	}
+	h.indexRecordings(time.Now())
+	sessions, _ := database.ListRecordings(1)
+	if len(sessions) != 1 {
+		t.Fatalf("expected the vault session's recording indexed, got %+v", sessions)
+	}
+
+	resp = authRequest(t, "GET", srv.URL+"/api/sessions/1/recording", nil)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/x-asciicast" ||
+		string(body) != "{\"version\": 2, \"width\": 80, \"height\": 24}\n[0.1, \"o\", \"hello vault\"]\n" {
+		t.Fatalf("unexpected recording response %d %q", resp.StatusCode, body)
+	}
+	for path, want := range map[string]int{
+		"/api/sessions/2/recording":     http.StatusNotFound,
+		"/api/sessions/1/recording?n=2": http.StatusNotFound,
+		"/api/sessions/99/recording":    http.StatusNotFound,
+		"/api/sessions/x/recording":     http.StatusBadRequest,
+	} {
+		resp = authRequest(t, "GET", srv.URL+path, nil)
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("%s: expected %d, got %d", path, want, resp.StatusCode)
+		}
+	}
+
+	// Past retention the recording is removed from disk and the index
+	h.indexRecordings(time.Now().Add(25 * time.Hour))
+	if recs, _ := database.ListRecordings(1); len(recs) != 0 {
+		t.Fatalf("expected the recording expired, got %+v", recs)
+	}
+}
+
+func TestRecordingSizeLimit(t *testing.T) {
+	recordings := t.TempDir()
+	var h *Handlers
+	srv, database := setupTestServerWith(t, func(handlers *Handlers) {
+		handlers.Gen.RecordingsDir = recordings
+		handlers.RecordingMaxBytes = 150
+		h = handlers
+	})
+	registerMachine(t, srv.URL, map[string]any{"name": "vault", "owner": "a", "local_user": "u", "public_key": testKey(t)})
+	database.SetRecordSessions("vault", true)
+	m, _ := database.GetMachine("vault")
+
+	os.MkdirAll(filepath.Join(recordings, "vault"), 0700)
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for i := range 2 {
+		at := start.Add(time.Duration(i) * time.Minute)
+		h.RecordPiperEvent(piperlog.Event{Type: piperlog.EventOpen, Time: at, Remote: fmt.Sprintf("203.0.113.7:%d", 5000+i),
+			User: "vault", Upstream: fmt.Sprintf("127.0.0.1:%d", m.Port), UpstreamUser: "u"})
+		path := filepath.Join(recordings, "vault", fmt.Sprintf("%d-shell-0.cast", at.Unix()))
+		os.WriteFile(path, make([]byte, 100), 0600)
+		os.Chtimes(path, at, at)
+	}
+	h.indexRecordings(time.Now())
+
+	files, _ := filepath.Glob(filepath.Join(recordings, "vault", "*.cast"))
+	if len(files) != 1 || filepath.Base(files[0]) != fmt.Sprintf("%d-shell-0.cast", start.Add(time.Minute).Unix()) {
+		t.Fatalf("expected only the newest recording kept, got %v", files)
+	}
+}
+
+func TestConcurrentSessionRecordingUnattributed(t *testing.T) {
+	recordings := t.TempDir()
+	var h *Handlers
+	srv, database := setupTestServerWith(t, func(handlers *Handlers) {
+		handlers.Gen.RecordingsDir = recordings
+		h = handlers
+	})
+	registerMachine(t, srv.URL, map[string]any{"name": "vault", "owner": "a", "local_user": "u", "public_key": testKey(t)})
+	database.SetRecordSessions("vault", true)
+	m, _ := database.GetMachine("vault")
+
+	// Two clients are connected under the same username when a shell starts;
+	// the recording's name cannot say whose it is
+	start := time.Now().Truncate(time.Second)
+	for i := range 2 {
+		h.RecordPiperEvent(piperlog.Event{Type: piperlog.EventOpen, Time: start, Remote: fmt.Sprintf("203.0.113.%d:5000", 7+i),
+			User: "vault", Upstream: fmt.Sprintf("127.0.0.1:%d", m.Port), UpstreamUser: "u"})
+	}
+	os.MkdirAll(filepath.Join(recordings, "vault"), 0700)
+	path := filepath.Join(recordings, "vault", fmt.Sprintf("%d-shell-0.cast", start.Unix()))
+	os.WriteFile(path, []byte("{\"version\": 2, \"width\": 80, \"height\": 24}\n"), 0600)
+
+	h.indexRecordings(time.Now().Add(time.Hour))
+	if sizes, _ := database.IndexedRecordings(); len(sizes) != 0 {
+		t.Fatalf("expected the recording left unattributed, got %v", sizes)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected the recording kept on disk: %v", err)
+	}
+}
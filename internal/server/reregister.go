@@ -0,0 +1,96 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/db"
+	"github.com/LipJ01/fly-ssh-bastion/internal/sshkey"
+)
+
+// reregister answers a registration for a name that is already taken. The
+// same key gets the existing assignment back, so a reinstalled client can
+// recover its port; a different key needs an authorized reclaim. Either way
+// the machine token is rotated, since the client is about to replace its
+// config. Owner and local user are left as they are.
+//
+// The public key is no secret, so with an enrollment token the same key only
+// gets the assignment back with a proof that the caller holds the private
+// key; proven says Register already checked one. The enrollment token is
+// used up in the same transaction as the token rotation, so a failed
+// re-registration leaves it usable.
+func (h *Handlers) reregister(w http.ResponseWriter, c caller, m *db.Machine, key *sshkey.Key, req registerRequest, proven bool) {
+	enrolling := !c.admin && c.machine == ""
+	sameKey := m.Fingerprint == key.Fingerprint
+	if sameKey && enrolling && !proven {
+		if req.Nonce == "" || req.Signature == "" {
+			jsonError(w, fmt.Sprintf("%q is already registered: re-registering it with an enrollment token needs a nonce from /api/register/challenge signed with its private key", m.Name), http.StatusForbidden)
+			return
+		}
+		if !h.checkKeyProof(w, key, req.Nonce, req.Signature) {
+			return
+		}
+	}
+	if !sameKey {
+		if !req.Reclaim {
+			jsonError(w, "machine already registered with a different key (use reclaim to replace it)", http.StatusConflict)
+			return
+		}
+		if !c.admin && c.machine != m.Name {
+			jsonError(w, "reclaiming a machine needs the API key or the machine's token", http.StatusForbidden)
+			return
+		}
+	}
+
+	machineToken, tokenHash, err := newToken("mt_")
+	if err != nil {
+		log.Printf("error generating machine token: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if enrolling {
+		err = h.DB.SetEnrolledMachineToken(m.Name, tokenHash, hashToken(c.enrollment))
+	} else {
+		err = h.DB.SetMachineToken(m.Name, tokenHash)
+	}
+	if errors.Is(err, db.ErrEnrollmentUnusable) {
+		jsonError(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Printf("error rotating machine token: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	if enrolling {
+		log.Printf("Enrollment token used to re-register existing machine %q", m.Name)
+	}
+	if sameKey {
+		log.Printf("Machine %q re-registered with its existing key", m.Name)
+	} else {
+		if err := h.DB.ReplaceMachineKey(m.Name, req.PublicKey, key.Fingerprint); err != nil {
+			log.Printf("error replacing machine key: %v", err)
+			jsonError(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Machine %q reclaimed with new key %s", m.Name, key.Fingerprint)
+		m.PublicKey, m.Fingerprint = req.PublicKey, key.Fingerprint
+		if m.IsActive() {
+			if err := h.Gen.WriteKey(m.Name, m.PublicKey); err != nil {
+				log.Printf("error writing key: %v", err)
+			}
+			if err := h.RegenerateConfig(); err != nil {
+				log.Printf("error regenerating config: %v", err)
+			}
+		}
+	}
+
+	status := http.StatusOK
+	if !m.IsActive() {
+		status = http.StatusAccepted
+	}
+	h.writeRegistration(w, status, m, machineToken)
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/sshkey"
+)
+
+func registerMachine(t *testing.T, url string, body map[string]any) (int, registerResponse) {
+	t.Helper()
+	resp := authRequest(t, "POST", url+"/api/register", body)
+	defer resp.Body.Close()
+	var reg registerResponse
+	json.NewDecoder(resp.Body).Decode(&reg)
+	return resp.StatusCode, reg
+}
+
+func TestReregisterSameKey(t *testing.T) {
+	srv, _ := setupTestServer(t)
+	body := map[string]any{"name": "nas", "owner": "test", "local_user": "test", "public_key": testKey(t)}
+
+	_, first := registerMachine(t, srv.URL, body)
+	code, again := registerMachine(t, srv.URL, body)
+	if code != http.StatusOK || again.Port != first.Port {
+		t.Fatalf("expected 200 with port %d, got %d %+v", first.Port, code, again)
+	}
+	if again.MachineToken == "" || again.MachineToken == first.MachineToken {
+		t.Fatal("expected the machine token to be rotated")
+	}
+
+	// The old token no longer works
+	resp := tokenRequest(t, "POST", srv.URL+"/api/heartbeat", "X-Machine-Token", first.MachineToken, map[string]string{"name": "nas"})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 with the old token, got %d", resp.StatusCode)
+	}
+}
+
+func TestReregisterWithEnrollmentToken(t *testing.T) {
+	srv, database := setupTestServer(t)
+	signer, pubKey := testSigner(t)
+	body := map[string]any{"name": "nas", "owner": "test", "local_user": "test", "public_key": pubKey}
+	_, first := registerMachine(t, srv.URL, body)
+
+	// Knowing the public key is not enough, and the failure leaves the token
+	// usable
+	e := createEnrollment(t, srv.URL, map[string]string{})
+	resp := tokenRequest(t, "POST", srv.URL+"/api/register", "X-Enrollment-Token", e.Token, body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 without a key proof, got %d", resp.StatusCode)
+	}
+	if _, err := database.GetUsableEnrollment(hashToken(e.Token)); err != nil {
+		t.Fatalf("expected the enrollment token to stay usable, got %v", err)
+	}
+	resp = tokenRequest(t, "POST", srv.URL+"/api/heartbeat", "X-Machine-Token", first.MachineToken, map[string]string{"name": "nas"})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the machine token to keep working, got %d", resp.StatusCode)
+	}
+
+	// With proof of the private key the client gets its assignment back
+	nonce := getChallenge(t, srv.URL)
+	body["nonce"] = nonce
+	body["signature"], _ = sshkey.SignChallenge(signer, sshkey.PurposeRegister, nonce)
+	resp = tokenRequest(t, "POST", srv.URL+"/api/register", "X-Enrollment-Token", e.Token, body)
+	var reg registerResponse
+	json.NewDecoder(resp.Body).Decode(&reg)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || reg.Port != first.Port || reg.MachineToken == first.MachineToken {
+		t.Fatalf("expected 200 with port %d and a new token, got %d %+v", first.Port, resp.StatusCode, reg)
+	}
+	if _, err := database.GetUsableEnrollment(hashToken(e.Token)); err == nil {
+		t.Fatal("expected the enrollment token to be used up")
+	}
+}
+
+func TestReclaimWithNewKey(t *testing.T) {
+	var h *Handlers
+	srv, database := setupTestServerWith(t, func(handlers *Handlers) { h = handlers })
+	body := map[string]any{"name": "nas", "owner": "test", "local_user": "test", "public_key": testKey(t)}
+	_, first := registerMachine(t, srv.URL, body)
+
+	newKey := testKey(t)
+	body["public_key"] = newKey
+	if code, _ := registerMachine(t, srv.URL, body); code != http.StatusConflict {
+		t.Fatalf("expected 409 without reclaim, got %d", code)
+	}
+
+	// An enrollment token cannot take over an existing machine
+	e := createEnrollment(t, srv.URL, map[string]string{})
+	body["reclaim"] = true
+	resp := tokenRequest(t, "POST", srv.URL+"/api/register", "X-Enrollment-Token", e.Token, body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 reclaiming with an enrollment token, got %d", resp.StatusCode)
+	}
+
+	// The machine's own token can
+	resp = tokenRequest(t, "POST", srv.URL+"/api/register", "X-Machine-Token", first.MachineToken, map[string]any{
+		"name": "nas", "local_user": "test", "public_key": newKey, "reclaim": true,
+	})
+	var reg registerResponse
+	json.NewDecoder(resp.Body).Decode(&reg)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || reg.Port != first.Port {
+		t.Fatalf("expected 200 keeping port %d, got %d %+v", first.Port, resp.StatusCode, reg)
+	}
+
+	m, _ := database.GetMachine("nas")
+	if m.PublicKey != newKey {
+		t.Fatalf("expected the key to be replaced, got %q", m.PublicKey)
+	}
+	data, _ := os.ReadFile(filepath.Join(h.Gen.KeysDir, "nas.pub"))
+	if strings.TrimSpace(string(data)) != newKey {
+		t.Fatalf("expected key file to be rewritten, got %q", data)
+	}
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/config"
+	"github.com/LipJ01/fly-ssh-bastion/internal/db"
+)
+
+// errSourceCIDRs refuses source CIDRs. sshpiperd routes a connection before
+// the bastion sees which key it used, so a key's client addresses could only
+// be checked after the session had started.
+var errSourceCIDRs = errors.New("source_cidrs is not supported: the bastion cannot check a client's address before routing it; " +
+	"send an empty list to clear it")
+
+// checkRestrictions validates access key restrictions.
+func checkRestrictions(r *db.KeyRestrictions) error {
+	if len(r.SourceCIDRs) > 0 {
+		return errSourceCIDRs
+	}
+	r.SourceCIDRs = nil
+	if r.SFTPOnly && r.ForceCommand != "" {
+		return errors.New("sftp_only and force_command cannot be combined")
+	}
+	if strings.ContainsAny(r.ForceCommand, "\r\n\x00") {
+		return errors.New("force_command must be a single line")
+	}
+	return nil
+}
+
+type authorizedKey struct {
+	KeyID      int64    `json:"key_id"`
+	Label      string   `json:"label"`
+	LocalUsers []string `json:"local_users,omitempty"`
+	Line       string   `json:"line"`
+}
+
+// AuthorizedKeys lists the authorized_keys lines a machine's sshd needs for
+// its restricted access keys: each key's upstream identity with the key's
+// restrictions as options. Lines apply to the listed local users, which are
+// db.AllLocalUsers for all of them.
+func (h *Handlers) AuthorizedKeys(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if !authorizeMachine(w, r, name) {
+		return
+	}
+	m, err := h.DB.GetMachine(name)
+	if err != nil {
+		log.Printf("error getting machine: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if m == nil {
+		jsonError(w, "machine not found", http.StatusNotFound)
+		return
+	}
+	keys, err := h.DB.ListAccessKeys(name)
+	if err != nil {
+		log.Printf("error listing access keys: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	revoked, err := h.revokedKeys()
+	if err != nil {
+		log.Printf("error listing revoked keys: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	lines := []authorizedKey{}
+	now := time.Now()
+	for _, k := range keys {
+		if !k.LimitsSession() || k.LimitsSource() || k.Expired(now) || revoked.Has(k.PublicKey) {
+			continue
+		}
+		pub, err := h.Gen.UpstreamKey(name, k.ID)
+		if err != nil {
+			log.Printf("error loading upstream key for access key %d: %v", k.ID, err)
+			jsonError(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		users := k.LocalUsers
+		if len(users) == 0 {
+			users = []string{m.LocalUser}
+		}
+		lines = append(lines, authorizedKey{
+			KeyID:      k.ID,
+			Label:      k.Label,
+			LocalUsers: users,
+			// Fields keeps a label from spilling onto another line
+			Line: fmt.Sprintf("%s %s bastion access key %d (%s)", config.AuthorizedKeyOptions(k.KeyRestrictions), pub, k.ID,
+				strings.Join(strings.Fields(k.Label), " ")),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"machine": name, "keys": lines})
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/db"
+	"github.com/LipJ01/fly-ssh-bastion/internal/piperlog"
+)
+
+func TestAccessKeyRestrictions(t *testing.T) {
+	var h *Handlers
+	srv, database := setupTestServerWith(t, func(handlers *Handlers) { h = handlers })
+	registerMachine(t, srv.URL, map[string]any{"name": "nas", "owner": "a", "local_user": "u", "public_key": testKey(t)})
+
+	for _, body := range []map[string]any{
+		{"label": "x", "public_key": testKey(t), "source_cidrs": []string{"10.0.0.0/8"}},
+		{"label": "x", "public_key": testKey(t), "sftp_only": true, "force_command": "true"},
+		{"label": "x", "public_key": testKey(t), "force_command": "true\nrm -rf /"},
+	} {
+		resp := authRequest(t, "POST", srv.URL+"/api/machines/nas/keys", body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%v: expected 400, got %d", body, resp.StatusCode)
+		}
+	}
+
+	resp := authRequest(t, "POST", srv.URL+"/api/machines/nas/keys", map[string]any{
+		"label": "backup", "public_key": testKey(t), "sftp_only": true, "source_cidrs": []string{},
+	})
+	var key db.AccessKey
+	json.NewDecoder(resp.Body).Decode(&key)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || !key.SFTPOnly || key.SourceCIDRs != nil {
+		t.Fatalf("expected the key added with its restrictions, got %d %+v", resp.StatusCode, key)
+	}
+	resp = authRequest(t, "GET", srv.URL+"/api/machines/nas/keys", nil)
+	var keys []db.AccessKey
+	json.NewDecoder(resp.Body).Decode(&keys)
+	resp.Body.Close()
+	if len(keys) != 1 || !keys[0].SFTPOnly {
+		t.Fatalf("expected restrictions in the key list, got %+v", keys)
+	}
+
+	// The key is piped with its own upstream identity, which the machine
+	// authorizes with the restrictions as options
+	data, _ := os.ReadFile(h.Gen.ConfigPath)
+	if !strings.Contains(string(data), fmt.Sprintf("nas_ak_%d_upstream", key.ID)) {
+		t.Fatalf("expected a pipe for the restricted key:\n%s", data)
+	}
+	resp = authRequest(t, "GET", srv.URL+"/api/machines/nas/authorized-keys", nil)
+	var authorized struct {
+		Keys []authorizedKey `json:"keys"`
+	}
+	json.NewDecoder(resp.Body).Decode(&authorized)
+	resp.Body.Close()
+	if len(authorized.Keys) != 1 || !strings.HasPrefix(authorized.Keys[0].Line, `command="internal-sftp",no-pty,`) ||
+		!strings.HasSuffix(authorized.Keys[0].Line, "(backup)") {
+		t.Fatalf("unexpected authorized keys %+v", authorized.Keys)
+	}
+
+	m, _ := database.GetMachine("nas")
+	h.RecordPiperEvent(piperlog.Event{Type: piperlog.EventAuth, Time: time.Now(), Remote: "192.0.2.9:5000", Fingerprint: key.Fingerprint})
+	h.RecordPiperEvent(piperlog.Event{Type: piperlog.EventOpen, Time: time.Now(), Remote: "192.0.2.9:5000",
+		User: "nas", Upstream: fmt.Sprintf("127.0.0.1:%d", m.Port), UpstreamUser: "u"})
+
+	// Lifting the restrictions drops the dedicated pipe and the open session
+	resp = authRequest(t, "PATCH", fmt.Sprintf("%s/api/machines/nas/keys/%d", srv.URL, key.ID),
+		map[string]any{"sftp_only": false})
+	var updated db.AccessKey
+	json.NewDecoder(resp.Body).Decode(&updated)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || updated.SFTPOnly || updated.SourceCIDRs != nil {
+		t.Fatalf("expected the restrictions lifted, got %d %+v", resp.StatusCode, updated)
+	}
+	data, _ = os.ReadFile(h.Gen.ConfigPath)
+	if strings.Contains(string(data), "_upstream") {
+		t.Fatalf("expected no dedicated pipe for an unrestricted key:\n%s", data)
+	}
+	if open, _ := database.ListSSHSessions(db.SSHSessionFilter{Active: true}); len(open) != 0 {
+		t.Fatalf("expected the key's session closed, got %+v", open)
+	}
+}
+
+func TestSourceRestrictedKeysNotRouted(t *testing.T) {
+	var h *Handlers
+	srv, database := setupTestServerWith(t, func(handlers *Handlers) { h = handlers })
+	registerMachine(t, srv.URL, map[string]any{"name": "nas", "owner": "a", "local_user": "u", "public_key": testKey(t)})
+
+	// A key stored with source CIDRs before they were refused is left out
+	// of the config, and can only have them cleared
+	ak := &db.AccessKey{MachineName: "nas", Label: "office", PublicKey: testKey(t),
+		KeyRestrictions: db.KeyRestrictions{SourceCIDRs: []string{"192.0.2.0/24"}}}
+	if err := database.AddAccessKey(ak); err != nil {
+		t.Fatalf("add key: %v", err)
+	}
+	h.Gen.WriteAccessKey("nas", ak.ID, ak.PublicKey)
+	if err := h.RegenerateConfig(); err != nil {
+		t.Fatalf("regenerate: %v", err)
+	}
+	keyFile := fmt.Sprintf("nas_ak_%d.pub", ak.ID)
+	if data, _ := os.ReadFile(h.Gen.ConfigPath); strings.Contains(string(data), keyFile) {
+		t.Fatalf("expected the address-limited key left out:\n%s", data)
+	}
+
+	keyURL := fmt.Sprintf("%s/api/machines/nas/keys/%d", srv.URL, ak.ID)
+	resp := authRequest(t, "PATCH", keyURL, map[string]any{"no_port_forwarding": true})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected a change keeping the CIDRs refused, got %d", resp.StatusCode)
+	}
+	resp = authRequest(t, "PATCH", keyURL, map[string]any{"source_cidrs": []string{}})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the CIDRs cleared, got %d", resp.StatusCode)
+	}
+	if data, _ := os.ReadFile(h.Gen.ConfigPath); !strings.Contains(string(data), keyFile) {
+		t.Fatalf("expected the key routed once its CIDRs are cleared:\n%s", data)
+	}
+}
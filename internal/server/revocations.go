@@ -0,0 +1,103 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/config"
+	"github.com/LipJ01/fly-ssh-bastion/internal/db"
+	"github.com/LipJ01/fly-ssh-bastion/internal/sshkey"
+)
+
+// rejectRevoked writes a 403 and returns true if the fingerprint is revoked.
+func (h *Handlers) rejectRevoked(w http.ResponseWriter, fingerprint string) bool {
+	revoked, err := h.DB.IsRevoked(fingerprint)
+	if err != nil {
+		log.Printf("error checking revocation: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return true
+	}
+	if revoked {
+		jsonError(w, "key has been revoked", http.StatusForbidden)
+		return true
+	}
+	return false
+}
+
+func (h *Handlers) RevokeKey(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Fingerprint string `json:"fingerprint"`
+		PublicKey   string `json:"public_key"`
+		Reason      string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	fingerprint := sshkey.NormalizeFingerprint(req.Fingerprint)
+	if fingerprint == "" && req.PublicKey != "" {
+		key, err := sshkey.Parse(req.PublicKey)
+		if err != nil {
+			jsonError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fingerprint = key.Fingerprint
+	}
+	if fingerprint == "" {
+		jsonError(w, "fingerprint or public_key is required", http.StatusBadRequest)
+		return
+	}
+
+	revoked, removedKeys, err := h.DB.RevokeKey(fingerprint, req.Reason)
+	if errors.Is(err, db.ErrAlreadyRevoked) {
+		jsonError(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("error revoking key: %v", err)
+		jsonError(w, "failed to revoke key", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("revoked key %s: removed machines %v, access keys %v", fingerprint, revoked.RemovedMachines, revoked.RemovedAccessKeys)
+
+	for _, name := range revoked.RemovedMachines {
+		_ = h.Gen.RemoveKey(name)
+		_ = h.Gen.CleanAccessKeys(name)
+	}
+	for _, k := range removedKeys {
+		_ = h.Gen.RemoveAccessKey(k.MachineName, k.ID)
+	}
+
+	if err := h.RegenerateConfig(); err != nil {
+		log.Printf("error regenerating config: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(revoked)
+}
+
+func (h *Handlers) ListRevokedKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := h.DB.ListRevokedKeys()
+	if err != nil {
+		log.Printf("error listing revoked keys: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if keys == nil {
+		keys = []db.RevokedKey{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+// revokedKeys returns the set of revoked key fingerprints.
+func (h *Handlers) revokedKeys() (config.Revoked, error) {
+	fps, err := h.DB.RevokedFingerprints()
+	if err != nil {
+		return nil, err
+	}
+	return config.NewRevoked(fps), nil
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/sshkey"
+)
+
+func TestRevokeKeyEndpoint(t *testing.T) {
+	srv, database := setupTestServer(t)
+
+	machineKey := testKey(t)
+	resp := authRequest(t, "POST", srv.URL+"/api/register", map[string]string{
+		"name": "victim", "owner": "test", "local_user": "test", "public_key": machineKey,
+	})
+	resp.Body.Close()
+	resp = authRequest(t, "POST", srv.URL+"/api/register", map[string]string{
+		"name": "other", "owner": "test", "local_user": "test", "public_key": testKey(t),
+	})
+	resp.Body.Close()
+
+	// The same compromised key is also an access key elsewhere
+	resp = authRequest(t, "POST", srv.URL+"/api/machines/other/keys", map[string]string{
+		"label": "laptop", "public_key": machineKey,
+	})
+	resp.Body.Close()
+
+	fp := sshkey.Fingerprint(machineKey)
+	resp = authRequest(t, "POST", srv.URL+"/api/revoked-keys", map[string]string{
+		"fingerprint": fp, "reason": "compromised",
+	})
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", resp.StatusCode)
+	}
+	var result map[string]any
+	json.NewDecoder(resp.Body).Decode(&result)
+	if machines, _ := result["removed_machines"].([]any); len(machines) != 1 {
+		t.Fatalf("expected 1 removed machine, got %v", result["removed_machines"])
+	}
+
+	if m, _ := database.GetMachine("victim"); m != nil {
+		t.Fatal("expected victim machine to be removed")
+	}
+	if keys, _ := database.ListAccessKeys("other"); len(keys) != 0 {
+		t.Fatalf("expected access key to be removed, got %d", len(keys))
+	}
+
+	// Future use of the key is blocked
+	resp2 := authRequest(t, "POST", srv.URL+"/api/register", map[string]string{
+		"name": "victim", "owner": "test", "local_user": "test", "public_key": machineKey,
+	})
+	resp2.Body.Close()
+	if resp2.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 registering revoked key, got %d", resp2.StatusCode)
+	}
+	resp3 := authRequest(t, "POST", srv.URL+"/api/machines/other/keys", map[string]string{
+		"label": "again", "public_key": machineKey,
+	})
+	resp3.Body.Close()
+	if resp3.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 adding revoked access key, got %d", resp3.StatusCode)
+	}
+
+	// Listed
+	resp4 := authRequest(t, "GET", srv.URL+"/api/revoked-keys", nil)
+	defer resp4.Body.Close()
+	var list []map[string]any
+	json.NewDecoder(resp4.Body).Decode(&list)
+	if len(list) != 1 || list[0]["fingerprint"] != fp {
+		t.Fatalf("unexpected revocation list: %v", list)
+	}
+}
+
+func TestRevokeKeyRequiresFingerprint(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	resp := authRequest(t, "POST", srv.URL+"/api/revoked-keys", map[string]string{"reason": "oops"})
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", resp.StatusCode)
+	}
+}
+
+func TestRegenerateConfigConcurrently(t *testing.T) {
+	var h *Handlers
+	srv, database := setupTestServerWith(t, func(handlers *Handlers) { h = handlers })
+	registerMachine(t, srv.URL, map[string]any{"name": "nas", "owner": "a", "local_user": "u", "public_key": testKey(t)})
+	doomed := testKey(t)
+	registerMachine(t, srv.URL, map[string]any{"name": "old", "owner": "a", "local_user": "u", "public_key": doomed})
+	machine, _ := database.GetMachine("nas")
+
+	// Rewrites from handlers and maintenance, and the session log checking
+	// keys, run alongside a revocation (go test -race catches a shared set)
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.RegenerateConfig()
+			h.identifyKey(machine, nil, "u", "")
+		}()
+	}
+	database.RevokeKey(sshkey.Fingerprint(doomed), "test")
+	wg.Wait()
+	if err := h.RegenerateConfig(); err != nil {
+		t.Fatalf("regenerate: %v", err)
+	}
+
+	data, _ := os.ReadFile(h.Gen.ConfigPath)
+	if !strings.Contains(string(data), "nas.pub") || strings.Contains(string(data), "old.pub") {
+		t.Fatalf("expected only nas routed:\n%s", data)
+	}
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/db"
+	"github.com/LipJ01/fly-ssh-bastion/internal/schedule"
+)
+
+// checkSchedule validates an access schedule. An empty schedule means
+// always reachable and takes no timezone.
+func checkSchedule(spec, tz string) error {
+	if spec == "" {
+		if tz != "" {
+			return errors.New("schedule_timezone needs a schedule")
+		}
+		return nil
+	}
+	if _, err := schedule.Parse(spec, tz); err != nil {
+		return fmt.Errorf("invalid schedule: %w", err)
+	}
+	return nil
+}
+
+// closedBySchedule returns the active machines and access keys that are
+// outside their schedule at now, keyed "machine:<name>" and "key:<id>".
+func (h *Handlers) closedBySchedule(now time.Time) (map[string]bool, []db.AccessKey, error) {
+	machines, err := h.DB.ListMachines()
+	if err != nil {
+		return nil, nil, err
+	}
+	closed := make(map[string]bool)
+	var keys []db.AccessKey
+	for _, m := range machines {
+		if !m.IsActive() {
+			continue
+		}
+		if !schedule.Open(m.Schedule, m.ScheduleTimezone, now) {
+			closed["machine:"+m.Name] = true
+		}
+		accessKeys, err := h.DB.ListAccessKeys(m.Name)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, k := range accessKeys {
+			if !schedule.Open(k.Schedule, k.ScheduleTimezone, now) {
+				closed["key:"+strconv.FormatInt(k.ID, 10)] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+	return closed, keys, nil
+}
+
+// applySchedules regenerates the sshpiper config when a machine or access
+// key crosses a schedule boundary, and closes the sessions of those whose
+// window has just ended. The first call only records the current state.
+func (h *Handlers) applySchedules(now time.Time) {
+	closed, keys, err := h.closedBySchedule(now)
+	if err != nil {
+		log.Printf("error checking access schedules: %v", err)
+		return
+	}
+	previous := h.scheduleClosed
+	h.scheduleClosed = closed
+	if previous == nil {
+		return
+	}
+
+	changed := len(closed) != len(previous)
+	var ended []string
+	for k := range closed {
+		if !previous[k] {
+			changed = true
+			ended = append(ended, k)
+		}
+	}
+	if !changed {
+		return
+	}
+	log.Printf("Access schedules changed; regenerating config")
+	if err := h.RegenerateConfig(); err != nil {
+		log.Printf("error regenerating config: %v", err)
+	}
+
+	const reason = "outside access schedule"
+	for _, k := range ended {
+		kind, id, _ := strings.Cut(k, ":")
+		if kind == "machine" {
+			h.disconnectMachineSessions(id, reason)
+			continue
+		}
+		for i := range keys {
+			if strconv.FormatInt(keys[i].ID, 10) == id {
+				h.disconnectKeySessions(&keys[i], reason)
+			}
+		}
+	}
+}
+
+// UpdateAccessKey changes an access key's schedule and restrictions. An
+// empty "schedule" removes the schedule; restrictions left out are kept.
+// Open sessions of a key whose restrictions change are closed, so that they
+// reconnect under the new ones.
+func (h *Handlers) UpdateAccessKey(w http.ResponseWriter, r *http.Request) {
+	machineName := chi.URLParam(r, "name")
+	keyID, err := strconv.ParseInt(chi.URLParam(r, "keyID"), 10, 64)
+	if err != nil {
+		jsonError(w, "invalid key id", http.StatusBadRequest)
+		return
+	}
+	key, err := h.DB.GetAccessKey(keyID)
+	if err != nil {
+		log.Printf("error getting access key: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if key == nil || key.MachineName != machineName {
+		jsonError(w, "access key not found", http.StatusNotFound)
+		return
+	}
+
+	var req struct {
+		Schedule         *string `json:"schedule"`
+		ScheduleTimezone *string `json:"schedule_timezone"`
+
+		SourceCIDRs       *[]string `json:"source_cidrs"`
+		ForceCommand      *string   `json:"force_command"`
+		SFTPOnly          *bool     `json:"sftp_only"`
+		NoPortForwarding  *bool     `json:"no_port_forwarding"`
+		NoAgentForwarding *bool     `json:"no_agent_forwarding"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	spec, tz := key.Schedule, key.ScheduleTimezone
+	if req.Schedule != nil {
+		spec = *req.Schedule
+	}
+	if req.ScheduleTimezone != nil {
+		tz = *req.ScheduleTimezone
+	}
+	if spec == "" && req.ScheduleTimezone == nil {
+		tz = ""
+	}
+	if err := checkSchedule(spec, tz); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	restrictions := key.KeyRestrictions
+	restrictions.SourceCIDRs = slices.Clone(key.SourceCIDRs)
+	if req.SourceCIDRs != nil {
+		restrictions.SourceCIDRs = *req.SourceCIDRs
+	}
+	if req.ForceCommand != nil {
+		restrictions.ForceCommand = *req.ForceCommand
+	}
+	if req.SFTPOnly != nil {
+		restrictions.SFTPOnly = *req.SFTPOnly
+	}
+	if req.NoPortForwarding != nil {
+		restrictions.NoPortForwarding = *req.NoPortForwarding
+	}
+	if req.NoAgentForwarding != nil {
+		restrictions.NoAgentForwarding = *req.NoAgentForwarding
+	}
+	if err := checkRestrictions(&restrictions); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	scheduleChanged := spec != key.Schedule || tz != key.ScheduleTimezone
+	restrictionsChanged := !restrictions.Equal(key.KeyRestrictions)
+	if scheduleChanged {
+		if err := h.DB.SetAccessKeySchedule(keyID, spec, tz); err != nil {
+			log.Printf("error updating access key: %v", err)
+			jsonError(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		key.Schedule, key.ScheduleTimezone = spec, tz
+	}
+	if restrictionsChanged {
+		if err := h.DB.SetAccessKeyRestrictions(keyID, restrictions); err != nil {
+			log.Printf("error updating access key: %v", err)
+			jsonError(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		key.KeyRestrictions = restrictions
+	}
+	if scheduleChanged || restrictionsChanged {
+		if err := h.RegenerateConfig(); err != nil {
+			log.Printf("error regenerating config: %v", err)
+		}
+	}
+	if restrictionsChanged {
+		h.disconnectKeySessions(key, "access key restrictions changed")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(key)
+}
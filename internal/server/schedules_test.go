@@ -0,0 +1,120 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/db"
+	"github.com/LipJ01/fly-ssh-bastion/internal/piperlog"
+)
+
+// dayName returns the schedule day name of now plus days, in UTC.
+func dayName(days int) string {
+	return strings.ToLower(time.Now().UTC().AddDate(0, 0, days).Format("Mon"))
+}
+
+func TestMachineSchedule(t *testing.T) {
+	var h *Handlers
+	srv, database := setupTestServerWith(t, func(handlers *Handlers) { h = handlers })
+	registerMachine(t, srv.URL, map[string]any{"name": "desk", "owner": "a", "local_user": "u", "public_key": testKey(t)})
+
+	for _, body := range []map[string]any{
+		{"schedule": "mon-fry"},
+		{"schedule": "mon", "schedule_timezone": "Mars/Olympus"},
+		{"schedule_timezone": "UTC"},
+	} {
+		resp := authRequest(t, "PATCH", srv.URL+"/api/machines/desk", body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%v: expected 400, got %d", body, resp.StatusCode)
+		}
+	}
+
+	// Closed all of today
+	resp := authRequest(t, "PATCH", srv.URL+"/api/machines/desk", map[string]any{"schedule": dayName(2), "schedule_timezone": "UTC"})
+	var entry machineListEntry
+	json.NewDecoder(resp.Body).Decode(&entry)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || entry.Schedule != dayName(2) || !entry.OutsideSchedule {
+		t.Fatalf("expected the machine outside its schedule, got %d %+v", resp.StatusCode, entry)
+	}
+	data, _ := os.ReadFile(h.Gen.ConfigPath)
+	if strings.Contains(string(data), `"desk"`) {
+		t.Fatalf("machine outside its schedule should not be routed:\n%s", data)
+	}
+
+	// Clearing the schedule clears its timezone and routes the machine
+	resp = authRequest(t, "PATCH", srv.URL+"/api/machines/desk", map[string]any{"schedule": ""})
+	resp.Body.Close()
+	m, _ := database.GetMachine("desk")
+	if m.Schedule != "" || m.ScheduleTimezone != "" {
+		t.Fatalf("expected the schedule cleared, got %+v", m)
+	}
+	data, _ = os.ReadFile(h.Gen.ConfigPath)
+	if !strings.Contains(string(data), `username: "desk"`) {
+		t.Fatalf("machine should be routed without a schedule:\n%s", data)
+	}
+}
+
+func TestAccessKeySchedule(t *testing.T) {
+	var h *Handlers
+	srv, database := setupTestServerWith(t, func(handlers *Handlers) { h = handlers })
+	registerMachine(t, srv.URL, map[string]any{"name": "desk", "owner": "a", "local_user": "u", "public_key": testKey(t)})
+
+	resp := authRequest(t, "POST", srv.URL+"/api/machines/desk/keys", map[string]any{
+		"label": "contractor", "public_key": testKey(t), "schedule": dayName(0) + " 00:00-24:00", "schedule_timezone": "UTC",
+	})
+	var key db.AccessKey
+	json.NewDecoder(resp.Body).Decode(&key)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || key.Schedule == "" {
+		t.Fatalf("expected the key added with its schedule, got %d %+v", resp.StatusCode, key)
+	}
+	keyFile := fmt.Sprintf("desk_ak_%d.pub", key.ID)
+	data, _ := os.ReadFile(h.Gen.ConfigPath)
+	if !strings.Contains(string(data), keyFile) {
+		t.Fatalf("key inside its schedule should be authorized:\n%s", data)
+	}
+
+	// The maintenance pass notices the window closing, reroutes and drops the
+	// key's sessions
+	h.applySchedules(time.Now())
+	m, _ := database.GetMachine("desk")
+	h.RecordPiperEvent(piperlog.Event{Type: piperlog.EventAuth, Time: time.Now(), Remote: "203.0.113.7:5000", Fingerprint: key.Fingerprint})
+	h.RecordPiperEvent(piperlog.Event{Type: piperlog.EventOpen, Time: time.Now(), Remote: "203.0.113.7:5000",
+		User: "desk", Upstream: fmt.Sprintf("127.0.0.1:%d", m.Port), UpstreamUser: "u"})
+	database.SetAccessKeySchedule(key.ID, dayName(2), "UTC")
+	h.applySchedules(time.Now())
+
+	data, _ = os.ReadFile(h.Gen.ConfigPath)
+	if strings.Contains(string(data), keyFile) || !strings.Contains(string(data), `username: "desk"`) {
+		t.Fatalf("expected only the key dropped from the config:\n%s", data)
+	}
+	sessions, _ := database.ListSSHSessions(db.SSHSessionFilter{})
+	if len(sessions) != 1 || sessions[0].EndReason != "outside access schedule" {
+		t.Fatalf("expected the key's session ended, got %+v", sessions)
+	}
+
+	resp = authRequest(t, "PATCH", fmt.Sprintf("%s/api/machines/desk/keys/%d", srv.URL, key.ID), map[string]any{"schedule": ""})
+	var updated db.AccessKey
+	json.NewDecoder(resp.Body).Decode(&updated)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || updated.ID != key.ID || updated.Schedule != "" || updated.ScheduleTimezone != "" {
+		t.Fatalf("expected the schedule removed, got %d %+v", resp.StatusCode, updated)
+	}
+	data, _ = os.ReadFile(h.Gen.ConfigPath)
+	if !strings.Contains(string(data), keyFile) {
+		t.Fatalf("key without a schedule should be authorized:\n%s", data)
+	}
+
+	resp = authRequest(t, "PATCH", srv.URL+"/api/machines/other/keys/1", map[string]any{"schedule": ""})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for a key of another machine, got %d", resp.StatusCode)
+	}
+}
@@ -6,19 +6,9 @@ import (
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/httprate"
-
-	"github.com/LipJ01/fly-ssh-bastion/internal/config"
-	"github.com/LipJ01/fly-ssh-bastion/internal/db"
 )
 
-func NewRouter(database *db.DB, gen *config.Generator, apiSecret, serverURL string, onChange func()) *chi.Mux {
-	h := &Handlers{
-		DB:        database,
-		Gen:       gen,
-		OnChange:  onChange,
-		ServerURL: serverURL,
-	}
-
+func NewRouter(h *Handlers, apiSecret string) *chi.Mux {
 	r := chi.NewRouter()
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
@@ -28,21 +18,81 @@ func NewRouter(database *db.DB, gen *config.Generator, apiSecret, serverURL stri
 
 	// Public
 	r.Get("/api/status", h.Status)
+	r.With(httprate.LimitByIP(5, time.Minute)).Post("/api/machines/{name}/access-requests", h.CreateAccessRequest)
+
+	// Machine endpoints: the API key, the machine's own token, or (for
+	// registration) an enrollment token
+	r.Group(func(r chi.Router) {
+		r.Use(httprate.LimitByIP(20, time.Minute))
+		r.Use(machineAuth(apiSecret, h.DB))
+		r.Post("/api/register/challenge", h.RegisterChallenge)
+		r.Post("/api/register", h.Register)
+		r.Get("/api/machines/{name}", h.GetMachine)
+		r.Post("/api/heartbeat", h.Heartbeat)
+		r.Post("/api/machines/{name}/events", h.TunnelEvent)
+		r.Get("/api/machines/{name}/uptime", h.Uptime)
+		r.Get("/api/machines/{name}/authorized-keys", h.AuthorizedKeys)
+	})
+
+	// Access request decisions: the API key, or an owner token for requests
+	// to that owner's machines
+	r.Group(func(r chi.Router) {
+		r.Use(httprate.LimitByIP(20, time.Minute))
+		r.Use(ownerAuth(apiSecret, h.DB))
+		r.Get("/api/access-requests", h.ListAccessRequests)
+		r.Post("/api/access-requests/{id}/approve", h.ApproveAccessRequest)
+		r.Post("/api/access-requests/{id}/deny", h.DenyAccessRequest)
+	})
 
 	// Authenticated
 	r.Group(func(r chi.Router) {
 		// Stricter limit on authenticated endpoints: 20 per minute per IP
 		r.Use(httprate.LimitByIP(20, time.Minute))
 		r.Use(apiKeyAuth(apiSecret))
-		r.Post("/api/register", h.Register)
 		r.Get("/api/machines", h.ListMachines)
+		r.Patch("/api/machines/{name}", h.UpdateMachine)
 		r.Delete("/api/machines/{name}", h.DeleteMachine)
+		r.Post("/api/machines/{name}/approve", h.ApproveMachine)
+		r.Post("/api/machines/{name}/reject", h.RejectMachine)
+		r.Post("/api/machines/{name}/disable", h.DisableMachine)
+		r.Post("/api/machines/{name}/enable", h.EnableMachine)
 		r.Put("/api/machines/{name}/rename", h.RenameMachine)
-		r.Post("/api/heartbeat", h.Heartbeat)
+
+		r.Get("/api/machines/{name}/facts", h.ListFacts)
 
 		r.Post("/api/machines/{name}/keys", h.AddAccessKey)
 		r.Get("/api/machines/{name}/keys", h.ListAccessKeys)
+		r.Patch("/api/machines/{name}/keys/{keyID}", h.UpdateAccessKey)
 		r.Delete("/api/machines/{name}/keys/{keyID}", h.DeleteAccessKey)
+
+		r.Post("/api/machines/{name}/aliases", h.AddAlias)
+		r.Get("/api/machines/{name}/aliases", h.ListAliases)
+		r.Delete("/api/machines/{name}/aliases/{alias}", h.DeleteAlias)
+
+		r.Post("/api/machines/{name}/users", h.AddMachineUser)
+		r.Get("/api/machines/{name}/users", h.ListMachineUsers)
+		r.Delete("/api/machines/{name}/users/{username}", h.DeleteMachineUser)
+
+		r.Post("/api/revoked-keys", h.RevokeKey)
+		r.Get("/api/revoked-keys", h.ListRevokedKeys)
+		r.Get("/api/keys/{fingerprint}/access", h.KeyAccess)
+		r.Get("/api/orphaned-keys", h.ListOrphanedAccessKeys)
+		r.Post("/api/orphaned-keys/{id}/restore", h.RestoreOrphanedAccessKey)
+		r.Delete("/api/orphaned-keys/{id}", h.DeleteOrphanedAccessKey)
+
+		r.Post("/api/enrollments", h.CreateEnrollment)
+		r.Get("/api/enrollments", h.ListEnrollments)
+
+		r.Post("/api/owner-tokens", h.CreateOwnerToken)
+		r.Get("/api/owner-tokens", h.ListOwnerTokens)
+		r.Delete("/api/owner-tokens/{id}", h.DeleteOwnerToken)
+
+		r.Get("/api/alerts", h.ListAlerts)
+		r.Get("/api/sessions", h.ListSSHSessions)
+		r.Delete("/api/sessions/{id}", h.DisconnectSSHSession)
+		r.Get("/api/sessions/{id}/recording", h.SessionRecording)
+
+		r.Get("/api/admin/backup", h.Backup)
 	})
 
 	return r
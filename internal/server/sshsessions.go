@@ -0,0 +1,330 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/config"
+	"github.com/LipJ01/fly-ssh-bastion/internal/db"
+	"github.com/LipJ01/fly-ssh-bastion/internal/piperlog"
+	"github.com/LipJ01/fly-ssh-bastion/internal/sshkey"
+)
+
+const (
+	// sshSessionRetention is how long ended SSH sessions are kept.
+	sshSessionRetention = 90 * 24 * time.Hour
+	// pendingAuthTTL is how long a logged key fingerprint waits for its
+	// connection's pipe to open.
+	pendingAuthTTL = time.Minute
+	// machineKeyLabel is recorded when a session used the machine's own
+	// registered key rather than an access key.
+	machineKeyLabel = "machine key"
+)
+
+// pendingAuths remembers which key each client address authenticated with
+// until the pipe opens. The zero value is ready to use.
+type pendingAuths struct {
+	mu     sync.Mutex
+	byAddr map[string]pendingAuth
+}
+
+type pendingAuth struct {
+	fingerprint string
+	at          time.Time
+}
+
+func (p *pendingAuths) put(addr, fingerprint string, at time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.byAddr == nil {
+		p.byAddr = make(map[string]pendingAuth)
+	}
+	for a, auth := range p.byAddr {
+		if at.Sub(auth.at) > pendingAuthTTL {
+			delete(p.byAddr, a)
+		}
+	}
+	p.byAddr[addr] = pendingAuth{fingerprint, at}
+}
+
+func (p *pendingAuths) take(addr string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	auth, ok := p.byAddr[addr]
+	delete(p.byAddr, addr)
+	if !ok {
+		return ""
+	}
+	return auth.fingerprint
+}
+
+// RecordPiperEvent records an sshpiperd connection event in the SSH session
+// log.
+func (h *Handlers) RecordPiperEvent(ev piperlog.Event) {
+	// Behind the relay sshpiperd sees the relay's address, not the client's
+	if h.Relay != nil {
+		if client, ok := h.Relay.Client(ev.Remote); ok {
+			ev.Remote = client
+		}
+	}
+
+	switch ev.Type {
+	case piperlog.EventAuth:
+		h.piperAuths.put(ev.Remote, ev.Fingerprint, ev.Time)
+
+	case piperlog.EventOpen:
+		fingerprint := h.piperAuths.take(ev.Remote)
+		ip, port, err := splitAddr(ev.Remote)
+		if err != nil {
+			log.Printf("ssh session: bad client address %q", ev.Remote)
+			return
+		}
+		_, upstreamPort, err := splitAddr(ev.Upstream)
+		if err != nil {
+			log.Printf("ssh session: bad upstream address %q", ev.Upstream)
+			return
+		}
+		machine, err := h.DB.MachineByPort(upstreamPort)
+		if err != nil {
+			log.Printf("error finding machine for ssh session: %v", err)
+			return
+		}
+		if machine == nil {
+			log.Printf("ssh session from %s to unknown port %d", ev.Remote, upstreamPort)
+			return
+		}
+
+		s := &db.SSHSession{MachineName: machine.Name, Username: ev.User, LocalUser: ev.UpstreamUser,
+			SourceIP: ip, SourcePort: port, StartedAt: ev.Time}
+		revoked, err := h.revokedKeys()
+		if err != nil {
+			log.Printf("error listing revoked keys: %v", err)
+		}
+		s.KeyFingerprint, s.KeyLabel = h.identifyKey(machine, revoked, ev.UpstreamUser, fingerprint)
+		if err := h.DB.StartSSHSession(s); err != nil {
+			log.Printf("error recording ssh session: %v", err)
+		}
+
+	case piperlog.EventClose:
+		ip, port, err := splitAddr(ev.Remote)
+		if err != nil {
+			return
+		}
+		if _, err := h.DB.EndSSHSession(ip, port, ev.Time, ev.Reason); err != nil {
+			log.Printf("error ending ssh session: %v", err)
+		}
+		// sshpiperd records every machine's sessions while any machine
+		// records, so delete those not wanted as soon as they are finished
+		if h.Gen.Recording() {
+			h.indexRecordings(time.Now())
+		}
+	}
+}
+
+// CloseSSHSessions ends every open SSH session, for when sshpiperd restarts
+// and drops its connections.
+func (h *Handlers) CloseSSHSessions(reason string) {
+	if n, err := h.DB.CloseOpenSSHSessions(time.Now(), reason); err != nil {
+		log.Printf("error closing ssh sessions: %v", err)
+	} else if n > 0 {
+		log.Printf("Closed %d ssh sessions: %s", n, reason)
+	}
+}
+
+// disconnectSession closes an open session's connection and ends it in the
+// log with reason. It reports whether the relay had the connection open.
+func (h *Handlers) disconnectSession(s db.SSHSession, reason string) bool {
+	closed := false
+	if h.Relay != nil {
+		closed = h.Relay.Disconnect(net.JoinHostPort(s.SourceIP, strconv.Itoa(s.SourcePort)))
+	}
+	// End it now rather than waiting for sshpiperd to log the close
+	if _, err := h.DB.EndSSHSession(s.SourceIP, s.SourcePort, time.Now(), reason); err != nil {
+		log.Printf("error ending ssh session: %v", err)
+	}
+	return closed
+}
+
+// disconnectMachineSessions closes every open session to the machine.
+func (h *Handlers) disconnectMachineSessions(name, reason string) {
+	sessions, err := h.DB.ListSSHSessions(db.SSHSessionFilter{Machine: name, Active: true})
+	if err != nil {
+		log.Printf("error listing ssh sessions: %v", err)
+		return
+	}
+	for _, s := range sessions {
+		h.disconnectSession(s, reason)
+	}
+	if len(sessions) > 0 {
+		log.Printf("Disconnected %d ssh sessions to %s: %s", len(sessions), name, reason)
+	}
+}
+
+// disconnectKeySessions closes the open sessions to the key's machine that
+// authenticated with it. Sessions whose key is unknown are closed too when
+// the key could log in as their local user. It returns how many were closed.
+func (h *Handlers) disconnectKeySessions(key *db.AccessKey, reason string) int {
+	sessions, err := h.DB.ListSSHSessions(db.SSHSessionFilter{Machine: key.MachineName, Active: true})
+	if err != nil {
+		log.Printf("error listing ssh sessions: %v", err)
+		return 0
+	}
+	m, err := h.DB.GetMachine(key.MachineName)
+	if err != nil {
+		log.Printf("error getting machine: %v", err)
+	}
+	// Without the machine's default user, every session of unknown key counts
+	allowsUser := func(user string) bool { return m == nil || key.AllowsUser(user, m.LocalUser) }
+	n := 0
+	for _, s := range sessions {
+		if s.KeyFingerprint == key.Fingerprint || (s.KeyFingerprint == "" && allowsUser(s.LocalUser)) {
+			h.disconnectSession(s, reason)
+			n++
+		}
+	}
+	if n > 0 {
+		log.Printf("Disconnected %d ssh sessions to %s using key %q: %s", n, key.MachineName, key.Label, reason)
+	}
+	return n
+}
+
+// identifyKey matches the authenticating key to the machine's key or one of
+// its access keys. Without a logged fingerprint the key is only known when
+// exactly one key that is not revoked may log in as localUser.
+func (h *Handlers) identifyKey(m *db.Machine, revoked config.Revoked, localUser, fingerprint string) (string, string) {
+	keys, err := h.DB.ListAccessKeys(m.Name)
+	if err != nil {
+		log.Printf("error listing access keys: %v", err)
+	}
+
+	if fingerprint != "" {
+		if fingerprint == m.Fingerprint {
+			return fingerprint, machineKeyLabel
+		}
+		for _, k := range keys {
+			if k.Fingerprint == fingerprint {
+				return fingerprint, k.Label
+			}
+		}
+		return fingerprint, ""
+	}
+
+	type candidate struct{ fingerprint, label string }
+	var candidates []candidate
+	if m.Fingerprint != "" && !revoked.Has(m.PublicKey) {
+		candidates = append(candidates, candidate{m.Fingerprint, machineKeyLabel})
+	}
+	for _, k := range keys {
+		if k.AllowsUser(localUser, m.LocalUser) && !revoked.Has(k.PublicKey) {
+			candidates = append(candidates, candidate{k.Fingerprint, k.Label})
+		}
+	}
+	if len(candidates) == 1 {
+		return candidates[0].fingerprint, candidates[0].label
+	}
+	return "", ""
+}
+
+func splitAddr(addr string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", 0, err
+	}
+	return host, port, nil
+}
+
+// ListSSHSessions returns the SSH session log, newest first, filtered by
+// ?machine=, ?fingerprint=, ?source_ip=, ?active=true and ?since=.
+func (h *Handlers) ListSSHSessions(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := db.SSHSessionFilter{
+		Machine:     q.Get("machine"),
+		Fingerprint: sshkey.NormalizeFingerprint(q.Get("fingerprint")),
+		SourceIP:    q.Get("source_ip"),
+		Limit:       100,
+	}
+	if s := q.Get("active"); s != "" {
+		active, err := strconv.ParseBool(s)
+		if err != nil {
+			jsonError(w, "invalid active", http.StatusBadRequest)
+			return
+		}
+		filter.Active = active
+	}
+	if s := q.Get("since"); s != "" {
+		d, err := parseDuration(s)
+		if err != nil || d <= 0 {
+			jsonError(w, "invalid since", http.StatusBadRequest)
+			return
+		}
+		filter.Since = time.Now().Add(-d)
+	}
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			jsonError(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		filter.Limit = min(n, 1000)
+	}
+
+	sessions, err := h.DB.ListSSHSessions(filter)
+	if err != nil {
+		log.Printf("error listing ssh sessions: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+// DisconnectSSHSession closes an open SSH session.
+func (h *Handlers) DisconnectSSHSession(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		jsonError(w, "invalid session id", http.StatusBadRequest)
+		return
+	}
+	if h.Relay == nil {
+		jsonError(w, "forced disconnect is not available without the relay", http.StatusNotImplemented)
+		return
+	}
+	session, err := h.DB.GetSSHSession(id)
+	if err != nil {
+		log.Printf("error getting ssh session: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if session == nil {
+		jsonError(w, "session not found", http.StatusNotFound)
+		return
+	}
+	if session.EndedAt != nil {
+		jsonError(w, "session already ended", http.StatusConflict)
+		return
+	}
+
+	if !h.disconnectSession(*session, "disconnected by admin") {
+		log.Printf("ssh session %d was not open at the relay", id)
+	}
+	log.Printf("Disconnected ssh session %d to %s from %s", id, session.MachineName, session.SourceIP)
+	session, err = h.DB.GetSSHSession(id)
+	if err != nil {
+		log.Printf("error getting ssh session: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(session)
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/config"
+	"github.com/LipJ01/fly-ssh-bastion/internal/db"
+	"github.com/LipJ01/fly-ssh-bastion/internal/piperlog"
+	"github.com/LipJ01/fly-ssh-bastion/internal/relay"
+	"github.com/LipJ01/fly-ssh-bastion/internal/sshkey"
+)
+
+func TestSSHSessionLog(t *testing.T) {
+	var h *Handlers
+	srv, database := setupTestServerWith(t, func(handlers *Handlers) { h = handlers })
+	registerMachine(t, srv.URL, map[string]any{"name": "nas", "owner": "a", "local_user": "admin", "public_key": testKey(t)})
+	phone := testKey(t)
+	resp := authRequest(t, "POST", srv.URL+"/api/machines/nas/keys", map[string]any{"label": "phone", "public_key": phone})
+	resp.Body.Close()
+	machine, _ := database.GetMachine("nas")
+
+	feed := func(line string) {
+		t.Helper()
+		ev, ok := piperlog.ParseLine(line)
+		if !ok {
+			t.Fatalf("line not parsed: %s", line)
+		}
+		h.RecordPiperEvent(ev)
+	}
+
+	// The key is logged before the pipe opens
+	feed("203.0.113.7:5000 authenticated with " + phone)
+	feed(fmt.Sprintf(`level=info msg="ssh connection pipe created 203.0.113.7:5000 (username [nas]) -> 127.0.0.1:%d (username [admin])"`, machine.Port))
+	// No key logged, and both the machine key and phone may log in
+	feed(fmt.Sprintf(`level=info msg="ssh connection pipe created 198.51.100.1:6000 (username [admin+nas]) -> [::1]:%d (username [admin])"`, machine.Port))
+	feed(`level=info msg="connection from 203.0.113.7:5000 closed reason: EOF"`)
+
+	resp = authRequest(t, "GET", srv.URL+"/api/sessions?machine=nas", nil)
+	var sessions []db.SSHSession
+	json.NewDecoder(resp.Body).Decode(&sessions)
+	resp.Body.Close()
+	if len(sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got %+v", sessions)
+	}
+	unknown, known := sessions[0], sessions[1]
+	if known.KeyLabel != "phone" || known.KeyFingerprint != sshkey.Fingerprint(phone) || known.SourceIP != "203.0.113.7" ||
+		known.LocalUser != "admin" || known.EndedAt == nil || known.EndReason != "EOF" {
+		t.Fatalf("unexpected session %+v", known)
+	}
+	if unknown.KeyFingerprint != "" || unknown.Username != "admin+nas" || unknown.EndedAt != nil {
+		t.Fatalf("expected an open session with an unknown key, got %+v", unknown)
+	}
+
+	resp = authRequest(t, "GET", srv.URL+"/api/sessions?fingerprint="+url.QueryEscape(sshkey.Fingerprint(phone)), nil)
+	json.NewDecoder(resp.Body).Decode(&sessions)
+	resp.Body.Close()
+	if len(sessions) != 1 || sessions[0].KeyLabel != "phone" {
+		t.Fatalf("expected one session by fingerprint, got %+v", sessions)
+	}
+
+	h.CloseSSHSessions("sshpiperd restarted")
+	resp = authRequest(t, "GET", srv.URL+"/api/sessions?active=true", nil)
+	json.NewDecoder(resp.Body).Decode(&sessions)
+	resp.Body.Close()
+	if len(sessions) != 0 {
+		t.Fatalf("expected no active sessions, got %+v", sessions)
+	}
+
+	resp = authRequest(t, "GET", srv.URL+"/api/sessions?since=forever", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a bad since, got %d", resp.StatusCode)
+	}
+}
+
+func TestIdentifyKeyByElimination(t *testing.T) {
+	var h *Handlers
+	srv, database := setupTestServerWith(t, func(handlers *Handlers) { h = handlers })
+	registerMachine(t, srv.URL, map[string]any{"name": "nas", "owner": "a", "local_user": "admin", "public_key": testKey(t)})
+	bobKey := testKey(t)
+	resp := authRequest(t, "POST", srv.URL+"/api/machines/nas/users", map[string]any{"username": "bob"})
+	resp.Body.Close()
+	resp = authRequest(t, "POST", srv.URL+"/api/machines/nas/keys", map[string]any{"label": "bob-laptop", "public_key": bobKey, "local_users": []string{"bob"}})
+	resp.Body.Close()
+
+	// Revoking the machine key leaves bob's key as the only way in as bob
+	machine, _ := database.GetMachine("nas")
+	revoked := config.NewRevoked([]string{machine.Fingerprint})
+	if fp, label := h.identifyKey(machine, revoked, "bob", ""); label != "bob-laptop" || fp != sshkey.Fingerprint(bobKey) {
+		t.Fatalf("expected bob's key, got %q %q", fp, label)
+	}
+	if _, label := h.identifyKey(machine, revoked, "admin", ""); label != "" {
+		t.Fatalf("expected no key for admin, got %q", label)
+	}
+}
+
+// startRelay starts a relay in front of a stand-in for sshpiperd, which
+// sends the address it sees for each connection on seen. It returns the
+// relay and the address clients connect to.
+func startRelay(t *testing.T) (*relay.Relay, string, <-chan string) {
+	t.Helper()
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { upstream.Close() })
+	seen := make(chan string, 4)
+	go func() {
+		for {
+			c, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			seen <- c.RemoteAddr().String()
+			go io.Copy(io.Discard, c)
+		}
+	}()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	rl := relay.New(upstream.Addr().String())
+	go rl.Serve(l)
+	return rl, l.Addr().String(), seen
+}
+
+// closedByRelay reports whether the server side closed c.
+func closedByRelay(c net.Conn) bool {
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := c.Read(make([]byte, 1))
+	return err == io.EOF
+}
+
+func TestDisconnectSSHSession(t *testing.T) {
+	rl, addr, seen := startRelay(t)
+
+	var h *Handlers
+	srv, database := setupTestServerWith(t, func(handlers *Handlers) {
+		handlers.Relay = rl
+		h = handlers
+	})
+	registerMachine(t, srv.URL, map[string]any{"name": "nas", "owner": "a", "local_user": "admin", "public_key": testKey(t)})
+	phone := testKey(t)
+	resp := authRequest(t, "POST", srv.URL+"/api/machines/nas/keys", map[string]any{"label": "phone", "public_key": phone})
+	var key db.AccessKey
+	json.NewDecoder(resp.Body).Decode(&key)
+	resp.Body.Close()
+	machine, _ := database.GetMachine("nas")
+
+	// Two clients connect through the relay with the phone key
+	var clients []net.Conn
+	for range 2 {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		clients = append(clients, c)
+		local := <-seen
+		h.RecordPiperEvent(piperlog.Event{Type: piperlog.EventAuth, Time: time.Now(), Remote: local, Fingerprint: key.Fingerprint})
+		h.RecordPiperEvent(piperlog.Event{Type: piperlog.EventOpen, Time: time.Now(), Remote: local,
+			User: "nas", Upstream: fmt.Sprintf("127.0.0.1:%d", machine.Port), UpstreamUser: "admin"})
+	}
+	sessions, _ := database.ListSSHSessions(db.SSHSessionFilter{Active: true})
+	if len(sessions) != 2 || fmt.Sprintf("%s:%d", sessions[1].SourceIP, sessions[1].SourcePort) != clients[0].LocalAddr().String() {
+		t.Fatalf("expected sessions logged with the clients' addresses, got %+v", sessions)
+	}
+	resp = authRequest(t, "DELETE", fmt.Sprintf("%s/api/sessions/%d", srv.URL, sessions[1].ID), nil)
+	var ended db.SSHSession
+	json.NewDecoder(resp.Body).Decode(&ended)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || ended.EndedAt == nil || ended.EndReason != "disconnected by admin" {
+		t.Fatalf("expected the session ended, got %d %+v", resp.StatusCode, ended)
+	}
+	if !closedByRelay(clients[0]) {
+		t.Fatal("expected the first client disconnected")
+	}
+	resp = authRequest(t, "DELETE", fmt.Sprintf("%s/api/sessions/%d", srv.URL, sessions[1].ID), nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409 for an ended session, got %d", resp.StatusCode)
+	}
+
+	// Removing the key with disconnect drops the other session
+	resp = authRequest(t, "DELETE", fmt.Sprintf("%s/api/machines/nas/keys/%d?disconnect=true", srv.URL, key.ID), nil)
+	var result struct{ Disconnected int }
+	json.NewDecoder(resp.Body).Decode(&result)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || result.Disconnected != 1 {
+		t.Fatalf("expected one session disconnected, got %d %+v", resp.StatusCode, result)
+	}
+	if !closedByRelay(clients[1]) {
+		t.Fatal("expected the second client disconnected")
+	}
+	if s, _ := database.GetSSHSession(sessions[0].ID); s.EndReason != "access key removed" {
+		t.Fatalf("unexpected end reason %q", s.EndReason)
+	}
+}
+
+func TestDisconnectWithoutRelay(t *testing.T) {
+	srv, _ := setupTestServer(t)
+	resp := authRequest(t, "DELETE", srv.URL+"/api/sessions/1", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotImplemented {
+		t.Fatalf("expected 501, got %d", resp.StatusCode)
+	}
+}
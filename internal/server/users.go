@@ -0,0 +1,166 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/LipJ01/fly-ssh-bastion/internal/db"
+)
+
+type localUserEntry struct {
+	Username string `json:"username"`
+	Default  bool   `json:"default,omitempty"`
+	SSHUser  string `json:"ssh_user"` // username to give the bastion to reach this account
+}
+
+func (h *Handlers) AddMachineUser(w http.ResponseWriter, r *http.Request) {
+	machineName := chi.URLParam(r, "name")
+
+	machine, err := h.DB.GetMachine(machineName)
+	if err != nil {
+		log.Printf("error getting machine: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if machine == nil {
+		jsonError(w, "machine not found", http.StatusNotFound)
+		return
+	}
+
+	var req struct {
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if req.Username == "" {
+		jsonError(w, "username is required", http.StatusBadRequest)
+		return
+	}
+	if !validName.MatchString(req.Username) {
+		jsonError(w, "invalid username: must be alphanumeric with optional dots, hyphens, underscores (max 64 chars)", http.StatusBadRequest)
+		return
+	}
+	if req.Username == machine.LocalUser {
+		jsonError(w, fmt.Sprintf("%q is already the machine's default user", req.Username), http.StatusConflict)
+		return
+	}
+
+	user, err := h.DB.AddMachineUser(machineName, req.Username)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			jsonError(w, "local user already added to this machine", http.StatusConflict)
+			return
+		}
+		log.Printf("error adding local user: %v", err)
+		jsonError(w, "failed to add local user", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.RegenerateConfig(); err != nil {
+		log.Printf("error regenerating config: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(user)
+}
+
+// ListMachineUsers lists every local user reachable on a machine, starting
+// with its default user.
+func (h *Handlers) ListMachineUsers(w http.ResponseWriter, r *http.Request) {
+	machineName := chi.URLParam(r, "name")
+
+	machine, err := h.DB.GetMachine(machineName)
+	if err != nil {
+		log.Printf("error getting machine: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if machine == nil {
+		jsonError(w, "machine not found", http.StatusNotFound)
+		return
+	}
+
+	users, err := h.DB.ListMachineUsers(machineName)
+	if err != nil {
+		log.Printf("error listing local users: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	result := []localUserEntry{{Username: machine.LocalUser, Default: true, SSHUser: machine.Name}}
+	for _, u := range users {
+		result = append(result, localUserEntry{Username: u.Username, SSHUser: u.Username + "+" + machine.Name})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func (h *Handlers) DeleteMachineUser(w http.ResponseWriter, r *http.Request) {
+	machineName := chi.URLParam(r, "name")
+	username := chi.URLParam(r, "username")
+
+	machine, err := h.DB.GetMachine(machineName)
+	if err != nil {
+		log.Printf("error getting machine: %v", err)
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if machine == nil {
+		jsonError(w, "machine not found", http.StatusNotFound)
+		return
+	}
+	if username == machine.LocalUser {
+		jsonError(w, "cannot remove the machine's default user", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.DB.DeleteMachineUser(machineName, username); err != nil {
+		jsonError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if err := h.RegenerateConfig(); err != nil {
+		log.Printf("error regenerating config: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"ok":true}`))
+}
+
+// checkLocalUsers verifies that every requested user is reachable on the
+// machine. db.AllLocalUsers must stand alone.
+func (h *Handlers) checkLocalUsers(machine *db.Machine, users []string) error {
+	if len(users) == 0 {
+		return nil
+	}
+	if slices.Contains(users, db.AllLocalUsers) {
+		if len(users) > 1 {
+			return fmt.Errorf("%q already allows every local user and cannot be combined with others", db.AllLocalUsers)
+		}
+		return nil
+	}
+	extra, err := h.DB.ListMachineUsers(machine.Name)
+	if err != nil {
+		return err
+	}
+	known := map[string]bool{machine.LocalUser: true}
+	for _, u := range extra {
+		known[u.Username] = true
+	}
+	for _, u := range users {
+		if !known[u] {
+			return fmt.Errorf("unknown local user %q: add it to the machine first", u)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestMachineUsers(t *testing.T) {
+	srv, database := setupTestServer(t)
+
+	resp := authRequest(t, "POST", srv.URL+"/api/register", map[string]string{
+		"name": "box", "owner": "test", "local_user": "admin", "public_key": testKey(t),
+	})
+	resp.Body.Close()
+
+	resp = authRequest(t, "POST", srv.URL+"/api/machines/box/users", map[string]string{"username": "alice"})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", resp.StatusCode)
+	}
+	for _, name := range []string{"alice", "admin"} {
+		resp = authRequest(t, "POST", srv.URL+"/api/machines/box/users", map[string]string{"username": name})
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusConflict {
+			t.Fatalf("expected 409 adding %q again, got %d", name, resp.StatusCode)
+		}
+	}
+	resp = authRequest(t, "POST", srv.URL+"/api/machines/box/users", map[string]string{"username": "bob+box"})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid username, got %d", resp.StatusCode)
+	}
+
+	resp = authRequest(t, "GET", srv.URL+"/api/machines/box/users", nil)
+	var users []localUserEntry
+	json.NewDecoder(resp.Body).Decode(&users)
+	resp.Body.Close()
+	if len(users) != 2 || !users[0].Default || users[0].SSHUser != "box" || users[1].SSHUser != "alice+box" {
+		t.Fatalf("unexpected users %+v", users)
+	}
+
+	// Access keys may only be restricted to known users
+	for _, users := range [][]string{{"mallory"}, {"*", "alice"}} {
+		resp = authRequest(t, "POST", srv.URL+"/api/machines/box/keys", map[string]any{
+			"label": "phone", "public_key": testKey(t), "local_users": users,
+		})
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("%v: expected 400, got %d", users, resp.StatusCode)
+		}
+	}
+	resp = authRequest(t, "POST", srv.URL+"/api/machines/box/keys", map[string]any{
+		"label": "phone", "public_key": testKey(t), "local_users": []string{"alice"},
+	})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", resp.StatusCode)
+	}
+	keys, _ := database.ListAccessKeys("box")
+	if len(keys) != 1 || !keys[0].AllowsUser("alice", "admin") || keys[0].AllowsUser("admin", "admin") {
+		t.Fatalf("unexpected keys %+v", keys)
+	}
+
+	resp = authRequest(t, "DELETE", srv.URL+"/api/machines/box/users/admin", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 removing default user, got %d", resp.StatusCode)
+	}
+	resp = authRequest(t, "DELETE", srv.URL+"/api/machines/box/users/alice", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,55 @@
+package sshkey
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Challenge purposes. A signature made for one purpose does not verify for
+// another, so a registration proof cannot be replayed elsewhere.
+const (
+	PurposeRegister = "register"
+)
+
+// challengeMessage is the data actually signed for a challenge.
+func challengeMessage(purpose, nonce string) []byte {
+	return []byte("fly-ssh-bastion-challenge-v1\x00" + purpose + "\x00" + nonce)
+}
+
+// SignChallenge signs a server-issued nonce with signer, returning the
+// base64 wire-format signature expected by Key.VerifyChallenge.
+func SignChallenge(signer ssh.Signer, purpose, nonce string) (string, error) {
+	msg := challengeMessage(purpose, nonce)
+	var sig *ssh.Signature
+	var err error
+	// Prefer SHA-256 over the legacy SHA-1 ssh-rsa signature
+	if as, ok := signer.(ssh.AlgorithmSigner); ok && signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		sig, err = as.SignWithAlgorithm(rand.Reader, msg, ssh.KeyAlgoRSASHA256)
+	} else {
+		sig, err = signer.Sign(rand.Reader, msg)
+	}
+	if err != nil {
+		return "", fmt.Errorf("sign challenge: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(ssh.Marshal(sig)), nil
+}
+
+// VerifyChallenge checks a signature made by SignChallenge against the key.
+// For certificates the signature must come from the certified key.
+func (k *Key) VerifyChallenge(purpose, nonce, signature string) error {
+	data, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("signature is not valid base64")
+	}
+	var sig ssh.Signature
+	if err := ssh.Unmarshal(data, &sig); err != nil {
+		return fmt.Errorf("malformed signature")
+	}
+	if err := k.Public.Verify(challengeMessage(purpose, nonce), &sig); err != nil {
+		return fmt.Errorf("signature does not match the public key")
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package sshkey
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// MaxLength is the longest authorized_keys line accepted. Certificates and
+// large RSA keys comfortably fit.
+const MaxLength = 8192
+
+// Policy controls which public keys the bastion accepts.
+type Policy struct {
+	MinRSABits        int
+	DisallowedTypes   []string
+	AllowCertificates bool
+}
+
+// DefaultPolicy rejects DSA and short RSA keys, and certificates. A
+// certificate is written out as a plain key, which sshd does not accept as a
+// user certificate and sshpiperd accepts without checking its validity,
+// principals or CA.
+var DefaultPolicy = Policy{
+	MinRSABits:      2048,
+	DisallowedTypes: []string{ssh.KeyAlgoDSA},
+}
+
+// Key is a parsed SSH public key.
+type Key struct {
+	Type        string // algorithm of the underlying key, e.g. ssh-ed25519
+	CertType    string // certificate algorithm, empty for plain keys
+	Bits        int
+	Comment     string
+	Fingerprint string // SHA256 fingerprint of the underlying key
+	Public      ssh.PublicKey
+}
+
+// IsCertificate reports whether the key is an OpenSSH certificate.
+func (k *Key) IsCertificate() bool {
+	return k.CertType != ""
+}
+
+// Parse parses a single authorized_keys style line ("type base64 [comment]").
+// Options prefixes are rejected.
+func Parse(line string) (*Key, error) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return nil, fmt.Errorf("public key is empty")
+	}
+	if strings.ContainsAny(line, "\r\n") {
+		return nil, fmt.Errorf("public key must be a single line")
+	}
+	if len(line) > MaxLength {
+		return nil, fmt.Errorf("public key too large")
+	}
+
+	pub, comment, options, rest, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return nil, fmt.Errorf("invalid SSH public key: %w", err)
+	}
+	if len(options) > 0 {
+		return nil, fmt.Errorf("public key must not include authorized_keys options")
+	}
+	if len(strings.TrimSpace(string(rest))) > 0 {
+		return nil, fmt.Errorf("public key must be a single line")
+	}
+
+	k := &Key{Comment: comment, Public: pub}
+	underlying := pub
+	if cert, ok := pub.(*ssh.Certificate); ok {
+		k.CertType = cert.Type()
+		underlying = cert.Key
+	}
+	k.Type = underlying.Type()
+	k.Bits = keyBits(underlying)
+	k.Fingerprint = ssh.FingerprintSHA256(underlying)
+	return k, nil
+}
+
+// Check returns an error if the key violates the policy.
+func (p Policy) Check(k *Key) error {
+	if k.IsCertificate() && !p.AllowCertificates {
+		return fmt.Errorf("certificates are not allowed")
+	}
+	if cert, ok := k.Public.(*ssh.Certificate); ok {
+		if err := checkValidity(cert, time.Now()); err != nil {
+			return err
+		}
+	}
+	for _, t := range p.DisallowedTypes {
+		if t == k.Type || (k.CertType != "" && t == k.CertType) {
+			return fmt.Errorf("key type %s is not allowed", t)
+		}
+	}
+	if k.Type == ssh.KeyAlgoRSA && k.Bits < p.MinRSABits {
+		return fmt.Errorf("RSA key too short: %d bits (minimum %d)", k.Bits, p.MinRSABits)
+	}
+	return nil
+}
+
+// Validate parses the line and checks it against the policy.
+func (p Policy) Validate(line string) (*Key, error) {
+	k, err := Parse(line)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.Check(k); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Fingerprint returns the SHA256 fingerprint of an authorized_keys line, or
+// an empty string if it cannot be parsed.
+func Fingerprint(line string) string {
+	k, err := Parse(line)
+	if err != nil {
+		return ""
+	}
+	return k.Fingerprint
+}
+
+// NormalizeFingerprint accepts a fingerprint with or without the "SHA256:"
+// prefix and returns it in canonical form.
+func NormalizeFingerprint(fp string) string {
+	fp = strings.TrimSpace(fp)
+	if fp == "" {
+		return ""
+	}
+	if strings.HasPrefix(strings.ToUpper(fp), "SHA256:") {
+		fp = fp[len("SHA256:"):]
+	}
+	return "SHA256:" + strings.TrimRight(fp, "=")
+}
+
+// checkValidity returns an error if the certificate is not valid at now.
+func checkValidity(cert *ssh.Certificate, now time.Time) error {
+	unix := uint64(now.Unix())
+	if unix < cert.ValidAfter {
+		return fmt.Errorf("certificate is not valid until %s", time.Unix(int64(cert.ValidAfter), 0).UTC().Format(time.RFC3339))
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity && unix >= cert.ValidBefore {
+		return fmt.Errorf("certificate expired at %s", time.Unix(int64(cert.ValidBefore), 0).UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+func keyBits(pub ssh.PublicKey) int {
+	switch pub.Type() {
+	case ssh.KeyAlgoED25519, ssh.KeyAlgoSKED25519:
+		return 256
+	case ssh.KeyAlgoSKECDSA256:
+		return 256
+	}
+	cpk, ok := pub.(ssh.CryptoPublicKey)
+	if !ok {
+		return 0
+	}
+	switch key := cpk.CryptoPublicKey().(type) {
+	case *rsa.PublicKey:
+		return key.N.BitLen()
+	case *ecdsa.PublicKey:
+		return key.Curve.Params().BitSize
+	}
+	return 0
+}
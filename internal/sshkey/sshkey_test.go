@@ -0,0 +1,264 @@
+package sshkey
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func authorizedLine(t *testing.T, pub ssh.PublicKey, comment string) string {
+	t.Helper()
+	line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))
+	if comment != "" {
+		line += " " + comment
+	}
+	return line
+}
+
+func ed25519Key(t *testing.T) (ssh.PublicKey, ssh.Signer) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	sshPub, _ := ssh.NewPublicKey(pub)
+	signer, _ := ssh.NewSignerFromKey(priv)
+	return sshPub, signer
+}
+
+func TestParseEd25519(t *testing.T) {
+	pub, _ := ed25519Key(t)
+	line := authorizedLine(t, pub, "alice@laptop")
+
+	k, err := Parse(line)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if k.Type != ssh.KeyAlgoED25519 || k.Bits != 256 {
+		t.Fatalf("unexpected key: %+v", k)
+	}
+	if k.Comment != "alice@laptop" {
+		t.Fatalf("expected comment, got %q", k.Comment)
+	}
+	if k.Fingerprint != ssh.FingerprintSHA256(pub) {
+		t.Fatalf("unexpected fingerprint %s", k.Fingerprint)
+	}
+	if err := DefaultPolicy.Check(k); err != nil {
+		t.Fatalf("default policy rejected ed25519: %v", err)
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	for _, line := range []string{
+		"",
+		"ssh-ed25519",
+		"ssh-ed25519 AAAA alice",
+		"ssh-ed25519 not-base64!!",
+		"ssh-foo " + base64.StdEncoding.EncodeToString([]byte("junk")),
+	} {
+		if _, err := Parse(line); err == nil {
+			t.Errorf("expected error for %q", line)
+		}
+	}
+}
+
+func TestParseRejectsOptionsAndMultiline(t *testing.T) {
+	pub, _ := ed25519Key(t)
+	line := authorizedLine(t, pub, "")
+
+	if _, err := Parse(`command="/bin/sh" ` + line); err == nil {
+		t.Fatal("expected error for key with options")
+	}
+	if _, err := Parse(line + "\n" + line); err == nil {
+		t.Fatal("expected error for multi-line input")
+	}
+}
+
+func TestPolicyRSABits(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	pub, _ := ssh.NewPublicKey(&priv.PublicKey)
+
+	k, err := Parse(authorizedLine(t, pub, ""))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if k.Bits != 1024 {
+		t.Fatalf("expected 1024 bits, got %d", k.Bits)
+	}
+	if err := DefaultPolicy.Check(k); err == nil {
+		t.Fatal("expected 1024-bit RSA key to be rejected")
+	}
+	lax := Policy{MinRSABits: 1024}
+	if err := lax.Check(k); err != nil {
+		t.Fatalf("expected lax policy to accept: %v", err)
+	}
+}
+
+func TestPolicyDisallowedType(t *testing.T) {
+	priv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	pub, _ := ssh.NewPublicKey(&priv.PublicKey)
+
+	k, err := Parse(authorizedLine(t, pub, ""))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if k.Bits != 256 {
+		t.Fatalf("expected 256 bits, got %d", k.Bits)
+	}
+	p := Policy{DisallowedTypes: []string{ssh.KeyAlgoECDSA256}}
+	if err := p.Check(k); err == nil {
+		t.Fatal("expected ecdsa to be rejected")
+	}
+}
+
+func TestParseSecurityKey(t *testing.T) {
+	pub, _, _ := ed25519.GenerateKey(rand.Reader)
+	blob := ssh.Marshal(struct {
+		Name        string
+		KeyBytes    []byte
+		Application string
+	}{ssh.KeyAlgoSKED25519, pub, "ssh:"})
+	line := ssh.KeyAlgoSKED25519 + " " + base64.StdEncoding.EncodeToString(blob) + " yubikey"
+
+	k, err := DefaultPolicy.Validate(line)
+	if err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	if k.Type != ssh.KeyAlgoSKED25519 {
+		t.Fatalf("unexpected type %s", k.Type)
+	}
+}
+
+func TestParseCertificate(t *testing.T) {
+	pub, _ := ed25519Key(t)
+	_, ca := ed25519Key(t)
+
+	cert := &ssh.Certificate{
+		Key:             pub,
+		CertType:        ssh.UserCert,
+		KeyId:           "alice",
+		ValidPrincipals: []string{"alice"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	line := authorizedLine(t, cert, "")
+
+	k, err := Parse(line)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if !k.IsCertificate() || k.Type != ssh.KeyAlgoED25519 {
+		t.Fatalf("unexpected key: %+v", k)
+	}
+	if k.Fingerprint != ssh.FingerprintSHA256(pub) {
+		t.Fatal("certificate fingerprint should match the certified key")
+	}
+	if err := DefaultPolicy.Check(k); err == nil {
+		t.Fatal("expected the default policy to reject certificates")
+	}
+	allow := Policy{AllowCertificates: true}
+	if err := allow.Check(k); err != nil {
+		t.Fatalf("policy allowing certificates rejected one: %v", err)
+	}
+
+	// Certificates outside their validity window are rejected
+	now := uint64(time.Now().Unix())
+	for name, window := range map[string][2]uint64{
+		"expired":         {now - 7200, now - 3600},
+		"not yet valid":   {now + 3600, ssh.CertTimeInfinity},
+		"valid right now": {now - 60, now + 3600},
+	} {
+		cert := &ssh.Certificate{Key: pub, CertType: ssh.UserCert, ValidAfter: window[0], ValidBefore: window[1]}
+		if err := cert.SignCert(rand.Reader, ca); err != nil {
+			t.Fatalf("sign: %v", err)
+		}
+		k, err := Parse(authorizedLine(t, cert, ""))
+		if err != nil {
+			t.Fatalf("parse: %v", err)
+		}
+		if err := allow.Check(k); (err == nil) != (name == "valid right now") {
+			t.Errorf("%s: unexpected result %v", name, err)
+		}
+	}
+}
+
+func TestNormalizeFingerprint(t *testing.T) {
+	cases := map[string]string{
+		"SHA256:abc":  "SHA256:abc",
+		"abc":         "SHA256:abc",
+		"sha256:abc=": "SHA256:abc",
+		"":            "",
+	}
+	for in, want := range cases {
+		if got := NormalizeFingerprint(in); got != want {
+			t.Errorf("NormalizeFingerprint(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestChallengeSignature(t *testing.T) {
+	pub, signer := ed25519Key(t)
+	k, err := Parse(authorizedLine(t, pub, ""))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	sig, err := SignChallenge(signer, PurposeRegister, "nonce-1")
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if err := k.VerifyChallenge(PurposeRegister, "nonce-1", sig); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if err := k.VerifyChallenge(PurposeRegister, "nonce-2", sig); err == nil {
+		t.Fatal("expected signature over another nonce to fail")
+	}
+	if err := k.VerifyChallenge("rotate", "nonce-1", sig); err == nil {
+		t.Fatal("expected signature for another purpose to fail")
+	}
+
+	_, other := ed25519Key(t)
+	forged, _ := SignChallenge(other, PurposeRegister, "nonce-1")
+	if err := k.VerifyChallenge(PurposeRegister, "nonce-1", forged); err == nil {
+		t.Fatal("expected signature from another key to fail")
+	}
+	if err := k.VerifyChallenge(PurposeRegister, "nonce-1", "not base64!"); err == nil {
+		t.Fatal("expected garbage signature to fail")
+	}
+}
+
+func TestChallengeSignatureRSA(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	signer, _ := ssh.NewSignerFromKey(priv)
+	k, _ := Parse(authorizedLine(t, signer.PublicKey(), ""))
+
+	sig, err := SignChallenge(signer, PurposeRegister, "n")
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	data, _ := base64.StdEncoding.DecodeString(sig)
+	var s ssh.Signature
+	ssh.Unmarshal(data, &s)
+	if s.Format != ssh.KeyAlgoRSASHA256 {
+		t.Fatalf("expected rsa-sha2-256 signature, got %s", s.Format)
+	}
+	if err := k.VerifyChallenge(PurposeRegister, "n", sig); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+}
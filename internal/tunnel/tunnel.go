@@ -1,13 +1,16 @@
 package tunnel
 
 import (
+	"bufio"
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -18,6 +21,33 @@ type Config struct {
 	RemotePort int // assigned remote port (e.g. 10024)
 	KeyPath    string
 	SSHUser    string
+
+	// OnEvent, if set, is called synchronously when each ssh session's
+	// forward is established and when the session ends. It must not block.
+	OnEvent func(Event)
+}
+
+// Event types.
+const (
+	EventConnect    = "connect"
+	EventDisconnect = "disconnect"
+)
+
+// Event describes the start or end of one ssh session. A session starts when
+// the bastion accepts the port forward, so a session that fails to
+// authenticate or to forward is not reported at all.
+type Event struct {
+	Type     string
+	Time     time.Time
+	Attempt  int           // 1 for the first session
+	Duration time.Duration // disconnect only: how long the session lasted
+	Reason   string        // disconnect only: why ssh exited
+}
+
+func (cfg Config) emit(e Event) {
+	if cfg.OnEvent != nil {
+		cfg.OnEvent(e)
+	}
 }
 
 // Run starts the reverse SSH tunnel with automatic reconnection.
@@ -32,7 +62,20 @@ func Run(ctx context.Context, cfg Config) error {
 		}
 
 		log.Printf("Connecting tunnel (attempt %d)...", attempt+1)
-		err := runOnce(ctx, cfg)
+		var started time.Time
+		connected := false
+		err := runOnce(ctx, cfg, func() {
+			started, connected = time.Now(), true
+			cfg.emit(Event{Type: EventConnect, Time: started, Attempt: attempt + 1})
+		})
+		if connected {
+			reason := "stopped"
+			if ctx.Err() == nil && err != nil {
+				reason = err.Error()
+			}
+			ended := time.Now()
+			cfg.emit(Event{Type: EventDisconnect, Time: ended, Attempt: attempt + 1, Duration: ended.Sub(started), Reason: reason})
+		}
 		if ctx.Err() != nil {
 			return ctx.Err()
 		}
@@ -49,10 +92,17 @@ func Run(ctx context.Context, cfg Config) error {
 	}
 }
 
-func runOnce(ctx context.Context, cfg Config) error {
+// forwardEstablished is what ssh -v logs when the server accepts a remote
+// forward.
+const forwardEstablished = "remote forward success"
+
+// runOnce runs one ssh session, calling started once the remote forward is
+// established. ssh only logs that at -v, so its debug lines are read for it
+// and the rest of its output is passed through.
+func runOnce(ctx context.Context, cfg Config, started func()) error {
 	knownHostsPath := filepath.Join(filepath.Dir(cfg.KeyPath), "bastion_known_hosts")
 	args := []string{
-		"-N",
+		"-N", "-v",
 		"-o", "ExitOnForwardFailure=yes",
 		"-o", "ServerAliveInterval=30",
 		"-o", "ServerAliveCountMax=3",
@@ -66,9 +116,29 @@ func runOnce(ctx context.Context, cfg Config) error {
 
 	cmd := exec.CommandContext(ctx, "ssh", args...)
 	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
 
-	if err := cmd.Run(); err != nil {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	forwarded := false
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !forwarded && strings.Contains(line, forwardEstablished) {
+			forwarded = true
+			started()
+		}
+		if !strings.HasPrefix(line, "debug") {
+			fmt.Fprintln(os.Stderr, line)
+		}
+	}
+	// Keep ssh from blocking on a full pipe if a line was too long to scan
+	io.Copy(os.Stderr, stderr)
+	if err := cmd.Wait(); err != nil {
 		return err
 	}
 	return fmt.Errorf("ssh exited cleanly")
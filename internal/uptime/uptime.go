@@ -0,0 +1,99 @@
+// Package uptime computes tunnel availability from a machine's session
+// history.
+package uptime
+
+import (
+	"sort"
+	"time"
+)
+
+// Session is one tunnel session. End is nil while it is still connected.
+type Session struct {
+	Start time.Time
+	End   *time.Time
+}
+
+// Outage is a period in the window with no connected session.
+type Outage struct {
+	Start           time.Time `json:"start"`
+	End             time.Time `json:"end"`
+	DurationSeconds int64     `json:"duration_seconds"`
+	Ongoing         bool      `json:"ongoing,omitempty"`
+}
+
+// Report summarises availability over [From, To].
+type Report struct {
+	From                time.Time `json:"from"`
+	To                  time.Time `json:"to"`
+	AvailabilityPercent float64   `json:"availability_percent"`
+	UpSeconds           int64     `json:"up_seconds"`
+	DownSeconds         int64     `json:"down_seconds"`
+	Sessions            int       `json:"sessions"`      // sessions overlapping the window
+	Reconnections       int       `json:"reconnections"` // sessions started in the window after an earlier one
+	Outages             []Outage  `json:"outages"`
+}
+
+// Compute reports availability over [from, to]. Open sessions count as
+// connected until to. Overlapping sessions are merged, so a session that was
+// never closed does not double-count time.
+func Compute(sessions []Session, from, to time.Time) Report {
+	r := Report{From: from, To: to, Outages: []Outage{}}
+	if !to.After(from) {
+		return r
+	}
+
+	sorted := make([]Session, len(sessions))
+	copy(sorted, sessions)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start.Before(sorted[j].Start) })
+
+	// Merge sessions into connected intervals clipped to the window
+	type interval struct{ start, end time.Time }
+	var up []interval
+	for i, s := range sorted {
+		end := to
+		if s.End != nil && s.End.Before(to) {
+			end = *s.End
+		}
+		if !end.After(from) || !s.Start.Before(to) {
+			continue
+		}
+		r.Sessions++
+		if i > 0 && !s.Start.Before(from) {
+			r.Reconnections++
+		}
+		start := s.Start
+		if start.Before(from) {
+			start = from
+		}
+		if n := len(up); n > 0 && !start.After(up[n-1].end) {
+			if end.After(up[n-1].end) {
+				up[n-1].end = end
+			}
+			continue
+		}
+		up = append(up, interval{start, end})
+	}
+
+	var upTime time.Duration
+	cursor := from
+	for _, iv := range up {
+		if iv.start.After(cursor) {
+			r.Outages = append(r.Outages, newOutage(cursor, iv.start, false))
+		}
+		upTime += iv.end.Sub(iv.start)
+		cursor = iv.end
+	}
+	if to.After(cursor) {
+		r.Outages = append(r.Outages, newOutage(cursor, to, true))
+	}
+
+	total := to.Sub(from)
+	r.UpSeconds = int64(upTime / time.Second)
+	r.DownSeconds = int64((total - upTime) / time.Second)
+	r.AvailabilityPercent = 100 * float64(upTime) / float64(total)
+	return r
+}
+
+func newOutage(start, end time.Time, ongoing bool) Outage {
+	return Outage{Start: start, End: end, DurationSeconds: int64(end.Sub(start) / time.Second), Ongoing: ongoing}
+}
@@ -0,0 +1,62 @@
+package uptime
+
+import (
+	"testing"
+	"time"
+)
+
+func at(h int) time.Time {
+	return time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(h) * time.Hour)
+}
+
+func ended(h int) *time.Time {
+	t := at(h)
+	return &t
+}
+
+func TestComputeOutagesAndReconnections(t *testing.T) {
+	sessions := []Session{
+		{Start: at(-5), End: ended(2)}, // started before the window
+		{Start: at(4), End: ended(6)},
+		{Start: at(7)}, // still connected
+	}
+	r := Compute(sessions, at(0), at(10))
+
+	if r.UpSeconds != int64(7*time.Hour/time.Second) || r.DownSeconds != int64(3*time.Hour/time.Second) {
+		t.Fatalf("unexpected up/down %d/%d", r.UpSeconds, r.DownSeconds)
+	}
+	if r.AvailabilityPercent != 70 {
+		t.Fatalf("expected 70%%, got %v", r.AvailabilityPercent)
+	}
+	if r.Sessions != 3 || r.Reconnections != 2 {
+		t.Fatalf("expected 3 sessions and 2 reconnections, got %d/%d", r.Sessions, r.Reconnections)
+	}
+	if len(r.Outages) != 2 || !r.Outages[0].Start.Equal(at(2)) || !r.Outages[1].End.Equal(at(7)) || r.Outages[1].Ongoing {
+		t.Fatalf("unexpected outages %+v", r.Outages)
+	}
+}
+
+func TestComputeOngoingOutage(t *testing.T) {
+	r := Compute([]Session{{Start: at(1), End: ended(3)}}, at(0), at(4))
+	if len(r.Outages) != 2 || !r.Outages[1].Ongoing || r.Outages[1].DurationSeconds != 3600 {
+		t.Fatalf("expected leading and ongoing outages, got %+v", r.Outages)
+	}
+	if r.Reconnections != 0 {
+		t.Fatalf("the first session is not a reconnection, got %d", r.Reconnections)
+	}
+}
+
+func TestComputeMergesOverlaps(t *testing.T) {
+	// A session never closed (client crashed) overlaps the next one
+	r := Compute([]Session{{Start: at(0)}, {Start: at(2), End: ended(3)}}, at(0), at(4))
+	if r.AvailabilityPercent != 100 || len(r.Outages) != 0 {
+		t.Fatalf("expected overlapping sessions to merge, got %+v", r)
+	}
+}
+
+func TestComputeEmpty(t *testing.T) {
+	r := Compute(nil, at(0), at(1))
+	if r.AvailabilityPercent != 0 || len(r.Outages) != 1 || r.Outages[0].DurationSeconds != 3600 {
+		t.Fatalf("expected a full outage, got %+v", r)
+	}
+}